@@ -0,0 +1,507 @@
+package freezerinv
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"gitlab.com/UrsusArcTech/logger"
+)
+
+// maxLineageDepth stops a parent_name cycle from recursing forever.
+const maxLineageDepth = 50
+
+// Aliquot is the lineage and quantity of a sample link. ParentName is the
+// link it was split from, in the same table. A consumed sample is gone but
+// its row stays so the lineage still reads end to end.
+type Aliquot struct {
+	ParentName        *string    `json:"parent_name"`
+	RemainingVolumeUl *float64   `json:"remaining_volume_ul"`
+	RemainingCount    *int       `json:"remaining_count"`
+	ConsumedAt        *time.Time `json:"consumed_at"`
+}
+
+// aliquotState is a link row as the lineage endpoints return it.
+type aliquotState struct {
+	EnteredName string `json:"entered_name"`
+	BoxId       int    `json:"box_id"`
+	Position    *int   `json:"position"`
+	SampleId    *int   `json:"sample_id"`
+	Aliquot
+}
+
+type aliquotRequest struct {
+	EnteredName *string  `json:"entered_name"`
+	BoxId       *int     `json:"box_id"`
+	Position    *int     `json:"position"`
+	VolumeUl    *float64 `json:"volume_ul"`
+	Count       *int     `json:"count"`
+}
+
+type aliquotCreated struct {
+	Aliquot aliquotState `json:"aliquot"`
+	Parent  aliquotState `json:"parent"`
+}
+
+// quantityRequest sets or uses up the remaining quantity. All on a consume
+// request marks the sample fully consumed whatever is left.
+type quantityRequest struct {
+	VolumeUl *float64 `json:"volume_ul"`
+	Count    *int     `json:"count"`
+	All      bool     `json:"all"`
+}
+
+type LineageNode struct {
+	EnteredName  string        `json:"entered_name"`
+	BoxId        int           `json:"box_id"`
+	BoxName      string        `json:"box_name"`
+	FreezerName  string        `json:"freezer_name"`
+	Position     *int          `json:"position"`
+	CheckedOutBy *string       `json:"checked_out_by"`
+	Children     []LineageNode `json:"children"`
+	Aliquot
+}
+
+type Lineage struct {
+	Sample string `json:"sample"`
+	// Ancestors runs from the oldest known parent down to the sample's own
+	// parent. The first may no longer be stored.
+	Ancestors []string    `json:"ancestors"`
+	Tree      LineageNode `json:"tree"`
+}
+
+// loadAliquot reads one stored sample, or writes a 404.
+func (h *Handlers) loadAliquot(w http.ResponseWriter, r *http.Request, kind *SampleType, enteredName string) (SampleLink, bool) {
+	link, err := h.store.GetSampleLink(r.Context(), kind, enteredName)
+	if err == errSampleLinkNotFound {
+		writeError(w, http.StatusNotFound, CodeSampleNotFound, kind.Label+" "+enteredName+" is not in any box")
+		return link, false
+	}
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return link, false
+	}
+	return link, true
+}
+
+// aliquotStateOf is the part of a link the lineage endpoints return.
+func aliquotStateOf(link SampleLink) aliquotState {
+	return aliquotState{EnteredName: link.EnteredName, BoxId: link.BoxId, Position: link.Position, SampleId: link.SampleId, Aliquot: link.Aliquot}
+}
+
+func consumedError(kind *SampleType, state SampleLink) *ApiError {
+	return &ApiError{Status: http.StatusConflict, Code: CodeSampleConsumed, Message: fmt.Sprintf("%s %s was fully consumed on %s", kind.Label, state.EnteredName, state.ConsumedAt.Format("2006-01-02"))}
+}
+
+// keptLinkError refuses to delete a link the lineage still needs: a consumed
+// sample, whose row is its only record, or a parent of other aliquots.
+func keptLinkError(kind *SampleType, enteredName string, consumedAt *time.Time, aliquots int) *ApiError {
+	if consumedAt != nil {
+		return &ApiError{Status: http.StatusConflict, Code: CodeSampleConsumed, Message: fmt.Sprintf("%s %s was fully consumed on %s, its record is kept for the lineage", kind.Label, enteredName, consumedAt.Format("2006-01-02"))}
+	}
+	if aliquots > 0 {
+		return &ApiError{Status: http.StatusConflict, Code: CodeHasAliquots, Message: fmt.Sprintf("%s %s has %d aliquots, remove them first", kind.Label, enteredName, aliquots)}
+	}
+	return nil
+}
+
+// takeQuantity works out what is left after using volume and count. Nil
+// amounts are not used; a tracked quantity reaching zero consumes the sample.
+func takeQuantity(state SampleLink, volume *float64, count *int) (remainingVolume *float64, remainingCount *int, consumed bool, apiErr *ApiError) {
+	remainingVolume, remainingCount = state.RemainingVolumeUl, state.RemainingCount
+
+	if volume != nil {
+		if *volume <= 0 {
+			return nil, nil, false, &ApiError{Status: http.StatusBadRequest, Code: CodeValidationFailed, Message: "volume_ul must be more than 0", Field: "volume_ul"}
+		}
+		if remainingVolume == nil || *remainingVolume < *volume {
+			return nil, nil, false, &ApiError{Status: http.StatusConflict, Code: CodeInsufficientQuantity, Message: fmt.Sprintf("%s has %s left, %.2f µL asked for", state.EnteredName, describeVolume(remainingVolume), *volume), Field: "volume_ul"}
+		}
+		left := *remainingVolume - *volume
+		remainingVolume = &left
+		consumed = consumed || left == 0
+	}
+
+	if count != nil {
+		if *count <= 0 {
+			return nil, nil, false, &ApiError{Status: http.StatusBadRequest, Code: CodeValidationFailed, Message: "count must be more than 0", Field: "count"}
+		}
+		if remainingCount == nil || *remainingCount < *count {
+			return nil, nil, false, &ApiError{Status: http.StatusConflict, Code: CodeInsufficientQuantity, Message: fmt.Sprintf("%s has %s left, %d asked for", state.EnteredName, describeCount(remainingCount), *count), Field: "count"}
+		}
+		left := *remainingCount - *count
+		remainingCount = &left
+		consumed = consumed || left == 0
+	}
+	return remainingVolume, remainingCount, consumed, nil
+}
+
+func describeVolume(v *float64) string {
+	if v == nil {
+		return "no recorded volume"
+	}
+	return fmt.Sprintf("%.2f µL", *v)
+}
+
+func describeCount(c *int) string {
+	if c == nil {
+		return "no recorded count"
+	}
+	return fmt.Sprintf("%d", *c)
+}
+
+// quantityUpdate writes new remaining quantities, but only if nobody changed
+// them since was was read. A consumed sample gives up its well.
+func quantityUpdate(kind *SampleType, was SampleLink, quantity SampleQuantity) (string, []interface{}) {
+	set := "remaining_volume_ul = $1, remaining_count = $2"
+	if quantity.Consumed {
+		set += ", consumed_at = now(), position = NULL"
+	}
+	where := "entered_name = $3 AND consumed_at IS NULL AND remaining_volume_ul IS NOT DISTINCT FROM $4 AND remaining_count IS NOT DISTINCT FROM $5"
+	return snapshotUpdate(kind.Table, set, where), []interface{}{quantity.VolumeUl, quantity.Count, was.EnteredName, was.RemainingVolumeUl, was.RemainingCount}
+}
+
+var errQuantityChanged = &ApiError{Status: http.StatusConflict, Code: CodeInsufficientQuantity, Message: "The remaining quantity changed meanwhile, reload and try again"}
+
+// createAliquot splits a new link off parentName into a box, taking its
+// volume or count from the parent in the same transaction.
+func (h *Handlers) createAliquot(w http.ResponseWriter, r *http.Request, kind *SampleType, parentName string, req aliquotRequest) (aliquotCreated, bool) {
+	var created aliquotCreated
+
+	if req.EnteredName == nil || *req.EnteredName == "" {
+		writeValidationError(w, "entered_name", "Missing required fields: entered_name")
+		return created, false
+	}
+	if req.BoxId == nil {
+		writeValidationError(w, "box_id", "Missing required fields: box_id")
+		return created, false
+	}
+	name := *req.EnteredName
+
+	parent, ok := h.loadAliquot(w, r, kind, parentName)
+	if !ok {
+		return created, false
+	}
+	if parent.ConsumedAt != nil {
+		writeApiError(w, consumedError(kind, parent))
+		return created, false
+	}
+	if !h.requireLinkRole(w, r, RoleTechnician, kind, parentName) || !h.requireBoxRole(w, r, RoleTechnician, *req.BoxId) {
+		return created, false
+	}
+
+	_, err := h.store.GetSampleLink(r.Context(), kind, name)
+	if err == nil {
+		writeApiError(w, &ApiError{Status: http.StatusConflict, Code: CodeSampleAlreadyStored, Message: kind.Label + " " + name + " is already stored", Field: "entered_name"})
+		return created, false
+	}
+	if err != errSampleLinkNotFound {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return created, false
+	}
+	if req.Position != nil && !h.checkPositionFree(w, r, *req.BoxId, *req.Position, kind.Key, name) {
+		return created, false
+	}
+
+	volume, count, consumed, apiErr := takeQuantity(parent, req.VolumeUl, req.Count)
+	if apiErr != nil {
+		writeApiError(w, apiErr)
+		return created, false
+	}
+
+	// the parent only changes when something was taken from it
+	var taken *SampleQuantity
+	if req.VolumeUl != nil || req.Count != nil {
+		taken = &SampleQuantity{VolumeUl: volume, Count: count, Consumed: consumed}
+	}
+	// an aliquot is the same sample, so it links to the parent's sample row
+	aliquot := SampleLink{
+		SampleId:    parent.SampleId,
+		EnteredName: name,
+		BoxId:       *req.BoxId,
+		Position:    req.Position,
+		Aliquot:     Aliquot{ParentName: &parentName, RemainingVolumeUl: req.VolumeUl, RemainingCount: req.Count},
+	}
+	aliquot, err = h.store.CreateAliquot(r.Context(), r, kind, parent, taken, aliquot)
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return created, false
+	}
+	if taken != nil {
+		if parent, err = h.store.GetSampleLink(r.Context(), kind, parentName); err != nil {
+			logger.LogError("Database error: " + err.Error())
+			writeDbError(w, err)
+			return created, false
+		}
+	}
+
+	created.Parent = aliquotStateOf(parent)
+	created.Aliquot = aliquotStateOf(aliquot)
+	return created, true
+}
+
+// consumeSample uses up some or all of what is left of a sample.
+func (h *Handlers) consumeSample(w http.ResponseWriter, r *http.Request, kind *SampleType, enteredName string, req quantityRequest) (aliquotState, bool) {
+	state, ok := h.loadAliquot(w, r, kind, enteredName)
+	if !ok {
+		return aliquotState{}, false
+	}
+	if state.ConsumedAt != nil {
+		writeApiError(w, consumedError(kind, state))
+		return aliquotState{}, false
+	}
+	if !h.requireLinkRole(w, r, RoleTechnician, kind, enteredName) {
+		return aliquotState{}, false
+	}
+	if !req.All && req.VolumeUl == nil && req.Count == nil {
+		writeValidationError(w, "volume_ul", "Give volume_ul, count or all")
+		return aliquotState{}, false
+	}
+
+	quantity := SampleQuantity{Consumed: req.All}
+	if req.All {
+		if state.RemainingVolumeUl != nil {
+			quantity.VolumeUl = new(float64)
+		}
+		if state.RemainingCount != nil {
+			quantity.Count = new(int)
+		}
+	} else {
+		var apiErr *ApiError
+		quantity.VolumeUl, quantity.Count, quantity.Consumed, apiErr = takeQuantity(state, req.VolumeUl, req.Count)
+		if apiErr != nil {
+			writeApiError(w, apiErr)
+			return aliquotState{}, false
+		}
+	}
+
+	return h.writeQuantity(w, r, kind, state, quantity)
+}
+
+// setQuantity records how much of a sample there is, e.g. after measuring
+// an extract. Nil amounts are left as they are.
+func (h *Handlers) setQuantity(w http.ResponseWriter, r *http.Request, kind *SampleType, enteredName string, req quantityRequest) (aliquotState, bool) {
+	state, ok := h.loadAliquot(w, r, kind, enteredName)
+	if !ok {
+		return aliquotState{}, false
+	}
+	if state.ConsumedAt != nil {
+		writeApiError(w, consumedError(kind, state))
+		return aliquotState{}, false
+	}
+	if !h.requireLinkRole(w, r, RoleTechnician, kind, enteredName) {
+		return aliquotState{}, false
+	}
+	if req.VolumeUl != nil && *req.VolumeUl < 0 {
+		writeValidationError(w, "volume_ul", "volume_ul cannot be negative")
+		return aliquotState{}, false
+	}
+	if req.Count != nil && *req.Count < 0 {
+		writeValidationError(w, "count", "count cannot be negative")
+		return aliquotState{}, false
+	}
+
+	quantity := SampleQuantity{VolumeUl: state.RemainingVolumeUl, Count: state.RemainingCount}
+	if req.VolumeUl != nil {
+		quantity.VolumeUl = req.VolumeUl
+	}
+	if req.Count != nil {
+		quantity.Count = req.Count
+	}
+	return h.writeQuantity(w, r, kind, state, quantity)
+}
+
+func (h *Handlers) writeQuantity(w http.ResponseWriter, r *http.Request, kind *SampleType, state SampleLink, quantity SampleQuantity) (aliquotState, bool) {
+	n, err := h.store.SetSampleQuantity(r.Context(), r, kind, state, quantity)
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return aliquotState{}, false
+	}
+	if n == 0 {
+		writeApiError(w, errQuantityChanged)
+		return aliquotState{}, false
+	}
+
+	after, err := h.store.GetSampleLink(r.Context(), kind, state.EnteredName)
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return aliquotState{}, false
+	}
+	return aliquotStateOf(after), true
+}
+
+// sampleLineage walks up to the oldest stored ancestor of a sample and
+// returns the whole family below it.
+func (h *Handlers) sampleLineage(w http.ResponseWriter, r *http.Request, kind *SampleType, enteredName string) (Lineage, bool) {
+	lineage := Lineage{Sample: enteredName, Ancestors: []string{}}
+	ctx := r.Context()
+
+	if _, ok := h.loadAliquot(w, r, kind, enteredName); !ok {
+		return lineage, false
+	}
+
+	up := "WITH RECURSIVE up AS (" +
+		"SELECT entered_name, parent_name, 0 AS depth FROM " + kind.Table + " WHERE entered_name = $1 " +
+		"UNION ALL SELECT p.entered_name, p.parent_name, up.depth + 1 FROM " + kind.Table + " p JOIN up ON p.entered_name = up.parent_name WHERE up.depth < $2" +
+		") SELECT entered_name, parent_name FROM up ORDER BY depth DESC"
+	rows, err := db.Query(ctx, up, enteredName, maxLineageDepth)
+	if err != nil {
+		writeDbError(w, err)
+		return lineage, false
+	}
+
+	root := enteredName
+	first := true
+	for rows.Next() {
+		var name string
+		var parent *string
+		if err := rows.Scan(&name, &parent); err != nil {
+			rows.Close()
+			writeDbError(w, err)
+			return lineage, false
+		}
+		// the oldest row may still name a parent that is no longer stored
+		if first && parent != nil {
+			lineage.Ancestors = append(lineage.Ancestors, *parent)
+		}
+		if first {
+			root = name
+			first = false
+		}
+		if name != enteredName {
+			lineage.Ancestors = append(lineage.Ancestors, name)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		writeDbError(w, err)
+		return lineage, false
+	}
+
+	down := "WITH RECURSIVE down AS (" +
+		"SELECT entered_name, 0 AS depth FROM " + kind.Table + " WHERE entered_name = $1 " +
+		"UNION ALL SELECT c.entered_name, down.depth + 1 FROM " + kind.Table + " c JOIN down ON c.parent_name = down.entered_name WHERE down.depth < $2" +
+		") SELECT l.entered_name, l.box_id, b.name, f.name, l.position, l.checked_out_by, l.parent_name, l.remaining_volume_ul, l.remaining_count, l.consumed_at " +
+		"FROM down JOIN " + kind.Table + " l ON l.entered_name = down.entered_name " +
+		"join mgl_freezer_inventory.boxes b on l.box_id = b.id join mgl_freezer_inventory.freezer f on b.freezer_id = f.id " +
+		"ORDER BY down.depth, l.entered_name"
+	rows, err = db.Query(ctx, down, root, maxLineageDepth)
+	if err != nil {
+		writeDbError(w, err)
+		return lineage, false
+	}
+	defer rows.Close()
+
+	var nodes []LineageNode
+	for rows.Next() {
+		var node LineageNode
+
+		err := rows.Scan(
+			&node.EnteredName,
+			&node.BoxId,
+			&node.BoxName,
+			&node.FreezerName,
+			&node.Position,
+			&node.CheckedOutBy,
+			&node.ParentName,
+			&node.RemainingVolumeUl,
+			&node.RemainingCount,
+			&node.ConsumedAt,
+		)
+
+		if err != nil {
+			writeDbError(w, err)
+			return lineage, false
+		}
+
+		node.Children = []LineageNode{}
+		nodes = append(nodes, node)
+	}
+	if err := rows.Err(); err != nil {
+		writeDbError(w, err)
+		return lineage, false
+	}
+
+	lineage.Tree = buildLineageTree(nodes, root)
+	return lineage, true
+}
+
+// buildLineageTree nests nodes under their parents, starting from root.
+func buildLineageTree(nodes []LineageNode, root string) LineageNode {
+	children := map[string][]LineageNode{}
+	var tree LineageNode
+	for _, node := range nodes {
+		if node.EnteredName == root {
+			tree = node
+		} else if node.ParentName != nil {
+			children[*node.ParentName] = append(children[*node.ParentName], node)
+		}
+	}
+
+	var attach func(node *LineageNode, depth int)
+	attach = func(node *LineageNode, depth int) {
+		if depth >= maxLineageDepth {
+			return
+		}
+		node.Children = append(node.Children, children[node.EnteredName]...)
+		for i := range node.Children {
+			attach(&node.Children[i], depth+1)
+		}
+	}
+	attach(&tree, 0)
+	return tree
+}
+
+func (h *Handlers) ApiCreateAliquot(w http.ResponseWriter, r *http.Request) {
+	kind, ok := pathSampleType(w, r)
+	if !ok {
+		return
+	}
+	var req aliquotRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if created, ok := h.createAliquot(w, r, kind, r.PathValue("name"), req); ok {
+		writeJSON(w, http.StatusCreated, created)
+	}
+}
+
+func (h *Handlers) ApiConsumeSample(w http.ResponseWriter, r *http.Request) {
+	apiQuantity(w, r, h.consumeSample)
+}
+
+func (h *Handlers) ApiSetSampleQuantity(w http.ResponseWriter, r *http.Request) {
+	apiQuantity(w, r, h.setQuantity)
+}
+
+func (h *Handlers) ApiSampleLineage(w http.ResponseWriter, r *http.Request) {
+	kind, ok := pathSampleType(w, r)
+	if !ok {
+		return
+	}
+	if !h.requireLinkRole(w, r, RoleViewer, kind, r.PathValue("name")) {
+		return
+	}
+	if lineage, ok := h.sampleLineage(w, r, kind, r.PathValue("name")); ok {
+		writeJSON(w, http.StatusOK, lineage)
+	}
+}
+
+func apiQuantity(w http.ResponseWriter, r *http.Request, apply func(http.ResponseWriter, *http.Request, *SampleType, string, quantityRequest) (aliquotState, bool)) {
+	kind, ok := pathSampleType(w, r)
+	if !ok {
+		return
+	}
+	var req quantityRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if state, ok := apply(w, r, kind, r.PathValue("name"), req); ok {
+		writeJSON(w, http.StatusOK, state)
+	}
+}
@@ -0,0 +1,170 @@
+package freezerinv
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestTakeQuantity(t *testing.T) {
+	for _, c := range []struct {
+		name         string
+		volume, left *float64
+		count, held  *int
+		wantVolume   *float64
+		wantCount    *int
+		wantConsumed bool
+		wantCode     string
+	}{
+		{name: "some volume", left: ptr(10.0), volume: ptr(4.0), wantVolume: ptr(6.0)},
+		{name: "all the volume", left: ptr(10.0), volume: ptr(10.0), wantVolume: ptr(0.0), wantConsumed: true},
+		{name: "the last piece", held: ptr(3), count: ptr(3), wantCount: ptr(0), wantConsumed: true},
+		{name: "volume left, count gone", left: ptr(10.0), held: ptr(1), volume: ptr(2.0), count: ptr(1), wantVolume: ptr(8.0), wantCount: ptr(0), wantConsumed: true},
+		{name: "nothing asked for", left: ptr(10.0), held: ptr(2), wantVolume: ptr(10.0), wantCount: ptr(2)},
+		{name: "no volume", left: ptr(10.0), volume: ptr(0.0), wantCode: CodeValidationFailed},
+		{name: "negative count", held: ptr(3), count: ptr(-1), wantCode: CodeValidationFailed},
+		{name: "too much volume", left: ptr(1.0), volume: ptr(2.0), wantCode: CodeInsufficientQuantity},
+		{name: "untracked volume", volume: ptr(1.0), wantCode: CodeInsufficientQuantity},
+		{name: "too many pieces", held: ptr(1), count: ptr(2), wantCode: CodeInsufficientQuantity},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			state := SampleLink{EnteredName: "E-1", Aliquot: Aliquot{RemainingVolumeUl: c.left, RemainingCount: c.held}}
+			volume, count, consumed, apiErr := takeQuantity(state, c.volume, c.count)
+			if c.wantCode != "" {
+				if apiErr == nil || apiErr.Code != c.wantCode {
+					t.Fatalf("got %v, want %s", apiErr, c.wantCode)
+				}
+				return
+			}
+			if apiErr != nil {
+				t.Fatalf("refused: %v", apiErr)
+			}
+			if !equalPtr(volume, c.wantVolume) || !equalPtr(count, c.wantCount) || consumed != c.wantConsumed {
+				t.Fatalf("left %s and %s, consumed %t; want %s and %s, consumed %t",
+					describeVolume(volume), describeCount(count), consumed, describeVolume(c.wantVolume), describeCount(c.wantCount), c.wantConsumed)
+			}
+		})
+	}
+}
+
+func TestQuantityUpdate(t *testing.T) {
+	was := SampleLink{EnteredName: "E-1", Aliquot: Aliquot{RemainingVolumeUl: ptr(10.0)}}
+
+	for _, c := range []struct {
+		name     string
+		quantity SampleQuantity
+		consumes bool
+	}{
+		{"some left", SampleQuantity{VolumeUl: ptr(6.0)}, false},
+		{"used up", SampleQuantity{VolumeUl: ptr(0.0), Consumed: true}, true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			query, args := quantityUpdate(tubes, was, c.quantity)
+			if got := strings.Contains(query, "consumed_at = now(), position = NULL"); got != c.consumes {
+				t.Fatalf("marks consumed: %t, want %t in %s", got, c.consumes, query)
+			}
+			// the update only applies while the row still holds what was read
+			if !strings.Contains(query, "consumed_at IS NULL AND remaining_volume_ul IS NOT DISTINCT FROM $4 AND remaining_count IS NOT DISTINCT FROM $5") {
+				t.Fatalf("no check against the quantity read: %s", query)
+			}
+			want := fmt.Sprint([]interface{}{c.quantity.VolumeUl, c.quantity.Count, "E-1", was.RemainingVolumeUl, was.RemainingCount})
+			if got := fmt.Sprint(args); got != want {
+				t.Fatalf("args %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+// lineageNode is a node named name under parent, no parent when empty.
+func lineageNode(name string, parent string) LineageNode {
+	node := LineageNode{EnteredName: name, Children: []LineageNode{}}
+	if parent != "" {
+		node.ParentName = &parent
+	}
+	return node
+}
+
+// lineageShape writes a tree as name(child child ...).
+func lineageShape(node LineageNode) string {
+	if len(node.Children) == 0 {
+		return node.EnteredName
+	}
+	var children []string
+	for _, child := range node.Children {
+		children = append(children, lineageShape(child))
+	}
+	return node.EnteredName + "(" + strings.Join(children, " ") + ")"
+}
+
+func TestBuildLineageTree(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		nodes []LineageNode
+		root  string
+		want  string
+	}{
+		{
+			name:  "single sample",
+			nodes: []LineageNode{lineageNode("E-1", "")},
+			root:  "E-1",
+			want:  "E-1",
+		},
+		{
+			name:  "two generations",
+			nodes: []LineageNode{lineageNode("E-1", ""), lineageNode("E-1a", "E-1"), lineageNode("E-1b", "E-1"), lineageNode("E-1a1", "E-1a")},
+			root:  "E-1",
+			want:  "E-1(E-1a(E-1a1) E-1b)",
+		},
+		{
+			// the root's own parent is gone, the tree still starts at the root
+			name:  "removed ancestor",
+			nodes: []LineageNode{lineageNode("E-1a", "E-1"), lineageNode("E-1a1", "E-1a")},
+			root:  "E-1a",
+			want:  "E-1a(E-1a1)",
+		},
+		{
+			name:  "unrelated rows",
+			nodes: []LineageNode{lineageNode("E-1", ""), lineageNode("E-2a", "E-2")},
+			root:  "E-1",
+			want:  "E-1",
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if got := lineageShape(buildLineageTree(c.nodes, c.root)); got != c.want {
+				t.Fatalf("got %s, want %s", got, c.want)
+			}
+		})
+	}
+}
+
+func TestBuildLineageTreeStopsAtMaxDepth(t *testing.T) {
+	nodes := []LineageNode{lineageNode("S-0", "")}
+	for i := 1; i <= maxLineageDepth+10; i++ {
+		nodes = append(nodes, lineageNode(fmt.Sprintf("S-%d", i), fmt.Sprintf("S-%d", i-1)))
+	}
+	tree := buildLineageTree(nodes, "S-0")
+
+	depth := 0
+	for node := tree; len(node.Children) > 0; node = node.Children[0] {
+		depth++
+	}
+	if depth != maxLineageDepth {
+		t.Fatalf("the chain nested %d deep, want it cut at %d", depth, maxLineageDepth)
+	}
+}
+
+func TestBuildLineageTreeOnCycles(t *testing.T) {
+	// B names A as its parent and A names B, so the recursive query returns
+	// the pair over and over until it reaches the depth limit
+	var nodes []LineageNode
+	for range maxLineageDepth / 2 {
+		nodes = append(nodes, lineageNode("A", "B"), lineageNode("B", "A"))
+	}
+	if got := lineageShape(buildLineageTree(nodes, "A")); !strings.HasPrefix(got, "A(B") {
+		t.Fatalf("got %s, want A with B below it", got)
+	}
+}
@@ -0,0 +1,588 @@
+package freezerinv
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.com/UrsusArcTech/logger"
+)
+
+// Handlers for the /api/v1 routes. They take path values and JSON bodies and
+// share the work with the legacy query string handlers.
+
+type boxRequest struct {
+	Name      *string `json:"name"`
+	FreezerId *int    `json:"freezer_id"`
+	Shelf     *int    `json:"shelf"`
+	Rack      *int    `json:"rack"`
+	Drawer    *int    `json:"drawer"`
+	Format    *string `json:"format"`
+}
+
+type freezerRequest struct {
+	FreezerLocationId       *int       `json:"freezer_location_id"`
+	Name                    *string    `json:"name"`
+	Model                   *string    `json:"model"`
+	Comments                *string    `json:"comments"`
+	CurrentHoldingTempC     *int       `json:"current_holding_temp_c"`
+	ManualProjectsContained *string    `json:"manual_projects_contained"`
+	LastCalibrated          *time.Time `json:"last_calibrated"`
+	ShelfCount              *int       `json:"shelf_count"`
+	ShelfLabel              *string    `json:"shelf_label"`
+	RacksPerShelf           *int       `json:"racks_per_shelf"`
+	DrawersPerRack          *int       `json:"drawers_per_rack"`
+	BoxesPerSlot            *int       `json:"boxes_per_slot"`
+}
+
+type roomRequest struct {
+	Lab   *string `json:"lab"`
+	Floor *string `json:"floor"`
+}
+
+type sampleLinkRequest struct {
+	EnteredName *string `json:"entered_name"`
+	BoxId       *int    `json:"box_id"`
+	Position    *int    `json:"position"`
+}
+
+type shelfMoveRequest struct {
+	FreezerId *int `json:"freezer_id"`
+	Shelf     *int `json:"shelf"`
+}
+
+type linkCreated struct {
+	Link    interface{} `json:"link"`
+	Message string      `json:"message,omitempty"`
+}
+
+// queryInts reads integer query parameters in order, writing a 400 for the
+// first one that is missing or not a number.
+func queryInts(w http.ResponseWriter, r *http.Request, names ...string) ([]int, bool) {
+	var values []int
+	for _, name := range names {
+		s := r.URL.Query().Get(name)
+		if s == "" {
+			logger.LogError("Missing required fields: " + name)
+			writeValidationError(w, name, "Missing required fields: "+name)
+			return nil, false
+		}
+		v, err := strconv.Atoi(s)
+		if err != nil {
+			writeValidationError(w, name, "Invalid "+name+": "+s)
+			return nil, false
+		}
+		values = append(values, v)
+	}
+	return values, true
+}
+
+// queryOptionalInt is queryInts for a parameter that may be left out.
+func queryOptionalInt(w http.ResponseWriter, r *http.Request, name string) (*int, bool) {
+	if r.URL.Query().Get(name) == "" {
+		return nil, true
+	}
+	values, ok := queryInts(w, r, name)
+	if !ok {
+		return nil, false
+	}
+	return &values[0], true
+}
+
+func pathInt(w http.ResponseWriter, r *http.Request, name string) (int, bool) {
+	v, err := strconv.Atoi(r.PathValue(name))
+	if err != nil {
+		writeValidationError(w, name, "Invalid "+name+": "+r.PathValue(name))
+		return 0, false
+	}
+	return v, true
+}
+
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		writeError(w, http.StatusUnsupportedMediaType, CodeUnsupportedMediaType, "Request body must be application/json")
+		return false
+	}
+
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeValidationError(w, "", "Invalid JSON body: "+err.Error())
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (h *Handlers) ApiListRoomFreezers(w http.ResponseWriter, r *http.Request) {
+	h.listFreezersInRoom(w, r, r.PathValue("id"), r.URL.Query().Get("include_retired") == "true")
+}
+
+func (h *Handlers) ApiCreateRoom(w http.ResponseWriter, r *http.Request) {
+	var req roomRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	var room FreezerRoom
+	req.applyTo(&room)
+
+	room, ok := h.createRoom(w, r, room)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusCreated, room)
+}
+
+func (h *Handlers) ApiUpdateRoom(w http.ResponseWriter, r *http.Request) {
+	roomId, ok := pathInt(w, r, "id")
+	if !ok {
+		return
+	}
+
+	var req roomRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	room, err := h.store.GetRoom(r.Context(), roomId)
+	if err == errRoomNotFound {
+		writeError(w, http.StatusNotFound, CodeRoomNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return
+	}
+	req.applyTo(&room)
+
+	room, ok = h.editRoom(w, r, room)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, room)
+}
+
+func (h *Handlers) ApiRetireRoom(w http.ResponseWriter, r *http.Request) {
+	roomId, ok := pathInt(w, r, "id")
+	if !ok {
+		return
+	}
+
+	room, ok := h.retireRoom(w, r, roomId)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, room)
+}
+
+func (req roomRequest) applyTo(room *FreezerRoom) {
+	if req.Lab != nil {
+		room.Lab = strings.TrimSpace(*req.Lab)
+	}
+	if req.Floor != nil {
+		room.Floor = strings.TrimSpace(*req.Floor)
+	}
+}
+
+func (h *Handlers) ApiGetFreezer(w http.ResponseWriter, r *http.Request) {
+	freezerId, ok := pathInt(w, r, "id")
+	if !ok {
+		return
+	}
+
+	freezer, err := h.store.GetFreezer(r.Context(), freezerId)
+	if err == errFreezerNotFound {
+		writeError(w, http.StatusNotFound, CodeFreezerNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, freezer)
+}
+
+func (h *Handlers) ApiCreateFreezer(w http.ResponseWriter, r *http.Request) {
+	var req freezerRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	freezer := FreezerDB{FreezerLayout: defaultLayout}
+	req.applyTo(&freezer)
+
+	freezer, ok := h.createFreezer(w, r, freezer)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusCreated, freezer)
+}
+
+// ApiUpdateFreezer applies a partial update; fields left out of the body keep
+// their current value. An empty comments string clears the comments.
+func (h *Handlers) ApiUpdateFreezer(w http.ResponseWriter, r *http.Request) {
+	freezerId, ok := pathInt(w, r, "id")
+	if !ok {
+		return
+	}
+
+	var req freezerRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	freezer, err := h.store.GetFreezer(r.Context(), freezerId)
+	if err == errFreezerNotFound {
+		writeError(w, http.StatusNotFound, CodeFreezerNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return
+	}
+	req.applyTo(&freezer)
+
+	freezer, ok = h.editFreezer(w, r, freezer)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, freezer)
+}
+
+func (h *Handlers) ApiRetireFreezer(w http.ResponseWriter, r *http.Request) {
+	freezerId, ok := pathInt(w, r, "id")
+	if !ok {
+		return
+	}
+
+	freezer, ok := h.retireFreezer(w, r, freezerId)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, freezer)
+}
+
+func (req freezerRequest) applyTo(freezer *FreezerDB) {
+	if req.FreezerLocationId != nil {
+		freezer.FreezerLocationId = *req.FreezerLocationId
+	}
+	if req.Name != nil {
+		freezer.Name = strings.TrimSpace(*req.Name)
+	}
+	if req.Model != nil {
+		freezer.Model = strings.TrimSpace(*req.Model)
+	}
+	if req.Comments != nil {
+		freezer.Comments = req.Comments
+		if *req.Comments == "" {
+			freezer.Comments = nil
+		}
+	}
+	if req.CurrentHoldingTempC != nil {
+		freezer.CurrentHoldingTempC = req.CurrentHoldingTempC
+	}
+	if req.ManualProjectsContained != nil {
+		freezer.ManualProjectsContained = *req.ManualProjectsContained
+	}
+	if req.LastCalibrated != nil {
+		freezer.LastCalibrated = req.LastCalibrated
+	}
+	if req.ShelfCount != nil {
+		freezer.ShelfCount = *req.ShelfCount
+	}
+	if req.ShelfLabel != nil {
+		freezer.ShelfLabel = strings.TrimSpace(*req.ShelfLabel)
+	}
+	// 0 removes the racks or drawers
+	if req.RacksPerShelf != nil {
+		freezer.RacksPerShelf = zeroAsNil(*req.RacksPerShelf)
+	}
+	if req.DrawersPerRack != nil {
+		freezer.DrawersPerRack = zeroAsNil(*req.DrawersPerRack)
+	}
+	if req.BoxesPerSlot != nil {
+		freezer.BoxesPerSlot = zeroAsNil(*req.BoxesPerSlot)
+	}
+}
+
+func emptyAsNil(s *string) *string {
+	if s == nil || *s == "" {
+		return nil
+	}
+	return s
+}
+
+// sameString compares two optional strings, nil only matching nil.
+func sameString(a *string, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func zeroAsNil(v int) *int {
+	if v == 0 {
+		return nil
+	}
+	return &v
+}
+
+func (h *Handlers) ApiListFreezerBoxes(w http.ResponseWriter, r *http.Request) {
+	h.listBoxesInFreezer(w, r, r.PathValue("id"))
+}
+
+func (h *Handlers) ApiCreateBox(w http.ResponseWriter, r *http.Request) {
+	var req boxRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	switch {
+	case req.Name == nil || *req.Name == "":
+		writeValidationError(w, "name", "Missing required fields: name")
+		return
+	case req.FreezerId == nil:
+		writeValidationError(w, "freezer_id", "Missing required fields: freezer_id")
+		return
+	case req.Shelf == nil:
+		writeValidationError(w, "shelf", "Missing required fields: shelf")
+		return
+	}
+
+	box, ok := h.createBox(w, r, Box{Name: *req.Name, FreezerId: *req.FreezerId, Shelf: *req.Shelf, Rack: req.Rack, Drawer: req.Drawer, Format: emptyAsNil(req.Format)})
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusCreated, box)
+}
+
+// ApiUpdateBox applies a partial update; fields left out of the body keep
+// their current value.
+func (h *Handlers) ApiUpdateBox(w http.ResponseWriter, r *http.Request) {
+	boxId, ok := pathInt(w, r, "id")
+	if !ok {
+		return
+	}
+
+	var req boxRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	box, err := h.store.GetBox(r.Context(), boxId)
+	if err == errBoxNotFound {
+		writeError(w, http.StatusNotFound, CodeBoxNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return
+	}
+
+	if req.Name != nil {
+		if *req.Name == "" {
+			writeValidationError(w, "name", "Box name cannot be empty")
+			return
+		}
+		box.Name = *req.Name
+	}
+	if req.FreezerId != nil {
+		box.FreezerId = *req.FreezerId
+	}
+	if req.Shelf != nil {
+		box.Shelf = *req.Shelf
+	}
+	// 0 takes the box out of its rack or drawer
+	if req.Rack != nil {
+		box.Rack = zeroAsNil(*req.Rack)
+	}
+	if req.Drawer != nil {
+		box.Drawer = zeroAsNil(*req.Drawer)
+	}
+	// "" stops tracking positions
+	if req.Format != nil {
+		box.Format = emptyAsNil(req.Format)
+	}
+
+	box, ok = h.editBox(w, r, box)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, box)
+}
+
+func (h *Handlers) ApiDeleteBox(w http.ResponseWriter, r *http.Request) {
+	boxId, ok := pathInt(w, r, "id")
+	if !ok || !h.removeBox(w, r, boxId) {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ApiMoveShelf moves every box on a shelf to the freezer and shelf in the body.
+func (h *Handlers) ApiMoveShelf(w http.ResponseWriter, r *http.Request) {
+	freezerId, ok := pathInt(w, r, "id")
+	if !ok {
+		return
+	}
+	shelf, ok := pathInt(w, r, "shelf")
+	if !ok {
+		return
+	}
+
+	var req shelfMoveRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if req.FreezerId == nil {
+		writeValidationError(w, "freezer_id", "Missing required fields: freezer_id")
+		return
+	}
+	if req.Shelf == nil {
+		writeValidationError(w, "shelf", "Missing required fields: shelf")
+		return
+	}
+
+	result, ok := h.moveShelf(w, r, freezerId, shelf, *req.FreezerId, *req.Shelf)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (h *Handlers) ApiListSampleLinks(w http.ResponseWriter, r *http.Request) {
+	t, ok := pathSampleType(w, r)
+	if !ok {
+		return
+	}
+	links, ok := h.listSampleLinks(w, r, t, r.PathValue("id"))
+	if !ok {
+		return
+	}
+	if links == nil {
+		links = []SampleLink{}
+	}
+	writeJSON(w, http.StatusOK, links)
+}
+
+func (h *Handlers) ApiCreateSampleLink(w http.ResponseWriter, r *http.Request) {
+	t, ok := pathSampleType(w, r)
+	if !ok {
+		return
+	}
+	var req sampleLinkRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if req.EnteredName == nil || *req.EnteredName == "" {
+		writeValidationError(w, "entered_name", "Missing required fields: entered_name")
+		return
+	}
+	if req.BoxId == nil {
+		writeValidationError(w, "box_id", "Missing required fields: box_id")
+		return
+	}
+
+	link, message, ok := h.linkSample(w, r, t, *req.BoxId, *req.EnteredName, req.Position)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusCreated, linkCreated{Link: link, Message: message})
+}
+
+func (h *Handlers) ApiUpdateSampleLink(w http.ResponseWriter, r *http.Request) {
+	t, ok := pathSampleType(w, r)
+	if !ok {
+		return
+	}
+	var req sampleLinkRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	newName := ""
+	if req.EnteredName != nil {
+		newName = *req.EnteredName
+	}
+	if !h.relinkSample(w, r, t, r.PathValue("name"), newName, req.BoxId, req.Position) {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handlers) ApiDeleteSampleLink(w http.ResponseWriter, r *http.Request) {
+	t, ok := pathSampleType(w, r)
+	if !ok {
+		return
+	}
+	if !h.unlinkSample(w, r, t, r.PathValue("name")) {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ApiSampleLocations lists every box holding the sample name, empty if none.
+func (h *Handlers) ApiSampleLocations(w http.ResponseWriter, r *http.Request) {
+	t, ok := pathSampleType(w, r)
+	if !ok {
+		return
+	}
+	if !h.requireLinkRole(w, r, RoleViewer, t, r.PathValue("name")) {
+		return
+	}
+	results, err := h.store.FindSampleLocations(r.Context(), t, r.PathValue("name"))
+	if err != nil {
+		logger.LogError(t.Label+" box check err: ", err.Error())
+		writeDbError(w, err)
+		return
+	}
+	if results == nil {
+		results = []SampleLocation{}
+	}
+	writeJSON(w, http.StatusOK, results)
+}
+
+func (h *Handlers) ApiGrantRole(w http.ResponseWriter, r *http.Request) {
+	var grant RoleGrant
+	if !decodeJSON(w, r, &grant) {
+		return
+	}
+	if !h.grantRoleChecked(w, r, grant) {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handlers) ApiRevokeRole(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathInt(w, r, "id")
+	if !ok {
+		return
+	}
+
+	grant, err := h.store.GetRoleGrant(r.Context(), id)
+	if err == errRoleNotFound {
+		writeError(w, http.StatusNotFound, CodeRoleNotFound, "Role not found")
+		return
+	}
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return
+	}
+	if !h.revokeRoleChecked(w, r, grant.Username, grant.FreezerLocationId, grant.FreezerId) {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,334 @@
+package freezerinv
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	boxesTable       = "mgl_freezer_inventory.boxes"
+	ednaLinkTable    = "mgl_freezer_inventory.mgl_edna_box_link"
+	fishLinkTable    = "mgl_freezer_inventory.mgl_fish_box_link"
+	freezerTable     = "mgl_freezer_inventory.freezer"
+	roomsTable       = "mgl_freezer_inventory.freezer_locations"
+	maintenanceTable = "mgl_freezer_inventory.freezer_maintenance"
+	attachmentsTable = "mgl_freezer_inventory.freezer_maintenance_attachments"
+	intervalsTable   = "mgl_freezer_inventory.freezer_maintenance_intervals"
+	rolesTable       = "mgl_freezer_inventory.user_roles"
+)
+
+type AuditEntry struct {
+	Id            int64           `json:"id"`
+	OccurredAt    time.Time       `json:"occurred_at"`
+	Actor         string          `json:"actor"`
+	Endpoint      string          `json:"endpoint"`
+	TableName     string          `json:"table_name"`
+	Action        string          `json:"action"`
+	BoxId         *int            `json:"box_id"`
+	FreezerId     *int            `json:"freezer_id"`
+	NewBoxId      *int            `json:"new_box_id"`
+	NewFreezerId  *int            `json:"new_freezer_id"`
+	SampleName    *string         `json:"sample_name"`
+	NewSampleName *string         `json:"new_sample_name"`
+	Before        json.RawMessage `json:"before"`
+	After         json.RawMessage `json:"after"`
+}
+
+// auditRowRef picks the location columns out of a row snapshot. Boxes carry
+// their own id, link rows point at a box.
+type auditRowRef struct {
+	Id          *int    `json:"id"`
+	BoxId       *int    `json:"box_id"`
+	FreezerId   *int    `json:"freezer_id"`
+	EnteredName *string `json:"entered_name"`
+}
+
+// the snapshot helpers wrap a mutation so it returns (before, after) jsonb
+// for every row it touches, which is what auditedExec expects
+
+func snapshotInsert(table, columns, values string) string {
+	return "INSERT INTO " + table + " AS t (" + columns + ") VALUES (" + values + ") RETURNING NULL::jsonb, to_jsonb(t)"
+}
+
+func snapshotUpdate(table, set, where string) string {
+	return "WITH old AS (SELECT ctid AS row_id, to_jsonb(t) AS doc FROM " + table + " t WHERE " + where + " FOR UPDATE) " +
+		"UPDATE " + table + " t SET " + set + " FROM old WHERE t.ctid = old.row_id RETURNING old.doc, to_jsonb(t)"
+}
+
+func snapshotDelete(table, where string) string {
+	return "DELETE FROM " + table + " t WHERE " + where + " RETURNING to_jsonb(t), NULL::jsonb"
+}
+
+// auditActor is the session user. Falls back to the remote address, or to
+// cli for changes made by a subcommand, which have no request.
+func auditActor(r *http.Request) string {
+	if r == nil {
+		return "cli"
+	}
+	if user := SessionUser(r); user != "" {
+		return user
+	}
+	return r.RemoteAddr
+}
+
+// auditedExec runs a snapshot query in a transaction and writes one audit_log
+// row per affected row before committing. Returns the number of rows touched.
+func auditedExec(r *http.Request, table string, action string, query string, args ...interface{}) (int64, error) {
+	after, err := auditedQuery(r, table, action, query, args...)
+	return int64(len(after)), err
+}
+
+// auditedQuery is auditedExec returning the after image of each row touched,
+// nil for deleted rows.
+func auditedQuery(r *http.Request, table string, action string, query string, args ...interface{}) ([]json.RawMessage, error) {
+	return auditedQueryIn(context.Background(), db, r, table, action, query, args...)
+}
+
+// auditedQueryIn is auditedQuery on the given pool.
+func auditedQueryIn(ctx context.Context, pool *pgxpool.Pool, r *http.Request, table string, action string, query string, args ...interface{}) ([]json.RawMessage, error) {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	afters, err := auditedQueryTx(ctx, tx, r, table, action, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return afters, nil
+}
+
+// auditedQueryTx is auditedQuery inside a transaction the caller commits, for
+// changes that have to land together.
+func auditedQueryTx(ctx context.Context, tx pgx.Tx, r *http.Request, table string, action string, query string, args ...interface{}) ([]json.RawMessage, error) {
+	rows, err := tx.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots [][2][]byte
+	for rows.Next() {
+		var before, after []byte
+		if err := rows.Scan(&before, &after); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		snapshots = append(snapshots, [2][]byte{before, after})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var afters []json.RawMessage
+	for _, snap := range snapshots {
+		if err := recordAudit(ctx, tx, r, table, action, snap[0], snap[1]); err != nil {
+			return nil, err
+		}
+		afters = append(afters, snap[1])
+	}
+	return afters, nil
+}
+
+// auditEndpoint is the path of the request behind a change, cli for a
+// subcommand.
+func auditEndpoint(r *http.Request) string {
+	if r == nil {
+		return "cli"
+	}
+	return r.URL.Path
+}
+
+func recordAudit(ctx context.Context, tx pgx.Tx, r *http.Request, table, action string, before, after []byte) error {
+	boxFreezer := func(boxId int) (*int, error) {
+		var id int
+		err := tx.QueryRow(ctx, "SELECT freezer_id FROM mgl_freezer_inventory.boxes WHERE id = $1", boxId).Scan(&id)
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		return &id, err
+	}
+	boxId, freezerId, sample, err := auditLocation(table, before, boxFreezer)
+	if err != nil {
+		return err
+	}
+	newBoxId, newFreezerId, newSample, err := auditLocation(table, after, boxFreezer)
+	if err != nil {
+		return err
+	}
+
+	query := "INSERT INTO mgl_freezer_inventory.audit_log (actor, endpoint, table_name, action, box_id, freezer_id, new_box_id, new_freezer_id, sample_name, new_sample_name, before, after) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)"
+	args := []interface{}{auditActor(r), auditEndpoint(r), table, action, boxId, freezerId, newBoxId, newFreezerId, sample, newSample, before, after}
+
+	_, err = tx.Exec(ctx, query, args...)
+	return err
+}
+
+// auditLocation picks the box, freezer and sample out of a row snapshot.
+// boxFreezer finds the freezer of a link row's box, nil if the box is gone.
+func auditLocation(table string, doc []byte, boxFreezer func(boxId int) (*int, error)) (boxId *int, freezerId *int, sample *string, err error) {
+	if doc == nil {
+		return nil, nil, nil, nil
+	}
+
+	var ref auditRowRef
+	if err := json.Unmarshal(doc, &ref); err != nil {
+		return nil, nil, nil, err
+	}
+
+	switch table {
+	case boxesTable:
+		return ref.Id, ref.FreezerId, nil, nil
+	case freezerTable:
+		return nil, ref.Id, nil, nil
+	case maintenanceTable, rolesTable:
+		return nil, ref.FreezerId, nil, nil
+	case roomsTable, intervalsTable:
+		return nil, nil, nil, nil
+	}
+
+	if ref.BoxId != nil {
+		if freezerId, err = boxFreezer(*ref.BoxId); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	return ref.BoxId, freezerId, ref.EnteredName, nil
+}
+
+// parseAuditTime accepts a plain date or an RFC3339 timestamp. A plain date
+// used as an upper bound covers the whole day.
+func parseAuditTime(s string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return t, err
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// GetAuditLog lists audit entries, newest first. Filters: boxid, freezerid,
+// sample, from, to. A box, freezer or sample matches on either side of a change.
+// Managers of a freezer can read its history; anything wider needs a lab-wide
+// manager.
+func (h *Handlers) GetAuditLog(w http.ResponseWriter, r *http.Request) {
+	filter := AuditFilter{Limit: 200}
+	var ok bool
+	if filter.FreezerId, ok = queryOptionalInt(w, r, "freezerid"); !ok {
+		return
+	}
+	if filter.FreezerId != nil {
+		if !h.requireRole(w, r, RoleManager, *filter.FreezerId) {
+			return
+		}
+	} else if !h.requireRoomRole(w, r, RoleManager, nil) {
+		return
+	}
+
+	q := r.URL.Query()
+
+	if limitStr := q.Get("limit"); limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 && l <= 1000 {
+			filter.Limit = l
+		}
+	}
+	if offsetStr := q.Get("offset"); offsetStr != "" {
+		if o, err := strconv.Atoi(offsetStr); err == nil && o >= 0 {
+			filter.Offset = o
+		}
+	}
+
+	if boxId := q.Get("boxid"); boxId != "" {
+		id, err := strconv.Atoi(boxId)
+		if err != nil {
+			writeValidationError(w, "boxid", "Invalid boxid")
+			return
+		}
+		filter.BoxId = &id
+	}
+
+	filter.Sample = q.Get("sample")
+
+	if from := q.Get("from"); from != "" {
+		t, err := parseAuditTime(from, false)
+		if err != nil {
+			writeValidationError(w, "from", "Invalid from date, use YYYY-MM-DD or RFC3339")
+			return
+		}
+		filter.From = &t
+	}
+
+	if to := q.Get("to"); to != "" {
+		t, err := parseAuditTime(to, true)
+		if err != nil {
+			writeValidationError(w, "to", "Invalid to date, use YYYY-MM-DD or RFC3339")
+			return
+		}
+		filter.To = &t
+	}
+
+	results, err := h.store.ListAudit(r.Context(), filter)
+	if err != nil {
+		writeDbError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+const auditColumns = "id, occurred_at, actor, endpoint, table_name, action, box_id, freezer_id, new_box_id, new_freezer_id, sample_name, new_sample_name, before, after"
+
+// auditWhere turns a filter into the WHERE, ORDER BY and LIMIT of an
+// audit_log query. placeholder writes the nth parameter for the database,
+// $n for Postgres and ?n for SQLite.
+func auditWhere(filter AuditFilter, placeholder func(n int) string) (string, []interface{}) {
+	var args []interface{}
+	var conditions []string
+	param := func(v interface{}) string {
+		args = append(args, v)
+		return placeholder(len(args))
+	}
+
+	if filter.BoxId != nil {
+		n := param(*filter.BoxId)
+		conditions = append(conditions, "(box_id = "+n+" OR new_box_id = "+n+")")
+	}
+	if filter.FreezerId != nil {
+		n := param(*filter.FreezerId)
+		conditions = append(conditions, "(freezer_id = "+n+" OR new_freezer_id = "+n+")")
+	}
+	if filter.Sample != "" {
+		n := param(filter.Sample)
+		conditions = append(conditions, "(sample_name = "+n+" OR new_sample_name = "+n+")")
+	}
+	if filter.From != nil {
+		conditions = append(conditions, "occurred_at >= "+param(filter.From.UTC()))
+	}
+	if filter.To != nil {
+		conditions = append(conditions, "occurred_at < "+param(filter.To.UTC()))
+	}
+
+	query := ""
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY occurred_at DESC, id DESC LIMIT " + param(filter.Limit) + " OFFSET " + param(filter.Offset)
+	return query, args
+}
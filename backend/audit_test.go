@@ -0,0 +1,73 @@
+package freezerinv
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseAuditTime(t *testing.T) {
+	day := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	stamp := time.Date(2026, 3, 1, 14, 30, 0, 0, time.FixedZone("", 2*60*60))
+
+	for _, c := range []struct {
+		in       string
+		endOfDay bool
+		want     time.Time
+	}{
+		{"2026-03-01", false, day},
+		// an upper bound of a plain date takes in all of that day
+		{"2026-03-01", true, day.AddDate(0, 0, 1)},
+		// a timestamp is taken as it is, bound or not
+		{"2026-03-01T14:30:00+02:00", false, stamp},
+		{"2026-03-01T14:30:00+02:00", true, stamp},
+	} {
+		got, err := parseAuditTime(c.in, c.endOfDay)
+		if err != nil || !got.Equal(c.want) {
+			t.Errorf("%s (end of day %t): got %v, %v; want %v", c.in, c.endOfDay, got, err, c.want)
+		}
+	}
+
+	for _, in := range []string{"", "yesterday", "01/03/2026", "2026-02-30", "2026-03-01 14:30"} {
+		if _, err := parseAuditTime(in, false); err == nil {
+			t.Errorf("%q accepted", in)
+		}
+	}
+}
+
+func TestAuditLocation(t *testing.T) {
+	boxFreezer := func(boxId int) (*int, error) {
+		if boxId == 7 {
+			return ptr(3), nil
+		}
+		return nil, nil
+	}
+
+	for _, c := range []struct {
+		name      string
+		table     string
+		doc       string
+		boxId     *int
+		freezerId *int
+		sample    *string
+	}{
+		{"box", boxesTable, `{"id": 7, "freezer_id": 3}`, ptr(7), ptr(3), nil},
+		{"freezer", freezerTable, `{"id": 3, "freezer_location_id": 1}`, nil, ptr(3), nil},
+		{"room", roomsTable, `{"id": 1}`, nil, nil, nil},
+		{"link", tubes.Table, `{"entered_name": "T-1", "box_id": 7}`, ptr(7), ptr(3), ptr("T-1")},
+		{"link in a removed box", tubes.Table, `{"entered_name": "T-1", "box_id": 8}`, ptr(8), nil, ptr("T-1")},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			boxId, freezerId, sample, err := auditLocation(c.table, []byte(c.doc), boxFreezer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !equalPtr(boxId, c.boxId) || !equalPtr(freezerId, c.freezerId) || !equalPtr(sample, c.sample) {
+				t.Fatalf("got box %v, freezer %v, sample %v", boxId, freezerId, sample)
+			}
+		})
+	}
+
+	if boxId, freezerId, sample, err := auditLocation(boxesTable, nil, boxFreezer); boxId != nil || freezerId != nil || sample != nil || err != nil {
+		t.Fatalf("a missing snapshot located something")
+	}
+}
@@ -0,0 +1,360 @@
+package freezerinv
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"gitlab.com/UrsusArcTech/logger"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const sessionCookieName = "freezer_session"
+
+type AuthConfig struct {
+	SessionSecret string
+	SessionTTL    time.Duration
+	SecureCookie  bool
+	// LdapURL enables LDAP login when set, e.g. ldaps://ldap.example.org
+	LdapURL string
+	// LdapBindDN is the DN template the username is substituted into,
+	// e.g. uid=%s,ou=people,dc=example,dc=org
+	LdapBindDN   string
+	LdapStartTLS bool
+}
+
+type SessionInfo struct {
+	Username string    `json:"username"`
+	Expires  time.Time `json:"expires"`
+	// Store is the Store.Name the server runs on, so the UI can hide the
+	// features only the central database has
+	Store string `json:"store,omitempty"`
+}
+
+type loginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type ctxKey int
+
+const sessionUserKey ctxKey = iota
+
+var authConfig AuthConfig
+var sessionKey []byte
+
+var errUserNotFound = errors.New("User not found")
+
+func InitAuth(cfg AuthConfig) error {
+	if cfg.SessionTTL <= 0 {
+		cfg.SessionTTL = 12 * time.Hour
+	}
+
+	if cfg.SessionSecret == "" {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+		logger.LogWarning("SESSION_SECRET not set - using a random key, sessions will not survive a restart")
+		sessionKey = key
+	} else {
+		sessionKey = []byte(cfg.SessionSecret)
+	}
+
+	if cfg.LdapURL != "" && !strings.Contains(cfg.LdapBindDN, "%s") {
+		return errors.New("LDAP bind DN must contain %s for the username")
+	}
+
+	authConfig = cfg
+	return nil
+}
+
+// CreateLocalUser adds or resets a local account with a bcrypt hashed password.
+func (h *Handlers) CreateLocalUser(username string, password string) error {
+	if username == "" || password == "" {
+		return errors.New("username and password are required")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	return h.store.SaveLocalUser(context.Background(), username, string(hash))
+}
+
+func signSession(username string, stamp string, expires time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(username + "|" + stamp + "|" + strconv.FormatInt(expires.Unix(), 10)))
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte(payload))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// parseSession checks the signature and expiry of a cookie value and returns
+// the session with the account stamp it was signed with.
+func parseSession(value string) (SessionInfo, string, bool) {
+	payload, sig, found := strings.Cut(value, ".")
+	if !found {
+		return SessionInfo{}, "", false
+	}
+
+	gotSig, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return SessionInfo{}, "", false
+	}
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte(payload))
+	if !hmac.Equal(gotSig, mac.Sum(nil)) {
+		return SessionInfo{}, "", false
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return SessionInfo{}, "", false
+	}
+	// usernames may hold |, the stamp and expiry never do
+	fields := string(raw)
+	expSep := strings.LastIndex(fields, "|")
+	if expSep <= 0 {
+		return SessionInfo{}, "", false
+	}
+	stampSep := strings.LastIndex(fields[:expSep], "|")
+	if stampSep <= 0 {
+		return SessionInfo{}, "", false
+	}
+	unix, err := strconv.ParseInt(fields[expSep+1:], 10, 64)
+	if err != nil {
+		return SessionInfo{}, "", false
+	}
+
+	info := SessionInfo{Username: fields[:stampSep], Expires: time.Unix(unix, 0)}
+	if time.Now().After(info.Expires) {
+		return SessionInfo{}, "", false
+	}
+	return info, fields[stampSep+1 : expSep], true
+}
+
+// accountStamp ties a session to the user's local password, so resetting it
+// ends every session signed before. Users without a local password get an
+// empty stamp.
+func (h *Handlers) accountStamp(ctx context.Context, username string) (stamp string, disabled bool, err error) {
+	user, err := h.store.LocalUser(ctx, username)
+	if err == errUserNotFound {
+		return "", false, nil
+	}
+	if err != nil || user.PasswordHash == nil {
+		return "", user.Disabled, err
+	}
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte(*user.PasswordHash))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:12]), user.Disabled, nil
+}
+
+// sessionFromRequest reads the session cookie. The account is looked up on
+// every request so a disabled account or a reset password logs out at once
+// rather than when the cookie expires.
+func (h *Handlers) sessionFromRequest(r *http.Request) (SessionInfo, bool) {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return SessionInfo{}, false
+	}
+	info, stamp, ok := parseSession(cookie.Value)
+	if !ok {
+		return SessionInfo{}, false
+	}
+
+	current, disabled, err := h.accountStamp(r.Context(), info.Username)
+	if err != nil {
+		logger.LogError("Session check for ", info.Username, " failed: ", err.Error())
+		return SessionInfo{}, false
+	}
+	if disabled || !hmac.Equal([]byte(stamp), []byte(current)) {
+		return SessionInfo{}, false
+	}
+	return info, true
+}
+
+// SessionUser returns the username RequireLogin let through, or "" for a
+// request that did not go through it.
+func SessionUser(r *http.Request) string {
+	user, _ := r.Context().Value(sessionUserKey).(string)
+	return user
+}
+
+// RequireLogin rejects requests without a valid session cookie and makes the
+// username available to the wrapped handler through SessionUser.
+func (h *Handlers) RequireLogin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		info, ok := h.sessionFromRequest(r)
+		if !ok {
+			writeError(w, http.StatusUnauthorized, CodeLoginRequired, "Login required")
+			return
+		}
+		ctx := context.WithValue(r.Context(), sessionUserKey, info.Username)
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// checkLocalPassword reports whether the user has a local account and whether
+// the password matched it. Disabled accounts are reported as an error.
+func (h *Handlers) checkLocalPassword(username string, password string) (found bool, ok bool, err error) {
+	user, err := h.store.LocalUser(context.Background(), username)
+	if err == errUserNotFound {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+	if user.Disabled {
+		return true, false, errors.New("account disabled")
+	}
+	if user.PasswordHash == nil {
+		return true, false, nil
+	}
+	return true, bcrypt.CompareHashAndPassword([]byte(*user.PasswordHash), []byte(password)) == nil, nil
+}
+
+func checkLdapPassword(username string, password string) error {
+	conn, err := ldap.DialURL(authConfig.LdapURL, ldap.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if authConfig.LdapStartTLS {
+		u, err := url.Parse(authConfig.LdapURL)
+		if err != nil {
+			return err
+		}
+		if err := conn.StartTLS(&tls.Config{ServerName: u.Hostname()}); err != nil {
+			return err
+		}
+	}
+
+	return conn.Bind(fmt.Sprintf(authConfig.LdapBindDN, ldap.EscapeDN(username)), password)
+}
+
+func (h *Handlers) authenticate(username string, password string) bool {
+	found, ok, err := h.checkLocalPassword(username, password)
+	if err != nil {
+		logger.LogError("Login for ", username, " refused: ", err.Error())
+		return false
+	}
+	if ok {
+		return true
+	}
+
+	if authConfig.LdapURL == "" {
+		return false
+	}
+	if err := checkLdapPassword(username, password); err != nil {
+		logger.LogError("LDAP bind for ", username, " failed: ", err.Error())
+		return false
+	}
+	if !found {
+		logger.LogMessage("LDAP user ", username, " logged in without a local account")
+	}
+	return true
+}
+
+// Login accepts a JSON or form encoded username and password and sets a
+// signed session cookie.
+func (h *Handlers) Login(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, CodeValidationFailed, "Login must be a POST")
+		return
+	}
+
+	var req loginRequest
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeValidationError(w, "", "Invalid login request")
+			return
+		}
+	} else {
+		req.Username = r.FormValue("username")
+		req.Password = r.FormValue("password")
+	}
+
+	req.Username = strings.TrimSpace(req.Username)
+	// an empty password is an anonymous bind on most directories, never accept it
+	if req.Username == "" {
+		writeValidationError(w, "username", "Missing required fields: username")
+		return
+	}
+	if req.Password == "" {
+		writeValidationError(w, "password", "Missing required fields: password")
+		return
+	}
+
+	if !h.authenticate(req.Username, req.Password) {
+		writeError(w, http.StatusUnauthorized, CodeInvalidCredentials, "Invalid username or password")
+		return
+	}
+
+	stamp, _, err := h.accountStamp(r.Context(), req.Username)
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return
+	}
+
+	info := SessionInfo{Username: req.Username, Expires: time.Now().Add(authConfig.SessionTTL), Store: h.store.Name()}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    signSession(info.Username, stamp, info.Expires),
+		Path:     "/",
+		Expires:  info.Expires,
+		HttpOnly: true,
+		Secure:   authConfig.SecureCookie || r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	logger.LogMessage("User logged in: ", info.Username)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+// Logout clears the session cookie. It is never a GET, so a link or a
+// prefetch cannot log anyone out.
+func Logout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		writeError(w, http.StatusMethodNotAllowed, CodeValidationFailed, "Logout must be a POST or DELETE")
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   authConfig.SecureCookie || r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *Handlers) WhoAmI(w http.ResponseWriter, r *http.Request) {
+	info, ok := h.sessionFromRequest(r)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, CodeLoginRequired, "Not logged in")
+		return
+	}
+	info.Store = h.store.Name()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
@@ -0,0 +1,102 @@
+package freezerinv
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSession(t *testing.T) {
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	signed := signSession("ann|lab", "stamp", expires)
+
+	info, stamp, ok := parseSession(signed)
+	if !ok || info.Username != "ann|lab" || stamp != "stamp" || !info.Expires.Equal(expires) {
+		t.Fatalf("got %+v, %q, %t", info, stamp, ok)
+	}
+
+	payload, sig, _ := strings.Cut(signed, ".")
+	other, _, _ := strings.Cut(signSession("bob", "stamp", expires), ".")
+	flipped := "A" + sig[1:]
+	if sig[0] == 'A' {
+		flipped = "B" + sig[1:]
+	}
+	for name, value := range map[string]string{
+		"expired":          signSession("ann", "stamp", time.Now().Add(-time.Minute)),
+		"no signature":     payload,
+		"bad signature":    payload + "." + flipped,
+		"swapped payload":  other + "." + sig,
+		"signature base64": payload + ".!!",
+		"empty":            "",
+	} {
+		if _, _, ok := parseSession(value); ok {
+			t.Errorf("%s session accepted", name)
+		}
+	}
+}
+
+func TestParseSessionNeedsAllFields(t *testing.T) {
+	for _, fields := range []string{"ann", "ann|123", "|stamp|123", "ann|stamp|soon"} {
+		if _, _, ok := parseSession(signedPayload(fields)); ok {
+			t.Errorf("%q accepted", fields)
+		}
+	}
+}
+
+// signedPayload signs fields as they are, to test payloads signSession never
+// writes.
+func signedPayload(fields string) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(fields))
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte(payload))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestSessionStamp(t *testing.T) {
+	h := NewHandlers(NewMemoryStore())
+	if err := h.CreateLocalUser("ann", "first"); err != nil {
+		t.Fatal(err)
+	}
+
+	signIn := func(username string) *http.Request {
+		stamp, _, err := h.accountStamp(t.Context(), username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest("GET", "/api/v1/session", nil)
+		r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: signSession(username, stamp, time.Now().Add(time.Hour))})
+		return r
+	}
+
+	r := signIn("ann")
+	if info, ok := h.sessionFromRequest(r); !ok || info.Username != "ann" {
+		t.Fatalf("a fresh session was refused")
+	}
+
+	// a reset password ends the sessions signed with the old one
+	if err := h.CreateLocalUser("ann", "second"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := h.sessionFromRequest(r); ok {
+		t.Fatalf("the session outlived a password reset")
+	}
+
+	r = signIn("ann")
+	memory := h.store.(*MemoryStore)
+	user := memory.users["ann"]
+	user.Disabled = true
+	memory.users["ann"] = user
+	if _, ok := h.sessionFromRequest(r); ok {
+		t.Fatalf("a disabled account kept its session")
+	}
+
+	// LDAP users have no local password and sign with an empty stamp
+	if _, ok := h.sessionFromRequest(signIn("lee")); !ok {
+		t.Fatalf("a session without a local account was refused")
+	}
+}
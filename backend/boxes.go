@@ -1,10 +1,9 @@
 package freezerinv
 
 import (
-	"context"
 	"encoding/json"
-	"errors"
 	"net/http"
+	"strconv"
 
 	"gitlab.com/UrsusArcTech/logger"
 )
@@ -14,6 +13,10 @@ type Box struct {
 	Name      string `json:"name"`
 	FreezerId int    `json:"freezer_id"`
 	Shelf     int    `json:"shelf"`
+	Rack      *int   `json:"rack"`
+	Drawer    *int   `json:"drawer"`
+	// Format is the key of a boxFormats entry, nil when positions are not tracked
+	Format *string `json:"format"`
 }
 
 type BoxesInFreezers struct {
@@ -25,19 +28,13 @@ type BoxesInFreezers struct {
 	Shelf       int    `json:"shelf"`
 }
 
-func MoveAllBoxesToShelf(w http.ResponseWriter, r *http.Request) {
-	oldShelf := r.URL.Query().Get("oldshelf")
-	newShelf := r.URL.Query().Get("newshelf")
-	oldFreezer := r.URL.Query().Get("oldfreezer")
-	newFreezer := r.URL.Query().Get("newfreezer")
-
-	query := "UPDATE mgl_freezer_inventory.boxes SET shelf = $1, freezer_id = $2 WHERE shelf = $3 and freezer_id = $4"
-	args := []interface{}{newShelf, newFreezer, oldShelf, oldFreezer}
+func (h *Handlers) MoveAllBoxesToShelf(w http.ResponseWriter, r *http.Request) {
+	ids, ok := queryInts(w, r, "oldfreezer", "oldshelf", "newfreezer", "newshelf")
+	if !ok {
+		return
+	}
 
-	_, err := db.Exec(context.Background(), query, args...)
-	if err != nil {
-		logger.LogError("Database error: " + err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if _, ok := h.moveShelf(w, r, ids[0], ids[1], ids[2], ids[3]); !ok {
 		return
 	}
 
@@ -45,93 +42,78 @@ func MoveAllBoxesToShelf(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("Request was successful"))
 }
 
-func GetAllBoxes(w http.ResponseWriter, r *http.Request) {
-	query := "select lab, floor, f.name as freezer_name, freezer_id, b.id as box_id, shelf from mgl_freezer_inventory.boxes b join mgl_freezer_inventory.freezer f on b.freezer_id = f.id join mgl_freezer_inventory.freezer_locations fl on fl.id = f.freezer_location_id"
+// moveShelf moves every box on one shelf to another shelf, possibly in another
+// freezer, keeping each box's rack and drawer.
+func (h *Handlers) moveShelf(w http.ResponseWriter, r *http.Request, oldFreezer int, oldShelf int, newFreezer int, newShelf int) (MoveResult, bool) {
+	result := MoveResult{BoxIds: []int{}}
+	if !h.requireRole(w, r, RoleManager, oldFreezer, newFreezer) {
+		return result, false
+	}
 
-	logger.LogMessage(query)
-	rows, err := db.Query(context.Background(), query)
+	boxes, err := h.store.ListBoxes(r.Context(), oldFreezer)
 	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return result, false
 	}
-
-	var results []BoxesInFreezers
-
-	for rows.Next() {
-		var box BoxesInFreezers
-
-		err := rows.Scan(
-			&box.Lab,
-			&box.Floor,
-			&box.FreezerName,
-			&box.FreezerId,
-			&box.BoxId,
-			&box.Shelf,
-		)
-
-		if err != nil {
-			http.Error(w, err.Error(), 500)
-			return
+	var moves []BoxMove
+	for _, box := range boxes {
+		if box.Shelf == oldShelf {
+			moves = append(moves, BoxMove{BoxId: box.Id, FreezerId: newFreezer, Shelf: newShelf, Rack: box.Rack, Drawer: box.Drawer})
 		}
+	}
 
-		results = append(results, box)
+	if len(moves) == 0 {
+		return result, true
+	}
+	return h.moveBoxes(w, r, moves, moveOptions{From: &oldFreezer})
+}
 
+func (h *Handlers) GetAllBoxes(w http.ResponseWriter, r *http.Request) {
+	if !h.requireReadScope(w, r, nil, nil, nil) {
+		return
+	}
+	results, err := h.store.ListBoxLocations(r.Context())
+	if err != nil {
+		writeDbError(w, err)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(results)
 }
 
-func GetBoxesByFreezer(w http.ResponseWriter, r *http.Request) {
-	query := "select id, name, freezer_id, shelf from mgl_freezer_inventory.boxes where freezer_id = $1"
-	args := []interface{}{}
-
-	roomId := r.URL.Query().Get("freezerid")
+func (h *Handlers) GetBoxesByFreezer(w http.ResponseWriter, r *http.Request) {
+	h.listBoxesInFreezer(w, r, r.URL.Query().Get("freezerid"))
+}
 
-	errRooms := errors.New("No freezer ID specified for box")
-	if roomId == "" {
+func (h *Handlers) listBoxesInFreezer(w http.ResponseWriter, r *http.Request, freezerId string) {
+	if freezerId == "" {
 		logger.LogError("No freezer ID specified for box")
-		http.Error(w, errRooms.Error(), 500)
+		writeValidationError(w, "freezerid", "No freezer ID specified for box")
 		return
 	}
-
-	args = append(args, roomId)
-
-	logger.LogMessage(query)
-	rows, err := db.Query(context.Background(), query, args...)
+	id, err := strconv.Atoi(freezerId)
 	if err != nil {
-		http.Error(w, err.Error(), 500)
+		writeValidationError(w, "freezerid", "Invalid freezerid: "+freezerId)
+		return
+	}
+	if !h.requireReadScope(w, r, nil, &id, nil) {
 		return
 	}
 
-	var results []Box
-
-	for rows.Next() {
-		var box Box
-
-		err := rows.Scan(
-			&box.Id,
-			&box.Name,
-			&box.FreezerId,
-			&box.Shelf,
-		)
-
-		if err != nil {
-			http.Error(w, err.Error(), 500)
-			return
-		}
-
-		results = append(results, box)
-
+	results, err := h.store.ListBoxes(r.Context(), id)
+	if err != nil {
+		writeDbError(w, err)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(results)
-
 }
 
 // InsertBox handles HTTP POST requests to create a new box
-func InsertBox(w http.ResponseWriter, r *http.Request) {
+func (h *Handlers) InsertBox(w http.ResponseWriter, r *http.Request) {
 
 	freezerId := r.URL.Query().Get("freezerid")
 	shelf := r.URL.Query().Get("shelf")
@@ -139,17 +121,25 @@ func InsertBox(w http.ResponseWriter, r *http.Request) {
 
 	if freezerId == "" || name == "" || shelf == "" {
 		logger.LogError("Missing required fields: name, shelf, and freezerid")
-		http.Error(w, "Missing required fields: name, shelf, and freezerid", http.StatusBadRequest)
+		writeValidationError(w, firstMissing(r, "name", "shelf", "freezerid"), "Missing required fields: name, shelf, and freezerid")
 		return
 	}
 
-	query := "INSERT INTO mgl_freezer_inventory.boxes (name, freezer_id, shelf) VALUES ($1, $2, $3)"
-	args := []interface{}{name, freezerId, shelf}
+	ids, ok := queryInts(w, r, "freezerid", "shelf")
+	if !ok {
+		return
+	}
 
-	_, err := db.Exec(context.Background(), query, args...)
-	if err != nil {
-		logger.LogError("Database error: " + err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	rack, ok := queryOptionalInt(w, r, "rack")
+	if !ok {
+		return
+	}
+	drawer, ok := queryOptionalInt(w, r, "drawer")
+	if !ok {
+		return
+	}
+
+	if _, ok := h.createBox(w, r, Box{Name: name, FreezerId: ids[0], Shelf: ids[1], Rack: rack, Drawer: drawer, Format: queryFormat(r)}); !ok {
 		return
 	}
 
@@ -157,24 +147,41 @@ func InsertBox(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("Request was successful"))
 }
 
+func (h *Handlers) createBox(w http.ResponseWriter, r *http.Request, box Box) (Box, bool) {
+	if apiErr := validateBoxFormat(box.Format); apiErr != nil {
+		writeApiError(w, apiErr)
+		return box, false
+	}
+	if !h.requireRole(w, r, RoleManager, box.FreezerId) {
+		return box, false
+	}
+
+	box, apiErr, err := h.store.CreateBox(r.Context(), r, box)
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return box, false
+	}
+	if apiErr != nil {
+		writeApiError(w, apiErr)
+		return box, false
+	}
+	return box, true
+}
+
 // InsertBox handles HTTP POST requests to create a new box
-func DeleteBox(w http.ResponseWriter, r *http.Request) {
+func (h *Handlers) DeleteBox(w http.ResponseWriter, r *http.Request) {
 
 	boxid := r.URL.Query().Get("boxid")
 
 	if boxid == "" {
 		logger.LogError("Missing required fields: boxid")
-		http.Error(w, "Missing required fields: boxid", http.StatusBadRequest)
+		writeValidationError(w, "boxid", "Missing required fields: boxid")
 		return
 	}
 
-	query := "DELETE FROM mgl_freezer_inventory.boxes WHERE id = $1"
-	args := []interface{}{boxid}
-
-	_, err := db.Exec(context.Background(), query, args...)
-	if err != nil {
-		logger.LogError("Database error: " + err.Error())
-		http.Error(w, "Database error", http.StatusInternalServerError)
+	ids, ok := queryInts(w, r, "boxid")
+	if !ok || !h.removeBox(w, r, ids[0]) {
 		return
 	}
 
@@ -182,8 +189,21 @@ func DeleteBox(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("Request was successful"))
 }
 
+func (h *Handlers) removeBox(w http.ResponseWriter, r *http.Request, boxId int) bool {
+	if !h.requireBoxRole(w, r, RoleManager, boxId) {
+		return false
+	}
+
+	if err := h.store.DeleteBox(r.Context(), r, boxId); err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return false
+	}
+	return true
+}
+
 // UpdateBox handles HTTP PUT requests to update a box's FreezerID
-func UpdateBox(w http.ResponseWriter, r *http.Request) {
+func (h *Handlers) UpdateBox(w http.ResponseWriter, r *http.Request) {
 	freezerId := r.URL.Query().Get("freezerid")
 	name := r.URL.Query().Get("name")
 	boxId := r.URL.Query().Get("boxid")
@@ -191,26 +211,83 @@ func UpdateBox(w http.ResponseWriter, r *http.Request) {
 
 	if freezerId == "" || name == "" || boxId == "" || shelf == "" {
 		logger.LogError("Missing required fields: name, freezerid, shelf, and boxid")
-		http.Error(w, "Missing required fields: name, freezerid, shelf, and boxid", http.StatusBadRequest)
+		writeValidationError(w, firstMissing(r, "name", "freezerid", "shelf", "boxid"), "Missing required fields: name, freezerid, shelf, and boxid")
+		return
+	}
+
+	ids, ok := queryInts(w, r, "boxid", "freezerid", "shelf")
+	if !ok {
 		return
 	}
 
-	query := "UPDATE mgl_freezer_inventory.boxes SET freezer_id = $1, name = $2, shelf = $3 WHERE id = $4"
-	args := []interface{}{freezerId, name, shelf, boxId}
+	rack, ok := queryOptionalInt(w, r, "rack")
+	if !ok {
+		return
+	}
+	drawer, ok := queryOptionalInt(w, r, "drawer")
+	if !ok {
+		return
+	}
 
-	result, err := db.Exec(context.Background(), query, args...)
+	box, err := h.store.GetBox(r.Context(), ids[0])
+	if err == errBoxNotFound {
+		writeError(w, http.StatusNotFound, CodeBoxNotFound, err.Error())
+		return
+	}
 	if err != nil {
 		logger.LogError("Database error: " + err.Error())
-		http.Error(w, "Database error", http.StatusInternalServerError)
+		writeDbError(w, err)
 		return
 	}
+	// the format is only changed when asked for
+	if r.URL.Query().Has("format") {
+		box.Format = queryFormat(r)
+	}
 
-	rowsAffected := result.RowsAffected()
-	if rowsAffected == 0 {
-		logger.LogError("No rows affected - box not found")
-		http.Error(w, "Box not found", http.StatusNotFound)
+	if _, ok := h.editBox(w, r, Box{Id: ids[0], Name: name, FreezerId: ids[1], Shelf: ids[2], Rack: rack, Drawer: drawer, Format: box.Format}); !ok {
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
 }
+
+// editBox saves the name and location of an existing box. The caller must
+// manage both the freezer the box is in and the one it is going to. A change
+// of location goes through moveBoxesTx, so it is refused into a retired or
+// full freezer.
+func (h *Handlers) editBox(w http.ResponseWriter, r *http.Request, box Box) (Box, bool) {
+	if !h.requireBoxRole(w, r, RoleManager, box.Id) || !h.requireRole(w, r, RoleManager, box.FreezerId) {
+		return box, false
+	}
+	if apiErr := validateBoxFormat(box.Format); apiErr != nil {
+		writeApiError(w, apiErr)
+		return box, false
+	}
+	if !h.checkFormatFitsSamples(w, r, box.Id, box.Format) {
+		return box, false
+	}
+
+	box, apiErr, err := h.store.UpdateBox(r.Context(), r, box)
+	if err == errBoxNotFound {
+		writeError(w, http.StatusNotFound, CodeBoxNotFound, err.Error())
+		return box, false
+	}
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return box, false
+	}
+	if apiErr != nil {
+		writeApiError(w, apiErr)
+		return box, false
+	}
+	return box, true
+}
+
+// queryFormat reads the optional format query parameter, empty means none.
+func queryFormat(r *http.Request) *string {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return &format
+	}
+	return nil
+}
@@ -0,0 +1,405 @@
+package freezerinv
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"gitlab.com/UrsusArcTech/logger"
+)
+
+const (
+	snapshotsTable = "mgl_freezer_inventory.freezer_capacity_snapshots"
+
+	defaultSnapshotInterval = 24 * time.Hour
+	defaultTrendDays        = 90
+)
+
+// Occupancy is how full a shelf, freezer or room is. Capacity only counts
+// freezers with boxes_per_slot set; UnknownCapacity says how many do not, and
+// PercentFull leaves their boxes out so it is not pushed over 100.
+type Occupancy struct {
+	Boxes           int      `json:"boxes"`
+	Capacity        *int     `json:"capacity"`
+	PercentFull     *float64 `json:"percent_full"`
+	UnknownCapacity int      `json:"unknown_capacity"`
+	// Samples counts the stored samples by sample type key
+	Samples map[string]int `json:"samples"`
+	// boxes in freezers whose capacity is known
+	countedBoxes int
+}
+
+// add counts part's boxes and samples into o.
+func (o *Occupancy) add(part Occupancy) {
+	o.Boxes += part.Boxes
+	o.addSamples(part.Samples)
+	o.UnknownCapacity += part.UnknownCapacity
+	if part.Capacity != nil {
+		total := *part.Capacity
+		if o.Capacity != nil {
+			total += *o.Capacity
+		}
+		o.Capacity = &total
+		o.countedBoxes += part.countedBoxes
+	}
+}
+
+// addSamples adds counts into o.Samples, listing every registered type even
+// when none are stored.
+func (o *Occupancy) addSamples(counts map[string]int) {
+	if o.Samples == nil {
+		o.Samples = map[string]int{}
+		for _, t := range sampleTypes {
+			o.Samples[t.Key] = 0
+		}
+	}
+	for key, n := range counts {
+		o.Samples[key] += n
+	}
+}
+
+// finish works out PercentFull once all the parts are added.
+func (o *Occupancy) finish() {
+	if o.Capacity == nil || *o.Capacity == 0 {
+		return
+	}
+	percent := math.Round(float64(o.countedBoxes)*1000/float64(*o.Capacity)) / 10
+	o.PercentFull = &percent
+}
+
+type ShelfCapacity struct {
+	Shelf int `json:"shelf"`
+	Occupancy
+}
+
+// BoxSamples is how many samples are stored in a box. Positions is nil for
+// boxes without a format.
+type BoxSamples struct {
+	Box
+	ByType    map[string]int `json:"by_type"`
+	Samples   int            `json:"samples"`
+	Positions *int           `json:"positions"`
+}
+
+type FreezerCapacity struct {
+	FreezerId    int    `json:"freezer_id"`
+	FreezerName  string `json:"freezer_name"`
+	ShelfLabel   string `json:"shelf_label"`
+	BoxesPerSlot *int   `json:"boxes_per_slot"`
+	Occupancy
+	Shelves []ShelfCapacity `json:"shelves"`
+	// BoxSamples is only filled in for a single freezer
+	BoxSamples []BoxSamples `json:"box_samples,omitempty"`
+}
+
+type RoomCapacity struct {
+	RoomId int    `json:"room_id"`
+	Lab    string `json:"lab"`
+	Floor  string `json:"floor"`
+	Occupancy
+	Freezers []FreezerCapacity `json:"freezers"`
+}
+
+// CapacityTrendPoint is the total of one day's snapshots.
+type CapacityTrendPoint struct {
+	Date string `json:"date"`
+	Occupancy
+}
+
+// freezerCapacities reports every active freezer in a room, or in every room
+// when roomId is nil, shelf by shelf. A single freezer is reported even if it
+// is retired. Consumed samples are not counted.
+func freezerCapacities(ctx context.Context, roomId *int, freezerId *int, withBoxes bool) ([]RoomCapacity, error) {
+	query := "SELECT fl.id, fl.lab, fl.floor, f.id, f.name, f.shelf_count, f.shelf_label, f.racks_per_shelf, f.drawers_per_rack, f.boxes_per_slot FROM mgl_freezer_inventory.freezer f JOIN mgl_freezer_inventory.freezer_locations fl ON fl.id = f.freezer_location_id WHERE ($2::integer IS NOT NULL OR NOT f.retired) AND ($1::integer IS NULL OR fl.id = $1) AND ($2::integer IS NULL OR f.id = $2) ORDER BY fl.lab, fl.floor, f.name"
+	rows, err := db.Query(ctx, query, roomId, freezerId)
+	if err != nil {
+		return nil, err
+	}
+
+	var rooms []RoomCapacity
+	var freezerIds []int
+	layouts := map[int]FreezerLayout{}
+	for rows.Next() {
+		var room RoomCapacity
+		var freezer FreezerCapacity
+		var l FreezerLayout
+		if err := rows.Scan(&room.RoomId, &room.Lab, &room.Floor, &freezer.FreezerId, &freezer.FreezerName, &l.ShelfCount, &l.ShelfLabel, &l.RacksPerShelf, &l.DrawersPerRack, &l.BoxesPerSlot); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		freezer.ShelfLabel = l.ShelfLabel
+		freezer.BoxesPerSlot = l.BoxesPerSlot
+		layouts[freezer.FreezerId] = l
+		freezerIds = append(freezerIds, freezer.FreezerId)
+
+		if n := len(rooms); n == 0 || rooms[n-1].RoomId != room.RoomId {
+			room.Freezers = []FreezerCapacity{}
+			rooms = append(rooms, room)
+		}
+		last := &rooms[len(rooms)-1]
+		last.Freezers = append(last.Freezers, freezer)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	boxes, err := boxSampleCounts(ctx, freezerIds)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range rooms {
+		room := &rooms[i]
+		for j := range room.Freezers {
+			freezer := &room.Freezers[j]
+			l := layouts[freezer.FreezerId]
+
+			// a box on a shelf counts against that shelf whether or not it
+			// sits in a rack
+			shelves := make([]ShelfCapacity, l.ShelfCount)
+			for s := range shelves {
+				shelves[s].Shelf = s + 1
+				shelves[s].addSamples(nil)
+				if l.BoxesPerSlot != nil {
+					capacity := l.shelfCapacity()
+					shelves[s].Capacity = &capacity
+				}
+			}
+			if withBoxes {
+				freezer.BoxSamples = []BoxSamples{}
+			}
+			freezer.addSamples(nil)
+			for _, box := range boxes[freezer.FreezerId] {
+				if box.Shelf >= 1 && box.Shelf <= l.ShelfCount {
+					shelf := &shelves[box.Shelf-1]
+					shelf.Boxes++
+					shelf.addSamples(box.ByType)
+					if shelf.Capacity != nil {
+						shelf.countedBoxes++
+					}
+				}
+				if withBoxes {
+					freezer.BoxSamples = append(freezer.BoxSamples, box)
+				}
+			}
+
+			for s := range shelves {
+				freezer.add(shelves[s].Occupancy)
+				shelves[s].finish()
+			}
+			if l.BoxesPerSlot == nil {
+				freezer.UnknownCapacity = 1
+			}
+			freezer.finish()
+			freezer.Shelves = shelves
+			room.add(freezer.Occupancy)
+		}
+		room.addSamples(nil)
+		room.finish()
+	}
+	return rooms, nil
+}
+
+// sampleCounts builds a jsonb object of unconsumed sample counts per type key,
+// for the boxes matching boxFilter. The boxes table is aliased b.
+func sampleCounts(boxFilter string) string {
+	var pairs []string
+	for _, t := range sampleTypes {
+		pairs = append(pairs, "'"+t.Key+"', (SELECT count(*) FROM "+t.Table+" l JOIN mgl_freezer_inventory.boxes b ON b.id = l.box_id WHERE "+boxFilter+" AND l.consumed_at IS NULL)")
+	}
+	return "jsonb_build_object(" + strings.Join(pairs, ", ") + ")"
+}
+
+// boxSampleCounts counts the unconsumed samples in every box of the given
+// freezers, keyed by freezer.
+func boxSampleCounts(ctx context.Context, freezerIds []int) (map[int][]BoxSamples, error) {
+	query := "SELECT bx.id, bx.name, bx.freezer_id, bx.shelf, bx.rack, bx.drawer, bx.format, " + sampleCounts("b.id = bx.id") + " " +
+		"FROM mgl_freezer_inventory.boxes bx WHERE bx.freezer_id = ANY($1) ORDER BY bx.shelf, bx.rack NULLS FIRST, bx.drawer NULLS FIRST, bx.name"
+	rows, err := db.Query(ctx, query, append([]int{}, freezerIds...))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := map[int][]BoxSamples{}
+	for rows.Next() {
+		var box BoxSamples
+		if err := rows.Scan(&box.Id, &box.Name, &box.FreezerId, &box.Shelf, &box.Rack, &box.Drawer, &box.Format, &box.ByType); err != nil {
+			return nil, err
+		}
+		for _, n := range box.ByType {
+			box.Samples += n
+		}
+		if box.Format != nil {
+			if format, ok := boxFormats[*box.Format]; ok {
+				size := format.size()
+				box.Positions = &size
+			}
+		}
+		counts[box.FreezerId] = append(counts[box.FreezerId], box)
+	}
+	return counts, rows.Err()
+}
+
+// takeCapacitySnapshot records today's occupancy of every active freezer.
+// Capacity is worked out the same way as FreezerLayout.slots counts slots.
+func takeCapacitySnapshot(ctx context.Context) (int64, error) {
+	query := "INSERT INTO " + snapshotsTable + " (taken_on, freezer_id, boxes, capacity, samples) " +
+		"SELECT current_date, f.id, " +
+		"(SELECT count(*) FROM mgl_freezer_inventory.boxes b WHERE b.freezer_id = f.id), " +
+		"f.boxes_per_slot * f.shelf_count * coalesce(f.racks_per_shelf, 1) * coalesce(f.drawers_per_rack, 1), " +
+		sampleCounts("b.freezer_id = f.id") + " " +
+		"FROM mgl_freezer_inventory.freezer f WHERE NOT f.retired " +
+		"ON CONFLICT (taken_on, freezer_id) DO UPDATE SET boxes = excluded.boxes, capacity = excluded.capacity, samples = excluded.samples, taken_at = now()"
+	tag, err := db.Exec(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// StartCapacitySnapshots takes a snapshot now and then every interval, in the
+// background, for the utilisation trend.
+func StartCapacitySnapshots(interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultSnapshotInterval
+	}
+	go func() {
+		for {
+			if _, err := takeCapacitySnapshot(context.Background()); err != nil {
+				logger.LogError("Capacity snapshot failed: " + err.Error())
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// capacityTrend adds up the snapshots per day between from and to.
+func capacityTrend(ctx context.Context, roomId *int, freezerId *int, from time.Time, to time.Time) ([]CapacityTrendPoint, error) {
+	query := "SELECT s.taken_on, sum(s.boxes), sum(s.capacity), coalesce(sum(s.boxes) FILTER (WHERE s.capacity IS NOT NULL), 0), count(*) FILTER (WHERE s.capacity IS NULL), jsonb_agg(s.samples) " +
+		"FROM " + snapshotsTable + " s JOIN mgl_freezer_inventory.freezer f ON f.id = s.freezer_id " +
+		"WHERE s.taken_on BETWEEN $1::date AND $2::date AND ($3::integer IS NULL OR f.freezer_location_id = $3) AND ($4::integer IS NULL OR f.id = $4) " +
+		"GROUP BY s.taken_on ORDER BY s.taken_on"
+	rows, err := db.Query(ctx, query, from, to, roomId, freezerId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	points := []CapacityTrendPoint{}
+	for rows.Next() {
+		var point CapacityTrendPoint
+		var day time.Time
+		var samples []map[string]int
+		if err := rows.Scan(&day, &point.Boxes, &point.Capacity, &point.countedBoxes, &point.UnknownCapacity, &samples); err != nil {
+			return nil, err
+		}
+		point.addSamples(nil)
+		for _, counts := range samples {
+			point.addSamples(counts)
+		}
+		point.Date = day.Format("2006-01-02")
+		point.finish()
+		points = append(points, point)
+	}
+	return points, rows.Err()
+}
+
+// ApiCapacity reports occupancy per room, freezer and shelf, optionally for
+// one room.
+func (h *Handlers) ApiCapacity(w http.ResponseWriter, r *http.Request) {
+	roomId, ok := queryOptionalInt(w, r, "room")
+	if !ok {
+		return
+	}
+	if !h.requireReadScope(w, r, roomId, nil, nil) {
+		return
+	}
+	rooms, err := freezerCapacities(r.Context(), roomId, nil, false)
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return
+	}
+	if rooms == nil {
+		rooms = []RoomCapacity{}
+	}
+	writeJSON(w, http.StatusOK, rooms)
+}
+
+// ApiFreezerCapacity is one freezer's occupancy with the sample counts of
+// each of its boxes.
+func (h *Handlers) ApiFreezerCapacity(w http.ResponseWriter, r *http.Request) {
+	freezerId, ok := pathInt(w, r, "id")
+	if !ok {
+		return
+	}
+	if _, err := h.store.GetFreezer(r.Context(), freezerId); err == errFreezerNotFound {
+		writeError(w, http.StatusNotFound, CodeFreezerNotFound, err.Error())
+		return
+	} else if err != nil {
+		writeDbError(w, err)
+		return
+	}
+	if !h.requireReadScope(w, r, nil, &freezerId, nil) {
+		return
+	}
+
+	rooms, err := freezerCapacities(r.Context(), nil, &freezerId, true)
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, rooms[0].Freezers[0])
+}
+
+func (h *Handlers) ApiCapacityTrend(w http.ResponseWriter, r *http.Request) {
+	roomId, ok := queryOptionalInt(w, r, "room")
+	if !ok {
+		return
+	}
+	freezerId, ok := queryOptionalInt(w, r, "freezer")
+	if !ok {
+		return
+	}
+	if !h.requireReadScope(w, r, roomId, freezerId, nil) {
+		return
+	}
+	now := time.Now()
+	defaultFrom := now.AddDate(0, 0, -defaultTrendDays)
+	from, ok := queryTime(w, r, "from", &defaultFrom)
+	if !ok {
+		return
+	}
+	to, ok := queryTime(w, r, "to", &now)
+	if !ok {
+		return
+	}
+
+	points, err := capacityTrend(r.Context(), roomId, freezerId, *from, *to)
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, points)
+}
+
+// ApiTakeCapacitySnapshot takes today's snapshot now rather than waiting for
+// the background one.
+func (h *Handlers) ApiTakeCapacitySnapshot(w http.ResponseWriter, r *http.Request) {
+	if !h.requireRoomRole(w, r, RoleManager, nil) {
+		return
+	}
+	taken, err := takeCapacitySnapshot(context.Background())
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]int64{"freezers": taken})
+}
@@ -0,0 +1,280 @@
+package freezerinv
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.com/UrsusArcTech/logger"
+)
+
+// Checkout is set on a sample link while the sample is out of its box. The
+// link keeps its box and position so the sample has somewhere to go back to.
+type Checkout struct {
+	CheckedOutBy *string    `json:"checked_out_by"`
+	CheckedOutAt *time.Time `json:"checked_out_at"`
+	Purpose      *string    `json:"checkout_purpose"`
+	// ExpectedReturn is a YYYY-MM-DD date
+	ExpectedReturn *string `json:"expected_return"`
+}
+
+type checkoutRequest struct {
+	// CheckedOutBy defaults to the session user
+	CheckedOutBy   *string `json:"checked_out_by"`
+	Purpose        *string `json:"purpose"`
+	ExpectedReturn *string `json:"expected_return"`
+}
+
+// checkoutState is a link row as the checkout endpoints return it.
+type checkoutState struct {
+	EnteredName string `json:"entered_name"`
+	BoxId       int    `json:"box_id"`
+	Position    *int   `json:"position"`
+	Checkout
+}
+
+// CheckedOutSample is one line of the currently out report.
+type CheckedOutSample struct {
+	SampleType  string `json:"sample_type"`
+	EnteredName string `json:"entered_name"`
+	BoxId       int    `json:"box_id"`
+	BoxName     string `json:"box_name"`
+	FreezerId   int    `json:"freezer_id"`
+	FreezerName string `json:"freezer_name"`
+	Lab         string `json:"lab"`
+	Floor       string `json:"floor"`
+	Overdue     bool   `json:"overdue"`
+	Checkout
+}
+
+// checkoutStateOf is the part of a link the checkout endpoints return.
+func checkoutStateOf(link SampleLink) checkoutState {
+	return checkoutState{EnteredName: link.EnteredName, BoxId: link.BoxId, Position: link.Position, Checkout: link.Checkout}
+}
+
+// checkedOutError reports a sample that is stored but currently out of its box.
+func checkedOutError(kind string, c Checkout, boxName string, locations interface{}) *ApiError {
+	message := fmt.Sprintf("%s is checked out of box %s by %s", kind, boxName, *c.CheckedOutBy)
+	if c.CheckedOutAt != nil {
+		message += " since " + c.CheckedOutAt.Format("2006-01-02")
+	}
+	if c.ExpectedReturn != nil {
+		message += ", due back " + *c.ExpectedReturn
+	}
+	return &ApiError{Status: http.StatusConflict, Code: CodeSampleCheckedOut, Message: message, Details: locations}
+}
+
+// loadCheckout reads the checkout state of a link, or writes a 404.
+func (h *Handlers) loadCheckout(w http.ResponseWriter, r *http.Request, t *SampleType, enteredName string) (Checkout, bool) {
+	link, err := h.store.GetSampleLink(r.Context(), t, enteredName)
+	if err == errSampleLinkNotFound {
+		writeError(w, http.StatusNotFound, CodeSampleNotFound, enteredName+" is not in any box")
+		return link.Checkout, false
+	}
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return link.Checkout, false
+	}
+	return link.Checkout, true
+}
+
+// checkoutSample marks a stored sample as out of its box.
+func (h *Handlers) checkoutSample(w http.ResponseWriter, r *http.Request, t *SampleType, enteredName string, req checkoutRequest) (checkoutState, bool) {
+	var state checkoutState
+
+	if !h.requireLinkRole(w, r, RoleTechnician, t, enteredName) {
+		return state, false
+	}
+
+	by := SessionUser(r)
+	if req.CheckedOutBy != nil && strings.TrimSpace(*req.CheckedOutBy) != "" {
+		by = strings.TrimSpace(*req.CheckedOutBy)
+	}
+	if by == "" {
+		writeValidationError(w, "checked_out_by", "Missing required fields: checked_out_by")
+		return state, false
+	}
+
+	expected := emptyAsNil(req.ExpectedReturn)
+	if expected != nil {
+		if _, err := time.Parse("2006-01-02", *expected); err != nil {
+			writeValidationError(w, "expected_return", "Invalid expected_return, use YYYY-MM-DD")
+			return state, false
+		}
+		// dates in this layout compare as strings
+		if *expected < time.Now().Format("2006-01-02") {
+			writeValidationError(w, "expected_return", "expected_return is in the past")
+			return state, false
+		}
+	}
+
+	current, ok := h.loadCheckout(w, r, t, enteredName)
+	if !ok {
+		return state, false
+	}
+	if current.CheckedOutBy != nil {
+		writeError(w, http.StatusConflict, CodeSampleCheckedOut, enteredName+" is already checked out by "+*current.CheckedOutBy)
+		return state, false
+	}
+
+	n, err := h.store.CheckoutSample(r.Context(), r, t, enteredName, Checkout{CheckedOutBy: &by, Purpose: emptyAsNil(req.Purpose), ExpectedReturn: expected})
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return state, false
+	}
+	if n == 0 {
+		// checked out by someone else between the check and the update
+		writeError(w, http.StatusConflict, CodeSampleCheckedOut, enteredName+" is already checked out")
+		return state, false
+	}
+	return h.checkoutResult(w, r, t, enteredName)
+}
+
+// checkoutResult reads a link back after a checkout or return.
+func (h *Handlers) checkoutResult(w http.ResponseWriter, r *http.Request, t *SampleType, enteredName string) (checkoutState, bool) {
+	link, err := h.store.GetSampleLink(r.Context(), t, enteredName)
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return checkoutState{}, false
+	}
+	return checkoutStateOf(link), true
+}
+
+// returnSample puts a checked out sample back in its box.
+func (h *Handlers) returnSample(w http.ResponseWriter, r *http.Request, t *SampleType, enteredName string) (checkoutState, bool) {
+	var state checkoutState
+
+	if !h.requireLinkRole(w, r, RoleTechnician, t, enteredName) {
+		return state, false
+	}
+
+	current, ok := h.loadCheckout(w, r, t, enteredName)
+	if !ok {
+		return state, false
+	}
+	if current.CheckedOutBy == nil {
+		writeError(w, http.StatusConflict, CodeSampleNotCheckedOut, enteredName+" is not checked out")
+		return state, false
+	}
+
+	n, err := h.store.ReturnSample(r.Context(), r, t, enteredName)
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return state, false
+	}
+	if n == 0 {
+		writeError(w, http.StatusConflict, CodeSampleNotCheckedOut, enteredName+" is not checked out")
+		return state, false
+	}
+	return h.checkoutResult(w, r, t, enteredName)
+}
+
+func (h *Handlers) ApiCheckoutSample(w http.ResponseWriter, r *http.Request) {
+	t, ok := pathSampleType(w, r)
+	if !ok {
+		return
+	}
+	var req checkoutRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if state, ok := h.checkoutSample(w, r, t, r.PathValue("name"), req); ok {
+		writeJSON(w, http.StatusOK, state)
+	}
+}
+
+func (h *Handlers) ApiReturnSample(w http.ResponseWriter, r *http.Request) {
+	t, ok := pathSampleType(w, r)
+	if !ok {
+		return
+	}
+	if state, ok := h.returnSample(w, r, t, r.PathValue("name")); ok {
+		writeJSON(w, http.StatusOK, state)
+	}
+}
+
+// ApiCheckedOutSamples lists every sample currently out of its box, overdue
+// and longest out first. Filters: overdue=true, by (who has it), type.
+func (h *Handlers) ApiCheckedOutSamples(w http.ResponseWriter, r *http.Request) {
+	if !h.requireReadScope(w, r, nil, nil, nil) {
+		return
+	}
+	query := "SELECT s.sample_type, s.entered_name, b.id, b.name, f.id, f.name, fl.lab, fl.floor, s.checked_out_by, s.checked_out_at, s.checkout_purpose, s.expected_return::text, coalesce(s.expected_return < current_date, false) AS overdue FROM (" +
+		unionLinks("entered_name, box_id, checked_out_by, checked_out_at, checkout_purpose, expected_return", "checked_out_at IS NOT NULL") +
+		") s join mgl_freezer_inventory.boxes b on s.box_id = b.id join mgl_freezer_inventory.freezer f on b.freezer_id = f.id join mgl_freezer_inventory.freezer_locations fl on fl.id = f.freezer_location_id"
+	args := []interface{}{}
+	conditions := []string{}
+
+	q := r.URL.Query()
+	if q.Get("overdue") == "true" {
+		conditions = append(conditions, "s.expected_return < current_date")
+	}
+	if by := q.Get("by"); by != "" {
+		args = append(args, by)
+		conditions = append(conditions, "s.checked_out_by = $"+strconv.Itoa(len(args)))
+	}
+	if sampleType := q.Get("type"); sampleType != "" {
+		t, ok := sampleTypesByKey[sampleType]
+		if !ok {
+			writeValidationError(w, "type", "Unknown type "+sampleType+", use "+sampleTypeChoices())
+			return
+		}
+		args = append(args, t.Key)
+		conditions = append(conditions, "s.sample_type = $"+strconv.Itoa(len(args)))
+	}
+
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY overdue DESC, s.checked_out_at"
+
+	logger.LogMessage(query)
+	rows, err := db.Query(r.Context(), query, args...)
+	if err != nil {
+		writeDbError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	results := []CheckedOutSample{}
+
+	for rows.Next() {
+		var sample CheckedOutSample
+
+		err := rows.Scan(
+			&sample.SampleType,
+			&sample.EnteredName,
+			&sample.BoxId,
+			&sample.BoxName,
+			&sample.FreezerId,
+			&sample.FreezerName,
+			&sample.Lab,
+			&sample.Floor,
+			&sample.CheckedOutBy,
+			&sample.CheckedOutAt,
+			&sample.Purpose,
+			&sample.ExpectedReturn,
+			&sample.Overdue,
+		)
+
+		if err != nil {
+			writeDbError(w, err)
+			return
+		}
+
+		results = append(results, sample)
+	}
+
+	if err := rows.Err(); err != nil {
+		writeDbError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, results)
+}
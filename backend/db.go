@@ -7,11 +7,11 @@ import (
 
 var db *pgxpool.Pool
 
-func Init(dsn string) error {
+func Init(dsn string) (*PostgresStore, error) {
     p, err := pgxpool.New(context.Background(), dsn)
     if err != nil {
-        return err
+        return nil, err
     }
     db = p
-    return nil
+    return NewPostgresStore(p), nil
 }
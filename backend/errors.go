@@ -0,0 +1,183 @@
+package freezerinv
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"gitlab.com/UrsusArcTech/logger"
+)
+
+// Stable error codes. Scripts branch on these, so never rename one.
+const (
+	CodeValidationFailed     = "VALIDATION_FAILED"
+	CodeUnsupportedMediaType = "UNSUPPORTED_MEDIA_TYPE"
+	CodeLoginRequired        = "LOGIN_REQUIRED"
+	CodeInvalidCredentials   = "INVALID_CREDENTIALS"
+	CodePermissionDenied     = "PERMISSION_DENIED"
+	CodeNotFound             = "NOT_FOUND"
+	CodeRoomNotFound         = "ROOM_NOT_FOUND"
+	CodeFreezerNotFound      = "FREEZER_NOT_FOUND"
+	CodeBoxNotFound          = "BOX_NOT_FOUND"
+	CodeSampleNotFound       = "SAMPLE_NOT_FOUND"
+	CodeRoleNotFound         = "ROLE_NOT_FOUND"
+	CodeSampleAlreadyStored  = "SAMPLE_ALREADY_STORED"
+	CodeFreezerNotEmpty      = "FREEZER_NOT_EMPTY"
+	CodeRoomNotEmpty         = "ROOM_NOT_EMPTY"
+	CodeRetired              = "RETIRED"
+	CodePositionOccupied     = "POSITION_OCCUPIED"
+	CodeImportInvalid        = "IMPORT_INVALID"
+	CodeLabelFailed          = "LABEL_FAILED"
+	CodeWrongBox             = "WRONG_BOX"
+	CodeSampleCheckedOut     = "SAMPLE_CHECKED_OUT"
+	CodeSampleNotCheckedOut  = "SAMPLE_NOT_CHECKED_OUT"
+	CodeSampleConsumed       = "SAMPLE_CONSUMED"
+	CodeHasAliquots          = "HAS_ALIQUOTS"
+	CodeInsufficientQuantity = "INSUFFICIENT_QUANTITY"
+	CodeOverCapacity         = "OVER_CAPACITY"
+	CodePlanStale            = "PLAN_STALE"
+	CodeAlreadyExists        = "ALREADY_EXISTS"
+	CodeReferenceNotFound    = "REFERENCE_NOT_FOUND"
+	CodeStillReferenced      = "STILL_REFERENCED"
+	CodeLookupUnavailable    = "LOOKUP_UNAVAILABLE"
+	CodeDatabaseError        = "DATABASE_ERROR"
+)
+
+// ApiError is the body of every error response.
+type ApiError struct {
+	Status  int         `json:"-"`
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Field   string      `json:"field,omitempty"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+func (e *ApiError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// pg error codes, see https://www.postgresql.org/docs/current/errcodes-appendix.html
+const (
+	pgUniqueViolation        = "23505"
+	pgForeignKeyViolation    = "23503"
+	pgNotNullViolation       = "23502"
+	pgCheckViolation         = "23514"
+	pgInvalidTextRepr        = "22P02"
+	pgNumericValueOutOfRange = "22003"
+)
+
+// matches the column in a constraint detail like Key (freezer_id)=(12) is not present in table "freezer".
+var pgDetailKey = regexp.MustCompile(`^Key \(([^)]+)\)=`)
+
+// referenceCodes gives a missing foreign key a more useful code than REFERENCE_NOT_FOUND.
+var referenceCodes = map[string]string{
+	"freezer_location_id": CodeRoomNotFound,
+	"freezer_id":          CodeFreezerNotFound,
+	"box_id":              CodeBoxNotFound,
+}
+
+// constraintCodes gives a unique violation on these indexes its own code.
+// Each registered sample type adds its position index and the unique
+// constraint on its entered names.
+var constraintCodes = map[string]string{}
+
+func writeApiError(w http.ResponseWriter, e *ApiError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.Status)
+	json.NewEncoder(w).Encode(e)
+}
+
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	writeApiError(w, &ApiError{Status: status, Code: code, Message: message})
+}
+
+func writeValidationError(w http.ResponseWriter, field string, message string) {
+	writeApiError(w, &ApiError{Status: http.StatusBadRequest, Code: CodeValidationFailed, Message: message, Field: field})
+}
+
+// writeDbError maps a pgx error onto the envelope. Anything unrecognised is
+// logged and reported without the driver's text.
+func writeDbError(w http.ResponseWriter, err error) {
+	writeApiError(w, dbApiError(err))
+}
+
+func dbApiError(err error) *ApiError {
+	var apiErr *ApiError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return &ApiError{Status: http.StatusNotFound, Code: CodeNotFound, Message: "Record not found"}
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		field := pgErr.ColumnName
+		if m := pgDetailKey.FindStringSubmatch(pgErr.Detail); m != nil {
+			field = m[1]
+		}
+		details := map[string]string{"constraint": pgErr.ConstraintName}
+
+		switch pgErr.Code {
+		case pgUniqueViolation:
+			switch constraintCodes[pgErr.ConstraintName] {
+			case CodePositionOccupied:
+				return &ApiError{Status: http.StatusConflict, Code: CodePositionOccupied, Message: "That position is already taken", Field: "position", Details: details}
+			case CodeSampleAlreadyStored:
+				return &ApiError{Status: http.StatusConflict, Code: CodeSampleAlreadyStored, Message: "A sample with this name is already stored", Field: "entered_name", Details: details}
+			}
+			return &ApiError{Status: http.StatusConflict, Code: CodeAlreadyExists, Message: "A record with this " + orValue(field, "key") + " already exists", Field: field, Details: details}
+		case pgForeignKeyViolation:
+			// the same code covers inserting a dangling reference and deleting a referenced row
+			if strings.Contains(pgErr.Detail, "still referenced") {
+				return &ApiError{Status: http.StatusConflict, Code: CodeStillReferenced, Message: "This record is still in use and cannot be removed", Field: field, Details: details}
+			}
+			code, ok := referenceCodes[field]
+			if !ok {
+				code = CodeReferenceNotFound
+			}
+			return &ApiError{Status: http.StatusBadRequest, Code: code, Message: "The referenced " + orValue(field, "record") + " does not exist", Field: field, Details: details}
+		case pgNotNullViolation:
+			return &ApiError{Status: http.StatusBadRequest, Code: CodeValidationFailed, Message: orValue(field, "A field") + " is required", Field: field}
+		case pgCheckViolation:
+			return &ApiError{Status: http.StatusBadRequest, Code: CodeValidationFailed, Message: "A value is out of the allowed range", Field: field, Details: details}
+		case pgInvalidTextRepr, pgNumericValueOutOfRange:
+			return &ApiError{Status: http.StatusBadRequest, Code: CodeValidationFailed, Message: "A value has the wrong format", Field: field}
+		}
+	}
+
+	logger.LogError("Database error: " + err.Error())
+	return &ApiError{Status: http.StatusInternalServerError, Code: CodeDatabaseError, Message: "Database error"}
+}
+
+func orValue(s string, fallback string) string {
+	if s == "" {
+		return fallback
+	}
+	return s
+}
+
+// alreadyStoredError reports a sample that is already linked to a box, naming
+// the first location in the message and listing all of them in details.
+func alreadyStoredError(kind string, boxName string, freezerName string, freezerModel string, shelf int, floor string, lab string, locations interface{}) *ApiError {
+	locStr := fmt.Sprintf("Box: %s, Freezer: %s (%s), Shelf: %d, Floor: %s, Lab: %s", boxName, freezerName, freezerModel, shelf, floor, lab)
+	return &ApiError{Status: http.StatusConflict, Code: CodeSampleAlreadyStored, Message: kind + " already exists in: " + locStr, Details: locations}
+}
+
+// firstMissing names the first empty query parameter, for the field of a
+// missing fields error.
+func firstMissing(r *http.Request, names ...string) string {
+	for _, name := range names {
+		if r.URL.Query().Get(name) == "" {
+			return name
+		}
+	}
+	return ""
+}
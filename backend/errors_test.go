@@ -0,0 +1,24 @@
+package freezerinv
+
+import (
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func TestDbApiErrorLinkConstraints(t *testing.T) {
+	for _, c := range []struct {
+		constraint string
+		want       string
+		field      string
+	}{
+		{"tube_link_entered_name_key", CodeSampleAlreadyStored, "entered_name"},
+		{"tube_link_position_idx", CodePositionOccupied, "position"},
+		{"boxes_pkey", CodeAlreadyExists, "id"},
+	} {
+		apiErr := dbApiError(&pgconn.PgError{Code: pgUniqueViolation, ConstraintName: c.constraint, ColumnName: "id"})
+		if apiErr.Code != c.want || apiErr.Field != c.field {
+			t.Errorf("%s maps to %s on %s, want %s on %s", c.constraint, apiErr.Code, apiErr.Field, c.want, c.field)
+		}
+	}
+}
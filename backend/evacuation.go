@@ -0,0 +1,346 @@
+package freezerinv
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"gitlab.com/UrsusArcTech/logger"
+)
+
+const (
+	evacuateAnywhere  = ""
+	evacuateSameRoom  = "room"
+	evacuateSameFloor = "floor"
+)
+
+type evacuationOptions struct {
+	// Scope keeps the boxes in the failing freezer's room or on its floor,
+	// empty allows any room
+	Scope string `json:"scope"`
+	// SameTempClass only uses freezers holding the same kind of temperature
+	SameTempClass bool `json:"same_temp_class"`
+	// Exclude lists freezers that must not receive boxes
+	Exclude []int `json:"exclude"`
+}
+
+// EvacuationMove is one box going from the failing freezer to a new slot.
+type EvacuationMove struct {
+	BoxId       int    `json:"box_id"`
+	BoxName     string `json:"box_name"`
+	FromShelf   int    `json:"from_shelf"`
+	FromRack    *int   `json:"from_rack"`
+	FromDrawer  *int   `json:"from_drawer"`
+	FreezerId   int    `json:"freezer_id"`
+	FreezerName string `json:"freezer_name"`
+	Shelf       int    `json:"shelf"`
+	Rack        *int   `json:"rack"`
+	Drawer      *int   `json:"drawer"`
+}
+
+// EvacuationTarget is a freezer the plan uses and what is left in it after.
+type EvacuationTarget struct {
+	FreezerId   int    `json:"freezer_id"`
+	FreezerName string `json:"freezer_name"`
+	Lab         string `json:"lab"`
+	Floor       string `json:"floor"`
+	TempClass   string `json:"temp_class"`
+	Receiving   int    `json:"receiving"`
+	FreeAfter   int    `json:"free_after"`
+}
+
+// EvacuationPlan is a preview; nothing moves until it is executed.
+type EvacuationPlan struct {
+	FreezerId   int                `json:"freezer_id"`
+	FreezerName string             `json:"freezer_name"`
+	TempClass   string             `json:"temp_class"`
+	Boxes       int                `json:"boxes"`
+	Moves       []EvacuationMove   `json:"moves"`
+	Unplaced    []Box              `json:"unplaced"`
+	Targets     []EvacuationTarget `json:"targets"`
+	Complete    bool               `json:"complete"`
+}
+
+// evacuationCandidate is a freezer that could take boxes, with the free space
+// left in each of its slots as the plan fills them.
+type evacuationCandidate struct {
+	target EvacuationTarget
+	roomId int
+	layout FreezerLayout
+	free   map[slotKey]int
+}
+
+// evacuationCandidates lists the active freezers the user manages that have
+// a known capacity and fit the options, closest to the failing freezer first.
+func (h *Handlers) evacuationCandidates(ctx context.Context, user string, source FreezerDB, room FreezerRoom, opts evacuationOptions) ([]*evacuationCandidate, error) {
+	query := "SELECT f.id, f.name, f.freezer_location_id, fl.lab, fl.floor, f.current_holding_temp_c, f.shelf_count, f.shelf_label, f.racks_per_shelf, f.drawers_per_rack, f.boxes_per_slot FROM mgl_freezer_inventory.freezer f JOIN mgl_freezer_inventory.freezer_locations fl ON fl.id = f.freezer_location_id WHERE NOT f.retired AND NOT fl.retired AND f.boxes_per_slot IS NOT NULL AND f.id <> $1 AND NOT f.id = ANY($2)"
+	args := []interface{}{source.Id, append([]int{}, opts.Exclude...)}
+	switch opts.Scope {
+	case evacuateSameRoom:
+		query += " AND f.freezer_location_id = $3"
+		args = append(args, source.FreezerLocationId)
+	case evacuateSameFloor:
+		query += " AND fl.lab = $3 AND fl.floor = $4"
+		args = append(args, room.Lab, room.Floor)
+	}
+	query += " ORDER BY f.name"
+
+	rows, err := db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sourceClass := temperatureClass(source.CurrentHoldingTempC)
+	var candidates []*evacuationCandidate
+	for rows.Next() {
+		var c evacuationCandidate
+		var holdingTempC *int
+		err := rows.Scan(
+			&c.target.FreezerId,
+			&c.target.FreezerName,
+			&c.roomId,
+			&c.target.Lab,
+			&c.target.Floor,
+			&holdingTempC,
+			&c.layout.ShelfCount,
+			&c.layout.ShelfLabel,
+			&c.layout.RacksPerShelf,
+			&c.layout.DrawersPerRack,
+			&c.layout.BoxesPerSlot,
+		)
+		if err != nil {
+			return nil, err
+		}
+		c.target.TempClass = temperatureClass(holdingTempC)
+		if opts.SameTempClass && c.target.TempClass != sourceClass {
+			continue
+		}
+		candidates = append(candidates, &c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var usable []*evacuationCandidate
+	for _, c := range candidates {
+		role, err := h.store.RoleRank(ctx, user, nil, &c.target.FreezerId)
+		if err != nil {
+			return nil, err
+		}
+		if role < roleRank[RoleManager] {
+			continue
+		}
+
+		occupied, err := slotOccupancy(ctx, db, c.target.FreezerId)
+		if err != nil {
+			return nil, err
+		}
+		c.free = map[slotKey]int{}
+		for _, key := range c.layout.slots() {
+			if n := *c.layout.BoxesPerSlot - occupied[key]; n > 0 {
+				c.free[key] = n
+				c.target.FreeAfter += n
+			}
+		}
+		usable = append(usable, c)
+	}
+
+	// same room first, then same floor, keeping name order within each
+	nearness := func(c *evacuationCandidate) int {
+		switch {
+		case c.roomId == source.FreezerLocationId:
+			return 0
+		case c.target.Lab == room.Lab && c.target.Floor == room.Floor:
+			return 1
+		}
+		return 2
+	}
+	sort.SliceStable(usable, func(i, j int) bool {
+		return nearness(usable[i]) < nearness(usable[j])
+	})
+	return usable, nil
+}
+
+// planEvacuation works out where every box in a failing freezer can go.
+// Boxes sharing a drawer, rack or shelf are kept together when one slot can
+// take them all, otherwise each goes to the first slot with room. Boxes that
+// fit nowhere are listed as unplaced.
+func (h *Handlers) planEvacuation(w http.ResponseWriter, r *http.Request, freezerId int, opts evacuationOptions) (EvacuationPlan, bool) {
+	var plan EvacuationPlan
+
+	switch opts.Scope {
+	case evacuateAnywhere, evacuateSameRoom, evacuateSameFloor:
+	default:
+		writeValidationError(w, "scope", "Unknown scope "+opts.Scope+", use room, floor or leave it empty")
+		return plan, false
+	}
+
+	source, err := h.store.GetFreezer(context.Background(), freezerId)
+	if err == errFreezerNotFound {
+		writeError(w, http.StatusNotFound, CodeFreezerNotFound, err.Error())
+		return plan, false
+	}
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return plan, false
+	}
+	if !h.requireRole(w, r, RoleManager, freezerId) {
+		return plan, false
+	}
+	room, err := h.store.GetRoom(context.Background(), source.FreezerLocationId)
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return plan, false
+	}
+
+	ctx := context.Background()
+	candidates, err := h.evacuationCandidates(ctx, SessionUser(r), source, room, opts)
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return plan, false
+	}
+
+	rows, err := db.Query(ctx, "SELECT id, name, freezer_id, shelf, rack, drawer, format FROM mgl_freezer_inventory.boxes WHERE freezer_id = $1 ORDER BY shelf, rack NULLS FIRST, drawer NULLS FIRST, name", freezerId)
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return plan, false
+	}
+	var groups [][]Box
+	for rows.Next() {
+		var box Box
+		if err := rows.Scan(&box.Id, &box.Name, &box.FreezerId, &box.Shelf, &box.Rack, &box.Drawer, &box.Format); err != nil {
+			rows.Close()
+			writeDbError(w, err)
+			return plan, false
+		}
+		n := len(groups)
+		if n > 0 && slotOf(groups[n-1][0].Shelf, groups[n-1][0].Rack, groups[n-1][0].Drawer) == slotOf(box.Shelf, box.Rack, box.Drawer) {
+			groups[n-1] = append(groups[n-1], box)
+		} else {
+			groups = append(groups, []Box{box})
+		}
+		plan.Boxes++
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		writeDbError(w, err)
+		return plan, false
+	}
+
+	// findSlot returns the first slot with room for n boxes
+	findSlot := func(n int) (*evacuationCandidate, slotKey, bool) {
+		for _, c := range candidates {
+			for _, key := range c.layout.slots() {
+				if c.free[key] >= n {
+					return c, key, true
+				}
+			}
+		}
+		return nil, slotKey{}, false
+	}
+	place := func(box Box, c *evacuationCandidate, key slotKey) {
+		shelf, rack, drawer := key.placement()
+		plan.Moves = append(plan.Moves, EvacuationMove{
+			BoxId:       box.Id,
+			BoxName:     box.Name,
+			FromShelf:   box.Shelf,
+			FromRack:    box.Rack,
+			FromDrawer:  box.Drawer,
+			FreezerId:   c.target.FreezerId,
+			FreezerName: c.target.FreezerName,
+			Shelf:       shelf,
+			Rack:        rack,
+			Drawer:      drawer,
+		})
+		c.free[key]--
+		c.target.Receiving++
+		c.target.FreeAfter--
+	}
+
+	plan.Moves = []EvacuationMove{}
+	plan.Unplaced = []Box{}
+	for _, group := range groups {
+		if c, key, ok := findSlot(len(group)); ok {
+			for _, box := range group {
+				place(box, c, key)
+			}
+			continue
+		}
+		for _, box := range group {
+			if c, key, ok := findSlot(1); ok {
+				place(box, c, key)
+			} else {
+				plan.Unplaced = append(plan.Unplaced, box)
+			}
+		}
+	}
+
+	plan.Targets = []EvacuationTarget{}
+	for _, c := range candidates {
+		if c.target.Receiving > 0 {
+			plan.Targets = append(plan.Targets, c.target)
+		}
+	}
+	plan.FreezerId = source.Id
+	plan.FreezerName = source.Name
+	plan.TempClass = temperatureClass(source.CurrentHoldingTempC)
+	plan.Complete = len(plan.Unplaced) == 0
+	return plan, true
+}
+
+// executeEvacuation moves a batch of boxes out of a freezer in one
+// transaction. The batch is normally a plan from planEvacuation, possibly
+// edited; it is checked again against the freezers as they are now, and if
+// any box cannot go where asked nothing moves.
+func (h *Handlers) executeEvacuation(w http.ResponseWriter, r *http.Request, freezerId int, req moveRequest) (MoveResult, bool) {
+	for i, move := range req.Moves {
+		if move.FreezerId == freezerId {
+			writeValidationError(w, fmt.Sprintf("moves[%d].freezer_id", i), "Boxes must move to a different freezer")
+			return MoveResult{}, false
+		}
+	}
+	if _, err := h.store.GetFreezer(context.Background(), freezerId); err == errFreezerNotFound {
+		writeError(w, http.StatusNotFound, CodeFreezerNotFound, err.Error())
+		return MoveResult{}, false
+	} else if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return MoveResult{}, false
+	}
+
+	return h.moveBoxes(w, r, req.Moves, moveOptions{From: &freezerId, RequireCapacity: true, Field: "moves"})
+}
+
+func (h *Handlers) ApiPlanEvacuation(w http.ResponseWriter, r *http.Request) {
+	freezerId, ok := pathInt(w, r, "id")
+	if !ok {
+		return
+	}
+	var opts evacuationOptions
+	if !decodeJSON(w, r, &opts) {
+		return
+	}
+	if plan, ok := h.planEvacuation(w, r, freezerId, opts); ok {
+		writeJSON(w, http.StatusOK, plan)
+	}
+}
+
+func (h *Handlers) ApiExecuteEvacuation(w http.ResponseWriter, r *http.Request) {
+	freezerId, ok := pathInt(w, r, "id")
+	if !ok {
+		return
+	}
+	var req moveRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if result, ok := h.executeEvacuation(w, r, freezerId, req); ok {
+		writeJSON(w, http.StatusOK, result)
+	}
+}
@@ -0,0 +1,267 @@
+package freezerinv
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/360EntSecGroup-Skylar/excelize"
+	"gitlab.com/UrsusArcTech/logger"
+)
+
+// InventoryRow is one stored sample with the full path to where it is.
+type InventoryRow struct {
+	RoomId        int     `json:"room_id"`
+	Lab           string  `json:"lab"`
+	Floor         string  `json:"floor"`
+	FreezerId     int     `json:"freezer_id"`
+	FreezerName   string  `json:"freezer_name"`
+	FreezerModel  string  `json:"freezer_model"`
+	Shelf         int     `json:"shelf"`
+	Rack          *int    `json:"rack"`
+	Drawer        *int    `json:"drawer"`
+	BoxId         int     `json:"box_id"`
+	BoxName       string  `json:"box_name"`
+	SampleType    string  `json:"sample_type"`
+	EnteredName   string  `json:"entered_name"`
+	SampleId      *int    `json:"sample_id"`
+	Position      *int    `json:"position"`
+	PositionLabel *string `json:"position_label"`
+}
+
+// inventoryColumns are the CSV and XLSX headings, in InventoryRow order.
+var inventoryColumns = []string{"room_id", "lab", "floor", "freezer_id", "freezer_name", "freezer_model", "shelf", "rack", "drawer", "box_id", "box_name", "sample_type", "entered_name", "sample_id", "position", "position_label"}
+
+// inventoryQuery joins every link table up to its room, the same way the
+// already-in-a-box checks do. Filters are added by the caller.
+func inventoryQuery() string {
+	return "SELECT fl.id, fl.lab, fl.floor, f.id, f.name, f.model, b.shelf, b.rack, b.drawer, b.id, b.name, b.format, s.sample_type, s.entered_name, s.sample_id, s.position FROM (" +
+		unionLinks("entered_name, {id} AS sample_id, position, box_id", "") +
+		") s join mgl_freezer_inventory.boxes b on s.box_id = b.id join mgl_freezer_inventory.freezer f on b.freezer_id = f.id join mgl_freezer_inventory.freezer_locations fl on fl.id = f.freezer_location_id"
+}
+
+// exportIncomplete is the first cell of the trailer row a CSV export ends
+// with when it stopped part way, so a truncated file cannot pass for a
+// complete one.
+const exportIncomplete = "# EXPORT INCOMPLETE"
+
+// spreadsheetText keeps a spreadsheet from reading a cell as a formula, the
+// same way typing a leading ' does.
+func spreadsheetText(cell string) string {
+	if cell != "" && strings.ContainsRune("=+-@", rune(cell[0])) {
+		return "'" + cell
+	}
+	return cell
+}
+
+// cells shows the row as the CSV and XLSX cells. Names typed in by users are
+// escaped with spreadsheetText.
+func (row InventoryRow) cells() []string {
+	optional := func(v *int) string {
+		if v == nil {
+			return ""
+		}
+		return strconv.Itoa(*v)
+	}
+	label := ""
+	if row.PositionLabel != nil {
+		label = *row.PositionLabel
+	}
+	return []string{
+		strconv.Itoa(row.RoomId), spreadsheetText(row.Lab), spreadsheetText(row.Floor),
+		strconv.Itoa(row.FreezerId), spreadsheetText(row.FreezerName), spreadsheetText(row.FreezerModel),
+		strconv.Itoa(row.Shelf), optional(row.Rack), optional(row.Drawer),
+		strconv.Itoa(row.BoxId), spreadsheetText(row.BoxName),
+		row.SampleType, spreadsheetText(row.EnteredName), optional(row.SampleId),
+		optional(row.Position), spreadsheetText(label),
+	}
+}
+
+// ApiExportInventory streams every stored sample as csv (the default), xlsx
+// or json. Filters: room, freezer, shelf, box and type (a sample type key).
+// The user needs the viewer role on the narrowest of room, freezer and box
+// given, lab-wide without any. A csv export that fails part way ends with an
+// exportIncomplete row and a json one is left without its closing bracket;
+// xlsx is only sent once complete, so it fails with an error instead.
+func (h *Handlers) ApiExportInventory(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "xlsx" && format != "json" {
+		writeValidationError(w, "format", "Unknown format "+format+", use csv, xlsx or json")
+		return
+	}
+
+	query := inventoryQuery()
+	args := []interface{}{}
+	conditions := []string{}
+
+	filters := map[string]*int{}
+	for _, filter := range []struct{ param, column string }{
+		{"room", "fl.id"},
+		{"freezer", "f.id"},
+		{"shelf", "b.shelf"},
+		{"box", "b.id"},
+	} {
+		value, ok := queryOptionalInt(w, r, filter.param)
+		if !ok {
+			return
+		}
+		if value != nil {
+			filters[filter.param] = value
+			args = append(args, *value)
+			conditions = append(conditions, filter.column+" = $"+strconv.Itoa(len(args)))
+		}
+	}
+	if !h.requireReadScope(w, r, filters["room"], filters["freezer"], filters["box"]) {
+		return
+	}
+
+	if sampleType := r.URL.Query().Get("type"); sampleType != "" {
+		t, ok := sampleTypesByKey[sampleType]
+		if !ok {
+			writeValidationError(w, "type", "Unknown type "+sampleType+", use "+sampleTypeChoices())
+			return
+		}
+		args = append(args, t.Key)
+		conditions = append(conditions, "s.sample_type = $"+strconv.Itoa(len(args)))
+	}
+
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY fl.lab, fl.floor, f.name, b.shelf, b.rack, b.drawer, b.name, s.sample_type, s.position, s.entered_name"
+
+	logger.LogMessage(query)
+	rows, err := db.Query(context.Background(), query, args...)
+	if err != nil {
+		writeDbError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	filename := "inventory-" + time.Now().Format("2006-01-02") + "." + format
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+
+	var write func(InventoryRow) error
+	var finish func() error
+	// fail marks an export cut short by err; csv and json have already sent
+	// their status by then
+	var fail func(error)
+
+	switch format {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		out := csv.NewWriter(w)
+		out.Write(inventoryColumns)
+		write = func(row InventoryRow) error { return out.Write(row.cells()) }
+		finish = func() error {
+			out.Flush()
+			return out.Error()
+		}
+		fail = func(error) {
+			out.Write([]string{exportIncomplete, "the export stopped early, try again"})
+			out.Flush()
+		}
+
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		first := true
+		w.Write([]byte("["))
+		write = func(row InventoryRow) error {
+			if !first {
+				w.Write([]byte(","))
+			}
+			first = false
+			return enc.Encode(row)
+		}
+		finish = func() error {
+			_, err := w.Write([]byte("]\n"))
+			return err
+		}
+		// an unclosed array will not parse, which is the signal
+		fail = func(error) {}
+
+	case "xlsx":
+		// excelize builds the workbook in memory, it is written out at the end
+		w.Header().Set("Content-Type", xlsxContentType)
+		book := excelize.NewFile()
+		book.SetSheetName("Sheet1", "Inventory")
+		line := 1
+		setRow := func(cells []string) {
+			for i, cell := range cells {
+				book.SetCellValue("Inventory", excelize.ToAlphaString(i)+strconv.Itoa(line), cell)
+			}
+			line++
+		}
+		setRow(inventoryColumns)
+		write = func(row InventoryRow) error {
+			setRow(row.cells())
+			return nil
+		}
+		finish = func() error { return book.Write(w) }
+		// nothing has been written yet, so a proper error can still be sent
+		fail = func(err error) {
+			w.Header().Del("Content-Disposition")
+			writeDbError(w, err)
+		}
+	}
+
+	for rows.Next() {
+		var row InventoryRow
+		var boxFormat *string
+
+		err := rows.Scan(
+			&row.RoomId,
+			&row.Lab,
+			&row.Floor,
+			&row.FreezerId,
+			&row.FreezerName,
+			&row.FreezerModel,
+			&row.Shelf,
+			&row.Rack,
+			&row.Drawer,
+			&row.BoxId,
+			&row.BoxName,
+			&boxFormat,
+			&row.SampleType,
+			&row.EnteredName,
+			&row.SampleId,
+			&row.Position,
+		)
+
+		if err != nil {
+			logger.LogError("Export failed: " + err.Error())
+			fail(err)
+			return
+		}
+
+		if row.Position != nil && boxFormat != nil {
+			if f, ok := boxFormats[*boxFormat]; ok {
+				label := f.positionLabel(*row.Position)
+				row.PositionLabel = &label
+			}
+		}
+
+		if err := write(row); err != nil {
+			logger.LogError("Export failed: " + err.Error())
+			fail(err)
+			return
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		logger.LogError("Export failed: " + err.Error())
+		fail(err)
+		return
+	}
+	if err := finish(); err != nil {
+		logger.LogError("Export failed: " + err.Error())
+	}
+}
@@ -0,0 +1,40 @@
+package freezerinv
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSpreadsheetText(t *testing.T) {
+	for in, want := range map[string]string{
+		"=HYPERLINK(\"x\")": "'=HYPERLINK(\"x\")",
+		"+1+1":              "'+1+1",
+		"-2+3":              "'-2+3",
+		"@SUM(A1)":          "'@SUM(A1)",
+		"E-100":             "E-100",
+		"1=1":               "1=1",
+		"'quoted":           "'quoted",
+		"":                  "",
+	} {
+		if got := spreadsheetText(in); got != want {
+			t.Errorf("%q became %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestInventoryRowCellsEscapeTypedNames(t *testing.T) {
+	label := "A1"
+	row := InventoryRow{
+		RoomId: 1, Lab: "=lab", Floor: "2",
+		FreezerId: 3, FreezerName: "+F1", FreezerModel: "@model",
+		Shelf: 1, Rack: ptr(2),
+		BoxId: 4, BoxName: "-B1",
+		SampleType: "edna", EnteredName: "=cmd|' /C calc'!A0", SampleId: ptr(5),
+		Position: ptr(1), PositionLabel: &label,
+	}
+
+	want := []string{"1", "'=lab", "2", "3", "'+F1", "'@model", "1", "2", "", "4", "'-B1", "edna", "'=cmd|' /C calc'!A0", "5", "1", "A1"}
+	if got := row.cells(); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("cells are %q, want %q", got, want)
+	}
+}
@@ -1,10 +1,12 @@
 package freezerinv
 
 import (
-	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"gitlab.com/UrsusArcTech/logger"
@@ -19,98 +21,186 @@ type FreezerDB struct {
 	Comments                *string    `json:"comments"`
 	CurrentHoldingTempC     *int       `json:"current_holding_temp_c"`
 	ManualProjectsContained string     `json:"manual_projects_contained"`
+	Retired                 bool       `json:"retired"`
+	FreezerLayout
+	TemperatureAlarm
 }
 
+var errFreezerNotFound = errors.New("Freezer not found")
+
 type FreezerExtr struct {
 	Id   int    `json:"id"`
 	Name string `json:"name"`
 }
 
-func GetAllFreezers(w http.ResponseWriter, r *http.Request) {
-
-	query := "select id, name from mgl_freezer_inventory.freezer"
-
-	logger.LogMessage(query)
-	rows, err := db.Query(context.Background(), query)
+func (h *Handlers) GetAllFreezers(w http.ResponseWriter, r *http.Request) {
+	freezers, err := h.store.ListFreezers(r.Context(), nil, r.URL.Query().Get("include_retired") == "true")
 	if err != nil {
-		http.Error(w, err.Error(), 500)
+		writeDbError(w, err)
 		return
 	}
 
 	var results []FreezerExtr
+	for _, freezer := range freezers {
+		results = append(results, FreezerExtr{Id: freezer.Id, Name: freezer.Name})
+	}
 
-	for rows.Next() {
-		var freezer FreezerExtr
-
-		err := rows.Scan(
-			&freezer.Id,
-			&freezer.Name,
-		)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
 
-		if err != nil {
-			http.Error(w, err.Error(), 500)
-			return
-		}
+func (h *Handlers) GetFreezersInRoom(w http.ResponseWriter, r *http.Request) {
+	h.listFreezersInRoom(w, r, r.URL.Query().Get("roomid"), r.URL.Query().Get("include_retired") == "true")
+}
 
-		results = append(results, freezer)
+func (h *Handlers) listFreezersInRoom(w http.ResponseWriter, r *http.Request, roomId string, includeRetired bool) {
+	if roomId == "" {
+		logger.LogError("No room ID specified for freezer")
+		writeValidationError(w, "roomid", "No room ID specified for freezer")
+		return
+	}
+	id, err := strconv.Atoi(roomId)
+	if err != nil {
+		writeValidationError(w, "roomid", "Invalid roomid: "+roomId)
+		return
+	}
 
+	results, err := h.store.ListFreezers(r.Context(), &id, includeRetired)
+	if err != nil {
+		writeDbError(w, err)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(results)
-
 }
 
-func GetFreezersInRoom(w http.ResponseWriter, r *http.Request) {
-	//there shouldn't be a join here but being lazy
-	query := "SELECT f.id, freezer_location_id, last_calibrated, name, model, comments, current_holding_temp_c, manual_projects_contained from mgl_freezer_inventory.freezer f join mgl_freezer_inventory.freezer_locations fl on fl.id = f.freezer_location_id WHERE fl.id = $1"
+// holding temperatures outside this range are typos, liquid nitrogen sits at -196
+const (
+	minHoldingTempC = -200
+	maxHoldingTempC = 25
+)
 
-	args := []interface{}{}
+// temperatureClass groups holding temperatures into the kinds of storage
+// samples can be swapped between.
+func temperatureClass(holdingTempC *int) string {
+	switch {
+	case holdingTempC == nil:
+		return "unknown"
+	case *holdingTempC <= -130:
+		return "cryogenic"
+	case *holdingTempC <= -50:
+		return "ultra_low"
+	case *holdingTempC <= -5:
+		return "freezer"
+	case *holdingTempC <= 10:
+		return "fridge"
+	}
+	return "ambient"
+}
 
-	roomId := r.URL.Query().Get("roomid")
+// validateFreezer checks the fields a user can set on a freezer.
+func validateFreezer(freezer FreezerDB) *ApiError {
+	invalid := func(field string, message string) *ApiError {
+		return &ApiError{Status: http.StatusBadRequest, Code: CodeValidationFailed, Message: message, Field: field}
+	}
 
-	errRooms := errors.New("No room ID specified for freezer")
-	if roomId == "" {
-		logger.LogError("No room ID specified for freezer")
-		http.Error(w, errRooms.Error(), 500)
-		return
+	switch {
+	case strings.TrimSpace(freezer.Name) == "":
+		return invalid("name", "Freezer name cannot be empty")
+	case strings.TrimSpace(freezer.Model) == "":
+		return invalid("model", "Freezer model cannot be empty")
+	case freezer.FreezerLocationId <= 0:
+		return invalid("freezer_location_id", "Missing required fields: freezer_location_id")
+	case freezer.CurrentHoldingTempC != nil && (*freezer.CurrentHoldingTempC < minHoldingTempC || *freezer.CurrentHoldingTempC > maxHoldingTempC):
+		return invalid("current_holding_temp_c", fmt.Sprintf("Holding temperature must be between %d and %d °C", minHoldingTempC, maxHoldingTempC))
 	}
+	return freezer.FreezerLayout.validate()
+}
 
-	args = append(args, roomId)
+// createFreezer adds a freezer to a room. The caller must manage the room.
+func (h *Handlers) createFreezer(w http.ResponseWriter, r *http.Request, freezer FreezerDB) (FreezerDB, bool) {
+	if apiErr := validateFreezer(freezer); apiErr != nil {
+		writeApiError(w, apiErr)
+		return freezer, false
+	}
+	if !h.requireRoomRole(w, r, RoleManager, &freezer.FreezerLocationId) {
+		return freezer, false
+	}
+	if !h.roomIsActive(w, r, freezer.FreezerLocationId) {
+		return freezer, false
+	}
 
-	logger.LogMessage(query)
-	rows, err := db.Query(context.Background(), query, args...)
+	freezer, err := h.store.CreateFreezer(r.Context(), r, freezer)
 	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return freezer, false
 	}
+	return freezer, true
+}
 
-	var results []FreezerDB
-
-	for rows.Next() {
-		var freezer FreezerDB
-
-		err := rows.Scan(
-			&freezer.Id,
-			&freezer.FreezerLocationId,
-			&freezer.LastCalibrated,
-			&freezer.Name,
-			&freezer.Model,
-			&freezer.Comments,
-			&freezer.CurrentHoldingTempC,
-			&freezer.ManualProjectsContained,
-		)
+// editFreezer saves the details of an existing freezer. Moving it to another
+// room needs a manager of that room as well.
+func (h *Handlers) editFreezer(w http.ResponseWriter, r *http.Request, freezer FreezerDB) (FreezerDB, bool) {
+	if apiErr := validateFreezer(freezer); apiErr != nil {
+		writeApiError(w, apiErr)
+		return freezer, false
+	}
+	if !h.requireRole(w, r, RoleManager, freezer.Id) || !h.requireRoomRole(w, r, RoleManager, &freezer.FreezerLocationId) {
+		return freezer, false
+	}
+	if !h.roomIsActive(w, r, freezer.FreezerLocationId) || !h.checkLayoutFitsBoxes(w, r, freezer.Id, freezer.FreezerLayout) {
+		return freezer, false
+	}
 
-		if err != nil {
-			http.Error(w, err.Error(), 500)
-			return
-		}
+	freezer, err := h.store.UpdateFreezer(r.Context(), r, freezer)
+	if err == errFreezerNotFound {
+		writeError(w, http.StatusNotFound, CodeFreezerNotFound, err.Error())
+		return freezer, false
+	}
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return freezer, false
+	}
+	return freezer, true
+}
 
-		results = append(results, freezer)
+// retireFreezer takes a freezer out of service. It has to be emptied first so
+// no box is left in a freezer nobody looks at.
+func (h *Handlers) retireFreezer(w http.ResponseWriter, r *http.Request, freezerId int) (FreezerDB, bool) {
+	freezer, err := h.store.GetFreezer(r.Context(), freezerId)
+	if err == errFreezerNotFound {
+		writeError(w, http.StatusNotFound, CodeFreezerNotFound, err.Error())
+		return freezer, false
+	}
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return freezer, false
+	}
 
+	if !h.requireRole(w, r, RoleManager, freezerId) {
+		return freezer, false
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(results)
+	stored, err := h.store.ListBoxes(r.Context(), freezerId)
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return freezer, false
+	}
+	if boxes := len(stored); boxes > 0 {
+		writeApiError(w, &ApiError{Status: http.StatusConflict, Code: CodeFreezerNotEmpty, Message: fmt.Sprintf("Freezer %s still holds %d boxes, move them before retiring it", freezer.Name, boxes), Details: map[string]int{"boxes": boxes}})
+		return freezer, false
+	}
 
+	freezer, err = h.store.RetireFreezer(r.Context(), r, freezerId)
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return freezer, false
+	}
+	return freezer, true
 }
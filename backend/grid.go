@@ -0,0 +1,233 @@
+package freezerinv
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gitlab.com/UrsusArcTech/logger"
+)
+
+// BoxFormat is the well layout of a cryobox or plate.
+type BoxFormat struct {
+	Rows int `json:"rows"`
+	Cols int `json:"cols"`
+}
+
+// boxFormats are keyed by well count, which is what the lab calls them.
+var boxFormats = map[string]BoxFormat{
+	"81":  {Rows: 9, Cols: 9},
+	"100": {Rows: 10, Cols: 10},
+	"96":  {Rows: 8, Cols: 12},
+}
+
+func (f BoxFormat) size() int {
+	return f.Rows * f.Cols
+}
+
+// positionLabel turns a 1 based well number into A1 style, row by row.
+func (f BoxFormat) positionLabel(position int) string {
+	row := (position - 1) / f.Cols
+	col := (position-1)%f.Cols + 1
+	return string(rune('A'+row)) + strconv.Itoa(col)
+}
+
+type GridCell struct {
+	Position   int    `json:"position"`
+	Label      string `json:"label"`
+	SampleType string `json:"sample_type,omitempty"`
+	Name       string `json:"name,omitempty"`
+}
+
+type BoxGrid struct {
+	BoxId  int        `json:"box_id"`
+	Format *string    `json:"format"`
+	Rows   int        `json:"rows"`
+	Cols   int        `json:"cols"`
+	Cells  []GridCell `json:"cells"`
+	// Unplaced lists samples in the box without a position
+	Unplaced []GridCell `json:"unplaced"`
+}
+
+// positionOccupants lists every sample in a box with its position, across
+// all the link tables.
+func positionOccupants() string {
+	return unionLinks("entered_name, position", "box_id = $1")
+}
+
+func validateBoxFormat(format *string) *ApiError {
+	if format == nil {
+		return nil
+	}
+	if _, ok := boxFormats[*format]; !ok {
+		return &ApiError{Status: http.StatusBadRequest, Code: CodeValidationFailed, Message: "Unknown box format: " + *format + ", use 81, 100 or 96", Field: "format"}
+	}
+	return nil
+}
+
+// boxOccupants lists the samples of every type in a box, placed ones in
+// well order first.
+func (h *Handlers) boxOccupants(ctx context.Context, boxId int) ([]SampleLink, error) {
+	var occupants []SampleLink
+	for _, t := range sampleTypes {
+		links, err := h.store.ListSampleLinks(ctx, t, boxId)
+		if err != nil {
+			return nil, err
+		}
+		occupants = append(occupants, links...)
+	}
+	sort.SliceStable(occupants, func(i, j int) bool {
+		a, b := occupants[i], occupants[j]
+		switch {
+		case (a.Position == nil) != (b.Position == nil):
+			return b.Position == nil
+		case a.Position != nil && *a.Position != *b.Position:
+			return *a.Position < *b.Position
+		}
+		return a.EnteredName < b.EnteredName
+	})
+	return occupants, nil
+}
+
+// checkFormatFitsSamples refuses a format change that would leave a sample in
+// a well the box no longer has.
+func (h *Handlers) checkFormatFitsSamples(w http.ResponseWriter, r *http.Request, boxId int, format *string) bool {
+	occupants, err := h.boxOccupants(r.Context(), boxId)
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return false
+	}
+	maxPosition := 0
+	for _, o := range occupants {
+		if o.Position != nil {
+			maxPosition = max(maxPosition, *o.Position)
+		}
+	}
+	if maxPosition == 0 {
+		return true
+	}
+	if format == nil || maxPosition > boxFormats[*format].size() {
+		writeApiError(w, &ApiError{Status: http.StatusConflict, Code: CodeValidationFailed, Message: fmt.Sprintf("A sample is stored in well %d, move it before changing the box format", maxPosition), Field: "format"})
+		return false
+	}
+	return true
+}
+
+// checkPositionFree writes the error response and returns false when the
+// position is not a well of the box, or another sample already sits in it.
+// The sample being placed is named by sampleType and enteredName so moving it
+// within its own well is not a collision.
+func (h *Handlers) checkPositionFree(w http.ResponseWriter, r *http.Request, boxId int, position int, sampleType string, enteredName string) bool {
+	box, err := h.store.GetBox(r.Context(), boxId)
+	if err == errBoxNotFound {
+		writeApiError(w, &ApiError{Status: http.StatusBadRequest, Code: CodeBoxNotFound, Message: err.Error(), Field: "box_id"})
+		return false
+	}
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return false
+	}
+
+	if box.Format == nil {
+		writeValidationError(w, "position", "Box "+box.Name+" has no grid format, set one before placing samples by position")
+		return false
+	}
+	format := boxFormats[*box.Format]
+	if position < 1 || position > format.size() {
+		writeValidationError(w, "position", fmt.Sprintf("Position must be between 1 and %d in a %s well box", format.size(), *box.Format))
+		return false
+	}
+
+	occupants, err := h.boxOccupants(r.Context(), boxId)
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return false
+	}
+	for _, o := range occupants {
+		if o.Position == nil || *o.Position != position || (o.SampleType == sampleType && o.EnteredName == enteredName) {
+			continue
+		}
+		writeApiError(w, &ApiError{
+			Status:  http.StatusConflict,
+			Code:    CodePositionOccupied,
+			Message: fmt.Sprintf("%s in box %s is already taken by %s %s", format.positionLabel(position), box.Name, o.SampleType, o.EnteredName),
+			Field:   "position",
+			Details: GridCell{Position: position, Label: format.positionLabel(position), SampleType: o.SampleType, Name: o.EnteredName},
+		})
+		return false
+	}
+	return true
+}
+
+// ApiBoxGrid returns every well of a box with the sample in it, if any.
+func (h *Handlers) ApiBoxGrid(w http.ResponseWriter, r *http.Request) {
+	boxId, ok := pathInt(w, r, "id")
+	if !ok {
+		return
+	}
+	if !h.requireReadScope(w, r, nil, nil, &boxId) {
+		return
+	}
+
+	box, err := h.store.GetBox(r.Context(), boxId)
+	if err == errBoxNotFound {
+		writeError(w, http.StatusNotFound, CodeBoxNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return
+	}
+
+	grid := BoxGrid{BoxId: box.Id, Format: box.Format, Cells: []GridCell{}, Unplaced: []GridCell{}}
+	var format BoxFormat
+	if box.Format != nil {
+		format = boxFormats[*box.Format]
+		grid.Rows, grid.Cols = format.Rows, format.Cols
+		for p := 1; p <= format.size(); p++ {
+			grid.Cells = append(grid.Cells, GridCell{Position: p, Label: format.positionLabel(p)})
+		}
+	}
+
+	occupants, err := h.boxOccupants(r.Context(), boxId)
+	if err != nil {
+		writeDbError(w, err)
+		return
+	}
+	for _, o := range occupants {
+		cell := GridCell{SampleType: o.SampleType, Name: o.EnteredName}
+		if o.Position == nil || *o.Position > len(grid.Cells) {
+			grid.Unplaced = append(grid.Unplaced, cell)
+			continue
+		}
+		cell.Position = *o.Position
+		cell.Label = format.positionLabel(*o.Position)
+		grid.Cells[*o.Position-1] = cell
+	}
+
+	writeJSON(w, http.StatusOK, grid)
+}
+
+// parsePosition reads a well as a number (1 is A1) or an A1 style label.
+func (f BoxFormat) parsePosition(s string) (int, bool) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if n, err := strconv.Atoi(s); err == nil {
+		return n, n >= 1 && n <= f.size()
+	}
+	if len(s) < 2 || s[0] < 'A' || s[0] > 'Z' {
+		return 0, false
+	}
+	row := int(s[0] - 'A')
+	col, err := strconv.Atoi(s[1:])
+	if err != nil || row >= f.Rows || col < 1 || col > f.Cols {
+		return 0, false
+	}
+	return row*f.Cols + col, true
+}
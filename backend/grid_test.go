@@ -0,0 +1,50 @@
+package freezerinv
+
+import "testing"
+
+func TestParsePosition(t *testing.T) {
+	plate := boxFormats["96"]
+	cryobox := boxFormats["81"]
+
+	for _, c := range []struct {
+		format   BoxFormat
+		in       string
+		want     int
+		accepted bool
+	}{
+		{plate, "A1", 1, true},
+		{plate, "a12", 12, true},
+		{plate, "B1", 13, true},
+		{plate, " H12 ", 96, true},
+		{plate, "1", 1, true},
+		{plate, "96", 96, true},
+		{plate, "0", 0, false},
+		{plate, "97", 0, false},
+		{plate, "-3", 0, false},
+		{plate, "I1", 0, false},  // a plate has eight rows
+		{plate, "A13", 0, false}, // and twelve columns
+		{plate, "A0", 0, false},
+		{plate, "A", 0, false},
+		{plate, "1A", 0, false},
+		{plate, "AA1", 0, false},
+		{plate, "", 0, false},
+		{cryobox, "I9", 81, true},
+		{cryobox, "A10", 0, false},
+	} {
+		got, ok := c.format.parsePosition(c.in)
+		if ok != c.accepted || (ok && got != c.want) {
+			t.Errorf("%q in a %dx%d box: got %d, %t; want %d, %t", c.in, c.format.Rows, c.format.Cols, got, ok, c.want, c.accepted)
+		}
+	}
+}
+
+func TestPositionLabelRoundTrips(t *testing.T) {
+	for name, format := range boxFormats {
+		for p := 1; p <= format.size(); p++ {
+			label := format.positionLabel(p)
+			if got, ok := format.parsePosition(label); !ok || got != p {
+				t.Fatalf("%s well box: %d labelled %s reads back as %d, %t", name, p, label, got, ok)
+			}
+		}
+	}
+}
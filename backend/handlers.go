@@ -0,0 +1,11 @@
+package freezerinv
+
+// Handlers serves the room, freezer, box and sample link routes from a Store,
+// so they can run against something other than the Postgres pool.
+type Handlers struct {
+	store Store
+}
+
+func NewHandlers(store Store) *Handlers {
+	return &Handlers{store: store}
+}
@@ -0,0 +1,550 @@
+package freezerinv
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tubes are a sample type without a resolver, so linking never reaches the
+// mgl database. Vials are a second one for names stored as two types.
+var tubes *SampleType
+
+func TestMain(m *testing.M) {
+	if err := registerSampleType(SampleType{Key: "tube", Label: "Tube", Table: "test.tube_link", IdColumn: "tube_id", Resolver: noResolver}); err != nil {
+		panic(err)
+	}
+	if err := registerSampleType(SampleType{Key: "vial", Label: "Vial", Table: "test.vial_link", IdColumn: "vial_id", Resolver: noResolver}); err != nil {
+		panic(err)
+	}
+	tubes = sampleTypesByKey["tube"]
+	if err := InitAuth(AuthConfig{SessionSecret: "handler tests"}); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+type testServer struct {
+	*httptest.Server
+	store Store
+	h     *Handlers
+}
+
+// newTestServer serves the /api/v1 routes the handlers here cover on a fresh
+// MemoryStore.
+func newTestServer(t *testing.T) *testServer {
+	return newTestServerOn(t, NewMemoryStore())
+}
+
+// newSQLiteTestServer is newTestServer on a SQLite store in a temporary file.
+func newSQLiteTestServer(t *testing.T) *testServer {
+	store, err := InitSQLite(filepath.Join(t.TempDir(), "freezer.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.db.Close() })
+	return newTestServerOn(t, store)
+}
+
+func newTestServerOn(t *testing.T, store Store) *testServer {
+	h := NewHandlers(store)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/v1/session", h.Login)
+	mux.HandleFunc("POST /api/v1/rooms", h.RequireLogin(h.ApiCreateRoom))
+	mux.HandleFunc("POST /api/v1/freezers", h.RequireLogin(h.ApiCreateFreezer))
+	mux.HandleFunc("POST /api/v1/freezers/{id}/retire", h.RequireLogin(h.ApiRetireFreezer))
+	mux.HandleFunc("GET /api/v1/freezers/{id}/boxes", h.RequireLogin(h.ApiListFreezerBoxes))
+	mux.HandleFunc("POST /api/v1/boxes", h.RequireLogin(h.ApiCreateBox))
+	mux.HandleFunc("PATCH /api/v1/boxes/{id}", h.RequireLogin(h.ApiUpdateBox))
+	mux.HandleFunc("DELETE /api/v1/boxes/{id}", h.RequireLogin(h.ApiDeleteBox))
+	mux.HandleFunc("POST /api/v1/boxes/move", h.RequireLogin(h.ApiMoveBoxes))
+	mux.HandleFunc("GET /api/v1/boxes/{id}/samples/{type}", h.RequireLogin(h.ApiListSampleLinks))
+	mux.HandleFunc("POST /api/v1/samples/{type}", h.RequireLogin(h.ApiCreateSampleLink))
+	mux.HandleFunc("PATCH /api/v1/samples/{type}/{name}", h.RequireLogin(h.ApiUpdateSampleLink))
+	mux.HandleFunc("DELETE /api/v1/samples/{type}/{name}", h.RequireLogin(h.ApiDeleteSampleLink))
+	mux.HandleFunc("POST /api/v1/samples/{type}/{name}/checkout", h.RequireLogin(h.ApiCheckoutSample))
+	mux.HandleFunc("POST /api/v1/samples/{type}/{name}/return", h.RequireLogin(h.ApiReturnSample))
+	mux.HandleFunc("POST /api/v1/samples/{type}/{name}/aliquots", h.RequireLogin(h.ApiCreateAliquot))
+	mux.HandleFunc("PUT /api/v1/samples/{type}/{name}/quantity", h.RequireLogin(h.ApiSetSampleQuantity))
+	mux.HandleFunc("GET /api/v1/scan/{code}", h.RequireLogin(h.ApiResolveScan))
+	mux.HandleFunc("GET /api/v1/boxes/{id}/grid", h.RequireLogin(h.ApiBoxGrid))
+	mux.HandleFunc("GET /api/v1/samples/{type}/{name}/locations", h.RequireLogin(h.ApiSampleLocations))
+	mux.HandleFunc("POST /api/v1/import", h.RequireLogin(h.ApiImportSamples))
+	mux.HandleFunc("POST /api/v1/boxes/{id}/scan", h.RequireLogin(h.ApiScanIntoBox))
+
+	srv := &testServer{Server: httptest.NewServer(mux), store: store, h: h}
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// login creates a local user holding role lab-wide, or no role when role is
+// empty, and returns a client with their session cookie.
+func (srv *testServer) login(t *testing.T, username string, role string) *http.Client {
+	t.Helper()
+	if err := srv.h.CreateLocalUser(username, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if role != "" {
+		if err := srv.store.SaveRoleGrant(context.Background(), nil, RoleGrant{Username: username, Role: role}, "test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+	status, body := srv.do(t, client, "POST", "/api/v1/session", loginRequest{Username: username, Password: "secret"})
+	if status != http.StatusOK {
+		t.Fatalf("login %s: %d %s", username, status, body)
+	}
+	return client
+}
+
+// do sends body as JSON and returns the status and the response body.
+func (srv *testServer) do(t *testing.T, client *http.Client, method string, path string, body interface{}) (int, []byte) {
+	t.Helper()
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req, err := http.NewRequest(method, srv.URL+path, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var out bytes.Buffer
+	out.ReadFrom(resp.Body)
+	return resp.StatusCode, out.Bytes()
+}
+
+// create sends body and decodes the created row into v, failing the test
+// unless the status is 201.
+func (srv *testServer) create(t *testing.T, client *http.Client, path string, body interface{}, v interface{}) {
+	t.Helper()
+	status, data := srv.do(t, client, "POST", path, body)
+	if status != http.StatusCreated {
+		t.Fatalf("POST %s: %d %s", path, status, data)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatalf("POST %s: %v in %s", path, err, data)
+	}
+}
+
+// expectError checks the status and error code of a refused request.
+func expectError(t *testing.T, status int, data []byte, wantStatus int, wantCode string) {
+	t.Helper()
+	var apiErr ApiError
+	json.Unmarshal(data, &apiErr)
+	if status != wantStatus || apiErr.Code != wantCode {
+		t.Fatalf("got %d %s, want %d %s: %s", status, apiErr.Code, wantStatus, wantCode, data)
+	}
+}
+
+// freezerFixture is a room with one freezer of two shelves, each holding
+// boxesPerSlot boxes.
+func (srv *testServer) freezerFixture(t *testing.T, client *http.Client, boxesPerSlot int) FreezerDB {
+	t.Helper()
+	var room FreezerRoom
+	srv.create(t, client, "/api/v1/rooms", map[string]string{"lab": "Genomics", "floor": "2"}, &room)
+
+	var freezer FreezerDB
+	srv.create(t, client, "/api/v1/freezers", map[string]interface{}{
+		"freezer_location_id": room.Id,
+		"name":                "F1",
+		"model":               "Thermo TSX",
+		"shelf_count":         2,
+		"boxes_per_slot":      boxesPerSlot,
+	}, &freezer)
+	return freezer
+}
+
+func TestLoginRequired(t *testing.T) {
+	srv := newTestServer(t)
+
+	status, data := srv.do(t, http.DefaultClient, "POST", "/api/v1/rooms", map[string]string{"lab": "Genomics", "floor": "2"})
+	expectError(t, status, data, http.StatusUnauthorized, CodeLoginRequired)
+
+	srv.h.CreateLocalUser("ana", "secret")
+	status, data = srv.do(t, http.DefaultClient, "POST", "/api/v1/session", loginRequest{Username: "ana", Password: "wrong"})
+	expectError(t, status, data, http.StatusUnauthorized, CodeInvalidCredentials)
+}
+
+func TestCreateBoxChecksRoles(t *testing.T) {
+	srv := newTestServer(t)
+	manager := srv.login(t, "mia", RoleManager)
+	technician := srv.login(t, "tom", RoleTechnician)
+	outsider := srv.login(t, "olga", "")
+	freezer := srv.freezerFixture(t, manager, 10)
+
+	box := map[string]interface{}{"name": "B1", "freezer_id": freezer.Id, "shelf": 1}
+	status, data := srv.do(t, technician, "POST", "/api/v1/boxes", box)
+	expectError(t, status, data, http.StatusForbidden, CodePermissionDenied)
+
+	status, data = srv.do(t, outsider, "POST", "/api/v1/rooms", map[string]string{"lab": "Genomics", "floor": "3"})
+	expectError(t, status, data, http.StatusForbidden, CodePermissionDenied)
+
+	// a grant on the freezer alone is enough for its boxes
+	freezerId := freezer.Id
+	srv.store.SaveRoleGrant(context.Background(), nil, RoleGrant{Username: "tom", Role: RoleManager, FreezerId: &freezerId}, "test")
+	var created Box
+	srv.create(t, technician, "/api/v1/boxes", box, &created)
+	if created.FreezerId != freezer.Id || created.Shelf != 1 {
+		t.Fatalf("created %+v", created)
+	}
+}
+
+func TestCreateBoxRefusesRetiredAndFullFreezers(t *testing.T) {
+	srv := newTestServer(t)
+	manager := srv.login(t, "mia", RoleManager)
+	freezer := srv.freezerFixture(t, manager, 1)
+
+	var box Box
+	srv.create(t, manager, "/api/v1/boxes", map[string]interface{}{"name": "B1", "freezer_id": freezer.Id, "shelf": 1}, &box)
+
+	status, data := srv.do(t, manager, "POST", "/api/v1/boxes", map[string]interface{}{"name": "B2", "freezer_id": freezer.Id, "shelf": 1})
+	expectError(t, status, data, http.StatusConflict, CodeOverCapacity)
+
+	status, data = srv.do(t, manager, "POST", "/api/v1/boxes", map[string]interface{}{"name": "B2", "freezer_id": freezer.Id, "shelf": 3})
+	expectError(t, status, data, http.StatusBadRequest, CodeValidationFailed)
+
+	status, data = srv.do(t, manager, "POST", "/api/v1/freezers/"+strconv.Itoa(freezer.Id)+"/retire", nil)
+	expectError(t, status, data, http.StatusConflict, CodeFreezerNotEmpty)
+
+	if status, data := srv.do(t, manager, "DELETE", "/api/v1/boxes/"+strconv.Itoa(box.Id), nil); status != http.StatusNoContent {
+		t.Fatalf("delete box: %d %s", status, data)
+	}
+	if status, data := srv.do(t, manager, "POST", "/api/v1/freezers/"+strconv.Itoa(freezer.Id)+"/retire", nil); status != http.StatusOK {
+		t.Fatalf("retire: %d %s", status, data)
+	}
+	status, data = srv.do(t, manager, "POST", "/api/v1/boxes", map[string]interface{}{"name": "B3", "freezer_id": freezer.Id, "shelf": 1})
+	expectError(t, status, data, http.StatusConflict, CodeRetired)
+}
+
+// TestMoveBoxesIsAllOrNothing runs on SQLite too, since both stores count
+// room after the whole batch the way moveBoxesTx does.
+func TestMoveBoxesIsAllOrNothing(t *testing.T) {
+	t.Run("memory", func(t *testing.T) { testMoveBoxesIsAllOrNothing(t, newTestServer(t)) })
+	t.Run("sqlite", func(t *testing.T) { testMoveBoxesIsAllOrNothing(t, newSQLiteTestServer(t)) })
+}
+
+func testMoveBoxesIsAllOrNothing(t *testing.T, srv *testServer) {
+	manager := srv.login(t, "mia", RoleManager)
+	freezer := srv.freezerFixture(t, manager, 1)
+
+	var first, second Box
+	srv.create(t, manager, "/api/v1/boxes", map[string]interface{}{"name": "B1", "freezer_id": freezer.Id, "shelf": 1}, &first)
+	srv.create(t, manager, "/api/v1/boxes", map[string]interface{}{"name": "B2", "freezer_id": freezer.Id, "shelf": 2}, &second)
+
+	// the first move would fit if the second box left shelf 2, but it stays
+	moves := moveRequest{Moves: []BoxMove{
+		{BoxId: first.Id, FreezerId: freezer.Id, Shelf: 2},
+		{BoxId: second.Id, FreezerId: freezer.Id, Shelf: 2},
+	}}
+	status, data := srv.do(t, manager, "POST", "/api/v1/boxes/move", moves)
+	expectError(t, status, data, http.StatusConflict, CodeOverCapacity)
+
+	stored, _ := srv.store.GetBox(context.Background(), first.Id)
+	if stored.Shelf != 1 {
+		t.Fatalf("box %d moved to shelf %d after a refused move", first.Id, stored.Shelf)
+	}
+
+	// room is counted once every box has moved, so two full shelves can swap
+	moves = moveRequest{Moves: []BoxMove{{BoxId: first.Id, FreezerId: freezer.Id, Shelf: 2}, {BoxId: second.Id, FreezerId: freezer.Id, Shelf: 1}}}
+	if status, data := srv.do(t, manager, "POST", "/api/v1/boxes/move", moves); status != http.StatusOK {
+		t.Fatalf("swap: %d %s", status, data)
+	}
+	for id, shelf := range map[int]int{first.Id: 2, second.Id: 1} {
+		if stored, _ := srv.store.GetBox(context.Background(), id); stored.Shelf != shelf {
+			t.Fatalf("box %d is on shelf %d after the swap, want %d", id, stored.Shelf, shelf)
+		}
+	}
+}
+
+func TestSampleLinks(t *testing.T) {
+	srv := newTestServer(t)
+	manager := srv.login(t, "mia", RoleManager)
+	technician := srv.login(t, "tom", RoleTechnician)
+	viewer := srv.login(t, "vic", RoleViewer)
+	freezer := srv.freezerFixture(t, manager, 10)
+
+	var box, other Box
+	srv.create(t, manager, "/api/v1/boxes", map[string]interface{}{"name": "B1", "freezer_id": freezer.Id, "shelf": 1, "format": "96"}, &box)
+	srv.create(t, manager, "/api/v1/boxes", map[string]interface{}{"name": "B2", "freezer_id": freezer.Id, "shelf": 2, "format": "96"}, &other)
+
+	status, data := srv.do(t, viewer, "POST", "/api/v1/samples/tube", map[string]interface{}{"entered_name": "T-1", "box_id": box.Id})
+	expectError(t, status, data, http.StatusForbidden, CodePermissionDenied)
+
+	var created linkCreated
+	srv.create(t, technician, "/api/v1/samples/tube", map[string]interface{}{"entered_name": "T-1", "box_id": box.Id, "position": 5}, &created)
+
+	status, data = srv.do(t, technician, "POST", "/api/v1/samples/tube", map[string]interface{}{"entered_name": "T-1", "box_id": other.Id})
+	expectError(t, status, data, http.StatusConflict, CodeSampleAlreadyStored)
+	status, data = srv.do(t, technician, "POST", "/api/v1/samples/tube", map[string]interface{}{"entered_name": "T-2", "box_id": box.Id, "position": 5})
+	expectError(t, status, data, http.StatusConflict, CodePositionOccupied)
+
+	// a move to another box leaves the well behind
+	if status, data := srv.do(t, technician, "PATCH", "/api/v1/samples/tube/T-1", map[string]interface{}{"box_id": other.Id}); status != http.StatusNoContent {
+		t.Fatalf("move sample: %d %s", status, data)
+	}
+	var links []SampleLink
+	status, data = srv.do(t, viewer, "GET", "/api/v1/boxes/"+strconv.Itoa(other.Id)+"/samples/tube", nil)
+	if err := json.Unmarshal(data, &links); err != nil || status != http.StatusOK {
+		t.Fatalf("list samples: %d %s", status, data)
+	}
+	if len(links) != 1 || links[0].EnteredName != "T-1" || links[0].Position != nil {
+		t.Fatalf("box %d holds %+v", other.Id, links)
+	}
+
+	status, data = srv.do(t, manager, "DELETE", "/api/v1/boxes/"+strconv.Itoa(other.Id), nil)
+	expectError(t, status, data, http.StatusConflict, CodeStillReferenced)
+
+	if status, data := srv.do(t, technician, "DELETE", "/api/v1/samples/tube/T-1", nil); status != http.StatusNoContent {
+		t.Fatalf("delete sample: %d %s", status, data)
+	}
+	if _, err := srv.store.GetSampleLink(context.Background(), tubes, "T-1"); err != errSampleLinkNotFound {
+		t.Fatalf("T-1 still stored: %v", err)
+	}
+	status, data = srv.do(t, technician, "DELETE", "/api/v1/samples/tube/T-1", nil)
+	expectError(t, status, data, http.StatusNotFound, CodeSampleNotFound)
+}
+
+func TestDeleteSampleLinkKeepsLineage(t *testing.T) {
+	srv := newTestServer(t)
+	manager := srv.login(t, "mia", RoleManager)
+	freezer := srv.freezerFixture(t, manager, 10)
+
+	var box Box
+	srv.create(t, manager, "/api/v1/boxes", map[string]interface{}{"name": "B1", "freezer_id": freezer.Id, "shelf": 1}, &box)
+
+	parent := "T-1"
+	consumedAt := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	srv.store.(*MemoryStore).links[tubes.Key] = []SampleLink{
+		{SampleType: tubes.Key, EnteredName: parent, BoxId: box.Id},
+		{SampleType: tubes.Key, EnteredName: "T-1a", BoxId: box.Id, Aliquot: Aliquot{ParentName: &parent}},
+		{SampleType: tubes.Key, EnteredName: "T-2", BoxId: box.Id, Aliquot: Aliquot{ConsumedAt: &consumedAt}},
+	}
+
+	status, data := srv.do(t, manager, "DELETE", "/api/v1/samples/tube/T-1", nil)
+	expectError(t, status, data, http.StatusConflict, CodeHasAliquots)
+	status, data = srv.do(t, manager, "DELETE", "/api/v1/samples/tube/T-2", nil)
+	expectError(t, status, data, http.StatusConflict, CodeSampleConsumed)
+	if status, data := srv.do(t, manager, "DELETE", "/api/v1/samples/tube/T-1a", nil); status != http.StatusNoContent {
+		t.Fatalf("delete aliquot: %d %s", status, data)
+	}
+}
+
+func TestCheckoutAndReturn(t *testing.T) {
+	srv := newTestServer(t)
+	manager := srv.login(t, "mia", RoleManager)
+	technician := srv.login(t, "tom", RoleTechnician)
+	freezer := srv.freezerFixture(t, manager, 10)
+
+	var box Box
+	srv.create(t, manager, "/api/v1/boxes", map[string]interface{}{"name": "B1", "freezer_id": freezer.Id, "shelf": 1, "format": "96"}, &box)
+	var created linkCreated
+	srv.create(t, technician, "/api/v1/samples/tube", map[string]interface{}{"entered_name": "T-1", "box_id": box.Id, "position": 5}, &created)
+
+	status, data := srv.do(t, technician, "POST", "/api/v1/samples/tube/T-9/checkout", map[string]string{})
+	expectError(t, status, data, http.StatusNotFound, CodeSampleNotFound)
+	status, data = srv.do(t, technician, "POST", "/api/v1/samples/tube/T-1/return", nil)
+	expectError(t, status, data, http.StatusConflict, CodeSampleNotCheckedOut)
+
+	var state checkoutState
+	status, data = srv.do(t, technician, "POST", "/api/v1/samples/tube/T-1/checkout", map[string]string{"purpose": "qPCR"})
+	if err := json.Unmarshal(data, &state); err != nil || status != http.StatusOK {
+		t.Fatalf("checkout: %d %s", status, data)
+	}
+	if state.CheckedOutBy == nil || *state.CheckedOutBy != "tom" || state.CheckedOutAt == nil || state.Position == nil || *state.Position != 5 {
+		t.Fatalf("checked out as %+v", state)
+	}
+	status, data = srv.do(t, manager, "POST", "/api/v1/samples/tube/T-1/checkout", map[string]string{})
+	expectError(t, status, data, http.StatusConflict, CodeSampleCheckedOut)
+
+	status, data = srv.do(t, technician, "POST", "/api/v1/samples/tube/T-1/return", nil)
+	if err := json.Unmarshal(data, &state); err != nil || status != http.StatusOK {
+		t.Fatalf("return: %d %s", status, data)
+	}
+	if state.CheckedOutBy != nil || state.CheckedOutAt != nil || state.Purpose != nil {
+		t.Fatalf("returned as %+v", state)
+	}
+}
+
+func TestScanNameStoredAsTwoTypes(t *testing.T) {
+	srv := newTestServer(t)
+	manager := srv.login(t, "mia", RoleManager)
+	freezer := srv.freezerFixture(t, manager, 10)
+
+	var box Box
+	srv.create(t, manager, "/api/v1/boxes", map[string]interface{}{"name": "B1", "freezer_id": freezer.Id, "shelf": 1}, &box)
+	var created linkCreated
+	srv.create(t, manager, "/api/v1/samples/tube", map[string]interface{}{"entered_name": "X-1", "box_id": box.Id}, &created)
+	srv.create(t, manager, "/api/v1/samples/vial", map[string]interface{}{"entered_name": "X-1", "box_id": box.Id}, &created)
+
+	status, data := srv.do(t, manager, "GET", "/api/v1/scan/X-1", nil)
+	expectError(t, status, data, http.StatusBadRequest, CodeValidationFailed)
+	var refused struct {
+		Details ScanResult `json:"details"`
+	}
+	json.Unmarshal(data, &refused)
+	if len(refused.Details.Candidates) != 2 {
+		t.Fatalf("candidates %v, want tube and vial", refused.Details.Candidates)
+	}
+
+	var result ScanResult
+	status, data = srv.do(t, manager, "GET", "/api/v1/scan/X-1?sample_type=vial", nil)
+	if err := json.Unmarshal(data, &result); err != nil || status != http.StatusOK {
+		t.Fatalf("scan vial: %d %s", status, data)
+	}
+	if result.SampleType != "vial" || result.BoxId == nil || *result.BoxId != box.Id {
+		t.Fatalf("resolved to %+v", result)
+	}
+
+	path := "/api/v1/boxes/" + strconv.Itoa(box.Id) + "/scan"
+	status, data = srv.do(t, manager, "POST", path, map[string]string{"code": "X-1", "action": "remove"})
+	expectError(t, status, data, http.StatusBadRequest, CodeValidationFailed)
+	if status, data := srv.do(t, manager, "POST", path, map[string]string{"code": "X-1", "action": "remove", "sample_type": "tube"}); status != http.StatusOK {
+		t.Fatalf("remove tube: %d %s", status, data)
+	}
+	if _, err := srv.store.GetSampleLink(context.Background(), sampleTypesByKey["vial"], "X-1"); err != nil {
+		t.Fatalf("the vial went with the tube: %v", err)
+	}
+}
+
+// importCSV posts sheet as a raw CSV import.
+func (srv *testServer) importCSV(t *testing.T, client *http.Client, sheet string) (int, []byte) {
+	t.Helper()
+	resp, err := client.Post(srv.URL+"/api/v1/import", "text/csv", strings.NewReader(sheet))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var out bytes.Buffer
+	out.ReadFrom(resp.Body)
+	return resp.StatusCode, out.Bytes()
+}
+
+func TestImportChecksBoxesFirst(t *testing.T) {
+	srv := newTestServer(t)
+	manager := srv.login(t, "mia", RoleManager)
+	viewer := srv.login(t, "vic", RoleViewer)
+	freezer := srv.freezerFixture(t, manager, 10)
+
+	var box Box
+	srv.create(t, manager, "/api/v1/boxes", map[string]interface{}{"name": "B1", "freezer_id": freezer.Id, "shelf": 1}, &box)
+	sheet := "box,type,entered_name\n" + strconv.Itoa(box.Id) + ",tube,T-1\n" + strconv.Itoa(box.Id) + ",tube,T-2\n"
+
+	status, data := srv.importCSV(t, viewer, sheet)
+	expectError(t, status, data, http.StatusForbidden, CodePermissionDenied)
+
+	var report ImportReport
+	status, data = srv.importCSV(t, manager, sheet)
+	if err := json.Unmarshal(data, &report); err != nil || status != http.StatusCreated || !report.Committed || report.Ready != 2 {
+		t.Fatalf("import: %d %s", status, data)
+	}
+
+	memory := srv.store.(*MemoryStore)
+	retired := memory.freezers[freezer.Id]
+	retired.Retired = true
+	memory.freezers[freezer.Id] = retired
+
+	status, data = srv.importCSV(t, manager, "box,type,entered_name\n"+strconv.Itoa(box.Id)+",tube,T-3\n")
+	expectError(t, status, data, http.StatusUnprocessableEntity, CodeImportInvalid)
+	status, data = srv.do(t, manager, "POST", "/api/v1/samples/tube", map[string]interface{}{"entered_name": "T-3", "box_id": box.Id})
+	expectError(t, status, data, http.StatusConflict, CodeRetired)
+}
+
+func TestRenameOntoStoredName(t *testing.T) {
+	t.Run("memory", func(t *testing.T) { testRenameOntoStoredName(t, newTestServer(t)) })
+	t.Run("sqlite", func(t *testing.T) { testRenameOntoStoredName(t, newSQLiteTestServer(t)) })
+}
+
+func testRenameOntoStoredName(t *testing.T, srv *testServer) {
+	manager := srv.login(t, "mia", RoleManager)
+	freezer := srv.freezerFixture(t, manager, 10)
+
+	var box Box
+	srv.create(t, manager, "/api/v1/boxes", map[string]interface{}{"name": "B1", "freezer_id": freezer.Id, "shelf": 1}, &box)
+	var created linkCreated
+	srv.create(t, manager, "/api/v1/samples/tube", map[string]interface{}{"entered_name": "T-1", "box_id": box.Id}, &created)
+	srv.create(t, manager, "/api/v1/samples/tube", map[string]interface{}{"entered_name": "T-2", "box_id": box.Id}, &created)
+
+	status, data := srv.do(t, manager, "PATCH", "/api/v1/samples/tube/T-2", map[string]interface{}{"entered_name": "T-1"})
+	expectError(t, status, data, http.StatusConflict, CodeSampleAlreadyStored)
+}
+
+func TestCreateAliquot(t *testing.T) {
+	srv := newTestServer(t)
+	manager := srv.login(t, "mia", RoleManager)
+	freezer := srv.freezerFixture(t, manager, 10)
+
+	var box Box
+	srv.create(t, manager, "/api/v1/boxes", map[string]interface{}{"name": "B1", "freezer_id": freezer.Id, "shelf": 1, "format": "96"}, &box)
+	var created linkCreated
+	srv.create(t, manager, "/api/v1/samples/tube", map[string]interface{}{"entered_name": "T-1", "box_id": box.Id, "position": 1}, &created)
+	srv.create(t, manager, "/api/v1/samples/tube", map[string]interface{}{"entered_name": "T-2", "box_id": box.Id}, &created)
+	if status, data := srv.do(t, manager, "PUT", "/api/v1/samples/tube/T-1/quantity", map[string]float64{"volume_ul": 50}); status != http.StatusOK {
+		t.Fatalf("set quantity: %d %s", status, data)
+	}
+
+	status, data := srv.do(t, manager, "POST", "/api/v1/samples/tube/T-1/aliquots", map[string]interface{}{"entered_name": "T-2", "box_id": box.Id, "volume_ul": 10})
+	expectError(t, status, data, http.StatusConflict, CodeSampleAlreadyStored)
+	status, data = srv.do(t, manager, "POST", "/api/v1/samples/tube/T-1/aliquots", map[string]interface{}{"entered_name": "T-1a", "box_id": box.Id, "volume_ul": 60})
+	expectError(t, status, data, http.StatusConflict, CodeInsufficientQuantity)
+
+	var split aliquotCreated
+	srv.create(t, manager, "/api/v1/samples/tube/T-1/aliquots", map[string]interface{}{"entered_name": "T-1a", "box_id": box.Id, "volume_ul": 50}, &split)
+	if split.Parent.ConsumedAt == nil || split.Parent.Position != nil || *split.Parent.RemainingVolumeUl != 0 {
+		t.Fatalf("parent left as %+v", split.Parent)
+	}
+	if split.Aliquot.ParentName == nil || *split.Aliquot.ParentName != "T-1" || *split.Aliquot.RemainingVolumeUl != 50 {
+		t.Fatalf("aliquot stored as %+v", split.Aliquot)
+	}
+}
+
+func TestReadRoutesNeedViewer(t *testing.T) {
+	srv := newTestServer(t)
+	manager := srv.login(t, "mia", RoleManager)
+	viewer := srv.login(t, "vic", RoleViewer)
+	nobody := srv.login(t, "nat", "")
+	freezer := srv.freezerFixture(t, manager, 10)
+
+	var box Box
+	srv.create(t, manager, "/api/v1/boxes", map[string]interface{}{"name": "B1", "freezer_id": freezer.Id, "shelf": 1, "format": "96"}, &box)
+	var created linkCreated
+	srv.create(t, manager, "/api/v1/samples/tube", map[string]interface{}{"entered_name": "T-1", "box_id": box.Id}, &created)
+
+	for _, path := range []string{
+		"/api/v1/freezers/" + strconv.Itoa(freezer.Id) + "/boxes",
+		"/api/v1/boxes/" + strconv.Itoa(box.Id) + "/grid",
+		"/api/v1/boxes/" + strconv.Itoa(box.Id) + "/samples/tube",
+		"/api/v1/samples/tube/T-1/locations",
+		"/api/v1/scan/T-1",
+	} {
+		status, data := srv.do(t, &http.Client{}, "GET", path, nil)
+		expectError(t, status, data, http.StatusUnauthorized, CodeLoginRequired)
+		status, data = srv.do(t, nobody, "GET", path, nil)
+		expectError(t, status, data, http.StatusForbidden, CodePermissionDenied)
+		if status, data := srv.do(t, viewer, "GET", path, nil); status != http.StatusOK {
+			t.Fatalf("GET %s as a viewer: %d %s", path, status, data)
+		}
+	}
+}
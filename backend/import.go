@@ -0,0 +1,496 @@
+package freezerinv
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/360EntSecGroup-Skylar/excelize"
+	"github.com/jackc/pgx/v5"
+	"gitlab.com/UrsusArcTech/logger"
+)
+
+const (
+	maxImportBytes = 10 << 20
+	maxImportRows  = 5000
+	// an import stops once this many sample lookups in a row time out,
+	// rather than waiting out the timeout on every remaining row
+	maxImportTimeouts = 3
+
+	xlsxContentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+)
+
+// row statuses in an import report. Unresolved rows are still stored, the
+// same way a single add keeps a name it could not match to the sample table.
+const (
+	importReady         = "ready"
+	importUnresolved    = "unresolved"
+	importAlreadyStored = "already_stored"
+	importError         = "error"
+)
+
+type ImportRow struct {
+	Line         int    `json:"line"`
+	Box          string `json:"box"`
+	BoxId        *int   `json:"box_id"`
+	SampleType   string `json:"sample_type"`
+	EnteredName  string `json:"entered_name"`
+	Position     *int   `json:"position"`
+	ResolvedId   *int   `json:"resolved_id"`
+	ResolvedName string `json:"resolved_name,omitempty"`
+	Status       string `json:"status"`
+	Message      string `json:"message,omitempty"`
+
+	// the position as written, parsed once the box format is known
+	positionText string
+}
+
+type ImportReport struct {
+	DryRun        bool        `json:"dry_run"`
+	Committed     bool        `json:"committed"`
+	Total         int         `json:"total"`
+	Ready         int         `json:"ready"`
+	Unresolved    int         `json:"unresolved"`
+	AlreadyStored int         `json:"already_stored"`
+	Errors        int         `json:"errors"`
+	Rows          []ImportRow `json:"rows"`
+}
+
+// importColumns maps the header names we accept onto the import fields.
+var importColumns = map[string]string{
+	"box":         "box",
+	"boxid":       "box",
+	"boxname":     "box",
+	"type":        "type",
+	"sampletype":  "type",
+	"enteredname": "name",
+	"name":        "name",
+	"sample":      "name",
+	"position":    "position",
+	"well":        "position",
+}
+
+// ApiImportSamples links many samples to boxes from a CSV or XLSX upload,
+// either as a multipart "file" field or as the raw body. With dry_run=true
+// nothing is written and the report says what would happen; otherwise every
+// row is stored in one transaction, or none are.
+func (h *Handlers) ApiImportSamples(w http.ResponseWriter, r *http.Request) {
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+
+	table, apiErr := readImportTable(w, r)
+	if apiErr != nil {
+		writeApiError(w, apiErr)
+		return
+	}
+
+	rows, apiErr := parseImportRows(table)
+	if apiErr != nil {
+		writeApiError(w, apiErr)
+		return
+	}
+
+	report, ok := h.checkImportRows(w, r, rows)
+	if !ok {
+		return
+	}
+
+	report.DryRun = dryRun
+	if dryRun {
+		writeJSON(w, http.StatusOK, report)
+		return
+	}
+
+	if report.Errors > 0 || report.AlreadyStored > 0 {
+		writeApiError(w, &ApiError{Status: http.StatusUnprocessableEntity, Code: CodeImportInvalid, Message: fmt.Sprintf("Nothing was imported: %d rows have errors and %d samples are already stored", report.Errors, report.AlreadyStored), Details: report})
+		return
+	}
+
+	if err := h.commitImport(r, report.Rows); err != nil {
+		logger.LogError("Import failed: " + err.Error())
+		writeDbError(w, err)
+		return
+	}
+
+	logger.LogMessage("Imported ", report.Total, " samples for ", SessionUser(r))
+	report.Committed = true
+	writeJSON(w, http.StatusCreated, report)
+}
+
+// readImportTable returns the cells of the uploaded file, header row first.
+func readImportTable(w http.ResponseWriter, r *http.Request) ([][]string, *ApiError) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportBytes)
+
+	invalid := func(message string) *ApiError {
+		return &ApiError{Status: http.StatusBadRequest, Code: CodeValidationFailed, Message: message, Field: "file"}
+	}
+
+	var body io.Reader = r.Body
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	name := ""
+
+	if contentType == "multipart/form-data" {
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			return nil, invalid("Upload the sheet as the file field: " + err.Error())
+		}
+		defer file.Close()
+		body = file
+		name = header.Filename
+		contentType, _, _ = mime.ParseMediaType(header.Header.Get("Content-Type"))
+	}
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, invalid("Could not read the upload: " + err.Error())
+	}
+
+	if contentType == xlsxContentType || strings.EqualFold(filepath.Ext(name), ".xlsx") {
+		book, err := excelize.OpenReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, invalid("Not a readable XLSX file: " + err.Error())
+		}
+		sheets := book.GetSheetMap()
+		if len(sheets) == 0 {
+			return nil, invalid("The workbook has no sheets")
+		}
+		var indexes []int
+		for i := range sheets {
+			indexes = append(indexes, i)
+		}
+		sort.Ints(indexes)
+		return book.GetRows(sheets[indexes[0]]), nil
+	}
+
+	reader := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	table, err := reader.ReadAll()
+	if err != nil {
+		return nil, invalid("Not a readable CSV file: " + err.Error())
+	}
+	return table, nil
+}
+
+// parseImportRows maps the header onto the import fields and skips blank lines.
+func parseImportRows(table [][]string) ([]ImportRow, *ApiError) {
+	invalid := func(message string) *ApiError {
+		return &ApiError{Status: http.StatusBadRequest, Code: CodeValidationFailed, Message: message, Field: "file"}
+	}
+
+	if len(table) == 0 {
+		return nil, invalid("The file is empty")
+	}
+
+	columns := map[string]int{}
+	for i, heading := range table[0] {
+		key := strings.NewReplacer(" ", "", "_", "", "-", "").Replace(strings.ToLower(strings.TrimSpace(heading)))
+		if field, ok := importColumns[key]; ok {
+			if _, seen := columns[field]; !seen {
+				columns[field] = i
+			}
+		}
+	}
+	for _, field := range []string{"box", "type", "name"} {
+		if _, ok := columns[field]; !ok {
+			return nil, invalid("The header row needs box, type and entered name columns, position is optional")
+		}
+	}
+
+	cell := func(record []string, field string) string {
+		i, ok := columns[field]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	var rows []ImportRow
+	for i, record := range table[1:] {
+		row := ImportRow{
+			Line:        i + 2,
+			Box:         cell(record, "box"),
+			SampleType:  strings.ToLower(cell(record, "type")),
+			EnteredName: cell(record, "name"),
+		}
+		row.positionText = cell(record, "position")
+		if row.Box == "" && row.SampleType == "" && row.EnteredName == "" && row.positionText == "" {
+			continue
+		}
+		rows = append(rows, row)
+	}
+
+	if len(rows) == 0 {
+		return nil, invalid("The file has no sample rows")
+	}
+	if len(rows) > maxImportRows {
+		return nil, invalid(fmt.Sprintf("At most %d rows can be imported at once", maxImportRows))
+	}
+	return rows, nil
+}
+
+// checkImportRows resolves every row against the boxes, the sample tables and
+// what is already stored, without writing anything. The boxes are looked up
+// and the technician role checked on all of them before any sample lookup.
+func (h *Handlers) checkImportRows(w http.ResponseWriter, r *http.Request, rows []ImportRow) (ImportReport, bool) {
+	ctx := r.Context()
+	report := ImportReport{Total: len(rows)}
+	boxes := map[string]*Box{}
+	occupied := map[int]map[int]string{}
+	seen := map[string]int{}
+	timeouts := 0
+
+	var boxIds []int
+	for i := range rows {
+		row := &rows[i]
+		fail := func(message string) {
+			row.Status = importError
+			row.Message = message
+		}
+
+		switch {
+		case row.Box == "":
+			fail("Missing box")
+		case row.EnteredName == "":
+			fail("Missing entered name")
+		default:
+			if t, ok := lookupSampleType(row.SampleType); ok {
+				row.SampleType = t.Key
+			} else {
+				fail("Unknown type " + strconv.Quote(row.SampleType) + ", use " + sampleTypeChoices())
+			}
+		}
+
+		if row.Status == "" {
+			box, problem, err := h.lookupImportBox(ctx, boxes, row.Box)
+			if err != nil {
+				logger.LogError("Database error: " + err.Error())
+				writeDbError(w, err)
+				return report, false
+			}
+			if problem != "" {
+				fail(problem)
+			} else {
+				row.BoxId = &box.Id
+				boxIds = append(boxIds, box.Id)
+			}
+		}
+	}
+	if !h.requireBoxRole(w, r, RoleTechnician, uniqueInts(boxIds)...) {
+		return report, false
+	}
+
+	for _, row := range rows {
+		fail := func(message string) {
+			row.Status = importError
+			row.Message = message
+		}
+
+		key := row.SampleType + "|" + row.EnteredName
+		if row.Status == "" {
+			if line, ok := seen[key]; ok {
+				fail(fmt.Sprintf("Also on line %d of this file", line))
+			} else {
+				seen[key] = row.Line
+			}
+		}
+
+		if row.Status == "" && row.positionText != "" {
+			box := boxes[row.Box]
+			if box.Format == nil {
+				fail("Box " + box.Name + " has no grid format, leave the position empty or set a format first")
+			} else if position, ok := boxFormats[*box.Format].parsePosition(row.positionText); !ok {
+				fail("Position " + row.positionText + " is not a well of a " + *box.Format + " well box")
+			} else {
+				if _, ok := occupied[box.Id]; !ok {
+					taken, err := boxOccupancy(ctx, box.Id)
+					if err != nil {
+						logger.LogError("Database error: " + err.Error())
+						writeDbError(w, err)
+						return report, false
+					}
+					occupied[box.Id] = taken
+				}
+				label := boxFormats[*box.Format].positionLabel(position)
+				if holder, ok := occupied[box.Id][position]; ok {
+					fail(label + " is already taken by " + holder)
+				} else {
+					occupied[box.Id][position] = row.SampleType + " " + row.EnteredName
+					row.Position = &position
+				}
+			}
+		}
+
+		if row.Status == "" {
+			stored, err := h.sampleStoredIn(ctx, row.SampleType, row.EnteredName)
+			if err != nil {
+				logger.LogError("Database error: " + err.Error())
+				writeDbError(w, err)
+				return report, false
+			}
+			if stored != "" {
+				row.Status = importAlreadyStored
+				row.Message = "Already stored in " + stored
+			}
+		}
+
+		if row.Status == "" {
+			t := sampleTypesByKey[row.SampleType]
+			id, name, err := t.resolve(ctx, row.EnteredName)
+			if ctx.Err() != nil {
+				// the client gave up, nobody is left to read the report
+				return report, false
+			}
+			if errors.Is(err, errResolverTimeout) {
+				timeouts++
+			} else {
+				timeouts = 0
+			}
+			if timeouts == maxImportTimeouts {
+				writeApiError(w, &ApiError{Status: http.StatusServiceUnavailable, Code: CodeLookupUnavailable, Message: fmt.Sprintf("The sample database did not answer %d lookups in a row, stopped at line %d. Try the import again later", maxImportTimeouts, row.Line)})
+				return report, false
+			}
+			if t.Resolver == noResolver {
+				// nothing to match against, so not being linked is expected
+				row.Status = importReady
+			} else if id == -1 {
+				row.Status = importUnresolved
+				row.Message = "Not found in the sample table or not unique, it will be stored but not linked"
+			} else {
+				row.Status = importReady
+				row.ResolvedId = &id
+				row.ResolvedName = name
+				if name != row.EnteredName {
+					row.Message = "Matched to " + name
+				}
+			}
+		}
+
+		switch row.Status {
+		case importReady:
+			report.Ready++
+		case importUnresolved:
+			report.Unresolved++
+		case importAlreadyStored:
+			report.AlreadyStored++
+		default:
+			report.Errors++
+		}
+		report.Rows = append(report.Rows, row)
+	}
+	return report, true
+}
+
+// lookupImportBox finds a box by id or by its name, which has to be unique.
+// A box that cannot be used is described by problem rather than an error.
+func (h *Handlers) lookupImportBox(ctx context.Context, cache map[string]*Box, ref string) (box *Box, problem string, err error) {
+	notFound := "Box " + ref + " not found"
+
+	if box, ok := cache[ref]; ok {
+		if box == nil {
+			return nil, notFound, nil
+		}
+		return box, "", nil
+	}
+
+	var ids []int
+	if id, err := strconv.Atoi(ref); err == nil {
+		ids = append(ids, id)
+	} else {
+		rows, err := db.Query(ctx, "SELECT id FROM mgl_freezer_inventory.boxes WHERE name = $1", ref)
+		if err != nil {
+			return nil, "", err
+		}
+		ids, err = pgx.CollectRows(rows, pgx.RowTo[int])
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	if len(ids) > 1 {
+		return nil, fmt.Sprintf("%d boxes are called %s, use the box id", len(ids), ref), nil
+	}
+	if len(ids) == 0 {
+		cache[ref] = nil
+		return nil, notFound, nil
+	}
+
+	found, err := h.store.GetBox(ctx, ids[0])
+	if err == errBoxNotFound {
+		cache[ref] = nil
+		return nil, notFound, nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	retired, err := h.retiredBoxError(ctx, found)
+	if err != nil {
+		return nil, "", err
+	}
+	if retired != nil {
+		return nil, retired.Message, nil
+	}
+	cache[ref] = &found
+	return &found, "", nil
+}
+
+// boxOccupancy maps each taken well of a box to the sample in it.
+func boxOccupancy(ctx context.Context, boxId int) (map[int]string, error) {
+	rows, err := db.Query(ctx, positionOccupants(), boxId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	taken := map[int]string{}
+	for rows.Next() {
+		var sampleType, name string
+		var position *int
+		if err := rows.Scan(&sampleType, &name, &position); err != nil {
+			return nil, err
+		}
+		if position != nil {
+			taken[*position] = sampleType + " " + name
+		}
+	}
+	return taken, rows.Err()
+}
+
+// sampleStoredIn describes where a sample already is, empty if nowhere.
+func (h *Handlers) sampleStoredIn(ctx context.Context, sampleType string, enteredName string) (string, error) {
+	locations, err := h.store.FindSampleLocations(ctx, sampleTypesByKey[sampleType], enteredName)
+	if err != nil || len(locations) == 0 {
+		return "", err
+	}
+	l := locations[0]
+	return fmt.Sprintf("box %s, freezer %s, shelf %d, %s floor %s", l.BoxName, l.FreezerName, l.Shelf, l.Lab, l.Floor), nil
+}
+
+// commitImport stores every row in one transaction with its audit entries.
+func (h *Handlers) commitImport(r *http.Request, rows []ImportRow) error {
+	links := make([]SampleLink, len(rows))
+	for i, row := range rows {
+		links[i] = SampleLink{SampleType: row.SampleType, SampleId: row.ResolvedId, EnteredName: row.EnteredName, BoxId: *row.BoxId, Position: row.Position}
+	}
+	return h.store.CreateSampleLinks(r.Context(), r, links)
+}
+
+func uniqueInts(values []int) []int {
+	seen := map[int]bool{}
+	var out []int
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			out = append(out, v)
+		}
+	}
+	return out
+}
@@ -0,0 +1,58 @@
+package freezerinv
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseImportRows(t *testing.T) {
+	table := [][]string{
+		{"Box Name", "Sample_Type", "Entered-Name", "Well", "Notes"},
+		{" B1 ", "EDNA", "E-1", "A1", "first"},
+		{"", "", "", ""},
+		{"B1", "fish", "F-1"},
+		{"7", "edna", " E-2 ", " 3 "},
+	}
+	rows, apiErr := parseImportRows(table)
+	if apiErr != nil {
+		t.Fatalf("refused: %v", apiErr)
+	}
+
+	want := []ImportRow{
+		{Line: 2, Box: "B1", SampleType: "edna", EnteredName: "E-1", positionText: "A1"},
+		{Line: 4, Box: "B1", SampleType: "fish", EnteredName: "F-1"},
+		{Line: 5, Box: "7", SampleType: "edna", EnteredName: "E-2", positionText: "3"},
+	}
+	if len(rows) != len(want) {
+		t.Fatalf("got %d rows, want %d: %+v", len(rows), len(want), rows)
+	}
+	for i := range want {
+		if fmt.Sprintf("%+v", rows[i]) != fmt.Sprintf("%+v", want[i]) {
+			t.Errorf("row %d is %+v, want %+v", i, rows[i], want[i])
+		}
+	}
+}
+
+func TestParseImportRowsRefuses(t *testing.T) {
+	tooMany := [][]string{{"box", "type", "name"}}
+	for i := range maxImportRows + 1 {
+		tooMany = append(tooMany, []string{"B1", "edna", fmt.Sprintf("E-%d", i)})
+	}
+
+	for _, c := range []struct {
+		name  string
+		table [][]string
+	}{
+		{"empty file", nil},
+		{"no name column", [][]string{{"box", "type", "position"}, {"B1", "edna", "A1"}}},
+		{"header only", [][]string{{"box", "type", "name"}}},
+		{"blank rows only", [][]string{{"box", "type", "name"}, {"", " ", ""}}},
+		{"too many rows", tooMany},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if _, apiErr := parseImportRows(c.table); apiErr == nil || apiErr.Code != CodeValidationFailed || apiErr.Field != "file" {
+				t.Fatalf("got %v, want the file refused", apiErr)
+			}
+		})
+	}
+}
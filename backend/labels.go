@@ -0,0 +1,355 @@
+package freezerinv
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"gitlab.com/UrsusArcTech/logger"
+)
+
+// Scannable codes are derived from the record id, so a label printed today
+// still scans after the box is renamed or moved.
+const (
+	boxCodePrefix     = "BOX-"
+	freezerCodePrefix = "FRZ-"
+)
+
+func boxCode(boxId int) string {
+	return fmt.Sprintf("%s%06d", boxCodePrefix, boxId)
+}
+
+func freezerCode(freezerId int) string {
+	return fmt.Sprintf("%s%06d", freezerCodePrefix, freezerId)
+}
+
+// parseCode splits a scanned code into its prefix and id. ok is false for
+// anything that is not one of our codes.
+func parseCode(code string) (prefix string, id int, ok bool) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	for _, prefix := range []string{boxCodePrefix, freezerCodePrefix} {
+		if rest, found := strings.CutPrefix(code, prefix); found {
+			id, err := strconv.Atoi(rest)
+			return prefix, id, err == nil && id > 0
+		}
+	}
+	return "", 0, false
+}
+
+// LabelSize is the physical size of one label, in millimetres.
+type LabelSize struct {
+	Width  float64 `json:"width_mm"`
+	Height float64 `json:"height_mm"`
+}
+
+// labelSizes are the stocks our Brady and Zebra printers take, keyed by
+// their nominal size.
+var labelSizes = map[string]LabelSize{
+	"25x13":  {Width: 25.4, Height: 12.7},
+	"38x13":  {Width: 38.1, Height: 12.7},
+	"38x25":  {Width: 38.1, Height: 25.4},
+	"51x25":  {Width: 50.8, Height: 25.4},
+	"102x51": {Width: 101.6, Height: 50.8},
+}
+
+const defaultLabelSize = "51x25"
+
+// labelSheets are page sizes labels can be tiled onto, for office printers.
+var labelSheets = map[string]LabelSize{
+	"a4":     {Width: 210, Height: 297},
+	"letter": {Width: 215.9, Height: 279.4},
+}
+
+// labelItem is what goes on one label: the code to encode and the text
+// printed next to it, most important line first.
+type labelItem struct {
+	Code  string
+	Lines []string
+}
+
+// labelOptions are the query parameters every label endpoint takes.
+type labelOptions struct {
+	Format    string
+	Symbology string
+	Size      LabelSize
+	// Sheet is nil when every label gets its own page
+	Sheet *LabelSize
+	Dpi   int
+}
+
+func readLabelOptions(w http.ResponseWriter, r *http.Request) (labelOptions, bool) {
+	q := r.URL.Query()
+	opts := labelOptions{Format: q.Get("format"), Symbology: q.Get("symbology"), Dpi: 203}
+
+	if opts.Format == "" {
+		opts.Format = "pdf"
+	}
+	if opts.Format != "pdf" && opts.Format != "svg" && opts.Format != "zpl" {
+		writeValidationError(w, "format", "Unknown format "+opts.Format+", use pdf, svg or zpl")
+		return opts, false
+	}
+
+	if opts.Symbology == "" {
+		opts.Symbology = "qr"
+	}
+	if opts.Symbology != "qr" && opts.Symbology != "code128" {
+		writeValidationError(w, "symbology", "Unknown symbology "+opts.Symbology+", use qr or code128")
+		return opts, false
+	}
+
+	sizeName := q.Get("size")
+	if sizeName == "" {
+		sizeName = defaultLabelSize
+	}
+	size, ok := labelSizes[sizeName]
+	if !ok {
+		writeValidationError(w, "size", "Unknown label size "+sizeName)
+		return opts, false
+	}
+	opts.Size = size
+
+	if sheetName := q.Get("sheet"); sheetName != "" {
+		sheet, ok := labelSheets[sheetName]
+		if !ok {
+			writeValidationError(w, "sheet", "Unknown sheet "+sheetName+", use a4 or letter")
+			return opts, false
+		}
+		opts.Sheet = &sheet
+	}
+
+	if dpi := q.Get("dpi"); dpi != "" {
+		if dpi != "203" && dpi != "300" {
+			writeValidationError(w, "dpi", "Unknown dpi "+dpi+", use 203 or 300")
+			return opts, false
+		}
+		opts.Dpi, _ = strconv.Atoi(dpi)
+	}
+	return opts, true
+}
+
+// queryIdList reads a comma separated list of ids, nil if the parameter is absent.
+func queryIdList(w http.ResponseWriter, r *http.Request, name string) ([]int, bool) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return nil, true
+	}
+	var ids []int
+	for _, part := range strings.Split(s, ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			writeValidationError(w, name, "Invalid "+name+": "+s)
+			return nil, false
+		}
+		ids = append(ids, id)
+	}
+	return ids, true
+}
+
+// boxLabel puts the box name, then where it lives, next to its code.
+func boxLabel(box Box, freezer FreezerDB, room FreezerRoom) labelItem {
+	place := fmt.Sprintf("%s %d", freezer.ShelfLabel, box.Shelf)
+	if box.Rack != nil {
+		place += fmt.Sprintf(" · Rack %d", *box.Rack)
+	}
+	if box.Drawer != nil {
+		place += fmt.Sprintf(" · Drawer %d", *box.Drawer)
+	}
+	return labelItem{
+		Code:  boxCode(box.Id),
+		Lines: []string{box.Name, freezer.Name + " · " + place, room.Lab + " " + room.Floor, boxCode(box.Id)},
+	}
+}
+
+func freezerLabel(freezer FreezerDB, room FreezerRoom) labelItem {
+	return labelItem{
+		Code:  freezerCode(freezer.Id),
+		Lines: []string{freezer.Name, freezer.Model, room.Lab + " " + room.Floor, freezerCode(freezer.Id)},
+	}
+}
+
+// ApiBoxLabels renders labels for the boxes in ids, or every box in freezer.
+// Options: format (pdf, svg or zpl), symbology (qr or code128), size, sheet
+// and dpi for zpl.
+func (h *Handlers) ApiBoxLabels(w http.ResponseWriter, r *http.Request) {
+	opts, ok := readLabelOptions(w, r)
+	if !ok {
+		return
+	}
+	ids, ok := queryIdList(w, r, "ids")
+	if !ok {
+		return
+	}
+	freezerId, ok := queryOptionalInt(w, r, "freezer")
+	if !ok {
+		return
+	}
+	if ids == nil && freezerId == nil {
+		writeValidationError(w, "ids", "Give box ids or a freezer")
+		return
+	}
+	if freezerId != nil && !h.requireReadScope(w, r, nil, freezerId, nil) {
+		return
+	}
+	if !h.requireBoxRole(w, r, RoleViewer, uniqueInts(ids)...) {
+		return
+	}
+
+	if freezerId != nil {
+		rows, err := db.Query(context.Background(), "SELECT id FROM mgl_freezer_inventory.boxes WHERE freezer_id = $1 ORDER BY shelf, rack, drawer, name", *freezerId)
+		if err != nil {
+			writeDbError(w, err)
+			return
+		}
+		inFreezer, err := pgx.CollectRows(rows, pgx.RowTo[int])
+		if err != nil {
+			writeDbError(w, err)
+			return
+		}
+		ids = append(ids, inFreezer...)
+	}
+
+	freezers := map[int]FreezerDB{}
+	rooms := map[int]FreezerRoom{}
+	var items []labelItem
+
+	for _, id := range uniqueInts(ids) {
+		box, err := h.store.GetBox(context.Background(), id)
+		if err == errBoxNotFound {
+			writeError(w, http.StatusNotFound, CodeBoxNotFound, fmt.Sprintf("Box %d not found", id))
+			return
+		}
+		if err != nil {
+			writeDbError(w, err)
+			return
+		}
+
+		freezer, room, err := h.labelPlace(freezers, rooms, box.FreezerId)
+		if err != nil {
+			writeDbError(w, err)
+			return
+		}
+		items = append(items, boxLabel(box, freezer, room))
+	}
+
+	writeLabels(w, opts, "box-labels", items)
+}
+
+// ApiFreezerLabels renders labels for the freezers in ids, or every active
+// freezer in room. Takes the same options as ApiBoxLabels.
+func (h *Handlers) ApiFreezerLabels(w http.ResponseWriter, r *http.Request) {
+	opts, ok := readLabelOptions(w, r)
+	if !ok {
+		return
+	}
+	ids, ok := queryIdList(w, r, "ids")
+	if !ok {
+		return
+	}
+	roomId, ok := queryOptionalInt(w, r, "room")
+	if !ok {
+		return
+	}
+	if ids == nil && roomId == nil {
+		writeValidationError(w, "ids", "Give freezer ids or a room")
+		return
+	}
+	if roomId != nil && !h.requireReadScope(w, r, roomId, nil, nil) {
+		return
+	}
+	if !h.requireRole(w, r, RoleViewer, uniqueInts(ids)...) {
+		return
+	}
+
+	if roomId != nil {
+		rows, err := db.Query(context.Background(), "SELECT id FROM mgl_freezer_inventory.freezer WHERE freezer_location_id = $1 AND NOT retired ORDER BY name", *roomId)
+		if err != nil {
+			writeDbError(w, err)
+			return
+		}
+		inRoom, err := pgx.CollectRows(rows, pgx.RowTo[int])
+		if err != nil {
+			writeDbError(w, err)
+			return
+		}
+		ids = append(ids, inRoom...)
+	}
+
+	freezers := map[int]FreezerDB{}
+	rooms := map[int]FreezerRoom{}
+	var items []labelItem
+
+	for _, id := range uniqueInts(ids) {
+		freezer, room, err := h.labelPlace(freezers, rooms, id)
+		if err == errFreezerNotFound {
+			writeError(w, http.StatusNotFound, CodeFreezerNotFound, fmt.Sprintf("Freezer %d not found", id))
+			return
+		}
+		if err != nil {
+			writeDbError(w, err)
+			return
+		}
+		items = append(items, freezerLabel(freezer, room))
+	}
+
+	writeLabels(w, opts, "freezer-labels", items)
+}
+
+// labelPlace loads a freezer and its room, once per request.
+func (h *Handlers) labelPlace(freezers map[int]FreezerDB, rooms map[int]FreezerRoom, freezerId int) (FreezerDB, FreezerRoom, error) {
+	freezer, ok := freezers[freezerId]
+	if !ok {
+		var err error
+		if freezer, err = h.store.GetFreezer(context.Background(), freezerId); err != nil {
+			return freezer, FreezerRoom{}, err
+		}
+		freezers[freezerId] = freezer
+	}
+
+	room, ok := rooms[freezer.FreezerLocationId]
+	if !ok {
+		var err error
+		if room, err = h.store.GetRoom(context.Background(), freezer.FreezerLocationId); err != nil {
+			return freezer, room, err
+		}
+		rooms[freezer.FreezerLocationId] = room
+	}
+	return freezer, room, nil
+}
+
+// writeLabels renders items in the requested format as a download.
+func writeLabels(w http.ResponseWriter, opts labelOptions, name string, items []labelItem) {
+	if len(items) == 0 {
+		writeError(w, http.StatusNotFound, CodeNotFound, "Nothing to label")
+		return
+	}
+
+	var body []byte
+	var contentType string
+	var err error
+
+	switch opts.Format {
+	case "pdf":
+		contentType = "application/pdf"
+		body, err = renderLabelsPDF(opts, items)
+	case "svg":
+		contentType = "image/svg+xml"
+		body, err = renderLabelsSVG(opts, items)
+	case "zpl":
+		// sent to the printer as is, so plain text
+		contentType = "text/plain; charset=utf-8"
+		body, err = renderLabelsZPL(opts, items)
+	}
+
+	if err != nil {
+		logger.LogError("Label rendering failed: " + err.Error())
+		writeError(w, http.StatusInternalServerError, CodeLabelFailed, "Could not render labels: "+err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+"."+opts.Format+`"`)
+	w.Write(body)
+}
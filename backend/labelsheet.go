@@ -0,0 +1,280 @@
+package freezerinv
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"math"
+	"strings"
+
+	"github.com/boombuler/barcode"
+	"github.com/boombuler/barcode/code128"
+	"github.com/boombuler/barcode/qr"
+	"github.com/jung-kurt/gofpdf"
+)
+
+const (
+	// sheetMargin and sheetGap space labels tiled onto a sheet, in mm
+	sheetMargin = 10.0
+	sheetGap    = 2.0
+	// minLineHeight is the smallest text we print, in mm
+	minLineHeight = 1.4
+	maxLineHeight = 4.0
+	mmPerPoint    = 25.4 / 72
+)
+
+// barcodeModules encodes code as a grid of dark modules. Code128 is a single
+// row, stretched to the bar height when drawn.
+func barcodeModules(symbology string, code string) ([][]bool, error) {
+	var bc barcode.Barcode
+	var err error
+	if symbology == "code128" {
+		bc, err = code128.Encode(code)
+	} else {
+		bc, err = qr.Encode(code, qr.M, qr.Auto)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := bc.Bounds()
+	modules := make([][]bool, bounds.Dy())
+	for y := range modules {
+		modules[y] = make([]bool, bounds.Dx())
+		for x := range modules[y] {
+			r, _, _, _ := bc.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			modules[y][x] = r < 0x8000
+		}
+	}
+	return modules, nil
+}
+
+// labelLayout is where the parts of one label go, in mm from its top left.
+type labelLayout struct {
+	modules              [][]bool
+	barX, barY           float64
+	moduleW, moduleH     float64
+	textX, textY         float64
+	lineHeight, fontSize float64
+	lines                []string
+}
+
+// layoutLabel puts a QR code on the left with the text beside it, or a
+// Code128 bar across the top with the text below.
+func layoutLabel(opts labelOptions, item labelItem) (labelLayout, error) {
+	modules, err := barcodeModules(opts.Symbology, item.Code)
+	if err != nil {
+		return labelLayout{}, err
+	}
+
+	w, h := opts.Size.Width, opts.Size.Height
+	pad := math.Min(1.5, h*0.08)
+	l := labelLayout{modules: modules, barX: pad, barY: pad}
+
+	var textW, textH float64
+	if opts.Symbology == "code128" {
+		barH := (h - 2*pad) * 0.5
+		l.moduleW = (w - 2*pad) / float64(len(modules[0]))
+		l.moduleH = barH
+		l.textX = pad
+		l.textY = pad + barH + pad/2
+		textW = w - 2*pad
+		textH = h - l.textY - pad
+	} else {
+		side := h - 2*pad
+		l.moduleW = side / float64(len(modules[0]))
+		l.moduleH = side / float64(len(modules))
+		l.textX = 2*pad + side
+		l.textY = pad
+		textW = w - l.textX - pad
+		textH = h - 2*pad
+	}
+
+	// small labels keep only the first lines
+	lines := item.Lines
+	if fit := int(textH / minLineHeight); fit < len(lines) {
+		lines = lines[:fit]
+	}
+	if len(lines) == 0 || textW <= 0 {
+		return l, nil
+	}
+
+	l.lineHeight = math.Min(maxLineHeight, textH/float64(len(lines)))
+	l.fontSize = l.lineHeight * 0.8
+	// a rough average glyph width, enough to keep text off the edge
+	maxChars := int(textW / (l.fontSize * 0.55))
+	for _, line := range lines {
+		if runes := []rune(line); len(runes) > maxChars {
+			line = string(runes[:max(maxChars-1, 0)]) + "…"
+		}
+		l.lines = append(l.lines, line)
+	}
+	return l, nil
+}
+
+// darkRuns calls draw once per horizontal run of dark modules.
+func (l labelLayout) darkRuns(draw func(x, y, w, h float64)) {
+	for y, row := range l.modules {
+		for x := 0; x < len(row); x++ {
+			if !row[x] {
+				continue
+			}
+			start := x
+			for x < len(row) && row[x] {
+				x++
+			}
+			draw(l.barX+float64(start)*l.moduleW, l.barY+float64(y)*l.moduleH, float64(x-start)*l.moduleW, l.moduleH)
+		}
+	}
+}
+
+// labelSpot is where a label lands: which page and its top left on it.
+type labelSpot struct {
+	page int
+	x, y float64
+}
+
+// placeLabels tiles count labels onto the sheet, or one per page without one.
+func placeLabels(opts labelOptions, count int) (LabelSize, []labelSpot, error) {
+	spots := make([]labelSpot, count)
+	if opts.Sheet == nil {
+		for i := range spots {
+			spots[i].page = i
+		}
+		return opts.Size, spots, nil
+	}
+
+	cols := int((opts.Sheet.Width - 2*sheetMargin + sheetGap) / (opts.Size.Width + sheetGap))
+	rows := int((opts.Sheet.Height - 2*sheetMargin + sheetGap) / (opts.Size.Height + sheetGap))
+	if cols < 1 || rows < 1 {
+		return *opts.Sheet, nil, errors.New("the label does not fit on the sheet")
+	}
+
+	for i := range spots {
+		n := i % (cols * rows)
+		spots[i] = labelSpot{
+			page: i / (cols * rows),
+			x:    sheetMargin + float64(n%cols)*(opts.Size.Width+sheetGap),
+			y:    sheetMargin + float64(n/cols)*(opts.Size.Height+sheetGap),
+		}
+	}
+	return *opts.Sheet, spots, nil
+}
+
+func renderLabelsPDF(opts labelOptions, items []labelItem) ([]byte, error) {
+	page, spots, err := placeLabels(opts, len(items))
+	if err != nil {
+		return nil, err
+	}
+
+	pdf := gofpdf.NewCustom(&gofpdf.InitType{UnitStr: "mm", Size: gofpdf.SizeType{Wd: page.Width, Ht: page.Height}})
+	pdf.SetMargins(0, 0, 0)
+	pdf.SetAutoPageBreak(false, 0)
+	pdf.SetFillColor(0, 0, 0)
+	translate := pdf.UnicodeTranslatorFromDescriptor("")
+
+	for i, item := range items {
+		l, err := layoutLabel(opts, item)
+		if err != nil {
+			return nil, err
+		}
+		spot := spots[i]
+		if i == 0 || spot.page != spots[i-1].page {
+			pdf.AddPage()
+		}
+
+		l.darkRuns(func(x, y, w, h float64) {
+			pdf.Rect(spot.x+x, spot.y+y, w, h, "F")
+		})
+		pdf.SetFont("Helvetica", "", l.fontSize/mmPerPoint)
+		for n, line := range l.lines {
+			// Text takes the baseline
+			pdf.Text(spot.x+l.textX, spot.y+l.textY+float64(n)*l.lineHeight+l.fontSize, translate(line))
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := pdf.Output(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// renderLabelsSVG draws the pages one above the other in a single document.
+func renderLabelsSVG(opts labelOptions, items []labelItem) ([]byte, error) {
+	page, spots, err := placeLabels(opts, len(items))
+	if err != nil {
+		return nil, err
+	}
+
+	pages := spots[len(spots)-1].page + 1
+	height := float64(pages)*page.Height + float64(pages-1)*sheetGap
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%.2fmm" height="%.2fmm" viewBox="0 0 %.2f %.2f">`+"\n", page.Width, height, page.Width, height)
+	for p := 0; p < pages; p++ {
+		fmt.Fprintf(&buf, `<rect x="0" y="%.2f" width="%.2f" height="%.2f" fill="#fff" stroke="#ccc" stroke-width="0.1"/>`+"\n", float64(p)*(page.Height+sheetGap), page.Width, page.Height)
+	}
+
+	for i, item := range items {
+		l, err := layoutLabel(opts, item)
+		if err != nil {
+			return nil, err
+		}
+		spot := spots[i]
+		x0 := spot.x
+		y0 := spot.y + float64(spot.page)*(page.Height+sheetGap)
+
+		var path strings.Builder
+		l.darkRuns(func(x, y, w, h float64) {
+			fmt.Fprintf(&path, "M%.3f %.3fh%.3fv%.3fh%.3fz", x0+x, y0+y, w, h, -w)
+		})
+		fmt.Fprintf(&buf, `<path d="%s" fill="#000"/>`+"\n", path.String())
+
+		for n, line := range l.lines {
+			fmt.Fprintf(&buf, `<text x="%.2f" y="%.2f" font-family="Helvetica, Arial, sans-serif" font-size="%.2f">%s</text>`+"\n",
+				x0+l.textX, y0+l.textY+float64(n)*l.lineHeight+l.fontSize, l.fontSize, html.EscapeString(line))
+		}
+	}
+	buf.WriteString("</svg>\n")
+	return buf.Bytes(), nil
+}
+
+// zplEscape hex-escapes the characters ZPL treats as commands, for use
+// after ^FH\.
+func zplEscape(s string) string {
+	return strings.NewReplacer(`\`, `\5C`, "^", `\5E`, "~", `\7E`).Replace(s)
+}
+
+// renderLabelsZPL writes one ^XA...^XZ format per label. The printer draws
+// the barcode itself, we only size it to the space the layout gives it.
+func renderLabelsZPL(opts labelOptions, items []labelItem) ([]byte, error) {
+	dots := float64(opts.Dpi) / 25.4
+	d := func(mm float64) int { return int(math.Round(mm * dots)) }
+
+	var buf bytes.Buffer
+	for _, item := range items {
+		l, err := layoutLabel(opts, item)
+		if err != nil {
+			return nil, err
+		}
+
+		fmt.Fprintf(&buf, "^XA\n^CI28\n^PW%d\n^LL%d\n", d(opts.Size.Width), d(opts.Size.Height))
+
+		cols := len(l.modules[0])
+		if opts.Symbology == "code128" {
+			moduleDots := min(max(d(l.moduleW*float64(cols))/cols, 1), 10)
+			fmt.Fprintf(&buf, "^FO%d,%d^BY%d^BCN,%d,N,N,N^FD%s^FS\n", d(l.barX), d(l.barY), moduleDots, d(l.moduleH), item.Code)
+		} else {
+			magnification := min(max(d(l.moduleW*float64(cols))/cols, 1), 10)
+			fmt.Fprintf(&buf, "^FO%d,%d^BQN,2,%d^FDMA,%s^FS\n", d(l.barX), d(l.barY), magnification, item.Code)
+		}
+
+		for n, line := range l.lines {
+			fmt.Fprintf(&buf, "^FO%d,%d^A0N,%d,%d^FH\\^FD%s^FS\n", d(l.textX), d(l.textY+float64(n)*l.lineHeight), d(l.fontSize), d(l.fontSize), zplEscape(line))
+		}
+		buf.WriteString("^XZ\n")
+	}
+	return buf.Bytes(), nil
+}
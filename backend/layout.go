@@ -0,0 +1,201 @@
+package freezerinv
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"gitlab.com/UrsusArcTech/logger"
+)
+
+// FreezerLayout describes how boxes are arranged in a freezer. Racks and
+// drawers are optional subdivisions of a shelf.
+type FreezerLayout struct {
+	ShelfCount     int    `json:"shelf_count"`
+	ShelfLabel     string `json:"shelf_label"`
+	RacksPerShelf  *int   `json:"racks_per_shelf"`
+	DrawersPerRack *int   `json:"drawers_per_rack"`
+	// BoxesPerSlot is how many boxes fit in the smallest subdivision: a
+	// drawer, a rack, or a shelf. Nil when nobody has counted.
+	BoxesPerSlot *int `json:"boxes_per_slot"`
+}
+
+const (
+	maxLayoutSize   = 50
+	maxBoxesPerSlot = 1000
+)
+
+// defaultLayout matches the five shelf uprights the UI used to assume.
+var defaultLayout = FreezerLayout{ShelfCount: 5, ShelfLabel: "Shelf"}
+
+func (l FreezerLayout) validate() *ApiError {
+	invalid := func(field string, message string) *ApiError {
+		return &ApiError{Status: http.StatusBadRequest, Code: CodeValidationFailed, Message: message, Field: field}
+	}
+
+	switch {
+	case l.ShelfCount < 1 || l.ShelfCount > maxLayoutSize:
+		return invalid("shelf_count", fmt.Sprintf("Shelf count must be between 1 and %d", maxLayoutSize))
+	case strings.TrimSpace(l.ShelfLabel) == "":
+		return invalid("shelf_label", "Shelf label cannot be empty")
+	case l.RacksPerShelf != nil && (*l.RacksPerShelf < 1 || *l.RacksPerShelf > maxLayoutSize):
+		return invalid("racks_per_shelf", fmt.Sprintf("Racks per shelf must be between 1 and %d", maxLayoutSize))
+	case l.DrawersPerRack != nil && (*l.DrawersPerRack < 1 || *l.DrawersPerRack > maxLayoutSize):
+		return invalid("drawers_per_rack", fmt.Sprintf("Drawers per rack must be between 1 and %d", maxLayoutSize))
+	case l.DrawersPerRack != nil && l.RacksPerShelf == nil:
+		return invalid("drawers_per_rack", "Drawers need racks to go in, set racks per shelf first")
+	case l.BoxesPerSlot != nil && (*l.BoxesPerSlot < 1 || *l.BoxesPerSlot > maxBoxesPerSlot):
+		return invalid("boxes_per_slot", fmt.Sprintf("Boxes per slot must be between 1 and %d", maxBoxesPerSlot))
+	}
+	return nil
+}
+
+// checkPlacement reports whether a box can sit at shelf/rack/drawer in this
+// layout. A box may sit directly on a shelf even when the shelf has racks.
+func (l FreezerLayout) checkPlacement(shelf int, rack *int, drawer *int) *ApiError {
+	invalid := func(field string, message string) *ApiError {
+		return &ApiError{Status: http.StatusBadRequest, Code: CodeValidationFailed, Message: message, Field: field}
+	}
+
+	if shelf < 1 || shelf > l.ShelfCount {
+		return invalid("shelf", fmt.Sprintf("%s must be between 1 and %d in this freezer", l.ShelfLabel, l.ShelfCount))
+	}
+	if rack != nil {
+		if l.RacksPerShelf == nil {
+			return invalid("rack", "This freezer has no racks")
+		}
+		if *rack < 1 || *rack > *l.RacksPerShelf {
+			return invalid("rack", fmt.Sprintf("Rack must be between 1 and %d in this freezer", *l.RacksPerShelf))
+		}
+	}
+	if drawer != nil {
+		if rack == nil {
+			return invalid("drawer", "A drawer needs a rack")
+		}
+		if l.DrawersPerRack == nil {
+			return invalid("drawer", "This freezer has no drawers")
+		}
+		if *drawer < 1 || *drawer > *l.DrawersPerRack {
+			return invalid("drawer", fmt.Sprintf("Drawer must be between 1 and %d in this freezer", *l.DrawersPerRack))
+		}
+	}
+	return nil
+}
+
+// checkLayoutFitsBoxes refuses a layout change that would leave boxes on a
+// shelf, rack or drawer that no longer exists.
+func (h *Handlers) checkLayoutFitsBoxes(w http.ResponseWriter, r *http.Request, freezerId int, l FreezerLayout) bool {
+	boxes, err := h.store.ListBoxes(r.Context(), freezerId)
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return false
+	}
+
+	var maxShelf, maxRack, maxDrawer int
+	for _, box := range boxes {
+		maxShelf = max(maxShelf, box.Shelf)
+		if box.Rack != nil {
+			maxRack = max(maxRack, *box.Rack)
+		}
+		if box.Drawer != nil {
+			maxDrawer = max(maxDrawer, *box.Drawer)
+		}
+	}
+
+	conflict := func(field string, message string) bool {
+		writeApiError(w, &ApiError{Status: http.StatusConflict, Code: CodeValidationFailed, Message: message, Field: field})
+		return false
+	}
+
+	if maxShelf > l.ShelfCount {
+		return conflict("shelf_count", fmt.Sprintf("Boxes are stored on %s %d, move them before reducing the shelf count", strings.ToLower(l.ShelfLabel), maxShelf))
+	}
+	if maxRack > 0 && (l.RacksPerShelf == nil || maxRack > *l.RacksPerShelf) {
+		return conflict("racks_per_shelf", fmt.Sprintf("Boxes are stored in rack %d, move them before reducing the racks", maxRack))
+	}
+	if maxDrawer > 0 && (l.DrawersPerRack == nil || maxDrawer > *l.DrawersPerRack) {
+		return conflict("drawers_per_rack", fmt.Sprintf("Boxes are stored in drawer %d, move them before reducing the drawers", maxDrawer))
+	}
+	return true
+}
+
+// slotKey is one drawer, rack or shelf, whichever is the smallest
+// subdivision of the freezer. Rack and drawer are 0 when not used.
+type slotKey struct {
+	Shelf  int
+	Rack   int
+	Drawer int
+}
+
+func slotOf(shelf int, rack *int, drawer *int) slotKey {
+	key := slotKey{Shelf: shelf}
+	if rack != nil {
+		key.Rack = *rack
+	}
+	if drawer != nil {
+		key.Drawer = *drawer
+	}
+	return key
+}
+
+// placement turns a slot back into the nullable rack and drawer of a box.
+func (k slotKey) placement() (shelf int, rack *int, drawer *int) {
+	return k.Shelf, zeroAsNil(k.Rack), zeroAsNil(k.Drawer)
+}
+
+// slots lists every slot in the layout, shelf by shelf.
+func (l FreezerLayout) slots() []slotKey {
+	var keys []slotKey
+	for shelf := 1; shelf <= l.ShelfCount; shelf++ {
+		if l.RacksPerShelf == nil {
+			keys = append(keys, slotKey{Shelf: shelf})
+			continue
+		}
+		for rack := 1; rack <= *l.RacksPerShelf; rack++ {
+			if l.DrawersPerRack == nil {
+				keys = append(keys, slotKey{Shelf: shelf, Rack: rack})
+				continue
+			}
+			for drawer := 1; drawer <= *l.DrawersPerRack; drawer++ {
+				keys = append(keys, slotKey{Shelf: shelf, Rack: rack, Drawer: drawer})
+			}
+		}
+	}
+	return keys
+}
+
+// shelfCapacity is how many boxes fit on one shelf, counting its racks and
+// drawers. Boxes standing loose on a racked shelf count against it too.
+// BoxesPerSlot must be set.
+func (l FreezerLayout) shelfCapacity() int {
+	return *l.BoxesPerSlot * len(l.slots()) / l.ShelfCount
+}
+
+// queryer is the part of the pool and of a transaction the slot counts need.
+type queryer interface {
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+}
+
+// slotOccupancy counts the boxes in each slot of a freezer. Boxes standing
+// on a shelf of a racked freezer are counted under their shelf alone.
+func slotOccupancy(ctx context.Context, q queryer, freezerId int) (map[slotKey]int, error) {
+	rows, err := q.Query(ctx, "SELECT shelf, coalesce(rack, 0), coalesce(drawer, 0), count(*) FROM mgl_freezer_inventory.boxes WHERE freezer_id = $1 GROUP BY 1, 2, 3", freezerId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := map[slotKey]int{}
+	for rows.Next() {
+		var key slotKey
+		var n int
+		if err := rows.Scan(&key.Shelf, &key.Rack, &key.Drawer, &n); err != nil {
+			return nil, err
+		}
+		counts[key] = n
+	}
+	return counts, rows.Err()
+}
@@ -0,0 +1,126 @@
+package freezerinv
+
+import "testing"
+
+func TestValidateLayout(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		layout FreezerLayout
+		field  string
+	}{
+		{"shelves only", FreezerLayout{ShelfCount: 5, ShelfLabel: "Shelf"}, ""},
+		{"racks and drawers", FreezerLayout{ShelfCount: 4, ShelfLabel: "Tier", RacksPerShelf: ptr(3), DrawersPerRack: ptr(6), BoxesPerSlot: ptr(1)}, ""},
+		{"no shelves", FreezerLayout{ShelfCount: 0, ShelfLabel: "Shelf"}, "shelf_count"},
+		{"too many shelves", FreezerLayout{ShelfCount: maxLayoutSize + 1, ShelfLabel: "Shelf"}, "shelf_count"},
+		{"blank label", FreezerLayout{ShelfCount: 5, ShelfLabel: "  "}, "shelf_label"},
+		{"no racks", FreezerLayout{ShelfCount: 5, ShelfLabel: "Shelf", RacksPerShelf: ptr(0)}, "racks_per_shelf"},
+		{"drawers without racks", FreezerLayout{ShelfCount: 5, ShelfLabel: "Shelf", DrawersPerRack: ptr(2)}, "drawers_per_rack"},
+		{"too many boxes", FreezerLayout{ShelfCount: 5, ShelfLabel: "Shelf", BoxesPerSlot: ptr(maxBoxesPerSlot + 1)}, "boxes_per_slot"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			apiErr := c.layout.validate()
+			if c.field == "" {
+				if apiErr != nil {
+					t.Fatalf("refused: %v", apiErr)
+				}
+				return
+			}
+			if apiErr == nil || apiErr.Field != c.field {
+				t.Fatalf("got %v, want %s refused", apiErr, c.field)
+			}
+		})
+	}
+}
+
+func TestCheckPlacement(t *testing.T) {
+	shelves := FreezerLayout{ShelfCount: 3, ShelfLabel: "Shelf"}
+	racks := FreezerLayout{ShelfCount: 3, ShelfLabel: "Shelf", RacksPerShelf: ptr(4)}
+	drawers := FreezerLayout{ShelfCount: 3, ShelfLabel: "Shelf", RacksPerShelf: ptr(4), DrawersPerRack: ptr(2)}
+
+	for _, c := range []struct {
+		name         string
+		layout       FreezerLayout
+		shelf        int
+		rack, drawer *int
+		field        string
+	}{
+		{"on a shelf", shelves, 3, nil, nil, ""},
+		{"shelf 0", shelves, 0, nil, nil, "shelf"},
+		{"past the last shelf", shelves, 4, nil, nil, "shelf"},
+		{"rack without racks", shelves, 1, ptr(1), nil, "rack"},
+		{"in a rack", racks, 2, ptr(4), nil, ""},
+		{"loose on a racked shelf", racks, 2, nil, nil, ""},
+		{"past the last rack", racks, 2, ptr(5), nil, "rack"},
+		{"drawer without drawers", racks, 2, ptr(1), ptr(1), "drawer"},
+		{"in a drawer", drawers, 1, ptr(1), ptr(2), ""},
+		{"drawer without a rack", drawers, 1, nil, ptr(1), "drawer"},
+		{"past the last drawer", drawers, 1, ptr(1), ptr(3), "drawer"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			apiErr := c.layout.checkPlacement(c.shelf, c.rack, c.drawer)
+			if c.field == "" {
+				if apiErr != nil {
+					t.Fatalf("refused: %v", apiErr)
+				}
+				return
+			}
+			if apiErr == nil || apiErr.Code != CodeValidationFailed || apiErr.Field != c.field {
+				t.Fatalf("got %v, want %s refused", apiErr, c.field)
+			}
+		})
+	}
+}
+
+func TestShelfCapacity(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		layout FreezerLayout
+		want   int
+	}{
+		{"shelves", FreezerLayout{ShelfCount: 5, BoxesPerSlot: ptr(8)}, 8},
+		{"racks", FreezerLayout{ShelfCount: 5, RacksPerShelf: ptr(4), BoxesPerSlot: ptr(3)}, 12},
+		{"drawers", FreezerLayout{ShelfCount: 2, RacksPerShelf: ptr(2), DrawersPerRack: ptr(5), BoxesPerSlot: ptr(1)}, 10},
+	} {
+		if got := c.layout.shelfCapacity(); got != c.want {
+			t.Errorf("%s hold %d boxes a shelf, want %d", c.name, got, c.want)
+		}
+	}
+}
+
+func TestCheckRoom(t *testing.T) {
+	shelves := FreezerLayout{ShelfCount: 2, ShelfLabel: "Shelf", BoxesPerSlot: ptr(2)}
+	racks := FreezerLayout{ShelfCount: 2, ShelfLabel: "Shelf", RacksPerShelf: ptr(2), BoxesPerSlot: ptr(2)}
+	drawers := FreezerLayout{ShelfCount: 2, ShelfLabel: "Shelf", RacksPerShelf: ptr(1), DrawersPerRack: ptr(2), BoxesPerSlot: ptr(1)}
+
+	for _, c := range []struct {
+		name      string
+		layout    FreezerLayout
+		occupancy map[slotKey]int
+		key       slotKey
+		full      bool
+	}{
+		{"shelf with room", shelves, map[slotKey]int{{Shelf: 1}: 2}, slotKey{Shelf: 1}, false},
+		{"shelf over", shelves, map[slotKey]int{{Shelf: 1}: 3}, slotKey{Shelf: 1}, true},
+		{"other shelf full", shelves, map[slotKey]int{{Shelf: 1}: 1, {Shelf: 2}: 5}, slotKey{Shelf: 1}, false},
+		{"rack with room", racks, map[slotKey]int{{Shelf: 1, Rack: 1}: 2, {Shelf: 1, Rack: 2}: 1}, slotKey{Shelf: 1, Rack: 1}, false},
+		{"rack over", racks, map[slotKey]int{{Shelf: 1, Rack: 1}: 3}, slotKey{Shelf: 1, Rack: 1}, true},
+		// loose boxes use up the shelf its racks share
+		{"loose boxes fill the shelf", racks, map[slotKey]int{{Shelf: 1}: 3, {Shelf: 1, Rack: 1}: 2}, slotKey{Shelf: 1, Rack: 1}, true},
+		{"loose box on a full shelf", racks, map[slotKey]int{{Shelf: 1}: 1, {Shelf: 1, Rack: 1}: 2, {Shelf: 1, Rack: 2}: 2}, slotKey{Shelf: 1}, true},
+		{"drawer with room", drawers, map[slotKey]int{{Shelf: 1, Rack: 1, Drawer: 1}: 1}, slotKey{Shelf: 1, Rack: 1, Drawer: 1}, false},
+		{"drawer over", drawers, map[slotKey]int{{Shelf: 1, Rack: 1, Drawer: 1}: 2}, slotKey{Shelf: 1, Rack: 1, Drawer: 1}, true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			apiErr := c.layout.checkRoom(c.occupancy, c.key, "F1")
+			if !c.full {
+				if apiErr != nil {
+					t.Fatalf("refused: %v", apiErr)
+				}
+				return
+			}
+			if apiErr == nil || apiErr.Code != CodeOverCapacity {
+				t.Fatalf("got %v, want %s", apiErr, CodeOverCapacity)
+			}
+		})
+	}
+}
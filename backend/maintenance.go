@@ -0,0 +1,645 @@
+package freezerinv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"gitlab.com/UrsusArcTech/logger"
+)
+
+const (
+	maintenanceCalibration = "calibration"
+
+	maxAttachmentBytes = 10 << 20
+)
+
+// maintenanceKinds are the entries the log takes, matching the table's check.
+var maintenanceKinds = []string{maintenanceCalibration, "defrost", "repair", "service"}
+
+func isMaintenanceKind(kind string) bool {
+	for _, k := range maintenanceKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+type MaintenanceEntry struct {
+	Id          int                     `json:"id"`
+	FreezerId   int                     `json:"freezer_id"`
+	Kind        string                  `json:"kind"`
+	PerformedAt time.Time               `json:"performed_at"`
+	PerformedBy *string                 `json:"performed_by"`
+	Notes       *string                 `json:"notes"`
+	CreatedBy   *string                 `json:"created_by"`
+	Attachments []MaintenanceAttachment `json:"attachments"`
+}
+
+// MaintenanceAttachment describes a stored file; the content is downloaded
+// separately.
+type MaintenanceAttachment struct {
+	Id            int       `json:"id"`
+	MaintenanceId int       `json:"maintenance_id"`
+	Filename      string    `json:"filename"`
+	ContentType   string    `json:"content_type"`
+	SizeBytes     int       `json:"size_bytes"`
+	UploadedBy    *string   `json:"uploaded_by"`
+	UploadedAt    time.Time `json:"uploaded_at"`
+}
+
+type maintenanceRequest struct {
+	Kind string `json:"kind"`
+	// PerformedAt defaults to now
+	PerformedAt *time.Time `json:"performed_at"`
+	// PerformedBy defaults to the session user
+	PerformedBy *string `json:"performed_by"`
+	Notes       *string `json:"notes"`
+}
+
+type MaintenanceInterval struct {
+	Id           int    `json:"id"`
+	Model        string `json:"model"`
+	Kind         string `json:"kind"`
+	IntervalDays int    `json:"interval_days"`
+}
+
+// MaintenanceDue is one kind of maintenance a freezer is due for. LastDone
+// and DueAt are nil when it has never been done, which counts as overdue.
+type MaintenanceDue struct {
+	FreezerId    int        `json:"freezer_id"`
+	FreezerName  string     `json:"freezer_name"`
+	Model        string     `json:"model"`
+	Lab          string     `json:"lab"`
+	Floor        string     `json:"floor"`
+	Kind         string     `json:"kind"`
+	IntervalDays int        `json:"interval_days"`
+	LastDone     *time.Time `json:"last_done"`
+	DueAt        *time.Time `json:"due_at"`
+	Overdue      bool       `json:"overdue"`
+	DaysOverdue  int        `json:"days_overdue"`
+}
+
+// syncLastCalibrated sets the freezer's last_calibrated to its latest
+// calibration entry. forwardOnly keeps a newer value set by hand, for when
+// an old certificate is being backfilled.
+func syncLastCalibrated(ctx context.Context, tx pgx.Tx, r *http.Request, freezerId int, forwardOnly bool) error {
+	set := "last_calibrated = latest.performed_at"
+	where := "id = $1 AND latest.performed_at IS NOT NULL AND last_calibrated IS DISTINCT FROM latest.performed_at"
+	if forwardOnly {
+		where += " AND (last_calibrated IS NULL OR last_calibrated < latest.performed_at)"
+	}
+	latest := "(SELECT max(performed_at) AS performed_at FROM " + maintenanceTable + " WHERE freezer_id = $1 AND kind = '" + maintenanceCalibration + "') latest"
+
+	// snapshotUpdate has no room for a second FROM item, so join it in by hand
+	query := "WITH old AS (SELECT t.ctid AS row_id, to_jsonb(t) AS doc FROM " + freezerTable + " t, " + latest + " WHERE t." + where + " FOR UPDATE OF t) " +
+		"UPDATE " + freezerTable + " t SET " + set + " FROM old, " + latest + " WHERE t.ctid = old.row_id RETURNING old.doc, to_jsonb(t)"
+	_, err := auditedQueryTx(ctx, tx, r, freezerTable, "update", query, freezerId)
+	return err
+}
+
+// restoreLastCalibrated undoes what a deleted calibration entry did to the
+// freezer's last_calibrated once no calibration entries are left, putting
+// back the value from before the entry set it, as the audit log recorded it.
+// A value set by hand since, or one the entry never set, is left alone.
+func restoreLastCalibrated(ctx context.Context, tx pgx.Tx, r *http.Request, freezerId int, performedAt time.Time) error {
+	// performed_at is stored in last_calibrated with the session time zone
+	setValue := "$2::timestamptz::timestamp"
+	restored := "(SELECT (a.before->>'last_calibrated')::timestamp AS value FROM mgl_freezer_inventory.audit_log a WHERE a.table_name = '" + freezerTable + "' AND a.action = 'update' AND a.freezer_id = $1" +
+		" AND (a.after->>'last_calibrated')::timestamp = " + setValue + " AND a.before->'last_calibrated' IS DISTINCT FROM a.after->'last_calibrated' ORDER BY a.occurred_at DESC LIMIT 1) restored"
+	where := "t.id = $1 AND t.last_calibrated = " + setValue + " AND NOT EXISTS (SELECT 1 FROM " + maintenanceTable + " WHERE freezer_id = $1 AND kind = '" + maintenanceCalibration + "')"
+
+	query := "WITH old AS (SELECT t.ctid AS row_id, to_jsonb(t) AS doc FROM " + freezerTable + " t WHERE " + where + " FOR UPDATE OF t) " +
+		"UPDATE " + freezerTable + " t SET last_calibrated = restored.value FROM old, " + restored + " WHERE t.ctid = old.row_id RETURNING old.doc, to_jsonb(t)"
+	_, err := auditedQueryTx(ctx, tx, r, freezerTable, "update", query, freezerId, performedAt)
+	return err
+}
+
+// addMaintenance records maintenance on a freezer.
+func (h *Handlers) addMaintenance(w http.ResponseWriter, r *http.Request, freezerId int, req maintenanceRequest) (MaintenanceEntry, bool) {
+	var entry MaintenanceEntry
+
+	if !isMaintenanceKind(req.Kind) {
+		writeValidationError(w, "kind", "Unknown kind "+req.Kind+", use "+strings.Join(maintenanceKinds, ", "))
+		return entry, false
+	}
+	performedAt := time.Now()
+	if req.PerformedAt != nil {
+		if req.PerformedAt.After(time.Now().Add(readingClockSkew)) {
+			writeValidationError(w, "performed_at", "performed_at is in the future")
+			return entry, false
+		}
+		performedAt = *req.PerformedAt
+	}
+	performedBy := SessionUser(r)
+	if req.PerformedBy != nil {
+		performedBy = strings.TrimSpace(*req.PerformedBy)
+	}
+
+	if _, err := h.store.GetFreezer(context.Background(), freezerId); err == errFreezerNotFound {
+		writeError(w, http.StatusNotFound, CodeFreezerNotFound, err.Error())
+		return entry, false
+	} else if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return entry, false
+	}
+	if !h.requireRole(w, r, RoleTechnician, freezerId) {
+		return entry, false
+	}
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		writeDbError(w, err)
+		return entry, false
+	}
+	defer tx.Rollback(ctx)
+
+	query := snapshotInsert(maintenanceTable, "freezer_id, kind, performed_at, performed_by, notes, created_by", "$1, $2, $3, $4, $5, $6")
+	createdBy := SessionUser(r)
+	args := []interface{}{freezerId, req.Kind, performedAt, emptyAsNil(&performedBy), emptyAsNil(req.Notes), emptyAsNil(&createdBy)}
+	after, err := auditedQueryTx(ctx, tx, r, maintenanceTable, "insert", query, args...)
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return entry, false
+	}
+
+	if req.Kind == maintenanceCalibration {
+		if err := syncLastCalibrated(ctx, tx, r, freezerId, true); err != nil {
+			logger.LogError("Database error: " + err.Error())
+			writeDbError(w, err)
+			return entry, false
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		writeDbError(w, err)
+		return entry, false
+	}
+
+	json.Unmarshal(after[0], &entry)
+	entry.Attachments = []MaintenanceAttachment{}
+	return entry, true
+}
+
+// deleteMaintenance removes a mistaken entry and its attachments. Removing a
+// calibration moves last_calibrated back to the one before it, or to what it
+// was before any were logged when it was the only one.
+func (h *Handlers) deleteMaintenance(w http.ResponseWriter, r *http.Request, entryId int) bool {
+	var freezerId int
+	var kind string
+	var performedAt time.Time
+	err := db.QueryRow(context.Background(), "SELECT freezer_id, kind, performed_at FROM "+maintenanceTable+" WHERE id = $1", entryId).Scan(&freezerId, &kind, &performedAt)
+	if err == pgx.ErrNoRows {
+		writeError(w, http.StatusNotFound, CodeNotFound, fmt.Sprintf("Maintenance entry %d not found", entryId))
+		return false
+	}
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return false
+	}
+	if !h.requireRole(w, r, RoleManager, freezerId) {
+		return false
+	}
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		writeDbError(w, err)
+		return false
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := auditedQueryTx(ctx, tx, r, maintenanceTable, "delete", snapshotDelete(maintenanceTable, "id = $1"), entryId); err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return false
+	}
+	if kind == maintenanceCalibration {
+		if err := syncLastCalibrated(ctx, tx, r, freezerId, false); err != nil {
+			logger.LogError("Database error: " + err.Error())
+			writeDbError(w, err)
+			return false
+		}
+		if err := restoreLastCalibrated(ctx, tx, r, freezerId, performedAt); err != nil {
+			logger.LogError("Database error: " + err.Error())
+			writeDbError(w, err)
+			return false
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		writeDbError(w, err)
+		return false
+	}
+	return true
+}
+
+// listMaintenance returns a freezer's log, newest first, with the files
+// attached to each entry.
+func listMaintenance(freezerId int, kind string) ([]MaintenanceEntry, error) {
+	query := "SELECT id, freezer_id, kind, performed_at, performed_by, notes, created_by FROM " + maintenanceTable + " WHERE freezer_id = $1"
+	args := []interface{}{freezerId}
+	if kind != "" {
+		args = append(args, kind)
+		query += " AND kind = $2"
+	}
+	query += " ORDER BY performed_at DESC, id DESC"
+
+	rows, err := db.Query(context.Background(), query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []MaintenanceEntry{}
+	index := map[int]int{}
+
+	for rows.Next() {
+		var entry MaintenanceEntry
+
+		err := rows.Scan(
+			&entry.Id,
+			&entry.FreezerId,
+			&entry.Kind,
+			&entry.PerformedAt,
+			&entry.PerformedBy,
+			&entry.Notes,
+			&entry.CreatedBy,
+		)
+
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		entry.Attachments = []MaintenanceAttachment{}
+		index[entry.Id] = len(entries)
+		entries = append(entries, entry)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	query = "SELECT a.id, a.maintenance_id, a.filename, a.content_type, a.size_bytes, a.uploaded_by, a.uploaded_at FROM " + attachmentsTable + " a JOIN " + maintenanceTable + " m ON m.id = a.maintenance_id WHERE m.freezer_id = $1 ORDER BY a.uploaded_at"
+	rows, err = db.Query(context.Background(), query, freezerId)
+	if err != nil {
+		return nil, err
+	}
+	attachments, err := pgx.CollectRows(rows, pgx.RowToStructByPos[MaintenanceAttachment])
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range attachments {
+		if i, ok := index[a.MaintenanceId]; ok {
+			entries[i].Attachments = append(entries[i].Attachments, a)
+		}
+	}
+	return entries, nil
+}
+
+// addAttachment stores a file uploaded as the multipart "file" field. Files
+// are not written to the audit log, the table keeps who uploaded them.
+func (h *Handlers) addAttachment(w http.ResponseWriter, r *http.Request, entryId int) (MaintenanceAttachment, bool) {
+	var attachment MaintenanceAttachment
+
+	var freezerId int
+	err := db.QueryRow(context.Background(), "SELECT freezer_id FROM "+maintenanceTable+" WHERE id = $1", entryId).Scan(&freezerId)
+	if err == pgx.ErrNoRows {
+		writeError(w, http.StatusNotFound, CodeNotFound, fmt.Sprintf("Maintenance entry %d not found", entryId))
+		return attachment, false
+	}
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return attachment, false
+	}
+	if !h.requireRole(w, r, RoleTechnician, freezerId) {
+		return attachment, false
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxAttachmentBytes+1<<20)
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		writeValidationError(w, "file", "Upload the attachment as the file field: "+err.Error())
+		return attachment, false
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxAttachmentBytes+1))
+	if err != nil {
+		writeValidationError(w, "file", "Could not read the upload: "+err.Error())
+		return attachment, false
+	}
+	if len(data) > maxAttachmentBytes {
+		writeValidationError(w, "file", fmt.Sprintf("Attachments can be at most %d MB", maxAttachmentBytes>>20))
+		return attachment, false
+	}
+	if len(data) == 0 {
+		writeValidationError(w, "file", "The file is empty")
+		return attachment, false
+	}
+
+	filename := filepath.Base(header.Filename)
+	contentType := header.Header.Get("Content-Type")
+	if _, _, err := mime.ParseMediaType(contentType); err != nil || contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+
+	uploadedBy := SessionUser(r)
+	query := "INSERT INTO " + attachmentsTable + " (maintenance_id, filename, content_type, size_bytes, data, uploaded_by) VALUES ($1, $2, $3, $4, $5, $6) " +
+		"RETURNING id, maintenance_id, filename, content_type, size_bytes, uploaded_by, uploaded_at"
+	err = db.QueryRow(context.Background(), query, entryId, filename, contentType, len(data), data, emptyAsNil(&uploadedBy)).Scan(
+		&attachment.Id,
+		&attachment.MaintenanceId,
+		&attachment.Filename,
+		&attachment.ContentType,
+		&attachment.SizeBytes,
+		&attachment.UploadedBy,
+		&attachment.UploadedAt,
+	)
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return attachment, false
+	}
+	return attachment, true
+}
+
+// setMaintenanceInterval adds or replaces how often a model needs a kind of
+// maintenance. Zero days removes the interval.
+func (h *Handlers) setMaintenanceInterval(w http.ResponseWriter, r *http.Request, interval MaintenanceInterval) (*MaintenanceInterval, bool) {
+	interval.Model = strings.TrimSpace(interval.Model)
+	if interval.Model == "" {
+		writeValidationError(w, "model", "Missing required fields: model")
+		return nil, false
+	}
+	if !isMaintenanceKind(interval.Kind) {
+		writeValidationError(w, "kind", "Unknown kind "+interval.Kind+", use "+strings.Join(maintenanceKinds, ", "))
+		return nil, false
+	}
+	if interval.IntervalDays < 0 {
+		writeValidationError(w, "interval_days", "interval_days cannot be negative")
+		return nil, false
+	}
+	// intervals apply to every room, so only lab-wide managers set them
+	if !h.requireRoomRole(w, r, RoleManager, nil) {
+		return nil, false
+	}
+
+	if interval.IntervalDays == 0 {
+		_, err := auditedExec(r, intervalsTable, "delete", snapshotDelete(intervalsTable, "lower(model) = lower($1) AND kind = $2"), interval.Model, interval.Kind)
+		if err != nil {
+			logger.LogError("Database error: " + err.Error())
+			writeDbError(w, err)
+			return nil, false
+		}
+		return nil, true
+	}
+
+	query := snapshotUpdate(intervalsTable, "interval_days = $3", "lower(model) = lower($1) AND kind = $2")
+	after, err := auditedQuery(r, intervalsTable, "update", query, interval.Model, interval.Kind, interval.IntervalDays)
+	if err == nil && len(after) == 0 {
+		query = snapshotInsert(intervalsTable, "model, kind, interval_days", "$1, $2, $3")
+		after, err = auditedQuery(r, intervalsTable, "insert", query, interval.Model, interval.Kind, interval.IntervalDays)
+	}
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return nil, false
+	}
+
+	json.Unmarshal(after[0], &interval)
+	return &interval, true
+}
+
+func listMaintenanceIntervals() ([]MaintenanceInterval, error) {
+	rows, err := db.Query(context.Background(), "SELECT id, model, kind, interval_days FROM "+intervalsTable+" ORDER BY lower(model), kind")
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByPos[MaintenanceInterval])
+}
+
+// maintenanceDue lists what active freezers are due for within the given
+// number of days, most overdue first. A calibration never logged falls back
+// to the freezer's last_calibrated.
+func maintenanceDue(freezerId *int, withinDays int) ([]MaintenanceDue, error) {
+	query := "SELECT f.id, f.name, f.model, fl.lab, fl.floor, i.kind, i.interval_days, last.performed_at " +
+		"FROM mgl_freezer_inventory.freezer f " +
+		"JOIN mgl_freezer_inventory.freezer_locations fl ON fl.id = f.freezer_location_id " +
+		"JOIN " + intervalsTable + " i ON lower(i.model) = lower(f.model) " +
+		"LEFT JOIN LATERAL (SELECT coalesce(max(m.performed_at), CASE WHEN i.kind = '" + maintenanceCalibration + "' THEN f.last_calibrated::timestamptz END) AS performed_at " +
+		"FROM " + maintenanceTable + " m WHERE m.freezer_id = f.id AND m.kind = i.kind) last ON true " +
+		"WHERE NOT f.retired AND (last.performed_at IS NULL OR last.performed_at + make_interval(days => i.interval_days) < now() + make_interval(days => $1))"
+	args := []interface{}{withinDays}
+	if freezerId != nil {
+		args = append(args, *freezerId)
+		query += " AND f.id = $2"
+	}
+	query += " ORDER BY last.performed_at + make_interval(days => i.interval_days) NULLS FIRST, f.name"
+
+	logger.LogMessage(query)
+	rows, err := db.Query(context.Background(), query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	results := []MaintenanceDue{}
+
+	for rows.Next() {
+		var due MaintenanceDue
+
+		err := rows.Scan(
+			&due.FreezerId,
+			&due.FreezerName,
+			&due.Model,
+			&due.Lab,
+			&due.Floor,
+			&due.Kind,
+			&due.IntervalDays,
+			&due.LastDone,
+		)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if due.LastDone == nil {
+			due.Overdue = true
+		} else {
+			dueAt := due.LastDone.AddDate(0, 0, due.IntervalDays)
+			due.DueAt = &dueAt
+			due.Overdue = dueAt.Before(now)
+			if due.Overdue {
+				due.DaysOverdue = int(now.Sub(dueAt).Hours() / 24)
+			}
+		}
+		results = append(results, due)
+	}
+	return results, rows.Err()
+}
+
+func (h *Handlers) ApiListMaintenance(w http.ResponseWriter, r *http.Request) {
+	freezerId, ok := pathInt(w, r, "id")
+	if !ok {
+		return
+	}
+	kind := r.URL.Query().Get("kind")
+	if kind != "" && !isMaintenanceKind(kind) {
+		writeValidationError(w, "kind", "Unknown kind "+kind+", use "+strings.Join(maintenanceKinds, ", "))
+		return
+	}
+	if _, err := h.store.GetFreezer(context.Background(), freezerId); err == errFreezerNotFound {
+		writeError(w, http.StatusNotFound, CodeFreezerNotFound, err.Error())
+		return
+	} else if err != nil {
+		writeDbError(w, err)
+		return
+	}
+
+	entries, err := listMaintenance(freezerId, kind)
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+func (h *Handlers) ApiAddMaintenance(w http.ResponseWriter, r *http.Request) {
+	freezerId, ok := pathInt(w, r, "id")
+	if !ok {
+		return
+	}
+	var req maintenanceRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if entry, ok := h.addMaintenance(w, r, freezerId, req); ok {
+		writeJSON(w, http.StatusCreated, entry)
+	}
+}
+
+func (h *Handlers) ApiDeleteMaintenance(w http.ResponseWriter, r *http.Request) {
+	entryId, ok := pathInt(w, r, "id")
+	if !ok {
+		return
+	}
+	if h.deleteMaintenance(w, r, entryId) {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (h *Handlers) ApiAddMaintenanceAttachment(w http.ResponseWriter, r *http.Request) {
+	entryId, ok := pathInt(w, r, "id")
+	if !ok {
+		return
+	}
+	if attachment, ok := h.addAttachment(w, r, entryId); ok {
+		writeJSON(w, http.StatusCreated, attachment)
+	}
+}
+
+// ApiGetMaintenanceAttachment downloads a stored file.
+func (h *Handlers) ApiGetMaintenanceAttachment(w http.ResponseWriter, r *http.Request) {
+	attachmentId, ok := pathInt(w, r, "id")
+	if !ok {
+		return
+	}
+
+	var freezerId int
+	err := db.QueryRow(context.Background(), "SELECT m.freezer_id FROM "+attachmentsTable+" a JOIN "+maintenanceTable+" m ON m.id = a.maintenance_id WHERE a.id = $1", attachmentId).Scan(&freezerId)
+	if err == pgx.ErrNoRows {
+		writeError(w, http.StatusNotFound, CodeNotFound, fmt.Sprintf("Attachment %d not found", attachmentId))
+		return
+	}
+	if err != nil {
+		writeDbError(w, err)
+		return
+	}
+	// certificates and invoices are only for those who can see the freezer
+	if !h.requireRole(w, r, RoleViewer, freezerId) {
+		return
+	}
+
+	var filename, contentType string
+	var data []byte
+	err = db.QueryRow(context.Background(), "SELECT filename, content_type, data FROM "+attachmentsTable+" WHERE id = $1", attachmentId).Scan(&filename, &contentType, &data)
+	if err != nil {
+		writeDbError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
+
+func ApiListMaintenanceIntervals(w http.ResponseWriter, r *http.Request) {
+	intervals, err := listMaintenanceIntervals()
+	if err != nil {
+		writeDbError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, intervals)
+}
+
+func (h *Handlers) ApiSetMaintenanceInterval(w http.ResponseWriter, r *http.Request) {
+	var req MaintenanceInterval
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	interval, ok := h.setMaintenanceInterval(w, r, req)
+	if !ok {
+		return
+	}
+	if interval == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, http.StatusOK, interval)
+}
+
+// ApiMaintenanceOverdue lists overdue maintenance across active freezers.
+// within=N also lists what falls due in the next N days; freezer narrows it
+// to one freezer.
+func ApiMaintenanceOverdue(w http.ResponseWriter, r *http.Request) {
+	within := 0
+	if s := r.URL.Query().Get("within"); s != "" {
+		v, err := strconv.Atoi(s)
+		if err != nil || v < 0 {
+			writeValidationError(w, "within", "Invalid within: "+s)
+			return
+		}
+		within = v
+	}
+	freezerId, ok := queryOptionalInt(w, r, "freezer")
+	if !ok {
+		return
+	}
+
+	due, err := maintenanceDue(freezerId, within)
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, due)
+}
@@ -0,0 +1,270 @@
+package freezerinv
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"gitlab.com/UrsusArcTech/logger"
+)
+
+// The schema lives in numbered up/down pairs under migrations/, built into
+// the binary. Every up script only creates what is missing, so databases set
+// up by hand before migrations existed can run migrate up as they are.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+var migrationFileName = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+// migrationLockKey is the advisory lock held while a migration runs, so two
+// instances started together do not both apply it.
+const migrationLockKey = 52_411_024
+
+const migrationsTable = "mgl_freezer_inventory.schema_migrations"
+
+type Migration struct {
+	Version int    `json:"version"`
+	Name    string `json:"name"`
+	// AppliedAt is nil while the migration is pending
+	AppliedAt *time.Time `json:"applied_at"`
+	up        string
+	down      string
+}
+
+// loadMigrations reads the embedded scripts in version order. Versions must
+// run 1, 2, 3... with both an up and a down script.
+func loadMigrations() ([]Migration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		match := migrationFileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("migration %s is not named NNNN_name.up.sql or NNNN_name.down.sql", entry.Name())
+		}
+		version, _ := strconv.Atoi(match[1])
+		body, err := migrationFiles.ReadFile("migrations/" + entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d is named both %s and %s", version, m.Name, match[2])
+		}
+		if match[3] == "up" {
+			m.up = string(body)
+		} else {
+			m.down = string(body)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration %d is missing", i+1)
+		}
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both an up and a down script", m.Version, m.Name)
+		}
+	}
+	return migrations, nil
+}
+
+// String is the file name without the direction, e.g. 0003_app_users.
+func (m Migration) String() string {
+	return fmt.Sprintf("%04d_%s", m.Version, m.Name)
+}
+
+func ensureMigrationsTable(ctx context.Context) error {
+	_, err := db.Exec(ctx, `CREATE SCHEMA IF NOT EXISTS mgl_freezer_inventory;
+CREATE TABLE IF NOT EXISTS `+migrationsTable+` (
+    version    integer     PRIMARY KEY,
+    name       text        NOT NULL,
+    applied_at timestamptz NOT NULL DEFAULT now()
+)`)
+	return err
+}
+
+// appliedMigrations maps each applied version to when it ran.
+func appliedMigrations(ctx context.Context) (map[int]time.Time, error) {
+	rows, err := db.Query(ctx, "SELECT version, applied_at FROM "+migrationsTable)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		applied[version] = at
+	}
+	return applied, rows.Err()
+}
+
+// MigrationStatus lists every migration in the binary with when it was
+// applied.
+func MigrationStatus(ctx context.Context) ([]Migration, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	if err := ensureMigrationsTable(ctx); err != nil {
+		return nil, err
+	}
+	applied, err := appliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range migrations {
+		if at, ok := applied[migrations[i].Version]; ok {
+			migrations[i].AppliedAt = &at
+		}
+	}
+	return migrations, nil
+}
+
+// MigrateUp applies every pending migration in order, each in its own
+// transaction, and returns the ones it applied. It stops at the first that
+// fails, leaving the ones before it applied.
+func MigrateUp(ctx context.Context) ([]Migration, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	if err := ensureMigrationsTable(ctx); err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+	for _, m := range migrations {
+		ran, err := runMigration(ctx, m, true)
+		if err != nil {
+			return done, fmt.Errorf("migration %s: %w", m, err)
+		}
+		if ran {
+			logger.LogMessage("Applied migration " + m.String())
+			done = append(done, m)
+		}
+	}
+	return done, nil
+}
+
+// MigrateDown reverts the latest steps applied migrations, newest first. The
+// base schema refuses to be reverted, so it stops there with an error.
+func MigrateDown(ctx context.Context, steps int) ([]Migration, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	if err := ensureMigrationsTable(ctx); err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+	for i := len(migrations) - 1; i >= 0 && len(done) < steps; i-- {
+		m := migrations[i]
+		ran, err := runMigration(ctx, m, false)
+		if err != nil {
+			return done, fmt.Errorf("migration %s: %w", m, err)
+		}
+		if ran {
+			logger.LogMessage("Reverted migration " + m.String())
+			done = append(done, m)
+		}
+	}
+	return done, nil
+}
+
+// runMigration applies (up) or reverts m under the migration lock. It does
+// nothing and returns false when m is already in the wanted state, e.g.
+// because another instance got there first.
+func runMigration(ctx context.Context, m Migration, up bool) (bool, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", migrationLockKey); err != nil {
+		return false, err
+	}
+	var applied bool
+	if err := tx.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM "+migrationsTable+" WHERE version = $1)", m.Version).Scan(&applied); err != nil {
+		return false, err
+	}
+	if applied == up {
+		return false, nil
+	}
+
+	if up {
+		err = execScript(ctx, tx, m.up)
+		if err == nil {
+			_, err = tx.Exec(ctx, "INSERT INTO "+migrationsTable+" (version, name) VALUES ($1, $2)", m.Version, m.Name)
+		}
+	} else {
+		err = execScript(ctx, tx, m.down)
+		if err == nil {
+			_, err = tx.Exec(ctx, "DELETE FROM "+migrationsTable+" WHERE version = $1", m.Version)
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit(ctx)
+}
+
+// execScript runs a whole migration file. Without arguments pgx sends it
+// over the simple protocol, which allows several statements at once.
+func execScript(ctx context.Context, tx pgx.Tx, script string) error {
+	_, err := tx.Exec(ctx, script)
+	return err
+}
+
+// CheckSchemaVersion returns an error when the database is missing
+// migrations this build needs. A database ahead of the build, e.g. after a
+// rollback of the binary, is only warned about.
+func CheckSchemaVersion(ctx context.Context) error {
+	migrations, err := MigrationStatus(ctx)
+	if err != nil {
+		return err
+	}
+	var pending []string
+	for _, m := range migrations {
+		if m.AppliedAt == nil {
+			pending = append(pending, m.String())
+		}
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("the schema is behind this build, %d migration(s) pending starting at %s; run migrate up", len(pending), pending[0])
+	}
+
+	var newest int
+	if err := db.QueryRow(ctx, "SELECT coalesce(max(version), 0) FROM "+migrationsTable).Scan(&newest); err != nil {
+		return err
+	}
+	if newest > len(migrations) {
+		logger.LogWarning("The schema is at version ", newest, " but this build only knows up to ", len(migrations))
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package freezerinv
+
+import "testing"
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) == 0 || migrations[0].String() != "0001_base_schema" {
+		t.Fatalf("the base schema does not come first: %v", migrations)
+	}
+	for i, m := range migrations {
+		if m.Version != i+1 || m.up == "" || m.down == "" || m.AppliedAt != nil {
+			t.Errorf("migration %d loaded as %v (up %d bytes, down %d bytes)", i+1, m, len(m.up), len(m.down))
+		}
+	}
+}
+
+func TestMigrationFileName(t *testing.T) {
+	for name, valid := range map[string]bool{
+		"0001_base_schema.up.sql":   true,
+		"0012_user_roles.down.sql":  true,
+		"0003_app_users.sql":        false,
+		"0003_App_Users.up.sql":     false,
+		"base_schema.up.sql":        false,
+		"0003_app_users.up.sql.bak": false,
+		"0003-app-users.up.sql":     false,
+	} {
+		if migrationFileName.MatchString(name) != valid {
+			t.Errorf("%s: valid is %t, want %t", name, !valid, valid)
+		}
+	}
+}
@@ -0,0 +1,8 @@
+-- These tables held the inventory before migrations existed, so reverting
+-- past here would drop every room, freezer, box and sample. Refuse instead;
+-- drop them by hand if that is really wanted.
+DO $$
+BEGIN
+    RAISE EXCEPTION '0001_base_schema cannot be reverted, it would drop the whole inventory';
+END
+$$;
@@ -0,0 +1,44 @@
+-- The rooms, freezers, boxes and the two original link tables everything
+-- else builds on. Existing databases already have them, so each is only
+-- created when missing.
+CREATE SCHEMA IF NOT EXISTS mgl_freezer_inventory;
+
+CREATE TABLE IF NOT EXISTS mgl_freezer_inventory.freezer_locations (
+    id    serial PRIMARY KEY,
+    lab   text   NOT NULL,
+    floor text   NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS mgl_freezer_inventory.freezer (
+    id                        serial    PRIMARY KEY,
+    freezer_location_id       integer   NOT NULL REFERENCES mgl_freezer_inventory.freezer_locations (id),
+    last_calibrated           timestamp,
+    name                      text      NOT NULL,
+    model                     text      NOT NULL,
+    comments                  text,
+    current_holding_temp_c    integer,
+    manual_projects_contained text      NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS mgl_freezer_inventory.boxes (
+    id         serial  PRIMARY KEY,
+    name       text    NOT NULL,
+    freezer_id integer NOT NULL REFERENCES mgl_freezer_inventory.freezer (id),
+    shelf      integer NOT NULL
+);
+
+-- edna_id and fish_id are the matched sample in the mgl database, null when
+-- the entered name matched nothing.
+CREATE TABLE IF NOT EXISTS mgl_freezer_inventory.mgl_edna_box_link (
+    id           serial  PRIMARY KEY,
+    edna_id      integer,
+    entered_name text    NOT NULL UNIQUE,
+    box_id       integer NOT NULL REFERENCES mgl_freezer_inventory.boxes (id)
+);
+
+CREATE TABLE IF NOT EXISTS mgl_freezer_inventory.mgl_fish_box_link (
+    id           serial  PRIMARY KEY,
+    fish_id      integer,
+    entered_name text    NOT NULL UNIQUE,
+    box_id       integer NOT NULL REFERENCES mgl_freezer_inventory.boxes (id)
+);
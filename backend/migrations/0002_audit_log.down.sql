@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS mgl_freezer_inventory.audit_log;
+DROP FUNCTION IF EXISTS mgl_freezer_inventory.audit_log_append_only();
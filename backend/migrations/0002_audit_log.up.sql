@@ -0,0 +1,35 @@
+-- Append-only audit trail of every box and sample link mutation.
+CREATE TABLE IF NOT EXISTS mgl_freezer_inventory.audit_log (
+    id              bigserial PRIMARY KEY,
+    occurred_at     timestamptz NOT NULL DEFAULT now(),
+    actor           text        NOT NULL,
+    endpoint        text        NOT NULL,
+    table_name      text        NOT NULL,
+    action          text        NOT NULL CHECK (action IN ('insert', 'update', 'delete')),
+    box_id          integer,
+    freezer_id      integer,
+    new_box_id      integer,
+    new_freezer_id  integer,
+    sample_name     text,
+    new_sample_name text,
+    before          jsonb,
+    after           jsonb
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_occurred_at_idx ON mgl_freezer_inventory.audit_log (occurred_at);
+CREATE INDEX IF NOT EXISTS audit_log_box_idx ON mgl_freezer_inventory.audit_log (box_id, new_box_id);
+CREATE INDEX IF NOT EXISTS audit_log_freezer_idx ON mgl_freezer_inventory.audit_log (freezer_id, new_freezer_id);
+CREATE INDEX IF NOT EXISTS audit_log_sample_idx ON mgl_freezer_inventory.audit_log (sample_name, new_sample_name);
+
+CREATE OR REPLACE FUNCTION mgl_freezer_inventory.audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS audit_log_append_only ON mgl_freezer_inventory.audit_log;
+CREATE TRIGGER audit_log_append_only
+    BEFORE UPDATE OR DELETE ON mgl_freezer_inventory.audit_log
+    FOR EACH ROW EXECUTE FUNCTION mgl_freezer_inventory.audit_log_append_only();
+
+REVOKE UPDATE, DELETE, TRUNCATE ON mgl_freezer_inventory.audit_log FROM PUBLIC;
@@ -0,0 +1,9 @@
+-- Local accounts for the web UI. Users that authenticate against LDAP do not
+-- need a row here unless they should also have a local password.
+CREATE TABLE IF NOT EXISTS mgl_freezer_inventory.app_users (
+    username      text        PRIMARY KEY,
+    password_hash text,
+    display_name  text,
+    disabled      boolean     NOT NULL DEFAULT false,
+    created_at    timestamptz NOT NULL DEFAULT now()
+);
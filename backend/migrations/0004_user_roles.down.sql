@@ -0,0 +1 @@
+DROP TABLE IF EXISTS mgl_freezer_inventory.user_roles;
@@ -0,0 +1,15 @@
+-- Per-user roles. A grant applies to one room (freezer_locations row), one
+-- freezer, or everything when both scope columns are null.
+CREATE TABLE IF NOT EXISTS mgl_freezer_inventory.user_roles (
+    id                  serial      PRIMARY KEY,
+    username            text        NOT NULL,
+    role                text        NOT NULL CHECK (role IN ('viewer', 'technician', 'manager')),
+    freezer_location_id integer     REFERENCES mgl_freezer_inventory.freezer_locations (id) ON DELETE CASCADE,
+    freezer_id          integer     REFERENCES mgl_freezer_inventory.freezer (id) ON DELETE CASCADE,
+    granted_by          text,
+    granted_at          timestamptz NOT NULL DEFAULT now(),
+    CHECK (freezer_location_id IS NULL OR freezer_id IS NULL)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS user_roles_scope_idx
+    ON mgl_freezer_inventory.user_roles (username, coalesce(freezer_location_id, 0), coalesce(freezer_id, 0));
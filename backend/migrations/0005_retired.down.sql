@@ -0,0 +1,5 @@
+ALTER TABLE mgl_freezer_inventory.freezer
+    DROP COLUMN IF EXISTS retired;
+
+ALTER TABLE mgl_freezer_inventory.freezer_locations
+    DROP COLUMN IF EXISTS retired;
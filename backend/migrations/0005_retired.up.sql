@@ -0,0 +1,7 @@
+-- Freezers and rooms are retired rather than deleted so boxes, audit rows and
+-- role grants that point at them keep resolving.
+ALTER TABLE mgl_freezer_inventory.freezer
+    ADD COLUMN IF NOT EXISTS retired boolean NOT NULL DEFAULT false;
+
+ALTER TABLE mgl_freezer_inventory.freezer_locations
+    ADD COLUMN IF NOT EXISTS retired boolean NOT NULL DEFAULT false;
@@ -0,0 +1,9 @@
+ALTER TABLE mgl_freezer_inventory.boxes
+    DROP COLUMN IF EXISTS rack,
+    DROP COLUMN IF EXISTS drawer;
+
+ALTER TABLE mgl_freezer_inventory.freezer
+    DROP COLUMN IF EXISTS shelf_count,
+    DROP COLUMN IF EXISTS shelf_label,
+    DROP COLUMN IF EXISTS racks_per_shelf,
+    DROP COLUMN IF EXISTS drawers_per_rack;
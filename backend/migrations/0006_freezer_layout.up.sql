@@ -0,0 +1,12 @@
+-- Per-freezer shelf layout. Chest freezers have a few baskets, uprights have
+-- shelves that may hold racks, and racks may have drawers.
+ALTER TABLE mgl_freezer_inventory.freezer
+    ADD COLUMN IF NOT EXISTS shelf_count      integer NOT NULL DEFAULT 5 CHECK (shelf_count BETWEEN 1 AND 50),
+    ADD COLUMN IF NOT EXISTS shelf_label      text    NOT NULL DEFAULT 'Shelf',
+    ADD COLUMN IF NOT EXISTS racks_per_shelf  integer CHECK (racks_per_shelf BETWEEN 1 AND 50),
+    ADD COLUMN IF NOT EXISTS drawers_per_rack integer CHECK (drawers_per_rack BETWEEN 1 AND 50);
+
+-- Where a box sits within its shelf, null when the freezer has no racks/drawers.
+ALTER TABLE mgl_freezer_inventory.boxes
+    ADD COLUMN IF NOT EXISTS rack   integer CHECK (rack > 0),
+    ADD COLUMN IF NOT EXISTS drawer integer CHECK (drawer > 0);
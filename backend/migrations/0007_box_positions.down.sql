@@ -0,0 +1,11 @@
+DROP INDEX IF EXISTS mgl_freezer_inventory.mgl_edna_box_link_position_idx;
+DROP INDEX IF EXISTS mgl_freezer_inventory.mgl_fish_box_link_position_idx;
+
+ALTER TABLE mgl_freezer_inventory.mgl_edna_box_link
+    DROP COLUMN IF EXISTS position;
+
+ALTER TABLE mgl_freezer_inventory.mgl_fish_box_link
+    DROP COLUMN IF EXISTS position;
+
+ALTER TABLE mgl_freezer_inventory.boxes
+    DROP COLUMN IF EXISTS format;
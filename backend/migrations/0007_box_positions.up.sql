@@ -0,0 +1,16 @@
+-- Box formats and the well each sample tube sits in. Positions are numbered
+-- row by row from 1, so A1 is 1 and the last well is rows * columns.
+ALTER TABLE mgl_freezer_inventory.boxes
+    ADD COLUMN IF NOT EXISTS format text CHECK (format IN ('81', '100', '96'));
+
+ALTER TABLE mgl_freezer_inventory.mgl_edna_box_link
+    ADD COLUMN IF NOT EXISTS position integer CHECK (position > 0);
+
+ALTER TABLE mgl_freezer_inventory.mgl_fish_box_link
+    ADD COLUMN IF NOT EXISTS position integer CHECK (position > 0);
+
+CREATE UNIQUE INDEX IF NOT EXISTS mgl_edna_box_link_position_idx
+    ON mgl_freezer_inventory.mgl_edna_box_link (box_id, position) WHERE position IS NOT NULL;
+
+CREATE UNIQUE INDEX IF NOT EXISTS mgl_fish_box_link_position_idx
+    ON mgl_freezer_inventory.mgl_fish_box_link (box_id, position) WHERE position IS NOT NULL;
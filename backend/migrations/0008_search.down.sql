@@ -0,0 +1,5 @@
+-- pg_trgm stays, other schemas may use it
+DROP INDEX IF EXISTS mgl_freezer_inventory.mgl_edna_box_link_name_trgm_idx;
+DROP INDEX IF EXISTS mgl_freezer_inventory.mgl_fish_box_link_name_trgm_idx;
+DROP INDEX IF EXISTS mgl_freezer_inventory.boxes_name_trgm_idx;
+DROP INDEX IF EXISTS mgl_freezer_inventory.freezer_name_trgm_idx;
@@ -0,0 +1,15 @@
+-- Trigram indexes for /api/v1/search. They serve the substring (ILIKE) and
+-- fuzzy (%) matches on every searchable name.
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+CREATE INDEX IF NOT EXISTS mgl_edna_box_link_name_trgm_idx
+    ON mgl_freezer_inventory.mgl_edna_box_link USING gin (entered_name gin_trgm_ops);
+
+CREATE INDEX IF NOT EXISTS mgl_fish_box_link_name_trgm_idx
+    ON mgl_freezer_inventory.mgl_fish_box_link USING gin (entered_name gin_trgm_ops);
+
+CREATE INDEX IF NOT EXISTS boxes_name_trgm_idx
+    ON mgl_freezer_inventory.boxes USING gin (name gin_trgm_ops);
+
+CREATE INDEX IF NOT EXISTS freezer_name_trgm_idx
+    ON mgl_freezer_inventory.freezer USING gin (name gin_trgm_ops);
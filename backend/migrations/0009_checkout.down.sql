@@ -0,0 +1,14 @@
+DROP INDEX IF EXISTS mgl_freezer_inventory.mgl_edna_box_link_checked_out_idx;
+DROP INDEX IF EXISTS mgl_freezer_inventory.mgl_fish_box_link_checked_out_idx;
+
+ALTER TABLE mgl_freezer_inventory.mgl_edna_box_link
+    DROP COLUMN IF EXISTS checked_out_by,
+    DROP COLUMN IF EXISTS checked_out_at,
+    DROP COLUMN IF EXISTS checkout_purpose,
+    DROP COLUMN IF EXISTS expected_return;
+
+ALTER TABLE mgl_freezer_inventory.mgl_fish_box_link
+    DROP COLUMN IF EXISTS checked_out_by,
+    DROP COLUMN IF EXISTS checked_out_at,
+    DROP COLUMN IF EXISTS checkout_purpose,
+    DROP COLUMN IF EXISTS expected_return;
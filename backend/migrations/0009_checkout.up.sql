@@ -0,0 +1,19 @@
+-- Samples taken out of their box for a while. The link keeps its box and
+-- position while the sample is out; all four columns are NULL when it is in.
+ALTER TABLE mgl_freezer_inventory.mgl_edna_box_link
+    ADD COLUMN IF NOT EXISTS checked_out_by text,
+    ADD COLUMN IF NOT EXISTS checked_out_at timestamptz,
+    ADD COLUMN IF NOT EXISTS checkout_purpose text,
+    ADD COLUMN IF NOT EXISTS expected_return date;
+
+ALTER TABLE mgl_freezer_inventory.mgl_fish_box_link
+    ADD COLUMN IF NOT EXISTS checked_out_by text,
+    ADD COLUMN IF NOT EXISTS checked_out_at timestamptz,
+    ADD COLUMN IF NOT EXISTS checkout_purpose text,
+    ADD COLUMN IF NOT EXISTS expected_return date;
+
+CREATE INDEX IF NOT EXISTS mgl_edna_box_link_checked_out_idx
+    ON mgl_freezer_inventory.mgl_edna_box_link (checked_out_at) WHERE checked_out_at IS NOT NULL;
+
+CREATE INDEX IF NOT EXISTS mgl_fish_box_link_checked_out_idx
+    ON mgl_freezer_inventory.mgl_fish_box_link (checked_out_at) WHERE checked_out_at IS NOT NULL;
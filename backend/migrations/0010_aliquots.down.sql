@@ -0,0 +1,18 @@
+DROP TRIGGER IF EXISTS mgl_edna_box_link_rename_parent ON mgl_freezer_inventory.mgl_edna_box_link;
+DROP TRIGGER IF EXISTS mgl_fish_box_link_rename_parent ON mgl_freezer_inventory.mgl_fish_box_link;
+DROP FUNCTION IF EXISTS mgl_freezer_inventory.rename_aliquot_parent();
+
+DROP INDEX IF EXISTS mgl_freezer_inventory.mgl_edna_box_link_parent_idx;
+DROP INDEX IF EXISTS mgl_freezer_inventory.mgl_fish_box_link_parent_idx;
+
+ALTER TABLE mgl_freezer_inventory.mgl_edna_box_link
+    DROP COLUMN IF EXISTS parent_name,
+    DROP COLUMN IF EXISTS remaining_volume_ul,
+    DROP COLUMN IF EXISTS remaining_count,
+    DROP COLUMN IF EXISTS consumed_at;
+
+ALTER TABLE mgl_freezer_inventory.mgl_fish_box_link
+    DROP COLUMN IF EXISTS parent_name,
+    DROP COLUMN IF EXISTS remaining_volume_ul,
+    DROP COLUMN IF EXISTS remaining_count,
+    DROP COLUMN IF EXISTS consumed_at;
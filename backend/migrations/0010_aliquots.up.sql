@@ -0,0 +1,42 @@
+-- Aliquots and subsamples. A child link names its parent in the same table,
+-- so one extract or fin clip can be spread over several boxes. Remaining
+-- volume (eDNA) or count (fin clips) is tracked on each link, and a consumed
+-- sample keeps its row for the lineage but gives up its well.
+ALTER TABLE mgl_freezer_inventory.mgl_edna_box_link
+    ADD COLUMN IF NOT EXISTS parent_name text,
+    ADD COLUMN IF NOT EXISTS remaining_volume_ul numeric(10, 2) CHECK (remaining_volume_ul >= 0),
+    ADD COLUMN IF NOT EXISTS remaining_count integer CHECK (remaining_count >= 0),
+    ADD COLUMN IF NOT EXISTS consumed_at timestamptz;
+
+ALTER TABLE mgl_freezer_inventory.mgl_fish_box_link
+    ADD COLUMN IF NOT EXISTS parent_name text,
+    ADD COLUMN IF NOT EXISTS remaining_volume_ul numeric(10, 2) CHECK (remaining_volume_ul >= 0),
+    ADD COLUMN IF NOT EXISTS remaining_count integer CHECK (remaining_count >= 0),
+    ADD COLUMN IF NOT EXISTS consumed_at timestamptz;
+
+CREATE INDEX IF NOT EXISTS mgl_edna_box_link_parent_idx
+    ON mgl_freezer_inventory.mgl_edna_box_link (parent_name) WHERE parent_name IS NOT NULL;
+
+CREATE INDEX IF NOT EXISTS mgl_fish_box_link_parent_idx
+    ON mgl_freezer_inventory.mgl_fish_box_link (parent_name) WHERE parent_name IS NOT NULL;
+
+-- Renaming a parent carries its children along.
+CREATE OR REPLACE FUNCTION mgl_freezer_inventory.rename_aliquot_parent() RETURNS trigger AS $$
+BEGIN
+    EXECUTE format('UPDATE %I.%I SET parent_name = $1 WHERE parent_name = $2', TG_TABLE_SCHEMA, TG_TABLE_NAME)
+        USING NEW.entered_name, OLD.entered_name;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS mgl_edna_box_link_rename_parent ON mgl_freezer_inventory.mgl_edna_box_link;
+CREATE TRIGGER mgl_edna_box_link_rename_parent
+    AFTER UPDATE OF entered_name ON mgl_freezer_inventory.mgl_edna_box_link
+    FOR EACH ROW WHEN (OLD.entered_name IS DISTINCT FROM NEW.entered_name)
+    EXECUTE FUNCTION mgl_freezer_inventory.rename_aliquot_parent();
+
+DROP TRIGGER IF EXISTS mgl_fish_box_link_rename_parent ON mgl_freezer_inventory.mgl_fish_box_link;
+CREATE TRIGGER mgl_fish_box_link_rename_parent
+    AFTER UPDATE OF entered_name ON mgl_freezer_inventory.mgl_fish_box_link
+    FOR EACH ROW WHEN (OLD.entered_name IS DISTINCT FROM NEW.entered_name)
+    EXECUTE FUNCTION mgl_freezer_inventory.rename_aliquot_parent();
@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS mgl_freezer_inventory.freezer_temperature_readings;
+
+ALTER TABLE mgl_freezer_inventory.freezer
+    DROP COLUMN IF EXISTS alarm_min_c,
+    DROP COLUMN IF EXISTS alarm_max_c,
+    DROP COLUMN IF EXISTS alarm_delay_minutes;
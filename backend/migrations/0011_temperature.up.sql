@@ -0,0 +1,21 @@
+-- Temperature readings from data loggers, one row per freezer per moment.
+-- Uploading the same logger file twice stores nothing new.
+CREATE TABLE IF NOT EXISTS mgl_freezer_inventory.freezer_temperature_readings (
+    id          bigserial PRIMARY KEY,
+    freezer_id  integer       NOT NULL REFERENCES mgl_freezer_inventory.freezer (id),
+    recorded_at timestamptz   NOT NULL,
+    temp_c      numeric(6, 2) NOT NULL CHECK (temp_c BETWEEN -273.15 AND 100),
+    -- the logger or script that sent the reading
+    source      text,
+    created_by  text,
+    created_at  timestamptz   NOT NULL DEFAULT now(),
+    UNIQUE (freezer_id, recorded_at)
+);
+
+-- Alarm thresholds. A reading above alarm_max_c or below alarm_min_c starts
+-- an excursion; it only alarms once it has lasted alarm_delay_minutes, so a
+-- door left open for a moment does not page anyone.
+ALTER TABLE mgl_freezer_inventory.freezer
+    ADD COLUMN IF NOT EXISTS alarm_min_c         numeric(5, 1),
+    ADD COLUMN IF NOT EXISTS alarm_max_c         numeric(5, 1) CHECK (alarm_max_c > alarm_min_c),
+    ADD COLUMN IF NOT EXISTS alarm_delay_minutes integer NOT NULL DEFAULT 0 CHECK (alarm_delay_minutes >= 0);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS mgl_freezer_inventory.freezer_maintenance_intervals;
+DROP TABLE IF EXISTS mgl_freezer_inventory.freezer_maintenance_attachments;
+DROP TABLE IF EXISTS mgl_freezer_inventory.freezer_maintenance;
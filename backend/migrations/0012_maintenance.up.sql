@@ -0,0 +1,43 @@
+-- Maintenance history per freezer. A calibration entry moves the freezer's
+-- last_calibrated forward; the column is kept for freezers with no history.
+CREATE TABLE IF NOT EXISTS mgl_freezer_inventory.freezer_maintenance (
+    id           serial PRIMARY KEY,
+    freezer_id   integer     NOT NULL REFERENCES mgl_freezer_inventory.freezer (id),
+    kind         text        NOT NULL CHECK (kind IN ('calibration', 'defrost', 'repair', 'service')),
+    performed_at timestamptz NOT NULL,
+    performed_by text,
+    notes        text,
+    created_by   text,
+    created_at   timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS freezer_maintenance_freezer_idx
+    ON mgl_freezer_inventory.freezer_maintenance (freezer_id, kind, performed_at DESC);
+
+-- Certificates, invoices and photos for an entry. Kept in the database so
+-- they are backed up with it.
+CREATE TABLE IF NOT EXISTS mgl_freezer_inventory.freezer_maintenance_attachments (
+    id             serial PRIMARY KEY,
+    maintenance_id integer     NOT NULL REFERENCES mgl_freezer_inventory.freezer_maintenance (id) ON DELETE CASCADE,
+    filename       text        NOT NULL,
+    content_type   text        NOT NULL,
+    size_bytes     integer     NOT NULL,
+    data           bytea       NOT NULL,
+    uploaded_by    text,
+    uploaded_at    timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS freezer_maintenance_attachments_entry_idx
+    ON mgl_freezer_inventory.freezer_maintenance_attachments (maintenance_id);
+
+-- How often each kind of maintenance is due, per freezer model. Models match
+-- the freezer's model ignoring case.
+CREATE TABLE IF NOT EXISTS mgl_freezer_inventory.freezer_maintenance_intervals (
+    id            serial PRIMARY KEY,
+    model         text    NOT NULL,
+    kind          text    NOT NULL CHECK (kind IN ('calibration', 'defrost', 'repair', 'service')),
+    interval_days integer NOT NULL CHECK (interval_days > 0)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS freezer_maintenance_intervals_model_kind_idx
+    ON mgl_freezer_inventory.freezer_maintenance_intervals (lower(model), kind);
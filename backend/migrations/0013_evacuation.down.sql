@@ -0,0 +1,2 @@
+ALTER TABLE mgl_freezer_inventory.freezer
+    DROP COLUMN IF EXISTS boxes_per_slot;
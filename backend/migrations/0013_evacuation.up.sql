@@ -0,0 +1,5 @@
+-- How many boxes fit in the smallest subdivision of a freezer: a drawer, a
+-- rack, or a shelf when there are no racks. Freezers without it are not
+-- offered as evacuation targets, since their free space is unknown.
+ALTER TABLE mgl_freezer_inventory.freezer
+    ADD COLUMN IF NOT EXISTS boxes_per_slot integer CHECK (boxes_per_slot BETWEEN 1 AND 1000);
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS mgl_freezer_inventory.freezer_capacity_snapshots;
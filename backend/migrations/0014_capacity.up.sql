@@ -0,0 +1,14 @@
+-- Daily record of how full each freezer is, for the utilisation trend.
+-- Taking a snapshot again on the same day replaces that day's row.
+CREATE TABLE IF NOT EXISTS mgl_freezer_inventory.freezer_capacity_snapshots (
+    id           bigserial PRIMARY KEY,
+    taken_on     date        NOT NULL,
+    freezer_id   integer     NOT NULL REFERENCES mgl_freezer_inventory.freezer (id),
+    boxes        integer     NOT NULL,
+    -- null while the freezer has no boxes_per_slot
+    capacity     integer,
+    edna_samples integer     NOT NULL,
+    fish_samples integer     NOT NULL,
+    taken_at     timestamptz NOT NULL DEFAULT now(),
+    UNIQUE (taken_on, freezer_id)
+);
@@ -0,0 +1,15 @@
+DROP TABLE IF EXISTS mgl_freezer_inventory.mgl_plankton_box_link;
+DROP TABLE IF EXISTS mgl_freezer_inventory.mgl_otolith_box_link;
+DROP TABLE IF EXISTS mgl_freezer_inventory.mgl_scale_box_link;
+DROP TABLE IF EXISTS mgl_freezer_inventory.mgl_rnalater_box_link;
+
+-- fill the per-type columns back in for snapshots taken since
+UPDATE mgl_freezer_inventory.freezer_capacity_snapshots
+    SET edna_samples = coalesce((samples ->> 'edna')::integer, 0),
+        fish_samples = coalesce((samples ->> 'fish')::integer, 0)
+    WHERE edna_samples IS NULL OR fish_samples IS NULL;
+
+ALTER TABLE mgl_freezer_inventory.freezer_capacity_snapshots
+    DROP COLUMN IF EXISTS samples,
+    ALTER COLUMN edna_samples SET NOT NULL,
+    ALTER COLUMN fish_samples SET NOT NULL;
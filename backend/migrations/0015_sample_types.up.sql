@@ -0,0 +1,45 @@
+-- Link tables for the sample types registered from SAMPLE_TYPES_FILE (see
+-- sample_types.example.json). Each has the columns every link table has:
+-- the resolved id, box and position, checkout and aliquot columns, and the
+-- position, parent and checked out indexes named after the table.
+DO $$
+DECLARE
+    t text;
+BEGIN
+    FOREACH t IN ARRAY ARRAY['mgl_plankton_box_link', 'mgl_otolith_box_link', 'mgl_scale_box_link', 'mgl_rnalater_box_link'] LOOP
+        EXECUTE format('CREATE TABLE IF NOT EXISTS mgl_freezer_inventory.%I (
+            id                  serial PRIMARY KEY,
+            entered_name        text NOT NULL UNIQUE,
+            box_id              integer NOT NULL REFERENCES mgl_freezer_inventory.boxes (id),
+            sample_id           integer,
+            position            integer CHECK (position > 0),
+            checked_out_by      text,
+            checked_out_at      timestamptz,
+            checkout_purpose    text,
+            expected_return     date,
+            parent_name         text,
+            remaining_volume_ul numeric(10, 2) CHECK (remaining_volume_ul >= 0),
+            remaining_count     integer CHECK (remaining_count >= 0),
+            consumed_at         timestamptz
+        )', t);
+        EXECUTE format('CREATE UNIQUE INDEX IF NOT EXISTS %I ON mgl_freezer_inventory.%I (box_id, position) WHERE position IS NOT NULL', t || '_position_idx', t);
+        EXECUTE format('CREATE INDEX IF NOT EXISTS %I ON mgl_freezer_inventory.%I (parent_name) WHERE parent_name IS NOT NULL', t || '_parent_idx', t);
+        EXECUTE format('CREATE INDEX IF NOT EXISTS %I ON mgl_freezer_inventory.%I (checked_out_at) WHERE checked_out_at IS NOT NULL', t || '_checked_out_idx', t);
+        EXECUTE format('DROP TRIGGER IF EXISTS %I ON mgl_freezer_inventory.%I', t || '_rename_parent', t);
+        EXECUTE format('CREATE TRIGGER %I AFTER UPDATE OF entered_name ON mgl_freezer_inventory.%I
+            FOR EACH ROW WHEN (OLD.entered_name IS DISTINCT FROM NEW.entered_name)
+            EXECUTE FUNCTION mgl_freezer_inventory.rename_aliquot_parent()', t || '_rename_parent', t);
+    END LOOP;
+END;
+$$;
+
+-- Capacity snapshots count samples per type key rather than in a column per
+-- type. The old columns are kept for the rows taken before.
+ALTER TABLE mgl_freezer_inventory.freezer_capacity_snapshots
+    ADD COLUMN IF NOT EXISTS samples jsonb NOT NULL DEFAULT '{}',
+    ALTER COLUMN edna_samples DROP NOT NULL,
+    ALTER COLUMN fish_samples DROP NOT NULL;
+
+UPDATE mgl_freezer_inventory.freezer_capacity_snapshots
+    SET samples = jsonb_build_object('edna', edna_samples, 'fish', fish_samples)
+    WHERE samples = '{}' AND edna_samples IS NOT NULL;
@@ -0,0 +1,321 @@
+package freezerinv
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/jackc/pgx/v5"
+	"gitlab.com/UrsusArcTech/logger"
+)
+
+// BoxMove puts one box at a shelf, rack and drawer, possibly in another
+// freezer.
+type BoxMove struct {
+	BoxId     int  `json:"box_id"`
+	FreezerId int  `json:"freezer_id"`
+	Shelf     int  `json:"shelf"`
+	Rack      *int `json:"rack"`
+	Drawer    *int `json:"drawer"`
+}
+
+type moveRequest struct {
+	Moves []BoxMove `json:"moves"`
+}
+
+type MoveResult struct {
+	Moved  int   `json:"moved"`
+	BoxIds []int `json:"box_ids"`
+}
+
+type moveOptions struct {
+	// From, when set, is the freezer every box must still be in
+	From *int
+	// RequireCapacity refuses freezers without boxes_per_slot instead of
+	// letting them take any number of boxes
+	RequireCapacity bool
+	// Field names the moves in error responses, e.g. "moves" gives
+	// "moves[2].shelf"; empty leaves the index out
+	Field string
+}
+
+func (o moveOptions) fieldFor(i int) string {
+	if o.Field == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s[%d].", o.Field, i)
+}
+
+// boxError reports the box of move i gone, when box is nil, or no longer in
+// the From freezer.
+func (o moveOptions) boxError(i int, boxId int, box *Box) *ApiError {
+	field := o.fieldFor(i)
+	if box == nil {
+		return &ApiError{Status: http.StatusNotFound, Code: CodeBoxNotFound, Message: fmt.Sprintf("Box %d not found", boxId), Field: field + "box_id"}
+	}
+	if o.From != nil && box.FreezerId != *o.From {
+		return &ApiError{Status: http.StatusConflict, Code: CodePlanStale, Message: fmt.Sprintf("Box %s is no longer in freezer %d", box.Name, *o.From), Field: field + "box_id"}
+	}
+	return nil
+}
+
+// capacityError refuses a destination whose free space is unknown when
+// RequireCapacity is set.
+func (o moveOptions) capacityError(i int, freezerName string, layout FreezerLayout) *ApiError {
+	if layout.BoxesPerSlot != nil || !o.RequireCapacity {
+		return nil
+	}
+	return &ApiError{Status: http.StatusConflict, Code: CodeOverCapacity, Message: "Freezer " + freezerName + " has no boxes per slot set, so its free space is unknown", Field: o.fieldFor(i) + "freezer_id"}
+}
+
+// movingFreezer is a destination, locked for the length of the move.
+type movingFreezer struct {
+	name      string
+	retired   bool
+	layout    FreezerLayout
+	occupancy map[slotKey]int
+}
+
+// checkMoves reports why a batch of moves cannot go ahead, or nil. The
+// caller must validate roles first.
+func checkMoves(moves []BoxMove, opts moveOptions) *ApiError {
+	if len(moves) == 0 {
+		return &ApiError{Status: http.StatusBadRequest, Code: CodeValidationFailed, Message: "No moves given", Field: opts.Field}
+	}
+	seen := map[int]bool{}
+	for i, move := range moves {
+		if seen[move.BoxId] {
+			return &ApiError{Status: http.StatusBadRequest, Code: CodeValidationFailed, Message: fmt.Sprintf("Box %d is listed twice", move.BoxId), Field: opts.fieldFor(i) + "box_id"}
+		}
+		seen[move.BoxId] = true
+	}
+	return nil
+}
+
+// moveBoxesTx applies a batch of moves inside tx. Destinations are locked in
+// id order so two batches filling the same freezer cannot both count the
+// same free space. Either every box moves or the returned ApiError says why
+// none can; err is for database failures.
+func moveBoxesTx(ctx context.Context, tx pgx.Tx, r *http.Request, moves []BoxMove, opts moveOptions) (boxIds []int, apiErr *ApiError, err error) {
+	if apiErr := checkMoves(moves, opts); apiErr != nil {
+		return nil, apiErr, nil
+	}
+
+	var targetIds []int
+	for _, move := range moves {
+		boxIds = append(boxIds, move.BoxId)
+		targetIds = append(targetIds, move.FreezerId)
+	}
+	targetIds = uniqueInts(targetIds)
+	sort.Ints(targetIds)
+
+	rows, err := tx.Query(ctx, "SELECT f.id, f.name, f.retired OR fl.retired, f.shelf_count, f.shelf_label, f.racks_per_shelf, f.drawers_per_rack, f.boxes_per_slot FROM mgl_freezer_inventory.freezer f JOIN mgl_freezer_inventory.freezer_locations fl ON fl.id = f.freezer_location_id WHERE f.id = ANY($1) ORDER BY f.id FOR UPDATE OF f", targetIds)
+	if err != nil {
+		return nil, nil, err
+	}
+	targets := map[int]*movingFreezer{}
+	for rows.Next() {
+		var id int
+		var f movingFreezer
+		if err := rows.Scan(&id, &f.name, &f.retired, &f.layout.ShelfCount, &f.layout.ShelfLabel, &f.layout.RacksPerShelf, &f.layout.DrawersPerRack, &f.layout.BoxesPerSlot); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		targets[id] = &f
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	// locked in id order, like the freezers, so overlapping batches wait for
+	// each other instead of deadlocking
+	current := map[int]Box{}
+	rows, err = tx.Query(ctx, "SELECT id, name, freezer_id, shelf, rack, drawer FROM mgl_freezer_inventory.boxes WHERE id = ANY($1) ORDER BY id FOR UPDATE", boxIds)
+	if err != nil {
+		return nil, nil, err
+	}
+	for rows.Next() {
+		var box Box
+		if err := rows.Scan(&box.Id, &box.Name, &box.FreezerId, &box.Shelf, &box.Rack, &box.Drawer); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		current[box.Id] = box
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	for i, move := range moves {
+		field := opts.fieldFor(i)
+		box, ok := current[move.BoxId]
+		if !ok {
+			return nil, opts.boxError(i, move.BoxId, nil), nil
+		}
+		if apiErr := opts.boxError(i, move.BoxId, &box); apiErr != nil {
+			return nil, apiErr, nil
+		}
+
+		target, ok := targets[move.FreezerId]
+		if !ok {
+			return nil, &ApiError{Status: http.StatusBadRequest, Code: CodeFreezerNotFound, Message: "Freezer " + strconv.Itoa(move.FreezerId) + " not found", Field: field + "freezer_id"}, nil
+		}
+		if target.retired {
+			return nil, &ApiError{Status: http.StatusConflict, Code: CodeRetired, Message: "Freezer " + target.name + " is retired", Field: field + "freezer_id"}, nil
+		}
+		if apiErr := target.layout.checkPlacement(move.Shelf, move.Rack, move.Drawer); apiErr != nil {
+			apiErr.Field = field + apiErr.Field
+			return nil, apiErr, nil
+		}
+		if apiErr := opts.capacityError(i, target.name, target.layout); apiErr != nil {
+			return nil, apiErr, nil
+		}
+	}
+
+	// count what each destination will hold once every box has moved, then
+	// check only the slots the batch puts boxes into
+	for id, target := range targets {
+		if target.layout.BoxesPerSlot == nil {
+			continue
+		}
+		if target.occupancy, err = slotOccupancy(ctx, tx, id); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, move := range moves {
+		box := current[move.BoxId]
+		if from, ok := targets[box.FreezerId]; ok && from.occupancy != nil {
+			from.occupancy[slotOf(box.Shelf, box.Rack, box.Drawer)]--
+		}
+		if to := targets[move.FreezerId]; to.occupancy != nil {
+			to.occupancy[slotOf(move.Shelf, move.Rack, move.Drawer)]++
+		}
+	}
+	for i, move := range moves {
+		target := targets[move.FreezerId]
+		if target.occupancy == nil {
+			continue
+		}
+		if apiErr := target.layout.checkRoom(target.occupancy, slotOf(move.Shelf, move.Rack, move.Drawer), target.name); apiErr != nil {
+			apiErr.Field = opts.fieldFor(i) + apiErr.Field
+			return nil, apiErr, nil
+		}
+	}
+
+	query := snapshotUpdate(boxesTable, "freezer_id = $1, shelf = $2, rack = $3, drawer = $4", "id = $5")
+	for _, move := range moves {
+		if _, err := auditedQueryTx(ctx, tx, r, boxesTable, "update", query, move.FreezerId, move.Shelf, move.Rack, move.Drawer, move.BoxId); err != nil {
+			return nil, nil, err
+		}
+	}
+	return boxIds, nil, nil
+}
+
+// checkNewBox reports why a box cannot be created where it says, or nil, the
+// same way moveBoxesTx would refuse moving it there. The freezer stays locked
+// until tx ends.
+func checkNewBox(ctx context.Context, tx pgx.Tx, box Box) (*ApiError, error) {
+	var target movingFreezer
+	err := tx.QueryRow(ctx, "SELECT f.name, f.retired OR fl.retired, f.shelf_count, f.shelf_label, f.racks_per_shelf, f.drawers_per_rack, f.boxes_per_slot FROM mgl_freezer_inventory.freezer f JOIN mgl_freezer_inventory.freezer_locations fl ON fl.id = f.freezer_location_id WHERE f.id = $1 FOR UPDATE OF f", box.FreezerId).
+		Scan(&target.name, &target.retired, &target.layout.ShelfCount, &target.layout.ShelfLabel, &target.layout.RacksPerShelf, &target.layout.DrawersPerRack, &target.layout.BoxesPerSlot)
+	if err == pgx.ErrNoRows {
+		return &ApiError{Status: http.StatusBadRequest, Code: CodeFreezerNotFound, Message: "Freezer " + strconv.Itoa(box.FreezerId) + " not found", Field: "freezer_id"}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if target.retired {
+		return &ApiError{Status: http.StatusConflict, Code: CodeRetired, Message: "Freezer " + target.name + " is retired", Field: "freezer_id"}, nil
+	}
+	if apiErr := target.layout.checkPlacement(box.Shelf, box.Rack, box.Drawer); apiErr != nil || target.layout.BoxesPerSlot == nil {
+		return apiErr, nil
+	}
+
+	// counted under the freezer lock, so two new boxes cannot both take the
+	// last space
+	occupancy, err := slotOccupancy(ctx, tx, box.FreezerId)
+	if err != nil {
+		return nil, err
+	}
+	key := slotOf(box.Shelf, box.Rack, box.Drawer)
+	occupancy[key]++
+	return target.layout.checkRoom(occupancy, key, target.name), nil
+}
+
+// checkRoom reports a slot or its shelf holding more boxes than the layout
+// allows, with occupancy already counting the boxes being moved in.
+// BoxesPerSlot must be set.
+func (l FreezerLayout) checkRoom(occupancy map[slotKey]int, key slotKey, freezerName string) *ApiError {
+	onShelf := 0
+	for k, n := range occupancy {
+		if k.Shelf == key.Shelf {
+			onShelf += n
+		}
+	}
+	full := onShelf > l.shelfCapacity()
+	if key.Rack != 0 && (key.Drawer != 0 || l.DrawersPerRack == nil) {
+		full = full || occupancy[key] > *l.BoxesPerSlot
+	}
+	if !full {
+		return nil
+	}
+
+	where := fmt.Sprintf("%s %d", l.ShelfLabel, key.Shelf)
+	if key.Rack != 0 {
+		where += fmt.Sprintf(", rack %d", key.Rack)
+	}
+	if key.Drawer != 0 {
+		where += fmt.Sprintf(", drawer %d", key.Drawer)
+	}
+	return &ApiError{Status: http.StatusConflict, Code: CodeOverCapacity, Message: where + " in " + freezerName + " is full", Field: "shelf"}
+}
+
+// moveBoxes runs a batch of moves through the store for a handler, checking
+// the user manages every freezer a box leaves or enters.
+func (h *Handlers) moveBoxes(w http.ResponseWriter, r *http.Request, moves []BoxMove, opts moveOptions) (MoveResult, bool) {
+	var result MoveResult
+
+	if apiErr := checkMoves(moves, opts); apiErr != nil {
+		writeApiError(w, apiErr)
+		return result, false
+	}
+	var boxIds, targetIds []int
+	for _, move := range moves {
+		boxIds = append(boxIds, move.BoxId)
+		targetIds = append(targetIds, move.FreezerId)
+	}
+	if !h.requireBoxRole(w, r, RoleManager, boxIds...) || !h.requireRole(w, r, RoleManager, uniqueInts(targetIds)...) {
+		return result, false
+	}
+
+	moved, apiErr, err := h.store.MoveBoxes(r.Context(), r, moves, opts)
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return result, false
+	}
+	if apiErr != nil {
+		writeApiError(w, apiErr)
+		return result, false
+	}
+
+	result.Moved = len(moved)
+	result.BoxIds = moved
+	return result, true
+}
+
+// ApiMoveBoxes moves one or many boxes at once; if any cannot go where asked
+// none move.
+func (h *Handlers) ApiMoveBoxes(w http.ResponseWriter, r *http.Request) {
+	var req moveRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if result, ok := h.moveBoxes(w, r, req.Moves, moveOptions{Field: "moves"}); ok {
+		writeJSON(w, http.StatusOK, result)
+	}
+}
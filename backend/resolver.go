@@ -0,0 +1,271 @@
+package freezerinv
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.com/UrsusArcTech/logger"
+	"gitlab.com/mgl-database/mgl-go/object_processing_x/object_processing_edna"
+	"gitlab.com/mgl-database/mgl-go/object_processing_x/object_processing_specimen"
+)
+
+type ResolverConfig struct {
+	// Timeout bounds one lookup in the mgl database, defaultResolverTimeout
+	// when zero
+	Timeout time.Duration
+	// CacheTTL is how long a lookup is reused, 10m when zero; negative turns
+	// the cache off
+	CacheTTL time.Duration
+	// CacheSize is how many names each resolver remembers, 1000 when zero
+	CacheSize int
+	// MaxLookups caps the lookups each resolver has running in the mgl
+	// database at once, defaultMaxLookups when zero
+	MaxLookups int
+	// StubFile, when set, answers lookups from a JSON file instead of the
+	// mgl database, see mgl_stub.example.json
+	StubFile string
+}
+
+// SampleResolver looks an entered name up in the sample database. It returns
+// -1 and an empty name when nothing, or more than one thing, matches; err is
+// for lookups that could not be made at all.
+type SampleResolver interface {
+	Resolve(ctx context.Context, name string) (id int, foundName string, err error)
+}
+
+const (
+	defaultResolverTimeout = 5 * time.Second
+	defaultMaxLookups      = 4
+)
+
+var errResolverTimeout = errors.New("sample lookup timed out")
+
+// InitResolvers puts the timeout and cache in front of the mgl lookups, or
+// swaps them for the stub file.
+func InitResolvers(cfg ResolverConfig) error {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultResolverTimeout
+	}
+	if cfg.CacheTTL == 0 {
+		cfg.CacheTTL = 10 * time.Minute
+	}
+	if cfg.CacheSize <= 0 {
+		cfg.CacheSize = 1000
+	}
+	if cfg.MaxLookups <= 0 {
+		cfg.MaxLookups = defaultMaxLookups
+	}
+
+	edna := SampleResolver(newMglResolver(object_processing_edna.GetEDNAID, cfg.Timeout, cfg.MaxLookups))
+	specimen := SampleResolver(newMglResolver(object_processing_specimen.GetSpecimenID, cfg.Timeout, cfg.MaxLookups))
+	if cfg.StubFile != "" {
+		stub, err := loadStubResolvers(cfg.StubFile)
+		if err != nil {
+			return err
+		}
+		logger.LogWarning("Resolving samples from " + cfg.StubFile + " instead of the mgl database")
+		edna, specimen = stub["edna"], stub["specimen"]
+	} else if cfg.CacheTTL > 0 {
+		edna = newCachedResolver(edna, cfg.CacheTTL, cfg.CacheSize)
+		specimen = newCachedResolver(specimen, cfg.CacheTTL, cfg.CacheSize)
+	}
+
+	sampleResolvers["edna"] = edna
+	sampleResolvers["specimen"] = specimen
+	return nil
+}
+
+// mglResolver calls one of the mgl-go lookups. They take no context, so a
+// lookup that runs past the timeout is left to finish on its own and its
+// answer dropped. It keeps its slot until then, so a stalled database holds
+// at most cap(slots) lookups rather than one per request.
+type mglResolver struct {
+	lookup  func(name string) (int, string)
+	timeout time.Duration
+	slots   chan struct{}
+}
+
+func newMglResolver(lookup func(name string) (int, string), timeout time.Duration, maxLookups int) mglResolver {
+	return mglResolver{lookup: lookup, timeout: timeout, slots: make(chan struct{}, maxLookups)}
+}
+
+func (m mglResolver) Resolve(ctx context.Context, name string) (int, string, error) {
+	type found struct {
+		id   int
+		name string
+	}
+	timer := time.NewTimer(m.timeout)
+	defer timer.Stop()
+
+	// Waiting for a slot counts against the timeout
+	select {
+	case m.slots <- struct{}{}:
+	case <-timer.C:
+		return -1, "", errResolverTimeout
+	case <-ctx.Done():
+		return -1, "", ctx.Err()
+	}
+
+	done := make(chan found, 1)
+	go func() {
+		defer func() { <-m.slots }()
+		id, foundName := m.lookup(name)
+		done <- found{id, foundName}
+	}()
+
+	select {
+	case f := <-done:
+		return f.id, f.name, nil
+	case <-timer.C:
+		return -1, "", errResolverTimeout
+	case <-ctx.Done():
+		return -1, "", ctx.Err()
+	}
+}
+
+// noneResolver never matches, for types the database does not hold.
+type noneResolver struct{}
+
+func (noneResolver) Resolve(context.Context, string) (int, string, error) {
+	return -1, "", nil
+}
+
+// cachedResolver remembers the last size answers from next for ttl, misses
+// included, dropping the least recently used first. Failed lookups are not
+// kept.
+type cachedResolver struct {
+	next SampleResolver
+	ttl  time.Duration
+	size int
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type cachedLookup struct {
+	name      string
+	id        int
+	foundName string
+	expires   time.Time
+}
+
+func newCachedResolver(next SampleResolver, ttl time.Duration, size int) *cachedResolver {
+	return &cachedResolver{next: next, ttl: ttl, size: size, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+func (c *cachedResolver) Resolve(ctx context.Context, name string) (int, string, error) {
+	if id, foundName, ok := c.get(name); ok {
+		return id, foundName, nil
+	}
+	id, foundName, err := c.next.Resolve(ctx, name)
+	if err != nil {
+		return id, foundName, err
+	}
+	c.put(name, id, foundName)
+	return id, foundName, nil
+}
+
+func (c *cachedResolver) get(name string) (int, string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[name]
+	if !ok {
+		return 0, "", false
+	}
+	entry := el.Value.(*cachedLookup)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(el)
+		delete(c.entries, name)
+		return 0, "", false
+	}
+	c.order.MoveToFront(el)
+	return entry.id, entry.foundName, true
+}
+
+func (c *cachedResolver) put(name string, id int, foundName string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &cachedLookup{name: name, id: id, foundName: foundName, expires: time.Now().Add(c.ttl)}
+	if el, ok := c.entries[name]; ok {
+		el.Value = entry
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[name] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedLookup).name)
+	}
+}
+
+// stubSample is one sample in the stub file.
+type stubSample struct {
+	Id   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// stubResolver stands in for the mgl database with a fixed list of samples.
+// Like the real lookups, an exact name wins, otherwise the entered name must
+// be part of exactly one sample's name.
+type stubResolver struct {
+	samples []stubSample
+}
+
+// loadStubResolvers reads a JSON object of resolver name to samples, e.g.
+// {"edna": [{"id": 1, "name": "..."}], "specimen": [...]}.
+func loadStubResolvers(path string) (map[string]SampleResolver, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var lists map[string][]stubSample
+	if err := json.Unmarshal(data, &lists); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for key := range lists {
+		if key != "edna" && key != "specimen" {
+			return nil, fmt.Errorf("%s: unknown resolver %q, use edna or specimen", path, key)
+		}
+	}
+	return map[string]SampleResolver{
+		"edna":     stubResolver{samples: lists["edna"]},
+		"specimen": stubResolver{samples: lists["specimen"]},
+	}, nil
+}
+
+func (s stubResolver) Resolve(_ context.Context, name string) (int, string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return -1, "", nil
+	}
+	for _, sample := range s.samples {
+		if strings.EqualFold(sample.Name, name) {
+			return sample.Id, sample.Name, nil
+		}
+	}
+	var match *stubSample
+	for i, sample := range s.samples {
+		if !strings.Contains(strings.ToLower(sample.Name), strings.ToLower(name)) {
+			continue
+		}
+		if match != nil {
+			return -1, "", nil
+		}
+		match = &s.samples[i]
+	}
+	if match == nil {
+		return -1, "", nil
+	}
+	return match.Id, match.Name, nil
+}
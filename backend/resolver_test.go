@@ -0,0 +1,180 @@
+package freezerinv
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingResolver answers from a fixed map and counts the lookups that reach
+// it; a name in fail fails instead.
+type countingResolver struct {
+	mu    sync.Mutex
+	ids   map[string]int
+	fail  map[string]error
+	calls map[string]int
+}
+
+func newCountingResolver(ids map[string]int) *countingResolver {
+	return &countingResolver{ids: ids, fail: map[string]error{}, calls: map[string]int{}}
+}
+
+func (c *countingResolver) Resolve(_ context.Context, name string) (int, string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls[name]++
+	if err := c.fail[name]; err != nil {
+		return -1, "", err
+	}
+	if id, ok := c.ids[name]; ok {
+		return id, name, nil
+	}
+	return -1, "", nil
+}
+
+func (c *countingResolver) count(name string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.calls[name]
+}
+
+func resolveId(t *testing.T, r SampleResolver, name string) int {
+	t.Helper()
+	id, _, err := r.Resolve(context.Background(), name)
+	if err != nil {
+		t.Fatalf("resolving %q: %v", name, err)
+	}
+	return id
+}
+
+func TestCachedResolverReusesAndExpires(t *testing.T) {
+	next := newCountingResolver(map[string]int{"E-1": 1})
+	cache := newCachedResolver(next, time.Hour, 10)
+
+	for range 3 {
+		if id := resolveId(t, cache, "E-1"); id != 1 {
+			t.Fatalf("E-1 resolved to %d, want 1", id)
+		}
+		resolveId(t, cache, "missing")
+	}
+	if next.count("E-1") != 1 || next.count("missing") != 1 {
+		t.Fatalf("lookups reached the database %d and %d times, want once each", next.count("E-1"), next.count("missing"))
+	}
+
+	cache.entries["E-1"].Value.(*cachedLookup).expires = time.Now().Add(-time.Second)
+	resolveId(t, cache, "E-1")
+	if next.count("E-1") != 2 {
+		t.Fatalf("an expired lookup was reused")
+	}
+}
+
+func TestCachedResolverEvictsLeastRecentlyUsed(t *testing.T) {
+	next := newCountingResolver(map[string]int{"a": 1, "b": 2, "c": 3})
+	cache := newCachedResolver(next, time.Hour, 2)
+
+	resolveId(t, cache, "a")
+	resolveId(t, cache, "b")
+	resolveId(t, cache, "a") // b is now the least recently used
+	resolveId(t, cache, "c")
+
+	resolveId(t, cache, "a")
+	if next.count("a") != 1 {
+		t.Fatalf("a was evicted although it was used last")
+	}
+	resolveId(t, cache, "b")
+	if next.count("b") != 2 {
+		t.Fatalf("b was kept although it was the least recently used")
+	}
+	if len(cache.entries) != 2 || cache.order.Len() != 2 {
+		t.Fatalf("cache holds %d entries, want 2", len(cache.entries))
+	}
+}
+
+func TestCachedResolverDoesNotKeepErrors(t *testing.T) {
+	next := newCountingResolver(map[string]int{"E-1": 1})
+	next.fail["E-1"] = errResolverTimeout
+	cache := newCachedResolver(next, time.Hour, 10)
+
+	if _, _, err := cache.Resolve(context.Background(), "E-1"); !errors.Is(err, errResolverTimeout) {
+		t.Fatalf("got %v, want the timeout passed through", err)
+	}
+	delete(next.fail, "E-1")
+	if id := resolveId(t, cache, "E-1"); id != 1 {
+		t.Fatalf("E-1 resolved to %d after the failure, want 1", id)
+	}
+	if next.count("E-1") != 2 {
+		t.Fatalf("the failed lookup was cached")
+	}
+}
+
+func TestStubResolver(t *testing.T) {
+	stub := stubResolver{samples: []stubSample{
+		{Id: 1, Name: "E-100"},
+		{Id: 2, Name: "E-1000"},
+		{Id: 3, Name: "E-2000-B"},
+		{Id: 4, Name: "S-77"},
+	}}
+
+	for _, c := range []struct {
+		name string
+		want int
+	}{
+		{"E-100", 1},   // exact, although it is also part of E-1000
+		{"e-1000", 2},  // exact ignores case
+		{" S-77 ", 4},  // exact after trimming
+		{"2000", 3},    // part of exactly one name
+		{"s-7", 4},     // substrings ignore case too
+		{"E-10", -1},   // part of two names
+		{"E-3000", -1}, // part of none
+		{"", -1},       // nothing entered
+		{"   ", -1},    // only spaces
+	} {
+		if id := resolveId(t, stub, c.name); id != c.want {
+			t.Errorf("%q resolved to %d, want %d", c.name, id, c.want)
+		}
+	}
+}
+
+func TestMglResolverCapsLookups(t *testing.T) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	running, most := 0, 0
+	lookup := func(name string) (int, string) {
+		mu.Lock()
+		running++
+		most = max(most, running)
+		mu.Unlock()
+		<-release
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return 1, name
+	}
+	m := newMglResolver(lookup, 20*time.Millisecond, 2)
+
+	// every call times out, but the stalled lookups keep their slots
+	for range 5 {
+		if _, _, err := m.Resolve(context.Background(), "E-1"); !errors.Is(err, errResolverTimeout) {
+			t.Fatalf("got %v, want a timeout", err)
+		}
+	}
+	mu.Lock()
+	if most != 2 {
+		t.Errorf("%d lookups ran at once, want 2", most)
+	}
+	mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := m.Resolve(ctx, "E-1"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want the cancelled context", err)
+	}
+
+	close(release)
+	m.timeout = time.Second
+	if id, _, err := m.Resolve(context.Background(), "E-1"); err != nil || id != 1 {
+		t.Fatalf("got %d, %v once the database answered again", id, err)
+	}
+}
@@ -0,0 +1,297 @@
+package freezerinv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gitlab.com/UrsusArcTech/logger"
+)
+
+const (
+	RoleViewer     = "viewer"
+	RoleTechnician = "technician"
+	RoleManager    = "manager"
+)
+
+var roleRank = map[string]int{
+	RoleViewer:     1,
+	RoleTechnician: 2,
+	RoleManager:    3,
+}
+
+var errBoxNotFound = errors.New("Box not found")
+var errRoleNotFound = errors.New("Role not found")
+
+type RoleGrant struct {
+	Id                int        `json:"id"`
+	Username          string     `json:"username"`
+	Role              string     `json:"role"`
+	FreezerLocationId *int       `json:"freezer_location_id"`
+	FreezerId         *int       `json:"freezer_id"`
+	GrantedBy         *string    `json:"granted_by"`
+	GrantedAt         *time.Time `json:"granted_at"`
+}
+
+// requireRole checks the session user holds at least role on every freezer
+// listed. Writes the error response and returns false otherwise.
+func (h *Handlers) requireRole(w http.ResponseWriter, r *http.Request, role string, freezerIds ...int) bool {
+	user := SessionUser(r)
+	if user == "" {
+		writeError(w, http.StatusUnauthorized, CodeLoginRequired, "Login required")
+		return false
+	}
+
+	for _, freezerId := range freezerIds {
+		have, err := h.store.RoleRank(r.Context(), user, nil, &freezerId)
+		if err != nil {
+			logger.LogError("Role lookup error: " + err.Error())
+			writeDbError(w, err)
+			return false
+		}
+		if have < roleRank[role] {
+			logger.LogError(user, " lacks ", role, " role on freezer ", freezerId)
+			writeError(w, http.StatusForbidden, CodePermissionDenied, "You need the "+role+" role on freezer "+strconv.Itoa(freezerId))
+			return false
+		}
+	}
+	return true
+}
+
+// requireRoomRole checks the session user holds at least role on a room, or
+// lab-wide when roomId is nil.
+func (h *Handlers) requireRoomRole(w http.ResponseWriter, r *http.Request, role string, roomId *int) bool {
+	user := SessionUser(r)
+	if user == "" {
+		writeError(w, http.StatusUnauthorized, CodeLoginRequired, "Login required")
+		return false
+	}
+
+	scope := "lab-wide"
+	if roomId != nil {
+		scope = "on room " + strconv.Itoa(*roomId)
+	}
+	have, err := h.store.RoleRank(r.Context(), user, roomId, nil)
+	if err != nil {
+		logger.LogError("Role lookup error: " + err.Error())
+		writeDbError(w, err)
+		return false
+	}
+	if have < roleRank[role] {
+		logger.LogError(user, " lacks ", role, " role ", scope)
+		writeError(w, http.StatusForbidden, CodePermissionDenied, "You need the "+role+" role "+scope)
+		return false
+	}
+	return true
+}
+
+// requireBoxRole is requireRole for the freezers holding the given boxes.
+func (h *Handlers) requireBoxRole(w http.ResponseWriter, r *http.Request, role string, boxIds ...int) bool {
+	var freezerIds []int
+	for _, boxId := range boxIds {
+		box, err := h.store.GetBox(r.Context(), boxId)
+		if err == errBoxNotFound {
+			writeError(w, http.StatusNotFound, CodeBoxNotFound, err.Error())
+			return false
+		}
+		if err != nil {
+			logger.LogError("Box lookup error: " + err.Error())
+			writeDbError(w, err)
+			return false
+		}
+		freezerIds = append(freezerIds, box.FreezerId)
+	}
+	return h.requireRole(w, r, role, freezerIds...)
+}
+
+// requireLinkRole is requireRole for every freezer currently holding a sample
+// with this entered name.
+func (h *Handlers) requireLinkRole(w http.ResponseWriter, r *http.Request, role string, t *SampleType, enteredName string) bool {
+	freezerIds, err := h.store.SampleFreezerIds(r.Context(), t, enteredName)
+	if err != nil {
+		logger.LogError("Link lookup error: " + err.Error())
+		writeDbError(w, err)
+		return false
+	}
+	return h.requireRole(w, r, role, freezerIds...)
+}
+
+// requireReadScope checks the session user can read something narrowed to a
+// box, freezer or room, taking the narrowest given, or the whole lab when
+// none is.
+func (h *Handlers) requireReadScope(w http.ResponseWriter, r *http.Request, roomId *int, freezerId *int, boxId *int) bool {
+	switch {
+	case boxId != nil:
+		return h.requireBoxRole(w, r, RoleViewer, *boxId)
+	case freezerId != nil:
+		return h.requireRole(w, r, RoleViewer, *freezerId)
+	default:
+		return h.requireRoomRole(w, r, RoleViewer, roomId)
+	}
+}
+
+// scopeFromQuery reads the optional roomid or freezerid a grant applies to.
+func scopeFromQuery(r *http.Request) (roomId *int, freezerId *int, apiErr *ApiError) {
+	if s := r.URL.Query().Get("roomid"); s != "" {
+		id, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, nil, &ApiError{Status: http.StatusBadRequest, Code: CodeValidationFailed, Message: "Invalid roomid", Field: "roomid"}
+		}
+		roomId = &id
+	}
+	if s := r.URL.Query().Get("freezerid"); s != "" {
+		id, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, nil, &ApiError{Status: http.StatusBadRequest, Code: CodeValidationFailed, Message: "Invalid freezerid", Field: "freezerid"}
+		}
+		freezerId = &id
+	}
+	if roomId != nil && freezerId != nil {
+		return nil, nil, &ApiError{Status: http.StatusBadRequest, Code: CodeValidationFailed, Message: "Use either roomid or freezerid, not both", Field: "freezerid"}
+	}
+	return roomId, freezerId, nil
+}
+
+// canManageScope checks the session user is a manager over the whole scope
+// a grant is being changed on.
+func (h *Handlers) canManageScope(w http.ResponseWriter, r *http.Request, roomId *int, freezerId *int) bool {
+	user := SessionUser(r)
+
+	have, err := h.store.RoleRank(r.Context(), user, roomId, freezerId)
+	if err != nil {
+		logger.LogError("Role lookup error: " + err.Error())
+		writeDbError(w, err)
+		return false
+	}
+	if have < roleRank[RoleManager] {
+		writeError(w, http.StatusForbidden, CodePermissionDenied, "Only managers of this room or freezer can change its roles")
+		return false
+	}
+	return true
+}
+
+// GrantRole adds or replaces the role a user holds on one scope. Also used by
+// the grant subcommand to bootstrap the first lab-wide manager.
+func (h *Handlers) GrantRole(username string, role string, roomId *int, freezerId *int, grantedBy string) error {
+	if _, ok := roleRank[role]; !ok {
+		return errors.New("Unknown role: " + role)
+	}
+
+	grant := RoleGrant{Username: username, Role: role, FreezerLocationId: roomId, FreezerId: freezerId}
+	return h.store.SaveRoleGrant(context.Background(), nil, grant, grantedBy)
+}
+
+func (h *Handlers) GrantRoleHandler(w http.ResponseWriter, r *http.Request) {
+	username := r.URL.Query().Get("username")
+	role := r.URL.Query().Get("role")
+
+	roomId, freezerId, apiErr := scopeFromQuery(r)
+	if apiErr != nil {
+		writeApiError(w, apiErr)
+		return
+	}
+
+	if !h.grantRoleChecked(w, r, RoleGrant{Username: username, Role: role, FreezerLocationId: roomId, FreezerId: freezerId}) {
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Request was successful"))
+}
+
+// grantRoleChecked is GrantRole for a request, which must come from a manager
+// of the scope.
+func (h *Handlers) grantRoleChecked(w http.ResponseWriter, r *http.Request, grant RoleGrant) bool {
+	if grant.Username == "" {
+		writeValidationError(w, "username", "Missing required fields: username")
+		return false
+	}
+	if grant.Role == "" {
+		writeValidationError(w, "role", "Missing required fields: role")
+		return false
+	}
+	if _, ok := roleRank[grant.Role]; !ok {
+		writeValidationError(w, "role", "Unknown role: "+grant.Role)
+		return false
+	}
+	if grant.FreezerLocationId != nil && grant.FreezerId != nil {
+		writeValidationError(w, "freezer_id", "Use either a room or a freezer, not both")
+		return false
+	}
+
+	if !h.canManageScope(w, r, grant.FreezerLocationId, grant.FreezerId) {
+		return false
+	}
+
+	if err := h.store.SaveRoleGrant(r.Context(), r, grant, SessionUser(r)); err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return false
+	}
+	return true
+}
+
+func (h *Handlers) RevokeRole(w http.ResponseWriter, r *http.Request) {
+	username := r.URL.Query().Get("username")
+
+	if username == "" {
+		logger.LogError("Missing required fields: username")
+		writeValidationError(w, "username", "Missing required fields: username")
+		return
+	}
+
+	roomId, freezerId, apiErr := scopeFromQuery(r)
+	if apiErr != nil {
+		writeApiError(w, apiErr)
+		return
+	}
+
+	if !h.revokeRoleChecked(w, r, username, roomId, freezerId) {
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *Handlers) revokeRoleChecked(w http.ResponseWriter, r *http.Request, username string, roomId *int, freezerId *int) bool {
+	if !h.canManageScope(w, r, roomId, freezerId) {
+		return false
+	}
+
+	removed, err := h.store.DeleteRoleGrant(r.Context(), r, username, roomId, freezerId)
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return false
+	}
+
+	if removed == 0 {
+		writeError(w, http.StatusNotFound, CodeRoleNotFound, "Role not found")
+		return false
+	}
+	return true
+}
+
+// GetRoles lists grants, optionally for one username. Anyone can list their
+// own; everyone's needs a lab-wide viewer.
+func (h *Handlers) GetRoles(w http.ResponseWriter, r *http.Request) {
+	username := r.URL.Query().Get("username")
+	if username == "" || username != SessionUser(r) {
+		if !h.requireRoomRole(w, r, RoleViewer, nil) {
+			return
+		}
+	}
+
+	results, err := h.store.ListRoleGrants(r.Context(), username)
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
@@ -2,10 +2,12 @@ package freezerinv
 
 import (
 //	"gitlab.com/mgl-database/mgl-go"
+	"errors"
+	"fmt"
 	"net/http"
+	"strings"
 	"strconv"
 	"gitlab.com/UrsusArcTech/logger"
-	"context"
 	"encoding/json"
 )
 
@@ -13,68 +15,145 @@ type FreezerRoom struct{
 	Lab string `json:"lab"`
 	Floor string `json:"floor"`
 	Id int `json:"id"`
+	Retired bool `json:"retired"`
 }
 
-func GetFreezerRooms(w http.ResponseWriter, r *http.Request){
-	query := "SELECT lab, floor, id FROM mgl_freezer_inventory.freezer_locations"
-	args := []interface{}{}
-	where := ""
+var errRoomNotFound = errors.New("Room not found")
+
+func (h *Handlers) GetFreezerRooms(w http.ResponseWriter, r *http.Request){
+	filter := RoomFilter{
+		Search:         r.URL.Query().Get("search"),
+		IncludeRetired: r.URL.Query().Get("include_retired") == "true",
+		Limit:          200,
+	}
 	limitStr := r.URL.Query().Get("limit")
 	offsetStr := r.URL.Query().Get("offset")
-	limit := 200
-	offset := 0
 
 	if limitStr != "" {
 		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 && l <= 1000 {
-			limit = l
+			filter.Limit = l
 		}
 	}
 	if offsetStr != "" {
 		if o, err := strconv.Atoi(offsetStr); err == nil && o >= 0 {
-			offset = o
+			filter.Offset = o
 		}
 	}
 
+	results, err := h.store.ListRooms(r.Context(), filter)
+	if err != nil {
+		writeDbError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+func validateRoom(room FreezerRoom) *ApiError {
+	if strings.TrimSpace(room.Lab) == "" {
+		return &ApiError{Status: http.StatusBadRequest, Code: CodeValidationFailed, Message: "Lab cannot be empty", Field: "lab"}
+	}
+	if strings.TrimSpace(room.Floor) == "" {
+		return &ApiError{Status: http.StatusBadRequest, Code: CodeValidationFailed, Message: "Floor cannot be empty", Field: "floor"}
+	}
+	return nil
+}
 
-	searchQuery := r.URL.Query().Get("search")
-	if searchQuery != ""{
-		where = " WHERE lab ILIKE $1 OR floor ILIKE $1"
-		args = append(args, "%"+searchQuery+"%")
+// roomIsActive writes the error response and returns false when the room is
+// missing or retired, so nothing new gets put in it.
+func (h *Handlers) roomIsActive(w http.ResponseWriter, r *http.Request, roomId int) bool {
+	room, err := h.store.GetRoom(r.Context(), roomId)
+	if err == errRoomNotFound {
+		writeApiError(w, &ApiError{Status: http.StatusBadRequest, Code: CodeRoomNotFound, Message: err.Error(), Field: "freezer_location_id"})
+		return false
+	}
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return false
 	}
+	if room.Retired {
+		writeApiError(w, &ApiError{Status: http.StatusConflict, Code: CodeRetired, Message: "Room " + room.Lab + " – " + room.Floor + " is retired", Field: "freezer_location_id"})
+		return false
+	}
+	return true
+}
 
-	query += where + " ORDER BY floor LIMIT $" + strconv.Itoa(len(args)+1) + " OFFSET $" + strconv.Itoa(len(args)+2)
-	args = append(args, limit, offset)
+// createRoom adds a lab/floor. Only lab-wide managers can add rooms.
+func (h *Handlers) createRoom(w http.ResponseWriter, r *http.Request, room FreezerRoom) (FreezerRoom, bool) {
+	if apiErr := validateRoom(room); apiErr != nil {
+		writeApiError(w, apiErr)
+		return room, false
+	}
+	if !h.requireRoomRole(w, r, RoleManager, nil) {
+		return room, false
+	}
 
-	logger.LogMessage(query)
-	rows, err := db.Query(context.Background(), query, args...)
+	room, err := h.store.CreateRoom(r.Context(), r, room)
 	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return room, false
 	}
+	return room, true
+}
+
+func (h *Handlers) editRoom(w http.ResponseWriter, r *http.Request, room FreezerRoom) (FreezerRoom, bool) {
+	if apiErr := validateRoom(room); apiErr != nil {
+		writeApiError(w, apiErr)
+		return room, false
+	}
+	if !h.requireRoomRole(w, r, RoleManager, &room.Id) {
+		return room, false
+	}
+
+	room, err := h.store.UpdateRoom(r.Context(), r, room)
+	if err == errRoomNotFound {
+		writeError(w, http.StatusNotFound, CodeRoomNotFound, err.Error())
+		return room, false
+	}
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return room, false
+	}
+	return room, true
+}
 
-	defer rows.Close()
+// retireRoom takes a room out of service once all of its freezers are retired.
+func (h *Handlers) retireRoom(w http.ResponseWriter, r *http.Request, roomId int) (FreezerRoom, bool) {
+	room, err := h.store.GetRoom(r.Context(), roomId)
+	if err == errRoomNotFound {
+		writeError(w, http.StatusNotFound, CodeRoomNotFound, err.Error())
+		return room, false
+	}
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return room, false
+	}
 
-	var results []FreezerRoom
+	if !h.requireRoomRole(w, r, RoleManager, &roomId) {
+		return room, false
+	}
 
-	for rows.Next(){
-		var freezerRoom FreezerRoom
-		lab := ""
-		floor := ""
-		id := 0
+	active, err := h.store.ListFreezers(r.Context(), &roomId, false)
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return room, false
+	}
+	if freezers := len(active); freezers > 0 {
+		writeApiError(w, &ApiError{Status: http.StatusConflict, Code: CodeRoomNotEmpty, Message: fmt.Sprintf("Room still has %d freezers in service, retire or move them first", freezers), Details: map[string]int{"freezers": freezers}})
+		return room, false
+	}
 
-		err := rows.Scan(
-			&lab, &floor, &id,
-		)
-		if err != nil {
-			http.Error(w, err.Error(), 500)
-			return
-		}
-		
-		freezerRoom.Lab = lab
-		freezerRoom.Floor = floor
-		freezerRoom.Id = id
-		results = append(results, freezerRoom)
+	room, err = h.store.RetireRoom(r.Context(), r, roomId)
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return room, false
 	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(results)
+	return room, true
 }
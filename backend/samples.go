@@ -0,0 +1,394 @@
+package freezerinv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"gitlab.com/UrsusArcTech/logger"
+)
+
+var errSampleLinkNotFound = errors.New("Sample link not found")
+
+// SampleLink is a sample stored in a box. SampleId is what the type's
+// resolver matched the entered name to, nil when it matched nothing.
+type SampleLink struct {
+	SampleType  string `json:"sample_type"`
+	SampleId    *int   `json:"sample_id"`
+	EnteredName string `json:"entered_name"`
+	BoxId       int    `json:"box_id"`
+	Position    *int   `json:"position"`
+	Checkout
+	Aliquot
+}
+
+type SampleLocation struct {
+	Shelf        int    `json:"shelf"`
+	EnteredName  string `json:"entered_name"`
+	BoxName      string `json:"box_name"`
+	FreezerName  string `json:"freezer_name"`
+	FreezerModel string `json:"freezer_model"`
+	Lab          string `json:"lab"`
+	Floor        string `json:"floor"`
+	Checkout
+}
+
+// listSampleLinks lists the samples of one type in a box, in well order.
+func (h *Handlers) listSampleLinks(w http.ResponseWriter, r *http.Request, t *SampleType, boxId string) ([]SampleLink, bool) {
+	if boxId == "" {
+		logger.LogError("No box ID specified for " + t.Label)
+		writeValidationError(w, "boxid", "No box ID specified for "+t.Label)
+		return nil, false
+	}
+	id, err := strconv.Atoi(boxId)
+	if err != nil {
+		writeValidationError(w, "boxid", "Invalid boxid: "+boxId)
+		return nil, false
+	}
+	if !h.requireReadScope(w, r, nil, nil, &id) {
+		return nil, false
+	}
+
+	results, err := h.store.ListSampleLinks(r.Context(), t, id)
+	if err != nil {
+		writeDbError(w, err)
+		return nil, false
+	}
+	return results, true
+}
+
+// storedError explains why a sample stored at locations cannot be added again.
+func storedError(t *SampleType, locations []SampleLocation) *ApiError {
+	l := locations[0]
+	if l.CheckedOutBy != nil {
+		return checkedOutError(t.Label, l.Checkout, l.BoxName, locations)
+	}
+	return alreadyStoredError(t.Label, l.BoxName, l.FreezerName, l.FreezerModel, l.Shelf, l.Floor, l.Lab, locations)
+}
+
+// linkSample stores a sample name in a box, resolving it with the type's
+// resolver first. The message explains how the name was matched, empty on an
+// exact match. A nil position leaves the sample unplaced within the box.
+func (h *Handlers) linkSample(w http.ResponseWriter, r *http.Request, t *SampleType, boxId int, enteredName string, position *int) (SampleLink, string, bool) {
+	link := SampleLink{SampleType: t.Key, EnteredName: enteredName, BoxId: boxId, Position: position}
+
+	if !h.requireBoxRole(w, r, RoleTechnician, boxId) {
+		return link, "", false
+	}
+	box, err := h.store.GetBox(r.Context(), boxId)
+	if err != nil {
+		logger.LogError("Box lookup error: " + err.Error())
+		writeDbError(w, err)
+		return link, "", false
+	}
+	retired, err := h.retiredBoxError(r.Context(), box)
+	if err != nil {
+		logger.LogError("Box lookup error: " + err.Error())
+		writeDbError(w, err)
+		return link, "", false
+	}
+	if retired != nil {
+		writeApiError(w, retired)
+		return link, "", false
+	}
+
+	existing, err := h.store.FindSampleLocations(r.Context(), t, enteredName)
+	if err != nil {
+		logger.LogError(t.Label+" box check err: ", err.Error())
+		writeDbError(w, err)
+		return link, "", false
+	}
+	if len(existing) > 0 {
+		writeApiError(w, storedError(t, existing))
+		return link, "", false
+	}
+	if position != nil && !h.checkPositionFree(w, r, boxId, *position, t.Key, enteredName) {
+		return link, "", false
+	}
+
+	sampleId, sampleName, _ := t.resolve(r.Context(), enteredName)
+	if sampleId != -1 {
+		link.SampleId = &sampleId
+	}
+
+	link, err = h.store.CreateSampleLink(r.Context(), r, t, link)
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return link, "", false
+	}
+
+	message := ""
+	if sampleId == -1 && t.Resolver != noResolver {
+		message = t.Label + " ID was not found in database or is not unique (unique IDs can be used). The record is recorded but not linked to the " + t.Label + " table."
+	} else if sampleId != -1 && sampleName != enteredName {
+		message = t.Label + " ID matched to: " + sampleName + ". This will be used."
+	}
+	return link, message, true
+}
+
+// retiredBoxError reports a box whose freezer or room is retired, so no
+// samples go into it, or nil.
+func (h *Handlers) retiredBoxError(ctx context.Context, box Box) (*ApiError, error) {
+	freezer, err := h.store.GetFreezer(ctx, box.FreezerId)
+	if err != nil {
+		return nil, err
+	}
+	room, err := h.store.GetRoom(ctx, freezer.FreezerLocationId)
+	if err != nil {
+		return nil, err
+	}
+	if freezer.Retired || room.Retired {
+		return &ApiError{Status: http.StatusConflict, Code: CodeRetired, Message: "Box " + box.Name + " is in retired freezer " + freezer.Name, Field: "box_id"}, nil
+	}
+	return nil, nil
+}
+
+// relinkSample renames a stored sample, moves it to another box and/or to
+// another position. An empty newName keeps the name, a nil boxId keeps the
+// box. A nil position keeps the well unless the sample changes box; position
+// 0 clears it.
+func (h *Handlers) relinkSample(w http.ResponseWriter, r *http.Request, t *SampleType, enteredName string, newName string, boxId *int, position *int) bool {
+	if !h.requireLinkRole(w, r, RoleTechnician, t, enteredName) {
+		return false
+	}
+	if boxId != nil && !h.requireBoxRole(w, r, RoleTechnician, *boxId) {
+		return false
+	}
+
+	change := SampleLinkChange{NewName: newName, BoxId: boxId}
+	if position != nil {
+		if *position == 0 {
+			change.ClearPosition = true
+		} else {
+			targetBox, ok := h.sampleLinkBox(w, r, t, enteredName, boxId)
+			if !ok {
+				return false
+			}
+			if !h.checkPositionFree(w, r, targetBox, *position, t.Key, enteredName) {
+				return false
+			}
+			change.Position = position
+		}
+	}
+	if newName == "" && boxId == nil && position == nil {
+		writeValidationError(w, "entered_name", "Nothing to update: give a new name, box or position")
+		return false
+	}
+
+	rowsAffected, err := h.store.UpdateSampleLink(r.Context(), r, t, enteredName, change)
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return false
+	}
+
+	if rowsAffected == 0 {
+		logger.LogError("No rows affected - " + t.Key + " link not found")
+		writeError(w, http.StatusNotFound, CodeSampleNotFound, t.Label+" link not found")
+		return false
+	}
+	return true
+}
+
+// sampleLinkBox is the box a sample is going to: boxId when moving, otherwise
+// the box it is in now.
+func (h *Handlers) sampleLinkBox(w http.ResponseWriter, r *http.Request, t *SampleType, enteredName string, boxId *int) (int, bool) {
+	if boxId != nil {
+		return *boxId, true
+	}
+
+	link, err := h.store.GetSampleLink(r.Context(), t, enteredName)
+	if err == errSampleLinkNotFound {
+		writeError(w, http.StatusNotFound, CodeSampleNotFound, t.Label+" link not found")
+		return 0, false
+	}
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return 0, false
+	}
+	return link.BoxId, true
+}
+
+func (h *Handlers) unlinkSample(w http.ResponseWriter, r *http.Request, t *SampleType, enteredName string) bool {
+	if !h.requireLinkRole(w, r, RoleTechnician, t, enteredName) {
+		return false
+	}
+
+	rowsAffected, err := h.store.DeleteSampleLink(r.Context(), r, t, enteredName)
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return false
+	}
+
+	if rowsAffected == 0 {
+		logger.LogError("No rows affected - " + t.Key + " link not found")
+		writeError(w, http.StatusNotFound, CodeSampleNotFound, t.Label+" link not found")
+		return false
+	}
+	return true
+}
+
+// the legacy query string routes, one set per built in type
+
+// legacyLinks adds the old per-table id key, e.g. edna_id, that clients of
+// the legacy routes read.
+func legacyLinks(t *SampleType, links []SampleLink) []map[string]interface{} {
+	var out []map[string]interface{}
+	for _, link := range links {
+		var row map[string]interface{}
+		data, _ := json.Marshal(link)
+		json.Unmarshal(data, &row)
+		row[t.IdColumn] = link.SampleId
+		out = append(out, row)
+	}
+	return out
+}
+
+func (h *Handlers) legacyLinkByBox(w http.ResponseWriter, r *http.Request, t *SampleType) {
+	if links, ok := h.listSampleLinks(w, r, t, r.URL.Query().Get("boxid")); ok {
+		writeJSON(w, http.StatusOK, legacyLinks(t, links))
+	}
+}
+
+func (h *Handlers) legacyAlreadyInABox(w http.ResponseWriter, r *http.Request, t *SampleType, param string) {
+	enteredName := r.URL.Query().Get(param)
+
+	if enteredName == "" {
+		logger.LogError("Empty " + t.Label + " name for link check")
+		writeValidationError(w, param, "Empty "+t.Label+" name for link check")
+		return
+	}
+	if !h.requireLinkRole(w, r, RoleViewer, t, enteredName) {
+		return
+	}
+
+	results, err := h.store.FindSampleLocations(r.Context(), t, enteredName)
+	if err != nil {
+		logger.LogError(t.Label+" box check err: ", err.Error())
+		writeDbError(w, err)
+		return
+	}
+
+	if len(results) > 0 {
+		writeApiError(w, storedError(t, results))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, []SampleLocation{})
+}
+
+func (h *Handlers) legacyInsertLink(w http.ResponseWriter, r *http.Request, t *SampleType) {
+	enteredName := r.URL.Query().Get("enteredname")
+	boxId := r.URL.Query().Get("boxid")
+
+	if enteredName == "" || boxId == "" {
+		logger.LogError("Missing required fields: enteredname, and boxid")
+		writeValidationError(w, firstMissing(r, "enteredname", "boxid"), "Missing required fields: enteredname, and boxid")
+		return
+	}
+
+	ids, ok := queryInts(w, r, "boxid")
+	if !ok {
+		return
+	}
+	position, ok := queryOptionalInt(w, r, "position")
+	if !ok {
+		return
+	}
+
+	_, message, ok := h.linkSample(w, r, t, ids[0], enteredName, position)
+	if !ok {
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(message))
+}
+
+func (h *Handlers) legacyUpdateLink(w http.ResponseWriter, r *http.Request, t *SampleType) {
+	boxId := r.URL.Query().Get("boxid")
+	enteredname := r.URL.Query().Get("enteredname")
+	newenteredname := r.URL.Query().Get("newenteredname")
+
+	if boxId == "" || enteredname == "" {
+		logger.LogError("Missing required fields: enteredname, and boxid")
+		writeValidationError(w, firstMissing(r, "enteredname", "boxid"), "Missing required fields: enteredname, and boxid")
+		return
+	}
+
+	ids, ok := queryInts(w, r, "boxid")
+	if !ok {
+		return
+	}
+	position, ok := queryOptionalInt(w, r, "position")
+	if !ok {
+		return
+	}
+
+	if !h.relinkSample(w, r, t, enteredname, newenteredname, &ids[0], position) {
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *Handlers) legacyDeleteLink(w http.ResponseWriter, r *http.Request, t *SampleType) {
+	enteredname := r.URL.Query().Get("enteredname")
+
+	if enteredname == "" {
+		logger.LogError("Missing required fields: enteredname")
+		writeValidationError(w, "enteredname", "Missing required fields: enteredname")
+		return
+	}
+
+	if !h.unlinkSample(w, r, t, enteredname) {
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *Handlers) EdnaLinkByBox(w http.ResponseWriter, r *http.Request) {
+	h.legacyLinkByBox(w, r, sampleTypesByKey["edna"])
+}
+
+func (h *Handlers) CheckEdnaAlreadyInABox(w http.ResponseWriter, r *http.Request) {
+	h.legacyAlreadyInABox(w, r, sampleTypesByKey["edna"], "ednaid")
+}
+
+func (h *Handlers) InsertEdnaLink(w http.ResponseWriter, r *http.Request) {
+	h.legacyInsertLink(w, r, sampleTypesByKey["edna"])
+}
+
+func (h *Handlers) UpdateEdnaLink(w http.ResponseWriter, r *http.Request) {
+	h.legacyUpdateLink(w, r, sampleTypesByKey["edna"])
+}
+
+func (h *Handlers) DeleteEdnaLink(w http.ResponseWriter, r *http.Request) {
+	h.legacyDeleteLink(w, r, sampleTypesByKey["edna"])
+}
+
+func (h *Handlers) FishLinkByBox(w http.ResponseWriter, r *http.Request) {
+	h.legacyLinkByBox(w, r, sampleTypesByKey["fish"])
+}
+
+func (h *Handlers) CheckFishAlreadyInABox(w http.ResponseWriter, r *http.Request) {
+	h.legacyAlreadyInABox(w, r, sampleTypesByKey["fish"], "fishid")
+}
+
+func (h *Handlers) InsertfishLink(w http.ResponseWriter, r *http.Request) {
+	h.legacyInsertLink(w, r, sampleTypesByKey["fish"])
+}
+
+func (h *Handlers) UpdateFishLink(w http.ResponseWriter, r *http.Request) {
+	h.legacyUpdateLink(w, r, sampleTypesByKey["fish"])
+}
+
+func (h *Handlers) DeleteFishLink(w http.ResponseWriter, r *http.Request) {
+	h.legacyDeleteLink(w, r, sampleTypesByKey["fish"])
+}
@@ -0,0 +1,250 @@
+package freezerinv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"gitlab.com/UrsusArcTech/logger"
+	"gitlab.com/mgl-database/mgl-go/object_processing_x/object_processing_edna"
+	"gitlab.com/mgl-database/mgl-go/object_processing_x/object_processing_specimen"
+)
+
+// SampleType is a kind of sample the inventory stores. Every type has its own
+// link table with the same columns: entered_name, box_id, position, the
+// checkout and aliquot columns, and IdColumn for the id the resolver found.
+type SampleType struct {
+	// Key names the type in URLs, reports and import files, e.g. edna
+	Key   string `json:"key"`
+	Label string `json:"label"`
+	Table string `json:"table"`
+	// IdColumn holds the matched sample id, null when nothing matched
+	IdColumn string `json:"id_column"`
+	// Resolver names an entry of sampleResolvers
+	Resolver string `json:"resolver"`
+	// Aliases are other names an import file may use for the type
+	Aliases []string `json:"aliases,omitempty"`
+}
+
+// noResolver stores every name unlinked, for samples the database does not
+// hold yet.
+const noResolver = "none"
+
+// sampleResolvers are the lookups a sample type can use. InitResolvers adds
+// the cache or swaps in the stub file.
+var sampleResolvers = map[string]SampleResolver{
+	"edna":     newMglResolver(object_processing_edna.GetEDNAID, defaultResolverTimeout, defaultMaxLookups),
+	"specimen": newMglResolver(object_processing_specimen.GetSpecimenID, defaultResolverTimeout, defaultMaxLookups),
+	noResolver: noneResolver{},
+}
+
+// sampleTypes are the registered types in the order they are listed.
+var (
+	sampleTypes      []*SampleType
+	sampleTypesByKey = map[string]*SampleType{}
+)
+
+var (
+	sampleKeyPattern   = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+	identifierPattern  = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+	linkTablePattern   = regexp.MustCompile(`^([a-z_][a-z0-9_]*\.)?[a-z_][a-z0-9_]*$`)
+	reservedSampleKeys = map[string]bool{"box": true, "freezer": true, "out": true}
+)
+
+func init() {
+	for _, t := range []SampleType{
+		{Key: "edna", Label: "eDNA", Table: ednaLinkTable, IdColumn: "edna_id", Resolver: "edna", Aliases: []string{"e-dna"}},
+		{Key: "fish", Label: "Fish", Table: fishLinkTable, IdColumn: "fish_id", Resolver: "specimen", Aliases: []string{"fin clip"}},
+	} {
+		if err := registerSampleType(t); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// registerSampleType adds t to the registry. Table and column names go into
+// queries as they are, so they must be plain identifiers.
+func registerSampleType(t SampleType) error {
+	t.Key = strings.ToLower(strings.TrimSpace(t.Key))
+	switch {
+	case !sampleKeyPattern.MatchString(t.Key):
+		return fmt.Errorf("sample type key %q must be lower case letters, digits and underscores", t.Key)
+	case reservedSampleKeys[t.Key]:
+		return fmt.Errorf("sample type key %q is reserved", t.Key)
+	case t.Label == "":
+		return fmt.Errorf("sample type %s has no label", t.Key)
+	case !linkTablePattern.MatchString(t.Table):
+		return fmt.Errorf("sample type %s: %q is not a table name", t.Key, t.Table)
+	case !identifierPattern.MatchString(t.IdColumn):
+		return fmt.Errorf("sample type %s: %q is not a column name", t.Key, t.IdColumn)
+	}
+	if _, ok := sampleResolvers[t.Resolver]; !ok {
+		return fmt.Errorf("sample type %s: unknown resolver %q", t.Key, t.Resolver)
+	}
+	for _, name := range append([]string{t.Key}, t.Aliases...) {
+		if _, taken := lookupSampleType(name); taken {
+			return fmt.Errorf("sample type %s: %q is already used by another type", t.Key, name)
+		}
+	}
+	for _, other := range sampleTypes {
+		if other.Table == t.Table {
+			return fmt.Errorf("sample type %s: table %s already belongs to %s", t.Key, t.Table, other.Key)
+		}
+	}
+
+	registered := t
+	sampleTypes = append(sampleTypes, &registered)
+	sampleTypesByKey[t.Key] = &registered
+	constraintCodes[registered.indexName("position")] = CodePositionOccupied
+	constraintCodes[registered.uniqueName("entered_name")] = CodeSampleAlreadyStored
+	return nil
+}
+
+// LoadSampleTypes registers the types listed in a JSON file after the built
+// in eDNA and fish types. An empty path loads nothing.
+func LoadSampleTypes(path string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var types []SampleType
+	if err := json.Unmarshal(data, &types); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	for _, t := range types {
+		if err := registerSampleType(t); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		logger.LogMessage("Registered sample type " + t.Key + " in " + t.Table)
+	}
+	return nil
+}
+
+// CheckSampleTypeTables makes sure every registered type has its link table,
+// with its id column, in Postgres. Types from SAMPLE_TYPES_FILE need a
+// migration creating the table, like 0015_sample_types.
+func CheckSampleTypeTables(ctx context.Context) error {
+	var missing []string
+	for _, t := range sampleTypes {
+		var table, column bool
+		err := db.QueryRow(ctx, "SELECT to_regclass($1) IS NOT NULL, EXISTS (SELECT 1 FROM pg_attribute WHERE attrelid = to_regclass($1) AND attname = $2 AND NOT attisdropped)", t.Table, t.IdColumn).Scan(&table, &column)
+		if err != nil {
+			return err
+		}
+		switch {
+		case !table:
+			missing = append(missing, t.Key+" (no table "+t.Table+")")
+		case !column:
+			missing = append(missing, t.Key+" (no column "+t.IdColumn+" in "+t.Table+")")
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("sample types without a link table: %s; add a migration creating them and run migrate up", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// lookupSampleType finds a type by its key or one of its aliases, ignoring
+// case and surrounding spaces.
+func lookupSampleType(name string) (*SampleType, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if t, ok := sampleTypesByKey[name]; ok {
+		return t, true
+	}
+	for _, t := range sampleTypes {
+		for _, alias := range t.Aliases {
+			if strings.ToLower(alias) == name {
+				return t, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// sampleTypeChoices lists the type keys and any extra choices for an error
+// message, e.g. "edna, fish, box or freezer".
+func sampleTypeChoices(extra ...string) string {
+	var keys []string
+	for _, t := range sampleTypes {
+		keys = append(keys, t.Key)
+	}
+	keys = append(keys, extra...)
+	if len(keys) == 1 {
+		return keys[0]
+	}
+	return strings.Join(keys[:len(keys)-1], ", ") + " or " + keys[len(keys)-1]
+}
+
+// pathSampleType reads the {type} path value, or writes a 404.
+func pathSampleType(w http.ResponseWriter, r *http.Request) (*SampleType, bool) {
+	key := r.PathValue("type")
+	t, ok := sampleTypesByKey[key]
+	if !ok {
+		writeError(w, http.StatusNotFound, CodeNotFound, "Unknown sample type "+key+", use "+sampleTypeChoices())
+	}
+	return t, ok
+}
+
+// indexName is the name an index on the link table gets in the migrations,
+// e.g. mgl_edna_box_link_position_idx.
+func (t *SampleType) indexName(purpose string) string {
+	table := t.Table[strings.LastIndex(t.Table, ".")+1:]
+	return table + "_" + purpose + "_idx"
+}
+
+// uniqueName is the name Postgres gives an inline UNIQUE constraint on a
+// column of the link table, e.g. mgl_edna_box_link_entered_name_key.
+func (t *SampleType) uniqueName(column string) string {
+	table := t.Table[strings.LastIndex(t.Table, ".")+1:]
+	return table + "_" + column + "_key"
+}
+
+// resolve looks the entered name up with the type's resolver. A failed lookup
+// is logged and comes back as -1 along with its error, so callers that store
+// the sample unlinked can ignore it.
+func (t *SampleType) resolve(ctx context.Context, enteredName string) (int, string, error) {
+	if t.Resolver == noResolver {
+		return -1, "", nil
+	}
+	foundId, foundName, err := sampleResolvers[t.Resolver].Resolve(ctx, enteredName)
+	if err != nil {
+		logger.LogError(enteredName, " - "+t.Label+" lookup failed, storing it unlinked: ", err.Error())
+		return -1, "", err
+	}
+
+	if foundId == -1 && foundName == "" {
+		logger.LogError(enteredName, " - "+t.Label+" not linked. May be due to being not a unique ID. Try using unique ID.")
+		return foundId, foundName, nil
+	}
+
+	logger.LogMessage("Using: ", foundName, " from ", enteredName, " found "+t.Label+" sample: ", foundName, " with ID: ", foundId)
+	return foundId, foundName, nil
+}
+
+// unionLinks stacks every link table into one query, each row starting with
+// its type key as sample_type. In columns, {id} stands for the table's
+// IdColumn; where is added to each part as it is.
+func unionLinks(columns string, where string) string {
+	var parts []string
+	for _, t := range sampleTypes {
+		part := "SELECT '" + t.Key + "' AS sample_type, " + strings.ReplaceAll(columns, "{id}", t.IdColumn) + " FROM " + t.Table
+		if where != "" {
+			part += " WHERE " + where
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, " UNION ALL ")
+}
+
+// ApiSampleTypes lists the registered sample types, for the UI to build one
+// list per type.
+func ApiSampleTypes(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, sampleTypes)
+}
@@ -0,0 +1,297 @@
+package freezerinv
+
+import (
+	"context"
+	"net/http"
+
+	"gitlab.com/UrsusArcTech/logger"
+)
+
+// ScanResult says what a scanned code is. Box and freezer codes come from
+// our labels, anything else is taken to be a tube barcode, i.e. the sample's
+// entered name.
+type ScanResult struct {
+	// Kind is box, freezer or sample
+	Kind    string     `json:"kind"`
+	Code    string     `json:"code"`
+	Box     *Box       `json:"box,omitempty"`
+	Freezer *FreezerDB `json:"freezer,omitempty"`
+	// for samples: the box it is in, nil if it is not stored anywhere
+	SampleType  string `json:"sample_type,omitempty"`
+	EnteredName string `json:"entered_name,omitempty"`
+	BoxId       *int   `json:"box_id,omitempty"`
+	// Candidates are the sample types an unstored name resolves to
+	Candidates []string `json:"candidates,omitempty"`
+}
+
+type scanRequest struct {
+	Code string `json:"code"`
+	// Action is in, out (check the sample out, it keeps its place) or remove
+	// (take it out of the box for good)
+	Action string `json:"action"`
+	// SampleType picks the sample type key when the code alone cannot tell
+	SampleType string `json:"sample_type"`
+}
+
+type ScanFiled struct {
+	// Result is checked_in, checked_out, removed, returned or already_here
+	Result      string      `json:"result"`
+	SampleType  string      `json:"sample_type"`
+	EnteredName string      `json:"entered_name"`
+	BoxId       int         `json:"box_id"`
+	Link        interface{} `json:"link,omitempty"`
+	Message     string      `json:"message,omitempty"`
+}
+
+// storedSample finds the link holding a name and the box it is in. A name
+// stored as more than one sample type is refused with the types as
+// candidates unless sampleType picks one of them.
+func (h *Handlers) storedSample(w http.ResponseWriter, r *http.Request, enteredName string, sampleType string) (link SampleLink, found bool, ok bool) {
+	var matches []SampleLink
+	for _, t := range sampleTypes {
+		if sampleType != "" && t.Key != sampleType {
+			continue
+		}
+		link, err := h.store.GetSampleLink(r.Context(), t, enteredName)
+		if err == errSampleLinkNotFound {
+			continue
+		}
+		if err != nil {
+			logger.LogError("Database error: " + err.Error())
+			writeDbError(w, err)
+			return link, false, false
+		}
+		matches = append(matches, link)
+	}
+
+	switch len(matches) {
+	case 0:
+		return link, false, true
+	case 1:
+		return matches[0], true, true
+	}
+	candidates := make([]string, len(matches))
+	for i, match := range matches {
+		candidates[i] = match.SampleType
+	}
+	writeApiError(w, &ApiError{
+		Status:  http.StatusBadRequest,
+		Code:    CodeValidationFailed,
+		Message: enteredName + " is stored as more than one sample type, pick a sample type",
+		Field:   "sample_type",
+		Details: ScanResult{Kind: "sample", Code: enteredName, EnteredName: enteredName, Candidates: candidates},
+	})
+	return link, false, false
+}
+
+// sampleCandidates lists the sample types a name resolves in.
+func sampleCandidates(ctx context.Context, enteredName string) []string {
+	var candidates []string
+	for _, t := range sampleTypes {
+		if id, _, _ := t.resolve(ctx, enteredName); id != -1 {
+			candidates = append(candidates, t.Key)
+		}
+	}
+	return candidates
+}
+
+// ApiResolveScan resolves a scanned code to a box, a freezer or a sample.
+func (h *Handlers) ApiResolveScan(w http.ResponseWriter, r *http.Request) {
+	code := r.PathValue("code")
+	result := ScanResult{Code: code}
+
+	if prefix, id, ok := parseCode(code); ok {
+		switch prefix {
+		case boxCodePrefix:
+			box, err := h.store.GetBox(r.Context(), id)
+			if err == errBoxNotFound {
+				writeError(w, http.StatusNotFound, CodeBoxNotFound, "No box has the code "+code)
+				return
+			}
+			if err != nil {
+				writeDbError(w, err)
+				return
+			}
+			if !h.requireReadScope(w, r, nil, nil, &box.Id) {
+				return
+			}
+			result.Kind = "box"
+			result.Box = &box
+
+		case freezerCodePrefix:
+			freezer, err := h.store.GetFreezer(r.Context(), id)
+			if err == errFreezerNotFound {
+				writeError(w, http.StatusNotFound, CodeFreezerNotFound, "No freezer has the code "+code)
+				return
+			}
+			if err != nil {
+				writeDbError(w, err)
+				return
+			}
+			if !h.requireReadScope(w, r, nil, &freezer.Id, nil) {
+				return
+			}
+			result.Kind = "freezer"
+			result.Freezer = &freezer
+		}
+		writeJSON(w, http.StatusOK, result)
+		return
+	}
+
+	result.Kind = "sample"
+	result.EnteredName = code
+
+	// any signed in user may look a name up, a stored one needs its box
+	if !h.requireRole(w, r, RoleViewer) {
+		return
+	}
+
+	sampleType := r.URL.Query().Get("sample_type")
+	if _, ok := sampleTypesByKey[sampleType]; sampleType != "" && !ok {
+		writeValidationError(w, "sample_type", "Unknown sample type "+sampleType+", use "+sampleTypeChoices())
+		return
+	}
+	stored, found, ok := h.storedSample(w, r, code, sampleType)
+	if !ok {
+		return
+	}
+	if found && !h.requireReadScope(w, r, nil, nil, &stored.BoxId) {
+		return
+	}
+	if found {
+		result.SampleType = stored.SampleType
+		result.BoxId = &stored.BoxId
+	} else {
+		result.Candidates = sampleCandidates(r.Context(), code)
+		if len(result.Candidates) == 1 {
+			result.SampleType = result.Candidates[0]
+		}
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// ApiScanIntoBox files a scanned tube into the box, checks it out of the box
+// or removes it for good, using the same checks as doing so by hand.
+func (h *Handlers) ApiScanIntoBox(w http.ResponseWriter, r *http.Request) {
+	boxId, ok := pathInt(w, r, "id")
+	if !ok {
+		return
+	}
+	var req scanRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if req.Code == "" {
+		writeValidationError(w, "code", "Missing required fields: code")
+		return
+	}
+	if req.Action != "in" && req.Action != "out" && req.Action != "remove" {
+		writeValidationError(w, "action", "Unknown action "+req.Action+", use in, out or remove")
+		return
+	}
+	if _, ok := sampleTypesByKey[req.SampleType]; req.SampleType != "" && !ok {
+		writeValidationError(w, "sample_type", "Unknown sample type "+req.SampleType+", use "+sampleTypeChoices())
+		return
+	}
+
+	if _, err := h.store.GetBox(r.Context(), boxId); err == errBoxNotFound {
+		writeError(w, http.StatusNotFound, CodeBoxNotFound, err.Error())
+		return
+	} else if err != nil {
+		writeDbError(w, err)
+		return
+	}
+
+	stored, found, ok := h.storedSample(w, r, req.Code, req.SampleType)
+	if !ok {
+		return
+	}
+	storedType, storedBox := stored.SampleType, stored.BoxId
+
+	filed := ScanFiled{SampleType: storedType, EnteredName: req.Code, BoxId: boxId}
+
+	if req.Action == "out" || req.Action == "remove" {
+		if !found {
+			writeError(w, http.StatusNotFound, CodeSampleNotFound, req.Code+" is not in any box")
+			return
+		}
+		if storedBox != boxId {
+			writeApiError(w, h.wrongBoxError(r.Context(), req.Code, storedType, storedBox))
+			return
+		}
+
+		t := sampleTypesByKey[storedType]
+		if req.Action == "remove" {
+			if !h.unlinkSample(w, r, t, req.Code) {
+				return
+			}
+			filed.Result = "removed"
+			writeJSON(w, http.StatusOK, filed)
+			return
+		}
+
+		state, ok := h.checkoutSample(w, r, t, req.Code, checkoutRequest{})
+		if !ok {
+			return
+		}
+		filed.Result = "checked_out"
+		filed.Link = state
+		writeJSON(w, http.StatusOK, filed)
+		return
+	}
+
+	if found && storedBox == boxId {
+		t := sampleTypesByKey[storedType]
+		checkout, ok := h.loadCheckout(w, r, t, req.Code)
+		if !ok {
+			return
+		}
+		// scanning a checked out sample back into its own box returns it
+		if checkout.CheckedOutBy != nil {
+			state, ok := h.returnSample(w, r, t, req.Code)
+			if !ok {
+				return
+			}
+			filed.Result = "returned"
+			filed.Link = state
+			writeJSON(w, http.StatusOK, filed)
+			return
+		}
+		filed.Result = "already_here"
+		writeJSON(w, http.StatusOK, filed)
+		return
+	}
+
+	// a sample stored elsewhere keeps its type so linking reports the conflict
+	sampleType := storedType
+	if !found {
+		sampleType = req.SampleType
+	}
+	if sampleType == "" {
+		candidates := sampleCandidates(r.Context(), req.Code)
+		if len(candidates) != 1 {
+			writeValidationError(w, "sample_type", "Cannot tell what type of sample "+req.Code+" is, pick a sample type")
+			return
+		}
+		sampleType = candidates[0]
+	}
+	filed.SampleType = sampleType
+
+	link, message, ok := h.linkSample(w, r, sampleTypesByKey[sampleType], boxId, req.Code, nil)
+	if !ok {
+		return
+	}
+	filed.Link, filed.Message = link, message
+
+	filed.Result = "checked_in"
+	writeJSON(w, http.StatusCreated, filed)
+}
+
+// wrongBoxError is a check out scan of a sample that lives in another box.
+func (h *Handlers) wrongBoxError(ctx context.Context, enteredName string, sampleType string, boxId int) *ApiError {
+	message := enteredName + " is not in this box"
+	if box, err := h.store.GetBox(ctx, boxId); err == nil {
+		message += ", it is in box " + box.Name
+	}
+	return &ApiError{Status: http.StatusConflict, Code: CodeWrongBox, Message: message, Details: ScanResult{Kind: "sample", Code: enteredName, SampleType: sampleType, EnteredName: enteredName, BoxId: &boxId}}
+}
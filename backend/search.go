@@ -0,0 +1,176 @@
+package freezerinv
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"gitlab.com/UrsusArcTech/logger"
+)
+
+// how a search hit matched, best first
+const (
+	matchExact     = "exact"
+	matchPrefix    = "prefix"
+	matchSubstring = "substring"
+	matchFuzzy     = "fuzzy"
+)
+
+var matchRanks = []string{matchExact, matchPrefix, matchSubstring, matchFuzzy}
+
+// LocationPath is where something is, from the room down. Fields below the
+// level of the hit are nil, a freezer has no box.
+type LocationPath struct {
+	RoomId        int     `json:"room_id"`
+	Lab           string  `json:"lab"`
+	Floor         string  `json:"floor"`
+	FreezerId     int     `json:"freezer_id"`
+	FreezerName   string  `json:"freezer_name"`
+	Shelf         *int    `json:"shelf"`
+	Rack          *int    `json:"rack"`
+	Drawer        *int    `json:"drawer"`
+	BoxId         *int    `json:"box_id"`
+	BoxName       *string `json:"box_name"`
+	Position      *int    `json:"position"`
+	PositionLabel *string `json:"position_label"`
+}
+
+type SearchResult struct {
+	// Kind is a sample type key, box or freezer
+	Kind       string       `json:"kind"`
+	Name       string       `json:"name"`
+	Match      string       `json:"match"`
+	Similarity float64      `json:"similarity"`
+	Path       LocationPath `json:"path"`
+}
+
+type SearchPage struct {
+	Query   string         `json:"query"`
+	Total   int            `json:"total"`
+	Limit   int            `json:"limit"`
+	Offset  int            `json:"offset"`
+	Results []SearchResult `json:"results"`
+}
+
+// searchHits puts the searchable names side by side: samples from every link
+// table, box names and the names of freezers still in use.
+func searchHits() string {
+	return "SELECT * FROM (" + unionLinks("entered_name, box_id, NULL::int, position", "") + ") s(kind, name, box_id, freezer_id, position) " +
+		"UNION ALL SELECT 'box', name, id, NULL::int, NULL::int FROM mgl_freezer_inventory.boxes " +
+		"UNION ALL SELECT 'freezer', name, NULL::int, id, NULL::int FROM mgl_freezer_inventory.freezer WHERE NOT retired"
+}
+
+// escapeLike makes s match literally inside a LIKE pattern.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// Search matches q against sample names, box names and freezer names by
+// prefix, substring and trigram similarity. Filters: type (a sample type key,
+// box or freezer), limit and offset.
+func (h *Handlers) Search(w http.ResponseWriter, r *http.Request) {
+	if !h.requireReadScope(w, r, nil, nil, nil) {
+		return
+	}
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	if q == "" {
+		writeValidationError(w, "q", "Missing required fields: q")
+		return
+	}
+
+	limit := 25
+	offset := 0
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 && l <= 200 {
+			limit = l
+		}
+	}
+	if offsetStr := r.URL.Query().Get("offset"); offsetStr != "" {
+		if o, err := strconv.Atoi(offsetStr); err == nil && o >= 0 {
+			offset = o
+		}
+	}
+
+	args := []interface{}{q, escapeLike(q) + "%", "%" + escapeLike(q) + "%"}
+	where := "(h.name ILIKE $3 OR h.name % $1)"
+
+	if kind := r.URL.Query().Get("type"); kind != "" {
+		if _, ok := sampleTypesByKey[kind]; !ok && kind != "box" && kind != "freezer" {
+			writeValidationError(w, "type", "Unknown type "+kind+", use "+sampleTypeChoices("box", "freezer"))
+			return
+		}
+		args = append(args, kind)
+		where += " AND h.kind = $" + strconv.Itoa(len(args))
+	}
+
+	query := "SELECT h.kind, h.name, " +
+		"CASE WHEN lower(h.name) = lower($1) THEN 0 WHEN h.name ILIKE $2 THEN 1 WHEN h.name ILIKE $3 THEN 2 ELSE 3 END AS rank, " +
+		"similarity(h.name, $1) AS score, fl.id, fl.lab, fl.floor, f.id, f.name, b.shelf, b.rack, b.drawer, b.id, b.name, b.format, h.position, count(*) OVER () " +
+		"FROM (" + searchHits() + ") h " +
+		"left join mgl_freezer_inventory.boxes b on b.id = h.box_id " +
+		"join mgl_freezer_inventory.freezer f on f.id = coalesce(h.freezer_id, b.freezer_id) " +
+		"join mgl_freezer_inventory.freezer_locations fl on fl.id = f.freezer_location_id " +
+		"WHERE " + where +
+		" ORDER BY rank, score DESC, h.name, h.kind" +
+		" LIMIT $" + strconv.Itoa(len(args)+1) + " OFFSET $" + strconv.Itoa(len(args)+2)
+	args = append(args, limit, offset)
+
+	logger.LogMessage(query)
+	rows, err := db.Query(context.Background(), query, args...)
+	if err != nil {
+		writeDbError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	page := SearchPage{Query: q, Limit: limit, Offset: offset, Results: []SearchResult{}}
+
+	for rows.Next() {
+		var result SearchResult
+		var rank int
+		var boxFormat *string
+
+		err := rows.Scan(
+			&result.Kind,
+			&result.Name,
+			&rank,
+			&result.Similarity,
+			&result.Path.RoomId,
+			&result.Path.Lab,
+			&result.Path.Floor,
+			&result.Path.FreezerId,
+			&result.Path.FreezerName,
+			&result.Path.Shelf,
+			&result.Path.Rack,
+			&result.Path.Drawer,
+			&result.Path.BoxId,
+			&result.Path.BoxName,
+			&boxFormat,
+			&result.Path.Position,
+			&page.Total,
+		)
+
+		if err != nil {
+			writeDbError(w, err)
+			return
+		}
+
+		result.Match = matchRanks[rank]
+		if result.Path.Position != nil && boxFormat != nil {
+			if f, ok := boxFormats[*boxFormat]; ok {
+				label := f.positionLabel(*result.Path.Position)
+				result.Path.PositionLabel = &label
+			}
+		}
+
+		page.Results = append(page.Results, result)
+	}
+
+	if err := rows.Err(); err != nil {
+		writeDbError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, page)
+}
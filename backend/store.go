@@ -0,0 +1,150 @@
+package freezerinv
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// Store is the storage behind the room, freezer, box and sample link
+// handlers. Lookups of a single row return errRoomNotFound, errFreezerNotFound,
+// errBoxNotFound or errSampleLinkNotFound when there is none. Changes take the request so they are
+// audited against its session user and path.
+type Store interface {
+	// Name is postgres, sqlite or memory. The session reports it so the UI
+	// can hide what only the central database does.
+	Name() string
+
+	ListRooms(ctx context.Context, filter RoomFilter) ([]FreezerRoom, error)
+	GetRoom(ctx context.Context, roomId int) (FreezerRoom, error)
+	CreateRoom(ctx context.Context, r *http.Request, room FreezerRoom) (FreezerRoom, error)
+	// UpdateRoom saves the lab and floor, errRoomNotFound when it is gone
+	UpdateRoom(ctx context.Context, r *http.Request, room FreezerRoom) (FreezerRoom, error)
+	RetireRoom(ctx context.Context, r *http.Request, roomId int) (FreezerRoom, error)
+
+	// ListFreezers lists the freezers of one room, or of every room when
+	// roomId is nil
+	ListFreezers(ctx context.Context, roomId *int, includeRetired bool) ([]FreezerDB, error)
+	GetFreezer(ctx context.Context, freezerId int) (FreezerDB, error)
+	CreateFreezer(ctx context.Context, r *http.Request, freezer FreezerDB) (FreezerDB, error)
+	UpdateFreezer(ctx context.Context, r *http.Request, freezer FreezerDB) (FreezerDB, error)
+	RetireFreezer(ctx context.Context, r *http.Request, freezerId int) (FreezerDB, error)
+
+	// ListBoxLocations lists every box with the room and freezer it is in
+	ListBoxLocations(ctx context.Context) ([]BoxesInFreezers, error)
+	ListBoxes(ctx context.Context, freezerId int) ([]Box, error)
+	GetBox(ctx context.Context, boxId int) (Box, error)
+	// CreateBox is refused with an ApiError when the freezer is retired or the
+	// place is not in its layout
+	CreateBox(ctx context.Context, r *http.Request, box Box) (Box, *ApiError, error)
+	// UpdateBox renames, reformats and moves a box. A move is refused with an
+	// ApiError when the destination is retired, full or not in the layout.
+	UpdateBox(ctx context.Context, r *http.Request, box Box) (Box, *ApiError, error)
+	DeleteBox(ctx context.Context, r *http.Request, boxId int) error
+	// MoveBoxes moves a batch of boxes and returns their ids. Either every box
+	// moves or an ApiError says why none can, as UpdateBox does for one.
+	MoveBoxes(ctx context.Context, r *http.Request, moves []BoxMove, opts moveOptions) ([]int, *ApiError, error)
+
+	// ListSampleLinks lists the samples of one type in a box, in well order
+	ListSampleLinks(ctx context.Context, t *SampleType, boxId int) ([]SampleLink, error)
+	// GetSampleLink is the stored sample with that name
+	GetSampleLink(ctx context.Context, t *SampleType, enteredName string) (SampleLink, error)
+	// FindSampleLocations lists every box a sample name is stored in
+	FindSampleLocations(ctx context.Context, t *SampleType, enteredName string) ([]SampleLocation, error)
+	// SampleFreezerIds lists the freezers holding a sample name
+	SampleFreezerIds(ctx context.Context, t *SampleType, enteredName string) ([]int, error)
+	// CreateSampleLink stores link, with SampleId nil when nothing matched
+	CreateSampleLink(ctx context.Context, r *http.Request, t *SampleType, link SampleLink) (SampleLink, error)
+	// UpdateSampleLink applies change to the named sample and returns how many
+	// links it touched
+	UpdateSampleLink(ctx context.Context, r *http.Request, t *SampleType, enteredName string, change SampleLinkChange) (int64, error)
+	// DeleteSampleLink removes the named sample, refusing a consumed one or a
+	// parent of aliquots with keptLinkError
+	DeleteSampleLink(ctx context.Context, r *http.Request, t *SampleType, enteredName string) (int64, error)
+	// CreateSampleLinks stores every link, each in the table of its
+	// SampleType, or none of them
+	CreateSampleLinks(ctx context.Context, r *http.Request, links []SampleLink) error
+	// CheckoutSample marks the named sample out of its box, stamped now, and
+	// returns how many links it touched; none when it is already out
+	CheckoutSample(ctx context.Context, r *http.Request, t *SampleType, enteredName string, checkout Checkout) (int64, error)
+	// ReturnSample clears the checkout of the named sample and returns how
+	// many links it touched; none when it was not out
+	ReturnSample(ctx context.Context, r *http.Request, t *SampleType, enteredName string) (int64, error)
+	// SetSampleQuantity writes what is left of a sample read as was and
+	// returns how many links it touched; none when it was consumed or its
+	// quantity changed since. Consuming it frees its well.
+	SetSampleQuantity(ctx context.Context, r *http.Request, t *SampleType, was SampleLink, quantity SampleQuantity) (int64, error)
+	// CreateAliquot stores aliquot and, when taken is set, writes the
+	// parent's new quantity in the same transaction the way
+	// SetSampleQuantity does, failing with errQuantityChanged if it changed
+	CreateAliquot(ctx context.Context, r *http.Request, t *SampleType, parent SampleLink, taken *SampleQuantity, aliquot SampleLink) (SampleLink, error)
+
+	// RoleRank is the roleRank of the highest role a user holds on a freezer,
+	// counting its room and lab-wide grants. With a room and no freezer it
+	// counts the room and lab-wide grants, with neither only lab-wide ones.
+	RoleRank(ctx context.Context, username string, roomId *int, freezerId *int) (int, error)
+	// ListRoleGrants lists every grant, or one user's when username is set
+	ListRoleGrants(ctx context.Context, username string) ([]RoleGrant, error)
+	// GetRoleGrant is one grant, errRoleNotFound when there is none
+	GetRoleGrant(ctx context.Context, grantId int) (RoleGrant, error)
+	// SaveRoleGrant gives a user a role, replacing what they held on the same
+	// scope. r is nil for the grant subcommand.
+	SaveRoleGrant(ctx context.Context, r *http.Request, grant RoleGrant, grantedBy string) error
+	// DeleteRoleGrant takes away what a user holds on one scope and returns
+	// how many grants it removed
+	DeleteRoleGrant(ctx context.Context, r *http.Request, username string, roomId *int, freezerId *int) (int64, error)
+
+	// LocalUser is a local account, errUserNotFound when there is none
+	LocalUser(ctx context.Context, username string) (LocalUser, error)
+	// SaveLocalUser adds or resets a local account and enables it again
+	SaveLocalUser(ctx context.Context, username string, passwordHash string) error
+
+	// ListAudit lists the audit entries matching filter, newest first
+	ListAudit(ctx context.Context, filter AuditFilter) ([]AuditEntry, error)
+}
+
+// RoomFilter picks the rooms ListRooms returns. Search matches the lab or
+// floor.
+type RoomFilter struct {
+	Search         string
+	IncludeRetired bool
+	Limit          int
+	Offset         int
+}
+
+// SampleLinkChange is an update to a stored sample. An empty NewName keeps
+// the name and a nil BoxId keeps the box. A nil Position keeps the well
+// unless the sample changes box; ClearPosition takes it out of its well.
+type SampleLinkChange struct {
+	NewName       string
+	BoxId         *int
+	Position      *int
+	ClearPosition bool
+}
+
+// SampleQuantity is what is left of a sample. Nil amounts are not tracked;
+// Consumed marks the sample used up.
+type SampleQuantity struct {
+	VolumeUl *float64
+	Count    *int
+	Consumed bool
+}
+
+// AuditFilter picks the entries ListAudit returns. A box, freezer or sample
+// matches on either side of a change. From is inclusive, To exclusive.
+type AuditFilter struct {
+	BoxId     *int
+	FreezerId *int
+	Sample    string
+	From      *time.Time
+	To        *time.Time
+	Limit     int
+	Offset    int
+}
+
+// LocalUser is an account that logs in with a password kept by the app
+// rather than LDAP. A nil PasswordHash can only log in through LDAP.
+type LocalUser struct {
+	PasswordHash *string
+	Disabled     bool
+}
@@ -0,0 +1,805 @@
+package freezerinv
+
+import (
+	"cmp"
+	"context"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore is the Store in process memory, for the handler tests and for
+// trying the UI without a database. It makes the same checks as SQLiteStore
+// but keeps no audit log, and nothing survives a restart.
+type MemoryStore struct {
+	mu       sync.Mutex
+	lastId   int
+	rooms    map[int]FreezerRoom
+	freezers map[int]FreezerDB
+	boxes    map[int]Box
+	// links are the stored samples by type key, in the order they were added
+	links  map[string][]SampleLink
+	grants []RoleGrant
+	users  map[string]LocalUser
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		rooms:    map[int]FreezerRoom{},
+		freezers: map[int]FreezerDB{},
+		boxes:    map[int]Box{},
+		links:    map[string][]SampleLink{},
+		users:    map[string]LocalUser{},
+	}
+}
+
+// nextId hands out ids from one sequence for every table, so an id mixed up
+// between tables is never found by accident.
+func (s *MemoryStore) nextId() int {
+	s.lastId++
+	return s.lastId
+}
+
+func (s *MemoryStore) Name() string {
+	return "memory"
+}
+
+var (
+	memoryReferenceNotFound = &ApiError{Status: http.StatusBadRequest, Code: CodeReferenceNotFound, Message: "The referenced record does not exist"}
+	memoryStillReferenced   = &ApiError{Status: http.StatusConflict, Code: CodeStillReferenced, Message: "This record is still in use and cannot be removed"}
+	memoryPositionOccupied  = &ApiError{Status: http.StatusConflict, Code: CodePositionOccupied, Message: "That position is already taken", Field: "position"}
+	memoryNameTaken         = &ApiError{Status: http.StatusConflict, Code: CodeSampleAlreadyStored, Message: "A sample with this name is already stored", Field: "entered_name"}
+)
+
+func (s *MemoryStore) ListRooms(ctx context.Context, filter RoomFilter) ([]FreezerRoom, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	search := strings.ToLower(filter.Search)
+	var rooms []FreezerRoom
+	for _, room := range s.rooms {
+		if room.Retired && !filter.IncludeRetired {
+			continue
+		}
+		if search != "" && !strings.Contains(strings.ToLower(room.Lab), search) && !strings.Contains(strings.ToLower(room.Floor), search) {
+			continue
+		}
+		rooms = append(rooms, room)
+	}
+	slices.SortFunc(rooms, func(a, b FreezerRoom) int {
+		return cmp.Or(strings.Compare(a.Floor, b.Floor), cmp.Compare(a.Id, b.Id))
+	})
+
+	start := min(filter.Offset, len(rooms))
+	end := min(start+filter.Limit, len(rooms))
+	return rooms[start:end], nil
+}
+
+func (s *MemoryStore) GetRoom(ctx context.Context, roomId int) (FreezerRoom, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	room, ok := s.rooms[roomId]
+	if !ok {
+		return room, errRoomNotFound
+	}
+	return room, nil
+}
+
+func (s *MemoryStore) CreateRoom(ctx context.Context, r *http.Request, room FreezerRoom) (FreezerRoom, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	room.Id = s.nextId()
+	room.Retired = false
+	s.rooms[room.Id] = room
+	return room, nil
+}
+
+func (s *MemoryStore) UpdateRoom(ctx context.Context, r *http.Request, room FreezerRoom) (FreezerRoom, error) {
+	return s.updateRoom(room.Id, func(stored *FreezerRoom) {
+		stored.Lab, stored.Floor = room.Lab, room.Floor
+	})
+}
+
+func (s *MemoryStore) RetireRoom(ctx context.Context, r *http.Request, roomId int) (FreezerRoom, error) {
+	return s.updateRoom(roomId, func(stored *FreezerRoom) {
+		stored.Retired = true
+	})
+}
+
+func (s *MemoryStore) updateRoom(roomId int, change func(*FreezerRoom)) (FreezerRoom, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	room, ok := s.rooms[roomId]
+	if !ok {
+		return room, errRoomNotFound
+	}
+	change(&room)
+	s.rooms[roomId] = room
+	return room, nil
+}
+
+func (s *MemoryStore) ListFreezers(ctx context.Context, roomId *int, includeRetired bool) ([]FreezerDB, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var freezers []FreezerDB
+	for _, id := range slices.Sorted(maps.Keys(s.freezers)) {
+		freezer := s.freezers[id]
+		if roomId != nil && freezer.FreezerLocationId != *roomId {
+			continue
+		}
+		if freezer.Retired && !includeRetired {
+			continue
+		}
+		freezers = append(freezers, freezer)
+	}
+	return freezers, nil
+}
+
+func (s *MemoryStore) GetFreezer(ctx context.Context, freezerId int) (FreezerDB, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	freezer, ok := s.freezers[freezerId]
+	if !ok {
+		return freezer, errFreezerNotFound
+	}
+	return freezer, nil
+}
+
+func (s *MemoryStore) CreateFreezer(ctx context.Context, r *http.Request, freezer FreezerDB) (FreezerDB, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.rooms[freezer.FreezerLocationId]; !ok {
+		return freezer, memoryReferenceNotFound
+	}
+	freezer.Id = s.nextId()
+	freezer.Retired = false
+	s.freezers[freezer.Id] = freezer
+	return freezer, nil
+}
+
+// UpdateFreezer saves what SQLiteStore.UpdateFreezer does, leaving the
+// retired flag and the temperature alarm as they are.
+func (s *MemoryStore) UpdateFreezer(ctx context.Context, r *http.Request, freezer FreezerDB) (FreezerDB, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.freezers[freezer.Id]
+	if !ok {
+		return freezer, errFreezerNotFound
+	}
+	if _, ok := s.rooms[freezer.FreezerLocationId]; !ok {
+		return freezer, memoryReferenceNotFound
+	}
+	freezer.Retired, freezer.TemperatureAlarm = stored.Retired, stored.TemperatureAlarm
+	s.freezers[freezer.Id] = freezer
+	return freezer, nil
+}
+
+func (s *MemoryStore) RetireFreezer(ctx context.Context, r *http.Request, freezerId int) (FreezerDB, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	freezer, ok := s.freezers[freezerId]
+	if !ok {
+		return freezer, errFreezerNotFound
+	}
+	freezer.Retired = true
+	s.freezers[freezerId] = freezer
+	return freezer, nil
+}
+
+func (s *MemoryStore) ListBoxLocations(ctx context.Context) ([]BoxesInFreezers, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var boxes []BoxesInFreezers
+	for _, id := range slices.Sorted(maps.Keys(s.boxes)) {
+		box := s.boxes[id]
+		freezer := s.freezers[box.FreezerId]
+		room := s.rooms[freezer.FreezerLocationId]
+		boxes = append(boxes, BoxesInFreezers{Lab: room.Lab, Floor: room.Floor, FreezerName: freezer.Name, FreezerId: freezer.Id, BoxId: box.Id, Shelf: box.Shelf})
+	}
+	return boxes, nil
+}
+
+func (s *MemoryStore) ListBoxes(ctx context.Context, freezerId int) ([]Box, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var boxes []Box
+	for _, id := range slices.Sorted(maps.Keys(s.boxes)) {
+		if box := s.boxes[id]; box.FreezerId == freezerId {
+			boxes = append(boxes, box)
+		}
+	}
+	return boxes, nil
+}
+
+func (s *MemoryStore) GetBox(ctx context.Context, boxId int) (Box, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	box, ok := s.boxes[boxId]
+	if !ok {
+		return box, errBoxNotFound
+	}
+	return box, nil
+}
+
+// CreateBox puts the new box through the same checks as a move into its
+// place.
+func (s *MemoryStore) CreateBox(ctx context.Context, r *http.Request, box Box) (Box, *ApiError, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if apiErr := s.checkMove(Box{}, box); apiErr != nil {
+		return box, apiErr, nil
+	}
+	box.Id = s.nextId()
+	s.boxes[box.Id] = box
+	return box, nil, nil
+}
+
+// UpdateBox refuses a move the way SQLiteStore.UpdateBox does.
+func (s *MemoryStore) UpdateBox(ctx context.Context, r *http.Request, box Box) (Box, *ApiError, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, ok := s.boxes[box.Id]
+	if !ok {
+		return box, nil, errBoxNotFound
+	}
+	if slotOf(old.Shelf, old.Rack, old.Drawer) != slotOf(box.Shelf, box.Rack, box.Drawer) || old.FreezerId != box.FreezerId {
+		if apiErr := s.checkMove(old, box); apiErr != nil {
+			return box, apiErr, nil
+		}
+	}
+	s.boxes[box.Id] = box
+	return box, nil, nil
+}
+
+// checkTarget reports why a box cannot be put where moved says, leaving out
+// whether there is room, or nil.
+func (s *MemoryStore) checkTarget(moved Box) (FreezerDB, *ApiError) {
+	target, ok := s.freezers[moved.FreezerId]
+	if !ok {
+		return target, &ApiError{Status: http.StatusBadRequest, Code: CodeFreezerNotFound, Message: "Freezer " + strconv.Itoa(moved.FreezerId) + " not found", Field: "freezer_id"}
+	}
+	if target.Retired || s.rooms[target.FreezerLocationId].Retired {
+		return target, &ApiError{Status: http.StatusConflict, Code: CodeRetired, Message: "Freezer " + target.Name + " is retired", Field: "freezer_id"}
+	}
+	return target, target.FreezerLayout.checkPlacement(moved.Shelf, moved.Rack, moved.Drawer)
+}
+
+// checkMove reports why box cannot go where moved puts it, or nil.
+func (s *MemoryStore) checkMove(box Box, moved Box) *ApiError {
+	target, apiErr := s.checkTarget(moved)
+	if apiErr != nil || target.BoxesPerSlot == nil {
+		return apiErr
+	}
+
+	occupancy := memoryOccupancy(s.boxes, moved.FreezerId)
+	if box.FreezerId == moved.FreezerId {
+		occupancy[slotOf(box.Shelf, box.Rack, box.Drawer)]--
+	}
+	key := slotOf(moved.Shelf, moved.Rack, moved.Drawer)
+	occupancy[key]++
+	return target.FreezerLayout.checkRoom(occupancy, key, target.Name)
+}
+
+// memoryOccupancy counts the boxes in each slot of a freezer.
+func memoryOccupancy(boxes map[int]Box, freezerId int) map[slotKey]int {
+	occupancy := map[slotKey]int{}
+	for _, box := range boxes {
+		if box.FreezerId == freezerId {
+			occupancy[slotOf(box.Shelf, box.Rack, box.Drawer)]++
+		}
+	}
+	return occupancy
+}
+
+// MoveBoxes moves the boxes on a copy that only replaces the stored boxes
+// when every move passed. Like moveBoxesTx, room is counted once every box
+// has moved, so two full slots can swap boxes.
+func (s *MemoryStore) MoveBoxes(ctx context.Context, r *http.Request, moves []BoxMove, opts moveOptions) ([]int, *ApiError, error) {
+	if apiErr := checkMoves(moves, opts); apiErr != nil {
+		return nil, apiErr, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	boxes := maps.Clone(s.boxes)
+	var boxIds []int
+	for i, move := range moves {
+		before, ok := boxes[move.BoxId]
+		if !ok {
+			return nil, opts.boxError(i, move.BoxId, nil), nil
+		}
+		if apiErr := opts.boxError(i, move.BoxId, &before); apiErr != nil {
+			return nil, apiErr, nil
+		}
+
+		moved := before
+		moved.FreezerId, moved.Shelf, moved.Rack, moved.Drawer = move.FreezerId, move.Shelf, move.Rack, move.Drawer
+		target, apiErr := s.checkTarget(moved)
+		if apiErr != nil {
+			apiErr.Field = opts.fieldFor(i) + apiErr.Field
+			return nil, apiErr, nil
+		}
+		if apiErr := opts.capacityError(i, target.Name, target.FreezerLayout); apiErr != nil {
+			return nil, apiErr, nil
+		}
+
+		boxes[move.BoxId] = moved
+		boxIds = append(boxIds, move.BoxId)
+	}
+
+	for i, move := range moves {
+		target := s.freezers[move.FreezerId]
+		if target.BoxesPerSlot == nil {
+			continue
+		}
+		key := slotOf(move.Shelf, move.Rack, move.Drawer)
+		if apiErr := target.FreezerLayout.checkRoom(memoryOccupancy(boxes, move.FreezerId), key, target.Name); apiErr != nil {
+			apiErr.Field = opts.fieldFor(i) + apiErr.Field
+			return nil, apiErr, nil
+		}
+	}
+	s.boxes = boxes
+	return boxIds, nil, nil
+}
+
+func (s *MemoryStore) DeleteBox(ctx context.Context, r *http.Request, boxId int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, links := range s.links {
+		for _, link := range links {
+			if link.BoxId == boxId {
+				return memoryStillReferenced
+			}
+		}
+	}
+	delete(s.boxes, boxId)
+	return nil
+}
+
+// sortLinks puts links in the order SQLiteStore lists them: placed samples
+// by well, then the unplaced ones, each by name.
+func sortLinks(links []SampleLink) {
+	slices.SortStableFunc(links, func(a, b SampleLink) int {
+		switch {
+		case a.Position == nil && b.Position != nil:
+			return 1
+		case a.Position != nil && b.Position == nil:
+			return -1
+		case a.Position != nil && *a.Position != *b.Position:
+			return *a.Position - *b.Position
+		}
+		return strings.Compare(a.EnteredName, b.EnteredName)
+	})
+}
+
+// namedLinks are the links of one type with this entered name, with their
+// indexes in s.links.
+func (s *MemoryStore) namedLinks(t *SampleType, enteredName string) ([]int, []SampleLink) {
+	var indexes []int
+	var links []SampleLink
+	for i, link := range s.links[t.Key] {
+		if link.EnteredName == enteredName {
+			indexes = append(indexes, i)
+			links = append(links, link)
+		}
+	}
+	return indexes, links
+}
+
+func (s *MemoryStore) ListSampleLinks(ctx context.Context, t *SampleType, boxId int) ([]SampleLink, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var links []SampleLink
+	for _, link := range s.links[t.Key] {
+		if link.BoxId == boxId {
+			links = append(links, link)
+		}
+	}
+	sortLinks(links)
+	return links, nil
+}
+
+func (s *MemoryStore) GetSampleLink(ctx context.Context, t *SampleType, enteredName string) (SampleLink, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, links := s.namedLinks(t, enteredName)
+	if len(links) == 0 {
+		return SampleLink{}, errSampleLinkNotFound
+	}
+	sortLinks(links)
+	return links[0], nil
+}
+
+func (s *MemoryStore) FindSampleLocations(ctx context.Context, t *SampleType, enteredName string) ([]SampleLocation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, links := s.namedLinks(t, enteredName)
+	var locations []SampleLocation
+	for _, link := range links {
+		box := s.boxes[link.BoxId]
+		freezer := s.freezers[box.FreezerId]
+		room := s.rooms[freezer.FreezerLocationId]
+		locations = append(locations, SampleLocation{
+			Shelf:        box.Shelf,
+			EnteredName:  link.EnteredName,
+			BoxName:      box.Name,
+			FreezerName:  freezer.Name,
+			FreezerModel: freezer.Model,
+			Lab:          room.Lab,
+			Floor:        room.Floor,
+			Checkout:     link.Checkout,
+		})
+	}
+	return locations, nil
+}
+
+func (s *MemoryStore) SampleFreezerIds(ctx context.Context, t *SampleType, enteredName string) ([]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, links := s.namedLinks(t, enteredName)
+	var ids []int
+	for _, link := range links {
+		if id := s.boxes[link.BoxId].FreezerId; !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// checkLink refuses a link to a missing box, under a name already stored or
+// into a taken well. skip is the index of the link being changed, -1 for a
+// new one.
+func (s *MemoryStore) checkLink(t *SampleType, link SampleLink, skip int) *ApiError {
+	if _, ok := s.boxes[link.BoxId]; !ok {
+		return memoryReferenceNotFound
+	}
+	for i, other := range s.links[t.Key] {
+		if i != skip && other.EnteredName == link.EnteredName {
+			return memoryNameTaken
+		}
+	}
+	if link.Position == nil {
+		return nil
+	}
+	if *link.Position <= 0 {
+		return &ApiError{Status: http.StatusBadRequest, Code: CodeValidationFailed, Message: "A value is out of the allowed range"}
+	}
+	for i, other := range s.links[t.Key] {
+		if i != skip && other.BoxId == link.BoxId && other.Position != nil && *other.Position == *link.Position {
+			return memoryPositionOccupied
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) CreateSampleLink(ctx context.Context, r *http.Request, t *SampleType, link SampleLink) (SampleLink, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored := SampleLink{SampleType: t.Key, SampleId: link.SampleId, EnteredName: link.EnteredName, BoxId: link.BoxId, Position: link.Position}
+	if apiErr := s.checkLink(t, stored, -1); apiErr != nil {
+		return link, apiErr
+	}
+	s.links[t.Key] = append(s.links[t.Key], stored)
+	return stored, nil
+}
+
+func (s *MemoryStore) UpdateSampleLink(ctx context.Context, r *http.Request, t *SampleType, enteredName string, change SampleLinkChange) (int64, error) {
+	if change.NewName == "" && change.BoxId == nil && change.Position == nil && !change.ClearPosition {
+		return 0, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	indexes, links := s.namedLinks(t, enteredName)
+	for n, link := range links {
+		if change.NewName != "" {
+			link.EnteredName = change.NewName
+		}
+		if change.BoxId != nil {
+			// the old well means nothing in another box
+			if *change.BoxId != link.BoxId && change.Position == nil {
+				link.Position = nil
+			}
+			link.BoxId = *change.BoxId
+		}
+		if change.ClearPosition {
+			link.Position = nil
+		} else if change.Position != nil {
+			link.Position = change.Position
+		}
+		if apiErr := s.checkLink(t, link, indexes[n]); apiErr != nil {
+			return 0, apiErr
+		}
+		links[n] = link
+	}
+	for n, i := range indexes {
+		s.links[t.Key][i] = links[n]
+	}
+	return int64(len(indexes)), nil
+}
+
+func (s *MemoryStore) DeleteSampleLink(ctx context.Context, r *http.Request, t *SampleType, enteredName string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, befores := s.namedLinks(t, enteredName)
+	if len(befores) == 0 {
+		return 0, nil
+	}
+	aliquots := 0
+	for _, link := range s.links[t.Key] {
+		if link.ParentName != nil && *link.ParentName == enteredName {
+			aliquots++
+		}
+	}
+	if apiErr := keptLinkError(t, enteredName, befores[0].ConsumedAt, aliquots); apiErr != nil {
+		return 0, apiErr
+	}
+	s.links[t.Key] = slices.DeleteFunc(s.links[t.Key], func(link SampleLink) bool {
+		return link.EnteredName == enteredName
+	})
+	return int64(len(befores)), nil
+}
+
+// CreateSampleLinks checks each link against the ones before it and keeps
+// none unless all pass.
+func (s *MemoryStore) CreateSampleLinks(ctx context.Context, r *http.Request, links []SampleLink) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	saved := map[string][]SampleLink{}
+	for key, stored := range s.links {
+		saved[key] = slices.Clone(stored)
+	}
+	for _, link := range links {
+		t := sampleTypesByKey[link.SampleType]
+		stored := SampleLink{SampleType: t.Key, SampleId: link.SampleId, EnteredName: link.EnteredName, BoxId: link.BoxId, Position: link.Position}
+		if apiErr := s.checkLink(t, stored, -1); apiErr != nil {
+			s.links = saved
+			return apiErr
+		}
+		s.links[t.Key] = append(s.links[t.Key], stored)
+	}
+	return nil
+}
+
+// changeLinks applies change to the links of one type with this name that
+// match, returning how many it changed.
+func (s *MemoryStore) changeLinks(t *SampleType, enteredName string, match func(SampleLink) bool, change func(*SampleLink)) int64 {
+	var n int64
+	for i := range s.links[t.Key] {
+		link := &s.links[t.Key][i]
+		if link.EnteredName == enteredName && match(*link) {
+			change(link)
+			n++
+		}
+	}
+	return n
+}
+
+func (s *MemoryStore) CheckoutSample(ctx context.Context, r *http.Request, t *SampleType, enteredName string, checkout Checkout) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	checkout.CheckedOutAt = &now
+	return s.changeLinks(t, enteredName, func(link SampleLink) bool {
+		return link.CheckedOutAt == nil
+	}, func(link *SampleLink) {
+		link.Checkout = checkout
+	}), nil
+}
+
+func (s *MemoryStore) ReturnSample(ctx context.Context, r *http.Request, t *SampleType, enteredName string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.changeLinks(t, enteredName, func(link SampleLink) bool {
+		return link.CheckedOutAt != nil
+	}, func(link *SampleLink) {
+		link.Checkout = Checkout{}
+	}), nil
+}
+
+// setQuantity is SetSampleQuantity with s.mu held.
+func (s *MemoryStore) setQuantity(t *SampleType, was SampleLink, quantity SampleQuantity) int64 {
+	return s.changeLinks(t, was.EnteredName, func(link SampleLink) bool {
+		return link.ConsumedAt == nil && equalPtr(link.RemainingVolumeUl, was.RemainingVolumeUl) && equalPtr(link.RemainingCount, was.RemainingCount)
+	}, func(link *SampleLink) {
+		link.RemainingVolumeUl, link.RemainingCount = quantity.VolumeUl, quantity.Count
+		if quantity.Consumed {
+			now := time.Now().UTC()
+			link.ConsumedAt, link.Position = &now, nil
+		}
+	})
+}
+
+func (s *MemoryStore) SetSampleQuantity(ctx context.Context, r *http.Request, t *SampleType, was SampleLink, quantity SampleQuantity) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.setQuantity(t, was, quantity), nil
+}
+
+// CreateAliquot checks the aliquot before taking anything from the parent,
+// so a refused one leaves the parent as it was.
+func (s *MemoryStore) CreateAliquot(ctx context.Context, r *http.Request, t *SampleType, parent SampleLink, taken *SampleQuantity, aliquot SampleLink) (SampleLink, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored := SampleLink{SampleType: t.Key, SampleId: aliquot.SampleId, EnteredName: aliquot.EnteredName, BoxId: aliquot.BoxId, Position: aliquot.Position, Aliquot: aliquot.Aliquot}
+	stored.ConsumedAt = nil
+	if apiErr := s.checkLink(t, stored, -1); apiErr != nil {
+		return aliquot, apiErr
+	}
+	if taken != nil && s.setQuantity(t, parent, *taken) == 0 {
+		return aliquot, errQuantityChanged
+	}
+	s.links[t.Key] = append(s.links[t.Key], stored)
+	return stored, nil
+}
+
+// equalPtr says whether a and b are both nil or point at equal values.
+func equalPtr[T comparable](a *T, b *T) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func (s *MemoryStore) RoleRank(ctx context.Context, username string, roomId *int, freezerId *int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	best := 0
+	for _, grant := range s.grants {
+		if grant.Username != username {
+			continue
+		}
+		labWide := grant.FreezerId == nil && grant.FreezerLocationId == nil
+		var covers bool
+		switch {
+		case freezerId != nil:
+			freezer, found := s.freezers[*freezerId]
+			covers = labWide ||
+				(grant.FreezerId != nil && *grant.FreezerId == *freezerId) ||
+				(found && grant.FreezerLocationId != nil && *grant.FreezerLocationId == freezer.FreezerLocationId)
+		case roomId != nil:
+			covers = labWide || (grant.FreezerLocationId != nil && *grant.FreezerLocationId == *roomId)
+		default:
+			covers = labWide
+		}
+		if covers {
+			best = max(best, roleRank[grant.Role])
+		}
+	}
+	return best, nil
+}
+
+func (s *MemoryStore) ListRoleGrants(ctx context.Context, username string) ([]RoleGrant, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var grants []RoleGrant
+	for _, grant := range s.grants {
+		if username == "" || grant.Username == username {
+			grants = append(grants, grant)
+		}
+	}
+	slices.SortStableFunc(grants, func(a, b RoleGrant) int {
+		return cmp.Or(strings.Compare(a.Username, b.Username), cmp.Compare(a.Id, b.Id))
+	})
+	return grants, nil
+}
+
+func (s *MemoryStore) GetRoleGrant(ctx context.Context, grantId int) (RoleGrant, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, grant := range s.grants {
+		if grant.Id == grantId {
+			return grant, nil
+		}
+	}
+	return RoleGrant{}, errRoleNotFound
+}
+
+// roleGrantIndex is the index of a user's grant on one scope, -1 when they
+// hold none there.
+func (s *MemoryStore) roleGrantIndex(username string, roomId *int, freezerId *int) int {
+	return slices.IndexFunc(s.grants, func(grant RoleGrant) bool {
+		return grant.Username == username && equalIds(grant.FreezerLocationId, roomId) && equalIds(grant.FreezerId, freezerId)
+	})
+}
+
+func equalIds(a *int, b *int) bool {
+	return a == nil && b == nil || a != nil && b != nil && *a == *b
+}
+
+func (s *MemoryStore) SaveRoleGrant(ctx context.Context, r *http.Request, grant RoleGrant, grantedBy string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if grant.FreezerLocationId != nil {
+		if _, ok := s.rooms[*grant.FreezerLocationId]; !ok {
+			return memoryReferenceNotFound
+		}
+	}
+	if grant.FreezerId != nil {
+		if _, ok := s.freezers[*grant.FreezerId]; !ok {
+			return memoryReferenceNotFound
+		}
+	}
+
+	now := time.Now().UTC()
+	grant.GrantedBy, grant.GrantedAt = &grantedBy, &now
+	if i := s.roleGrantIndex(grant.Username, grant.FreezerLocationId, grant.FreezerId); i >= 0 {
+		grant.Id = s.grants[i].Id
+		s.grants[i] = grant
+		return nil
+	}
+	grant.Id = s.nextId()
+	s.grants = append(s.grants, grant)
+	return nil
+}
+
+func (s *MemoryStore) DeleteRoleGrant(ctx context.Context, r *http.Request, username string, roomId *int, freezerId *int) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.roleGrantIndex(username, roomId, freezerId)
+	if i < 0 {
+		return 0, nil
+	}
+	s.grants = slices.Delete(s.grants, i, i+1)
+	return 1, nil
+}
+
+func (s *MemoryStore) LocalUser(ctx context.Context, username string) (LocalUser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[username]
+	if !ok {
+		return user, errUserNotFound
+	}
+	return user, nil
+}
+
+func (s *MemoryStore) SaveLocalUser(ctx context.Context, username string, passwordHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.users[username] = LocalUser{PasswordHash: &passwordHash}
+	return nil
+}
+
+// ListAudit finds nothing, MemoryStore keeps no audit log.
+func (s *MemoryStore) ListAudit(ctx context.Context, filter AuditFilter) ([]AuditEntry, error) {
+	return nil, nil
+}
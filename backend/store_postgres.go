@@ -0,0 +1,729 @@
+package freezerinv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// PostgresStore is the Store on the mgl_freezer_inventory schema.
+type PostgresStore struct {
+	pool *pgxpool.Pool
+}
+
+func NewPostgresStore(pool *pgxpool.Pool) *PostgresStore {
+	return &PostgresStore{pool: pool}
+}
+
+const (
+	freezerColumns = "id, freezer_location_id, last_calibrated, name, model, comments, current_holding_temp_c, manual_projects_contained, retired, shelf_count, shelf_label, racks_per_shelf, drawers_per_rack, boxes_per_slot, alarm_min_c, alarm_max_c, alarm_delay_minutes"
+	boxColumns     = "id, name, freezer_id, shelf, rack, drawer, format"
+)
+
+// audited runs a snapshot query on the store's pool, see auditedQuery.
+func (s *PostgresStore) audited(ctx context.Context, r *http.Request, table string, action string, query string, args ...interface{}) ([]json.RawMessage, error) {
+	return auditedQueryIn(ctx, s.pool, r, table, action, query, args...)
+}
+
+// decodeSnapshot reads the first row a snapshot query returned into v.
+func decodeSnapshot(after []json.RawMessage, v interface{}) error {
+	if len(after) == 0 {
+		return errors.New("snapshot query returned no rows")
+	}
+	return json.Unmarshal(after[0], v)
+}
+
+func (s *PostgresStore) Name() string {
+	return "postgres"
+}
+
+func (s *PostgresStore) ListRooms(ctx context.Context, filter RoomFilter) ([]FreezerRoom, error) {
+	query := "SELECT lab, floor, id, retired FROM " + roomsTable
+	args := []interface{}{}
+	where := " WHERE NOT retired"
+	if filter.IncludeRetired {
+		where = " WHERE true"
+	}
+	if filter.Search != "" {
+		where += " AND (lab ILIKE $1 OR floor ILIKE $1)"
+		args = append(args, "%"+filter.Search+"%")
+	}
+	query += where + " ORDER BY floor LIMIT $" + strconv.Itoa(len(args)+1) + " OFFSET $" + strconv.Itoa(len(args)+2)
+	args = append(args, filter.Limit, filter.Offset)
+
+	rows, err := s.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rooms []FreezerRoom
+	for rows.Next() {
+		var room FreezerRoom
+		if err := rows.Scan(&room.Lab, &room.Floor, &room.Id, &room.Retired); err != nil {
+			return nil, err
+		}
+		rooms = append(rooms, room)
+	}
+	return rooms, rows.Err()
+}
+
+func (s *PostgresStore) GetRoom(ctx context.Context, roomId int) (FreezerRoom, error) {
+	var room FreezerRoom
+	query := "SELECT lab, floor, id, retired FROM " + roomsTable + " WHERE id = $1"
+	err := s.pool.QueryRow(ctx, query, roomId).Scan(&room.Lab, &room.Floor, &room.Id, &room.Retired)
+	if err == pgx.ErrNoRows {
+		return room, errRoomNotFound
+	}
+	return room, err
+}
+
+func (s *PostgresStore) CreateRoom(ctx context.Context, r *http.Request, room FreezerRoom) (FreezerRoom, error) {
+	query := snapshotInsert(roomsTable, "lab, floor", "$1, $2")
+	after, err := s.audited(ctx, r, roomsTable, "insert", query, room.Lab, room.Floor)
+	if err != nil {
+		return room, err
+	}
+	err = decodeSnapshot(after, &room)
+	return room, err
+}
+
+func (s *PostgresStore) UpdateRoom(ctx context.Context, r *http.Request, room FreezerRoom) (FreezerRoom, error) {
+	query := snapshotUpdate(roomsTable, "lab = $1, floor = $2", "id = $3")
+	return s.updateRoom(ctx, r, query, room.Lab, room.Floor, room.Id)
+}
+
+func (s *PostgresStore) RetireRoom(ctx context.Context, r *http.Request, roomId int) (FreezerRoom, error) {
+	query := snapshotUpdate(roomsTable, "retired = true", "id = $1")
+	return s.updateRoom(ctx, r, query, roomId)
+}
+
+func (s *PostgresStore) updateRoom(ctx context.Context, r *http.Request, query string, args ...interface{}) (FreezerRoom, error) {
+	var room FreezerRoom
+	after, err := s.audited(ctx, r, roomsTable, "update", query, args...)
+	if err != nil {
+		return room, err
+	}
+	if len(after) == 0 {
+		return room, errRoomNotFound
+	}
+	err = decodeSnapshot(after, &room)
+	return room, err
+}
+
+func scanFreezer(row pgx.Row) (FreezerDB, error) {
+	var freezer FreezerDB
+	err := row.Scan(
+		&freezer.Id,
+		&freezer.FreezerLocationId,
+		&freezer.LastCalibrated,
+		&freezer.Name,
+		&freezer.Model,
+		&freezer.Comments,
+		&freezer.CurrentHoldingTempC,
+		&freezer.ManualProjectsContained,
+		&freezer.Retired,
+		&freezer.ShelfCount,
+		&freezer.ShelfLabel,
+		&freezer.RacksPerShelf,
+		&freezer.DrawersPerRack,
+		&freezer.BoxesPerSlot,
+		&freezer.AlarmMinC,
+		&freezer.AlarmMaxC,
+		&freezer.AlarmDelayMinutes,
+	)
+	return freezer, err
+}
+
+func (s *PostgresStore) ListFreezers(ctx context.Context, roomId *int, includeRetired bool) ([]FreezerDB, error) {
+	query := "SELECT " + freezerColumns + " FROM " + freezerTable + " WHERE ($1::integer IS NULL OR freezer_location_id = $1)"
+	if !includeRetired {
+		query += " AND NOT retired"
+	}
+	query += " ORDER BY id"
+
+	rows, err := s.pool.Query(ctx, query, roomId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var freezers []FreezerDB
+	for rows.Next() {
+		freezer, err := scanFreezer(rows)
+		if err != nil {
+			return nil, err
+		}
+		freezers = append(freezers, freezer)
+	}
+	return freezers, rows.Err()
+}
+
+func (s *PostgresStore) GetFreezer(ctx context.Context, freezerId int) (FreezerDB, error) {
+	freezer, err := scanFreezer(s.pool.QueryRow(ctx, "SELECT "+freezerColumns+" FROM "+freezerTable+" WHERE id = $1", freezerId))
+	if err == pgx.ErrNoRows {
+		return freezer, errFreezerNotFound
+	}
+	return freezer, err
+}
+
+func (s *PostgresStore) CreateFreezer(ctx context.Context, r *http.Request, freezer FreezerDB) (FreezerDB, error) {
+	query := snapshotInsert(freezerTable, "freezer_location_id, last_calibrated, name, model, comments, current_holding_temp_c, manual_projects_contained, shelf_count, shelf_label, racks_per_shelf, drawers_per_rack, boxes_per_slot", "$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12")
+	args := []interface{}{freezer.FreezerLocationId, freezer.LastCalibrated, freezer.Name, freezer.Model, freezer.Comments, freezer.CurrentHoldingTempC, freezer.ManualProjectsContained, freezer.ShelfCount, freezer.ShelfLabel, freezer.RacksPerShelf, freezer.DrawersPerRack, freezer.BoxesPerSlot}
+	return s.saveFreezer(ctx, r, "insert", query, args...)
+}
+
+func (s *PostgresStore) UpdateFreezer(ctx context.Context, r *http.Request, freezer FreezerDB) (FreezerDB, error) {
+	query := snapshotUpdate(freezerTable, "freezer_location_id = $1, last_calibrated = $2, name = $3, model = $4, comments = $5, current_holding_temp_c = $6, manual_projects_contained = $7, shelf_count = $8, shelf_label = $9, racks_per_shelf = $10, drawers_per_rack = $11, boxes_per_slot = $12", "id = $13")
+	args := []interface{}{freezer.FreezerLocationId, freezer.LastCalibrated, freezer.Name, freezer.Model, freezer.Comments, freezer.CurrentHoldingTempC, freezer.ManualProjectsContained, freezer.ShelfCount, freezer.ShelfLabel, freezer.RacksPerShelf, freezer.DrawersPerRack, freezer.BoxesPerSlot, freezer.Id}
+	return s.saveFreezer(ctx, r, "update", query, args...)
+}
+
+func (s *PostgresStore) RetireFreezer(ctx context.Context, r *http.Request, freezerId int) (FreezerDB, error) {
+	return s.saveFreezer(ctx, r, "update", snapshotUpdate(freezerTable, "retired = true", "id = $1"), freezerId)
+}
+
+// saveFreezer runs a snapshot query on one freezer and reads it back. The
+// snapshot itself is not decoded since last_calibrated has no time zone in it.
+func (s *PostgresStore) saveFreezer(ctx context.Context, r *http.Request, action string, query string, args ...interface{}) (FreezerDB, error) {
+	after, err := s.audited(ctx, r, freezerTable, action, query, args...)
+	if err != nil {
+		return FreezerDB{}, err
+	}
+	if len(after) == 0 {
+		return FreezerDB{}, errFreezerNotFound
+	}
+
+	var ref auditRowRef
+	if err := decodeSnapshot(after, &ref); err != nil {
+		return FreezerDB{}, err
+	}
+	if ref.Id == nil {
+		return FreezerDB{}, errors.New("freezer snapshot has no id")
+	}
+	return s.GetFreezer(ctx, *ref.Id)
+}
+
+func (s *PostgresStore) ListBoxLocations(ctx context.Context) ([]BoxesInFreezers, error) {
+	query := "select lab, floor, f.name as freezer_name, freezer_id, b.id as box_id, shelf from mgl_freezer_inventory.boxes b join mgl_freezer_inventory.freezer f on b.freezer_id = f.id join mgl_freezer_inventory.freezer_locations fl on fl.id = f.freezer_location_id"
+	rows, err := s.pool.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var boxes []BoxesInFreezers
+	for rows.Next() {
+		var box BoxesInFreezers
+		if err := rows.Scan(&box.Lab, &box.Floor, &box.FreezerName, &box.FreezerId, &box.BoxId, &box.Shelf); err != nil {
+			return nil, err
+		}
+		boxes = append(boxes, box)
+	}
+	return boxes, rows.Err()
+}
+
+func (s *PostgresStore) ListBoxes(ctx context.Context, freezerId int) ([]Box, error) {
+	rows, err := s.pool.Query(ctx, "SELECT "+boxColumns+" FROM "+boxesTable+" WHERE freezer_id = $1", freezerId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var boxes []Box
+	for rows.Next() {
+		var box Box
+		if err := rows.Scan(&box.Id, &box.Name, &box.FreezerId, &box.Shelf, &box.Rack, &box.Drawer, &box.Format); err != nil {
+			return nil, err
+		}
+		boxes = append(boxes, box)
+	}
+	return boxes, rows.Err()
+}
+
+func (s *PostgresStore) GetBox(ctx context.Context, boxId int) (Box, error) {
+	var box Box
+	err := s.pool.QueryRow(ctx, "SELECT "+boxColumns+" FROM "+boxesTable+" WHERE id = $1", boxId).Scan(&box.Id, &box.Name, &box.FreezerId, &box.Shelf, &box.Rack, &box.Drawer, &box.Format)
+	if err == pgx.ErrNoRows {
+		return box, errBoxNotFound
+	}
+	return box, err
+}
+
+// CreateBox checks the freezer with checkNewBox, holding its lock until the
+// box is in.
+func (s *PostgresStore) CreateBox(ctx context.Context, r *http.Request, box Box) (Box, *ApiError, error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return box, nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	if apiErr, err := checkNewBox(ctx, tx, box); err != nil || apiErr != nil {
+		return box, apiErr, err
+	}
+
+	query := snapshotInsert(boxesTable, "name, freezer_id, shelf, rack, drawer, format", "$1, $2, $3, $4, $5, $6")
+	after, err := auditedQueryTx(ctx, tx, r, boxesTable, "insert", query, box.Name, box.FreezerId, box.Shelf, box.Rack, box.Drawer, box.Format)
+	if err != nil {
+		return box, nil, err
+	}
+	if err := decodeSnapshot(after, &box); err != nil {
+		return box, nil, err
+	}
+	return box, nil, tx.Commit(ctx)
+}
+
+// UpdateBox moves the box through moveBoxesTx, in the same transaction as
+// the rename, so a move into a retired or full freezer leaves the name alone.
+func (s *PostgresStore) UpdateBox(ctx context.Context, r *http.Request, box Box) (Box, *ApiError, error) {
+	old, err := s.GetBox(ctx, box.Id)
+	if err != nil {
+		return box, nil, err
+	}
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return box, nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	if slotOf(old.Shelf, old.Rack, old.Drawer) != slotOf(box.Shelf, box.Rack, box.Drawer) || old.FreezerId != box.FreezerId {
+		move := BoxMove{BoxId: box.Id, FreezerId: box.FreezerId, Shelf: box.Shelf, Rack: box.Rack, Drawer: box.Drawer}
+		_, apiErr, err := moveBoxesTx(ctx, tx, r, []BoxMove{move}, moveOptions{})
+		if err != nil || apiErr != nil {
+			return box, apiErr, err
+		}
+	}
+
+	if old.Name != box.Name || !sameString(old.Format, box.Format) {
+		query := snapshotUpdate(boxesTable, "name = $1, format = $2", "id = $3")
+		if _, err := auditedQueryTx(ctx, tx, r, boxesTable, "update", query, box.Name, box.Format, box.Id); err != nil {
+			return box, nil, err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return box, nil, err
+	}
+
+	box, err = s.GetBox(ctx, box.Id)
+	return box, nil, err
+}
+
+func (s *PostgresStore) DeleteBox(ctx context.Context, r *http.Request, boxId int) error {
+	_, err := s.audited(ctx, r, boxesTable, "delete", snapshotDelete(boxesTable, "id = $1"), boxId)
+	return err
+}
+
+func (s *PostgresStore) MoveBoxes(ctx context.Context, r *http.Request, moves []BoxMove, opts moveOptions) ([]int, *ApiError, error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	moved, apiErr, err := moveBoxesTx(ctx, tx, r, moves, opts)
+	if err != nil || apiErr != nil {
+		return nil, apiErr, err
+	}
+	return moved, nil, tx.Commit(ctx)
+}
+
+func (s *PostgresStore) ListSampleLinks(ctx context.Context, t *SampleType, boxId int) ([]SampleLink, error) {
+	return s.sampleLinks(ctx, t, "box_id = $1", boxId)
+}
+
+func (s *PostgresStore) GetSampleLink(ctx context.Context, t *SampleType, enteredName string) (SampleLink, error) {
+	links, err := s.sampleLinks(ctx, t, "entered_name = $1", enteredName)
+	if err != nil {
+		return SampleLink{}, err
+	}
+	if len(links) == 0 {
+		return SampleLink{}, errSampleLinkNotFound
+	}
+	return links[0], nil
+}
+
+// sampleLinks lists the link rows of one type matching where, in well order.
+func (s *PostgresStore) sampleLinks(ctx context.Context, t *SampleType, where string, args ...interface{}) ([]SampleLink, error) {
+	query := "select " + t.IdColumn + ", entered_name, box_id, position, checked_out_by, checked_out_at, checkout_purpose, expected_return::text, parent_name, remaining_volume_ul, remaining_count, consumed_at from " + t.Table + " where " + where + " order by position, entered_name"
+
+	rows, err := s.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var links []SampleLink
+	for rows.Next() {
+		link := SampleLink{SampleType: t.Key}
+		err := rows.Scan(
+			&link.SampleId,
+			&link.EnteredName,
+			&link.BoxId,
+			&link.Position,
+			&link.CheckedOutBy,
+			&link.CheckedOutAt,
+			&link.Purpose,
+			&link.ExpectedReturn,
+			&link.ParentName,
+			&link.RemainingVolumeUl,
+			&link.RemainingCount,
+			&link.ConsumedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+	return links, rows.Err()
+}
+
+func (s *PostgresStore) FindSampleLocations(ctx context.Context, t *SampleType, enteredName string) ([]SampleLocation, error) {
+	query := "SELECT shelf, l.entered_name, b.name as box_name, f.name as freezer_name, f.model as freezer_model, fl.lab, fl.floor, l.checked_out_by, l.checked_out_at, l.checkout_purpose, l.expected_return::text FROM " + t.Table + " l join mgl_freezer_inventory.boxes b on l.box_id = b.id join mgl_freezer_inventory.freezer f on b.freezer_id = f.id join mgl_freezer_inventory.freezer_locations fl on fl.id = f.freezer_location_id WHERE entered_name = $1"
+
+	rows, err := s.pool.Query(ctx, query, enteredName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var locations []SampleLocation
+	for rows.Next() {
+		var location SampleLocation
+		err := rows.Scan(
+			&location.Shelf,
+			&location.EnteredName,
+			&location.BoxName,
+			&location.FreezerName,
+			&location.FreezerModel,
+			&location.Lab,
+			&location.Floor,
+			&location.CheckedOutBy,
+			&location.CheckedOutAt,
+			&location.Purpose,
+			&location.ExpectedReturn,
+		)
+		if err != nil {
+			return nil, err
+		}
+		locations = append(locations, location)
+	}
+	return locations, rows.Err()
+}
+
+func (s *PostgresStore) SampleFreezerIds(ctx context.Context, t *SampleType, enteredName string) ([]int, error) {
+	query := "SELECT DISTINCT b.freezer_id FROM " + t.Table + " l JOIN mgl_freezer_inventory.boxes b ON l.box_id = b.id WHERE l.entered_name = $1"
+	rows, err := s.pool.Query(ctx, query, enteredName)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[int])
+}
+
+func (s *PostgresStore) CreateSampleLink(ctx context.Context, r *http.Request, t *SampleType, link SampleLink) (SampleLink, error) {
+	query := snapshotInsert(t.Table, "box_id, entered_name, position", "$1, $2, $3")
+	args := []interface{}{link.BoxId, link.EnteredName, link.Position}
+	if link.SampleId != nil {
+		query = snapshotInsert(t.Table, t.IdColumn+", box_id, entered_name, position", "$1, $2, $3, $4")
+		args = []interface{}{*link.SampleId, link.BoxId, link.EnteredName, link.Position}
+	}
+
+	after, err := s.audited(ctx, r, t.Table, "insert", query, args...)
+	if err != nil {
+		return link, err
+	}
+	sampleId := link.SampleId
+	if err := decodeSnapshot(after, &link); err != nil {
+		return link, err
+	}
+	link.SampleId = sampleId
+	return link, nil
+}
+
+func (s *PostgresStore) UpdateSampleLink(ctx context.Context, r *http.Request, t *SampleType, enteredName string, change SampleLinkChange) (int64, error) {
+	var sets []string
+	var args []interface{}
+	set := func(column string, value interface{}) {
+		args = append(args, value)
+		sets = append(sets, column+" = $"+strconv.Itoa(len(args)))
+	}
+
+	if change.NewName != "" {
+		set("entered_name", change.NewName)
+	}
+	if change.BoxId != nil {
+		set("box_id", *change.BoxId)
+		if change.Position == nil && !change.ClearPosition {
+			// the old well means nothing in another box
+			sets = append(sets, "position = CASE WHEN box_id = $"+strconv.Itoa(len(args))+" THEN position END")
+		}
+	}
+	if change.ClearPosition {
+		sets = append(sets, "position = NULL")
+	} else if change.Position != nil {
+		set("position", *change.Position)
+	}
+	if len(sets) == 0 {
+		return 0, nil
+	}
+
+	args = append(args, enteredName)
+	query := snapshotUpdate(t.Table, strings.Join(sets, ", "), "entered_name = $"+strconv.Itoa(len(args)))
+	after, err := s.audited(ctx, r, t.Table, "update", query, args...)
+	return int64(len(after)), err
+}
+
+// DeleteSampleLink refuses consumed samples and parents with keptLinkError.
+// The row is locked first so it cannot be consumed while it is checked.
+func (s *PostgresStore) DeleteSampleLink(ctx context.Context, r *http.Request, t *SampleType, enteredName string) (int64, error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	var consumedAt *time.Time
+	err = tx.QueryRow(ctx, "SELECT consumed_at FROM "+t.Table+" WHERE entered_name = $1 FOR UPDATE", enteredName).Scan(&consumedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var aliquots int
+	if err := tx.QueryRow(ctx, "SELECT count(*) FROM "+t.Table+" WHERE parent_name = $1", enteredName).Scan(&aliquots); err != nil {
+		return 0, err
+	}
+	if apiErr := keptLinkError(t, enteredName, consumedAt, aliquots); apiErr != nil {
+		return 0, apiErr
+	}
+
+	after, err := auditedQueryTx(ctx, tx, r, t.Table, "delete", snapshotDelete(t.Table, "entered_name = $1"), enteredName)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(after)), tx.Commit(ctx)
+}
+
+func (s *PostgresStore) CreateSampleLinks(ctx context.Context, r *http.Request, links []SampleLink) error {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	for _, link := range links {
+		t := sampleTypesByKey[link.SampleType]
+		query := snapshotInsert(t.Table, t.IdColumn+", box_id, entered_name, position", "$1, $2, $3, $4")
+		if _, err := auditedQueryTx(ctx, tx, r, t.Table, "insert", query, link.SampleId, link.BoxId, link.EnteredName, link.Position); err != nil {
+			return fmt.Errorf("%s %s: %w", t.Label, link.EnteredName, err)
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+func (s *PostgresStore) CheckoutSample(ctx context.Context, r *http.Request, t *SampleType, enteredName string, checkout Checkout) (int64, error) {
+	query := snapshotUpdate(t.Table, "checked_out_by = $1, checked_out_at = now(), checkout_purpose = $2, expected_return = $3", "entered_name = $4 AND checked_out_at IS NULL")
+	after, err := s.audited(ctx, r, t.Table, "update", query, checkout.CheckedOutBy, checkout.Purpose, checkout.ExpectedReturn, enteredName)
+	return int64(len(after)), err
+}
+
+func (s *PostgresStore) ReturnSample(ctx context.Context, r *http.Request, t *SampleType, enteredName string) (int64, error) {
+	query := snapshotUpdate(t.Table, "checked_out_by = NULL, checked_out_at = NULL, checkout_purpose = NULL, expected_return = NULL", "entered_name = $1 AND checked_out_at IS NOT NULL")
+	after, err := s.audited(ctx, r, t.Table, "update", query, enteredName)
+	return int64(len(after)), err
+}
+
+func (s *PostgresStore) SetSampleQuantity(ctx context.Context, r *http.Request, t *SampleType, was SampleLink, quantity SampleQuantity) (int64, error) {
+	query, args := quantityUpdate(t, was, quantity)
+	after, err := s.audited(ctx, r, t.Table, "update", query, args...)
+	return int64(len(after)), err
+}
+
+func (s *PostgresStore) CreateAliquot(ctx context.Context, r *http.Request, t *SampleType, parent SampleLink, taken *SampleQuantity, aliquot SampleLink) (SampleLink, error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return aliquot, err
+	}
+	defer tx.Rollback(ctx)
+
+	if taken != nil {
+		query, args := quantityUpdate(t, parent, *taken)
+		after, err := auditedQueryTx(ctx, tx, r, t.Table, "update", query, args...)
+		if err != nil {
+			return aliquot, err
+		}
+		if len(after) == 0 {
+			return aliquot, errQuantityChanged
+		}
+	}
+
+	query := snapshotInsert(t.Table, t.IdColumn+", box_id, entered_name, position, parent_name, remaining_volume_ul, remaining_count", "$1, $2, $3, $4, $5, $6, $7")
+	after, err := auditedQueryTx(ctx, tx, r, t.Table, "insert", query, aliquot.SampleId, aliquot.BoxId, aliquot.EnteredName, aliquot.Position, aliquot.ParentName, aliquot.RemainingVolumeUl, aliquot.RemainingCount)
+	if err != nil {
+		return aliquot, err
+	}
+	created := SampleLink{SampleType: t.Key}
+	if err := decodeSnapshot(after, &created); err != nil {
+		return aliquot, err
+	}
+	created.SampleId = aliquot.SampleId
+	return created, tx.Commit(ctx)
+}
+
+func (s *PostgresStore) RoleRank(ctx context.Context, username string, roomId *int, freezerId *int) (int, error) {
+	query := "SELECT role FROM mgl_freezer_inventory.user_roles WHERE username = $1 AND freezer_id IS NULL AND freezer_location_id IS NULL"
+	args := []interface{}{username}
+	switch {
+	case freezerId != nil:
+		query = "SELECT role FROM mgl_freezer_inventory.user_roles WHERE username = $1 AND ((freezer_id IS NULL AND freezer_location_id IS NULL) OR freezer_id = $2 OR freezer_location_id = (SELECT freezer_location_id FROM mgl_freezer_inventory.freezer WHERE id = $2))"
+		args = append(args, *freezerId)
+	case roomId != nil:
+		query = "SELECT role FROM mgl_freezer_inventory.user_roles WHERE username = $1 AND ((freezer_id IS NULL AND freezer_location_id IS NULL) OR freezer_location_id = $2)"
+		args = append(args, *roomId)
+	}
+
+	rows, err := s.pool.Query(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	best := 0
+	for rows.Next() {
+		var role string
+		if err := rows.Scan(&role); err != nil {
+			return 0, err
+		}
+		if roleRank[role] > best {
+			best = roleRank[role]
+		}
+	}
+	return best, rows.Err()
+}
+
+// roleScopeWhere matches a user's grant on one scope, from $1 username, $2
+// room and $3 freezer.
+const roleScopeWhere = "username = $1 AND freezer_location_id IS NOT DISTINCT FROM $2 AND freezer_id IS NOT DISTINCT FROM $3"
+
+const roleGrantColumns = "id, username, role, freezer_location_id, freezer_id, granted_by, granted_at"
+
+func scanRoleGrant(row pgx.Row) (RoleGrant, error) {
+	var grant RoleGrant
+	err := row.Scan(&grant.Id, &grant.Username, &grant.Role, &grant.FreezerLocationId, &grant.FreezerId, &grant.GrantedBy, &grant.GrantedAt)
+	return grant, err
+}
+
+func (s *PostgresStore) ListRoleGrants(ctx context.Context, username string) ([]RoleGrant, error) {
+	rows, err := s.pool.Query(ctx, "SELECT "+roleGrantColumns+" FROM "+rolesTable+" WHERE $1 = '' OR username = $1 ORDER BY username, id", username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var grants []RoleGrant
+	for rows.Next() {
+		grant, err := scanRoleGrant(rows)
+		if err != nil {
+			return nil, err
+		}
+		grants = append(grants, grant)
+	}
+	return grants, rows.Err()
+}
+
+func (s *PostgresStore) GetRoleGrant(ctx context.Context, grantId int) (RoleGrant, error) {
+	grant, err := scanRoleGrant(s.pool.QueryRow(ctx, "SELECT "+roleGrantColumns+" FROM "+rolesTable+" WHERE id = $1", grantId))
+	if err == pgx.ErrNoRows {
+		return grant, errRoleNotFound
+	}
+	return grant, err
+}
+
+func (s *PostgresStore) SaveRoleGrant(ctx context.Context, r *http.Request, grant RoleGrant, grantedBy string) error {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	args := []interface{}{grant.Username, grant.FreezerLocationId, grant.FreezerId, grant.Role, grantedBy}
+	query := snapshotUpdate(rolesTable, "role = $4, granted_by = $5, granted_at = now()", roleScopeWhere)
+	after, err := auditedQueryTx(ctx, tx, r, rolesTable, "update", query, args...)
+	if err != nil {
+		return err
+	}
+	if len(after) == 0 {
+		query = snapshotInsert(rolesTable, "username, freezer_location_id, freezer_id, role, granted_by", "$1, $2, $3, $4, $5")
+		if _, err := auditedQueryTx(ctx, tx, r, rolesTable, "insert", query, args...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+func (s *PostgresStore) DeleteRoleGrant(ctx context.Context, r *http.Request, username string, roomId *int, freezerId *int) (int64, error) {
+	after, err := s.audited(ctx, r, rolesTable, "delete", snapshotDelete(rolesTable, roleScopeWhere), username, roomId, freezerId)
+	return int64(len(after)), err
+}
+
+func (s *PostgresStore) LocalUser(ctx context.Context, username string) (LocalUser, error) {
+	var user LocalUser
+	query := "SELECT password_hash, disabled FROM mgl_freezer_inventory.app_users WHERE username = $1"
+	err := s.pool.QueryRow(ctx, query, username).Scan(&user.PasswordHash, &user.Disabled)
+	if err == pgx.ErrNoRows {
+		return user, errUserNotFound
+	}
+	return user, err
+}
+
+func (s *PostgresStore) SaveLocalUser(ctx context.Context, username string, passwordHash string) error {
+	query := "INSERT INTO mgl_freezer_inventory.app_users (username, password_hash) VALUES ($1, $2) ON CONFLICT (username) DO UPDATE SET password_hash = EXCLUDED.password_hash, disabled = false"
+	_, err := s.pool.Exec(ctx, query, username, passwordHash)
+	return err
+}
+
+func (s *PostgresStore) ListAudit(ctx context.Context, filter AuditFilter) ([]AuditEntry, error) {
+	where, args := auditWhere(filter, func(n int) string { return "$" + strconv.Itoa(n) })
+	rows, err := s.pool.Query(ctx, "SELECT "+auditColumns+" FROM mgl_freezer_inventory.audit_log"+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []AuditEntry
+	for rows.Next() {
+		var entry AuditEntry
+		err := rows.Scan(
+			&entry.Id,
+			&entry.OccurredAt,
+			&entry.Actor,
+			&entry.Endpoint,
+			&entry.TableName,
+			&entry.Action,
+			&entry.BoxId,
+			&entry.FreezerId,
+			&entry.NewBoxId,
+			&entry.NewFreezerId,
+			&entry.SampleName,
+			&entry.NewSampleName,
+			&entry.Before,
+			&entry.After,
+		)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
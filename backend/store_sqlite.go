@@ -0,0 +1,1216 @@
+package freezerinv
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// SQLiteStore is the Store in a single SQLite file, for field stations that
+// cannot reach the central Postgres. Tables keep their Postgres names without
+// the mgl_freezer_inventory schema.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// sqliteSchema is created on open. Link tables are added per sample type.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS freezer_locations (
+    id      INTEGER PRIMARY KEY,
+    lab     TEXT    NOT NULL,
+    floor   TEXT    NOT NULL,
+    retired BOOLEAN NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS freezer (
+    id                        INTEGER PRIMARY KEY,
+    freezer_location_id       INTEGER NOT NULL REFERENCES freezer_locations (id),
+    last_calibrated           TIMESTAMP,
+    name                      TEXT    NOT NULL,
+    model                     TEXT    NOT NULL,
+    comments                  TEXT,
+    current_holding_temp_c    INTEGER,
+    manual_projects_contained TEXT    NOT NULL DEFAULT '',
+    retired                   BOOLEAN NOT NULL DEFAULT 0,
+    shelf_count               INTEGER NOT NULL DEFAULT 5 CHECK (shelf_count BETWEEN 1 AND 50),
+    shelf_label               TEXT    NOT NULL DEFAULT 'Shelf',
+    racks_per_shelf           INTEGER CHECK (racks_per_shelf BETWEEN 1 AND 50),
+    drawers_per_rack          INTEGER CHECK (drawers_per_rack BETWEEN 1 AND 50),
+    boxes_per_slot            INTEGER CHECK (boxes_per_slot BETWEEN 1 AND 1000),
+    alarm_min_c               REAL,
+    alarm_max_c               REAL CHECK (alarm_max_c > alarm_min_c),
+    alarm_delay_minutes       INTEGER NOT NULL DEFAULT 0 CHECK (alarm_delay_minutes >= 0)
+);
+
+CREATE TABLE IF NOT EXISTS boxes (
+    id         INTEGER PRIMARY KEY,
+    name       TEXT    NOT NULL,
+    freezer_id INTEGER NOT NULL REFERENCES freezer (id),
+    shelf      INTEGER NOT NULL,
+    rack       INTEGER CHECK (rack > 0),
+    drawer     INTEGER CHECK (drawer > 0),
+    format     TEXT    CHECK (format IN ('81', '100', '96'))
+);
+
+CREATE TABLE IF NOT EXISTS user_roles (
+    id                  INTEGER PRIMARY KEY,
+    username            TEXT      NOT NULL,
+    role                TEXT      NOT NULL CHECK (role IN ('viewer', 'technician', 'manager')),
+    freezer_location_id INTEGER   REFERENCES freezer_locations (id) ON DELETE CASCADE,
+    freezer_id          INTEGER   REFERENCES freezer (id) ON DELETE CASCADE,
+    granted_by          TEXT,
+    granted_at          TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CHECK (freezer_location_id IS NULL OR freezer_id IS NULL)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS user_roles_scope_idx
+    ON user_roles (username, coalesce(freezer_location_id, 0), coalesce(freezer_id, 0));
+
+CREATE TABLE IF NOT EXISTS app_users (
+    username      TEXT      PRIMARY KEY,
+    password_hash TEXT,
+    display_name  TEXT,
+    disabled      BOOLEAN   NOT NULL DEFAULT 0,
+    created_at    TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS audit_log (
+    id              INTEGER   PRIMARY KEY,
+    occurred_at     TIMESTAMP NOT NULL,
+    actor           TEXT      NOT NULL,
+    endpoint        TEXT      NOT NULL,
+    table_name      TEXT      NOT NULL,
+    action          TEXT      NOT NULL CHECK (action IN ('insert', 'update', 'delete')),
+    box_id          INTEGER,
+    freezer_id      INTEGER,
+    new_box_id      INTEGER,
+    new_freezer_id  INTEGER,
+    sample_name     TEXT,
+    new_sample_name TEXT,
+    before          TEXT,
+    after           TEXT
+);
+
+CREATE TRIGGER IF NOT EXISTS audit_log_no_update BEFORE UPDATE ON audit_log
+BEGIN
+    SELECT RAISE(ABORT, 'audit_log is append-only');
+END;
+
+CREATE TRIGGER IF NOT EXISTS audit_log_no_delete BEFORE DELETE ON audit_log
+BEGIN
+    SELECT RAISE(ABORT, 'audit_log is append-only');
+END;
+`
+
+// sqliteLinkSchema is the link table of one sample type, with the table
+// name and id column filled in.
+const sqliteLinkSchema = `
+CREATE TABLE IF NOT EXISTS %[1]s (
+    %[2]s               INTEGER,
+    entered_name        TEXT      NOT NULL,
+    box_id              INTEGER   NOT NULL REFERENCES boxes (id),
+    position            INTEGER   CHECK (position > 0),
+    checked_out_by      TEXT,
+    checked_out_at      TIMESTAMP,
+    checkout_purpose    TEXT,
+    expected_return     TEXT,
+    parent_name         TEXT,
+    remaining_volume_ul REAL,
+    remaining_count     INTEGER,
+    consumed_at         TIMESTAMP
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS %[1]s_position_idx
+    ON %[1]s (box_id, position) WHERE position IS NOT NULL;
+
+-- an index rather than UNIQUE on the column, so files made before it get it too
+CREATE UNIQUE INDEX IF NOT EXISTS %[1]s_entered_name_idx
+    ON %[1]s (entered_name);
+`
+
+// InitSQLite opens the SQLite file at path, creating it and any missing
+// tables, including one link table per registered sample type. Sample types
+// must be loaded first.
+func InitSQLite(path string) (*SQLiteStore, error) {
+	conn, err := sql.Open("sqlite", "file:"+path+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_time_format=sqlite")
+	if err != nil {
+		return nil, err
+	}
+	// one writer at a time, SQLite locks the whole file anyway
+	conn.SetMaxOpenConns(1)
+
+	schema := sqliteSchema
+	for _, t := range sampleTypes {
+		schema += fmt.Sprintf(sqliteLinkSchema, sqliteTable(t.Table), t.IdColumn)
+	}
+	if _, err := conn.Exec(schema); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &SQLiteStore{db: conn}, nil
+}
+
+// sqliteTable drops the schema from a Postgres table name.
+func sqliteTable(table string) string {
+	return table[strings.LastIndex(table, ".")+1:]
+}
+
+// sqlQueryer is the part of the database and of a transaction the lookups
+// need, so they can run inside a change.
+type sqlQueryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// sqliteError turns constraint failures into the ApiErrors dbApiError gives
+// for the Postgres ones. A foreign key failure on delete means the row is
+// still referenced, otherwise that the reference is missing.
+func sqliteError(err error, action string) error {
+	var liteErr *sqlite.Error
+	if !errors.As(err, &liteErr) {
+		return err
+	}
+
+	switch liteErr.Code() {
+	case sqlite3.SQLITE_CONSTRAINT_UNIQUE, sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY:
+		if strings.Contains(liteErr.Error(), ".position") {
+			return &ApiError{Status: http.StatusConflict, Code: CodePositionOccupied, Message: "That position is already taken", Field: "position"}
+		}
+		if strings.Contains(liteErr.Error(), ".entered_name") {
+			return &ApiError{Status: http.StatusConflict, Code: CodeSampleAlreadyStored, Message: "A sample with this name is already stored", Field: "entered_name"}
+		}
+		return &ApiError{Status: http.StatusConflict, Code: CodeAlreadyExists, Message: "A record with this key already exists"}
+	case sqlite3.SQLITE_CONSTRAINT_FOREIGNKEY:
+		if action == "delete" {
+			return &ApiError{Status: http.StatusConflict, Code: CodeStillReferenced, Message: "This record is still in use and cannot be removed"}
+		}
+		return &ApiError{Status: http.StatusBadRequest, Code: CodeReferenceNotFound, Message: "The referenced record does not exist"}
+	case sqlite3.SQLITE_CONSTRAINT_NOTNULL:
+		return &ApiError{Status: http.StatusBadRequest, Code: CodeValidationFailed, Message: "A required field is missing"}
+	case sqlite3.SQLITE_CONSTRAINT_CHECK:
+		return &ApiError{Status: http.StatusBadRequest, Code: CodeValidationFailed, Message: "A value is out of the allowed range"}
+	}
+	return err
+}
+
+// recordAudit writes one audit_log row for a change. before and after are
+// the row as the API returns it, nil for an insert or a delete.
+func (s *SQLiteStore) recordAudit(ctx context.Context, tx *sql.Tx, r *http.Request, table string, action string, before interface{}, after interface{}) error {
+	var docs [2][]byte
+	for i, v := range []interface{}{before, after} {
+		if v == nil {
+			continue
+		}
+		doc, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		docs[i] = doc
+	}
+
+	boxFreezer := func(boxId int) (*int, error) {
+		var id int
+		err := tx.QueryRowContext(ctx, "SELECT freezer_id FROM boxes WHERE id = ?", boxId).Scan(&id)
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return &id, err
+	}
+	boxId, freezerId, sample, err := auditLocation(table, docs[0], boxFreezer)
+	if err != nil {
+		return err
+	}
+	newBoxId, newFreezerId, newSample, err := auditLocation(table, docs[1], boxFreezer)
+	if err != nil {
+		return err
+	}
+
+	query := "INSERT INTO audit_log (occurred_at, actor, endpoint, table_name, action, box_id, freezer_id, new_box_id, new_freezer_id, sample_name, new_sample_name, before, after) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	args := []interface{}{time.Now().UTC(), auditActor(r), auditEndpoint(r), table, action, boxId, freezerId, newBoxId, newFreezerId, sample, newSample, docString(docs[0]), docString(docs[1])}
+
+	_, err = tx.ExecContext(ctx, query, args...)
+	return err
+}
+
+func docString(doc []byte) *string {
+	if doc == nil {
+		return nil
+	}
+	s := string(doc)
+	return &s
+}
+
+func (s *SQLiteStore) Name() string {
+	return "sqlite"
+}
+
+func (s *SQLiteStore) ListRooms(ctx context.Context, filter RoomFilter) ([]FreezerRoom, error) {
+	query := "SELECT lab, floor, id, retired FROM freezer_locations WHERE (?1 OR NOT retired) AND (?2 = '' OR lab LIKE '%' || ?2 || '%' OR floor LIKE '%' || ?2 || '%') ORDER BY floor LIMIT ?3 OFFSET ?4"
+	rows, err := s.db.QueryContext(ctx, query, filter.IncludeRetired, filter.Search, filter.Limit, filter.Offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rooms []FreezerRoom
+	for rows.Next() {
+		var room FreezerRoom
+		if err := rows.Scan(&room.Lab, &room.Floor, &room.Id, &room.Retired); err != nil {
+			return nil, err
+		}
+		rooms = append(rooms, room)
+	}
+	return rooms, rows.Err()
+}
+
+func (s *SQLiteStore) GetRoom(ctx context.Context, roomId int) (FreezerRoom, error) {
+	return sqliteRoom(ctx, s.db, roomId)
+}
+
+func sqliteRoom(ctx context.Context, q sqlQueryer, roomId int) (FreezerRoom, error) {
+	var room FreezerRoom
+	err := q.QueryRowContext(ctx, "SELECT lab, floor, id, retired FROM freezer_locations WHERE id = ?", roomId).Scan(&room.Lab, &room.Floor, &room.Id, &room.Retired)
+	if err == sql.ErrNoRows {
+		return room, errRoomNotFound
+	}
+	return room, err
+}
+
+func (s *SQLiteStore) CreateRoom(ctx context.Context, r *http.Request, room FreezerRoom) (FreezerRoom, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return room, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, "INSERT INTO freezer_locations (lab, floor) VALUES (?, ?)", room.Lab, room.Floor)
+	if err != nil {
+		return room, sqliteError(err, "insert")
+	}
+	id, _ := result.LastInsertId()
+	if room, err = sqliteRoom(ctx, tx, int(id)); err != nil {
+		return room, err
+	}
+	if err := s.recordAudit(ctx, tx, r, roomsTable, "insert", nil, room); err != nil {
+		return room, err
+	}
+	return room, tx.Commit()
+}
+
+func (s *SQLiteStore) UpdateRoom(ctx context.Context, r *http.Request, room FreezerRoom) (FreezerRoom, error) {
+	return s.updateRoom(ctx, r, room.Id, "lab = ?, floor = ?", room.Lab, room.Floor)
+}
+
+func (s *SQLiteStore) RetireRoom(ctx context.Context, r *http.Request, roomId int) (FreezerRoom, error) {
+	return s.updateRoom(ctx, r, roomId, "retired = 1")
+}
+
+func (s *SQLiteStore) updateRoom(ctx context.Context, r *http.Request, roomId int, set string, args ...interface{}) (FreezerRoom, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return FreezerRoom{}, err
+	}
+	defer tx.Rollback()
+
+	before, err := sqliteRoom(ctx, tx, roomId)
+	if err != nil {
+		return before, err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE freezer_locations SET "+set+" WHERE id = ?", append(args, roomId)...); err != nil {
+		return before, sqliteError(err, "update")
+	}
+	after, err := sqliteRoom(ctx, tx, roomId)
+	if err != nil {
+		return after, err
+	}
+	if err := s.recordAudit(ctx, tx, r, roomsTable, "update", before, after); err != nil {
+		return after, err
+	}
+	return after, tx.Commit()
+}
+
+func (s *SQLiteStore) ListFreezers(ctx context.Context, roomId *int, includeRetired bool) ([]FreezerDB, error) {
+	query := "SELECT " + freezerColumns + " FROM freezer WHERE (?1 IS NULL OR freezer_location_id = ?1) AND (?2 OR NOT retired) ORDER BY id"
+	rows, err := s.db.QueryContext(ctx, query, roomId, includeRetired)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var freezers []FreezerDB
+	for rows.Next() {
+		freezer, err := scanFreezer(rows)
+		if err != nil {
+			return nil, err
+		}
+		freezers = append(freezers, freezer)
+	}
+	return freezers, rows.Err()
+}
+
+func (s *SQLiteStore) GetFreezer(ctx context.Context, freezerId int) (FreezerDB, error) {
+	return sqliteFreezer(ctx, s.db, freezerId)
+}
+
+func sqliteFreezer(ctx context.Context, q sqlQueryer, freezerId int) (FreezerDB, error) {
+	freezer, err := scanFreezer(q.QueryRowContext(ctx, "SELECT "+freezerColumns+" FROM freezer WHERE id = ?", freezerId))
+	if err == sql.ErrNoRows {
+		return freezer, errFreezerNotFound
+	}
+	return freezer, err
+}
+
+func (s *SQLiteStore) CreateFreezer(ctx context.Context, r *http.Request, freezer FreezerDB) (FreezerDB, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return freezer, err
+	}
+	defer tx.Rollback()
+
+	query := "INSERT INTO freezer (freezer_location_id, last_calibrated, name, model, comments, current_holding_temp_c, manual_projects_contained, shelf_count, shelf_label, racks_per_shelf, drawers_per_rack, boxes_per_slot) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	args := []interface{}{freezer.FreezerLocationId, freezer.LastCalibrated, freezer.Name, freezer.Model, freezer.Comments, freezer.CurrentHoldingTempC, freezer.ManualProjectsContained, freezer.ShelfCount, freezer.ShelfLabel, freezer.RacksPerShelf, freezer.DrawersPerRack, freezer.BoxesPerSlot}
+	result, err := tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return freezer, sqliteError(err, "insert")
+	}
+	id, _ := result.LastInsertId()
+	if freezer, err = sqliteFreezer(ctx, tx, int(id)); err != nil {
+		return freezer, err
+	}
+	if err := s.recordAudit(ctx, tx, r, freezerTable, "insert", nil, freezer); err != nil {
+		return freezer, err
+	}
+	return freezer, tx.Commit()
+}
+
+func (s *SQLiteStore) UpdateFreezer(ctx context.Context, r *http.Request, freezer FreezerDB) (FreezerDB, error) {
+	set := "freezer_location_id = ?, last_calibrated = ?, name = ?, model = ?, comments = ?, current_holding_temp_c = ?, manual_projects_contained = ?, shelf_count = ?, shelf_label = ?, racks_per_shelf = ?, drawers_per_rack = ?, boxes_per_slot = ?"
+	args := []interface{}{freezer.FreezerLocationId, freezer.LastCalibrated, freezer.Name, freezer.Model, freezer.Comments, freezer.CurrentHoldingTempC, freezer.ManualProjectsContained, freezer.ShelfCount, freezer.ShelfLabel, freezer.RacksPerShelf, freezer.DrawersPerRack, freezer.BoxesPerSlot}
+	return s.updateFreezer(ctx, r, freezer.Id, set, args...)
+}
+
+func (s *SQLiteStore) RetireFreezer(ctx context.Context, r *http.Request, freezerId int) (FreezerDB, error) {
+	return s.updateFreezer(ctx, r, freezerId, "retired = 1")
+}
+
+func (s *SQLiteStore) updateFreezer(ctx context.Context, r *http.Request, freezerId int, set string, args ...interface{}) (FreezerDB, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return FreezerDB{}, err
+	}
+	defer tx.Rollback()
+
+	before, err := sqliteFreezer(ctx, tx, freezerId)
+	if err != nil {
+		return before, err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE freezer SET "+set+" WHERE id = ?", append(args, freezerId)...); err != nil {
+		return before, sqliteError(err, "update")
+	}
+	after, err := sqliteFreezer(ctx, tx, freezerId)
+	if err != nil {
+		return after, err
+	}
+	if err := s.recordAudit(ctx, tx, r, freezerTable, "update", before, after); err != nil {
+		return after, err
+	}
+	return after, tx.Commit()
+}
+
+func (s *SQLiteStore) ListBoxLocations(ctx context.Context) ([]BoxesInFreezers, error) {
+	query := "SELECT lab, floor, f.name, freezer_id, b.id, shelf FROM boxes b JOIN freezer f ON b.freezer_id = f.id JOIN freezer_locations fl ON fl.id = f.freezer_location_id"
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var boxes []BoxesInFreezers
+	for rows.Next() {
+		var box BoxesInFreezers
+		if err := rows.Scan(&box.Lab, &box.Floor, &box.FreezerName, &box.FreezerId, &box.BoxId, &box.Shelf); err != nil {
+			return nil, err
+		}
+		boxes = append(boxes, box)
+	}
+	return boxes, rows.Err()
+}
+
+func (s *SQLiteStore) ListBoxes(ctx context.Context, freezerId int) ([]Box, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+boxColumns+" FROM boxes WHERE freezer_id = ?", freezerId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var boxes []Box
+	for rows.Next() {
+		var box Box
+		if err := rows.Scan(&box.Id, &box.Name, &box.FreezerId, &box.Shelf, &box.Rack, &box.Drawer, &box.Format); err != nil {
+			return nil, err
+		}
+		boxes = append(boxes, box)
+	}
+	return boxes, rows.Err()
+}
+
+func (s *SQLiteStore) GetBox(ctx context.Context, boxId int) (Box, error) {
+	return sqliteBox(ctx, s.db, boxId)
+}
+
+func sqliteBox(ctx context.Context, q sqlQueryer, boxId int) (Box, error) {
+	var box Box
+	err := q.QueryRowContext(ctx, "SELECT "+boxColumns+" FROM boxes WHERE id = ?", boxId).Scan(&box.Id, &box.Name, &box.FreezerId, &box.Shelf, &box.Rack, &box.Drawer, &box.Format)
+	if err == sql.ErrNoRows {
+		return box, errBoxNotFound
+	}
+	return box, err
+}
+
+// CreateBox puts the new box through the same checks as a move into its
+// place.
+func (s *SQLiteStore) CreateBox(ctx context.Context, r *http.Request, box Box) (Box, *ApiError, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return box, nil, err
+	}
+	defer tx.Rollback()
+
+	if apiErr, err := s.checkMove(ctx, tx, Box{}, box); err != nil || apiErr != nil {
+		return box, apiErr, err
+	}
+
+	query := "INSERT INTO boxes (name, freezer_id, shelf, rack, drawer, format) VALUES (?, ?, ?, ?, ?, ?)"
+	result, err := tx.ExecContext(ctx, query, box.Name, box.FreezerId, box.Shelf, box.Rack, box.Drawer, box.Format)
+	if err != nil {
+		return box, nil, sqliteError(err, "insert")
+	}
+	id, _ := result.LastInsertId()
+	if box, err = sqliteBox(ctx, tx, int(id)); err != nil {
+		return box, nil, err
+	}
+	if err := s.recordAudit(ctx, tx, r, boxesTable, "insert", nil, box); err != nil {
+		return box, nil, err
+	}
+	return box, nil, tx.Commit()
+}
+
+// UpdateBox checks a move the way moveBoxesTx does, refusing retired
+// freezers and rooms, places outside the layout and full slots.
+func (s *SQLiteStore) UpdateBox(ctx context.Context, r *http.Request, box Box) (Box, *ApiError, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return box, nil, err
+	}
+	defer tx.Rollback()
+
+	old, err := sqliteBox(ctx, tx, box.Id)
+	if err != nil {
+		return box, nil, err
+	}
+
+	if slotOf(old.Shelf, old.Rack, old.Drawer) != slotOf(box.Shelf, box.Rack, box.Drawer) || old.FreezerId != box.FreezerId {
+		if apiErr, err := s.checkMove(ctx, tx, old, box); err != nil || apiErr != nil {
+			return box, apiErr, err
+		}
+	}
+
+	query := "UPDATE boxes SET name = ?, freezer_id = ?, shelf = ?, rack = ?, drawer = ?, format = ? WHERE id = ?"
+	if _, err := tx.ExecContext(ctx, query, box.Name, box.FreezerId, box.Shelf, box.Rack, box.Drawer, box.Format, box.Id); err != nil {
+		return box, nil, sqliteError(err, "update")
+	}
+	after, err := sqliteBox(ctx, tx, box.Id)
+	if err != nil {
+		return box, nil, err
+	}
+	if err := s.recordAudit(ctx, tx, r, boxesTable, "update", old, after); err != nil {
+		return box, nil, err
+	}
+	return after, nil, tx.Commit()
+}
+
+// checkTarget reports why a box cannot be put where moved says, leaving out
+// whether there is room, or nil.
+func (s *SQLiteStore) checkTarget(ctx context.Context, tx *sql.Tx, moved Box) (FreezerDB, *ApiError, error) {
+	target, err := sqliteFreezer(ctx, tx, moved.FreezerId)
+	if err == errFreezerNotFound {
+		return target, &ApiError{Status: http.StatusBadRequest, Code: CodeFreezerNotFound, Message: "Freezer " + strconv.Itoa(moved.FreezerId) + " not found", Field: "freezer_id"}, nil
+	}
+	if err != nil {
+		return target, nil, err
+	}
+	room, err := sqliteRoom(ctx, tx, target.FreezerLocationId)
+	if err != nil {
+		return target, nil, err
+	}
+	if target.Retired || room.Retired {
+		return target, &ApiError{Status: http.StatusConflict, Code: CodeRetired, Message: "Freezer " + target.Name + " is retired", Field: "freezer_id"}, nil
+	}
+	return target, target.FreezerLayout.checkPlacement(moved.Shelf, moved.Rack, moved.Drawer), nil
+}
+
+// checkMove reports why box cannot go where moved puts it, or nil.
+func (s *SQLiteStore) checkMove(ctx context.Context, tx *sql.Tx, box Box, moved Box) (*ApiError, error) {
+	target, apiErr, err := s.checkTarget(ctx, tx, moved)
+	if err != nil || apiErr != nil || target.BoxesPerSlot == nil {
+		return apiErr, err
+	}
+
+	occupancy, err := sqliteOccupancy(ctx, tx, moved.FreezerId)
+	if err != nil {
+		return nil, err
+	}
+	if box.FreezerId == moved.FreezerId {
+		occupancy[slotOf(box.Shelf, box.Rack, box.Drawer)]--
+	}
+	key := slotOf(moved.Shelf, moved.Rack, moved.Drawer)
+	occupancy[key]++
+	return target.FreezerLayout.checkRoom(occupancy, key, target.Name), nil
+}
+
+// sqliteOccupancy counts the boxes in each slot of a freezer, like
+// slotOccupancy.
+func sqliteOccupancy(ctx context.Context, tx *sql.Tx, freezerId int) (map[slotKey]int, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT shelf, coalesce(rack, 0), coalesce(drawer, 0), count(*) FROM boxes WHERE freezer_id = ? GROUP BY 1, 2, 3", freezerId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	occupancy := map[slotKey]int{}
+	for rows.Next() {
+		var key slotKey
+		var n int
+		if err := rows.Scan(&key.Shelf, &key.Rack, &key.Drawer, &n); err != nil {
+			return nil, err
+		}
+		occupancy[key] = n
+	}
+	return occupancy, rows.Err()
+}
+
+// MoveBoxes moves the boxes in one transaction. Like moveBoxesTx, room is
+// counted once every box has moved, so two full slots can swap boxes.
+func (s *SQLiteStore) MoveBoxes(ctx context.Context, r *http.Request, moves []BoxMove, opts moveOptions) ([]int, *ApiError, error) {
+	if apiErr := checkMoves(moves, opts); apiErr != nil {
+		return nil, apiErr, nil
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	var boxIds []int
+	targets := map[int]FreezerDB{}
+	for i, move := range moves {
+		before, err := sqliteBox(ctx, tx, move.BoxId)
+		if err == errBoxNotFound {
+			return nil, opts.boxError(i, move.BoxId, nil), nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if apiErr := opts.boxError(i, move.BoxId, &before); apiErr != nil {
+			return nil, apiErr, nil
+		}
+
+		moved := before
+		moved.FreezerId, moved.Shelf, moved.Rack, moved.Drawer = move.FreezerId, move.Shelf, move.Rack, move.Drawer
+		target, apiErr, err := s.checkTarget(ctx, tx, moved)
+		if err != nil {
+			return nil, nil, err
+		}
+		if apiErr != nil {
+			apiErr.Field = opts.fieldFor(i) + apiErr.Field
+			return nil, apiErr, nil
+		}
+		if apiErr := opts.capacityError(i, target.Name, target.FreezerLayout); apiErr != nil {
+			return nil, apiErr, nil
+		}
+		targets[move.FreezerId] = target
+
+		query := "UPDATE boxes SET freezer_id = ?, shelf = ?, rack = ?, drawer = ? WHERE id = ?"
+		if _, err := tx.ExecContext(ctx, query, move.FreezerId, move.Shelf, move.Rack, move.Drawer, move.BoxId); err != nil {
+			return nil, nil, sqliteError(err, "update")
+		}
+		after, err := sqliteBox(ctx, tx, move.BoxId)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := s.recordAudit(ctx, tx, r, boxesTable, "update", before, after); err != nil {
+			return nil, nil, err
+		}
+		boxIds = append(boxIds, move.BoxId)
+	}
+
+	// every box has moved inside tx, so the counts are what each freezer will
+	// hold; a full slot rolls the whole batch back
+	occupancy := map[int]map[slotKey]int{}
+	for i, move := range moves {
+		target := targets[move.FreezerId]
+		if target.BoxesPerSlot == nil {
+			continue
+		}
+		if _, ok := occupancy[move.FreezerId]; !ok {
+			if occupancy[move.FreezerId], err = sqliteOccupancy(ctx, tx, move.FreezerId); err != nil {
+				return nil, nil, err
+			}
+		}
+		key := slotOf(move.Shelf, move.Rack, move.Drawer)
+		if apiErr := target.FreezerLayout.checkRoom(occupancy[move.FreezerId], key, target.Name); apiErr != nil {
+			apiErr.Field = opts.fieldFor(i) + apiErr.Field
+			return nil, apiErr, nil
+		}
+	}
+	return boxIds, nil, tx.Commit()
+}
+
+func (s *SQLiteStore) DeleteBox(ctx context.Context, r *http.Request, boxId int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := sqliteBox(ctx, tx, boxId)
+	if err == errBoxNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM boxes WHERE id = ?", boxId); err != nil {
+		return sqliteError(err, "delete")
+	}
+	if err := s.recordAudit(ctx, tx, r, boxesTable, "delete", before, nil); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// sqliteLinks lists the link rows of one type matching where, with their
+// rowids so a change can read the same rows back after renaming them.
+func sqliteLinks(ctx context.Context, q sqlQueryer, t *SampleType, where string, args ...interface{}) ([]int64, []SampleLink, error) {
+	query := "SELECT rowid, " + t.IdColumn + ", entered_name, box_id, position, checked_out_by, checked_out_at, checkout_purpose, expected_return, parent_name, remaining_volume_ul, remaining_count, consumed_at FROM " + sqliteTable(t.Table) + " WHERE " + where + " ORDER BY position IS NULL, position, entered_name"
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var rowIds []int64
+	var links []SampleLink
+	for rows.Next() {
+		var rowId int64
+		link := SampleLink{SampleType: t.Key}
+		err := rows.Scan(
+			&rowId,
+			&link.SampleId,
+			&link.EnteredName,
+			&link.BoxId,
+			&link.Position,
+			&link.CheckedOutBy,
+			&link.CheckedOutAt,
+			&link.Purpose,
+			&link.ExpectedReturn,
+			&link.ParentName,
+			&link.RemainingVolumeUl,
+			&link.RemainingCount,
+			&link.ConsumedAt,
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+		rowIds = append(rowIds, rowId)
+		links = append(links, link)
+	}
+	return rowIds, links, rows.Err()
+}
+
+func (s *SQLiteStore) ListSampleLinks(ctx context.Context, t *SampleType, boxId int) ([]SampleLink, error) {
+	_, links, err := sqliteLinks(ctx, s.db, t, "box_id = ?", boxId)
+	return links, err
+}
+
+func (s *SQLiteStore) GetSampleLink(ctx context.Context, t *SampleType, enteredName string) (SampleLink, error) {
+	_, links, err := sqliteLinks(ctx, s.db, t, "entered_name = ?", enteredName)
+	if err != nil {
+		return SampleLink{}, err
+	}
+	if len(links) == 0 {
+		return SampleLink{}, errSampleLinkNotFound
+	}
+	return links[0], nil
+}
+
+func (s *SQLiteStore) FindSampleLocations(ctx context.Context, t *SampleType, enteredName string) ([]SampleLocation, error) {
+	query := "SELECT shelf, l.entered_name, b.name, f.name, f.model, fl.lab, fl.floor, l.checked_out_by, l.checked_out_at, l.checkout_purpose, l.expected_return FROM " + sqliteTable(t.Table) + " l JOIN boxes b ON l.box_id = b.id JOIN freezer f ON b.freezer_id = f.id JOIN freezer_locations fl ON fl.id = f.freezer_location_id WHERE entered_name = ?"
+	rows, err := s.db.QueryContext(ctx, query, enteredName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var locations []SampleLocation
+	for rows.Next() {
+		var location SampleLocation
+		err := rows.Scan(
+			&location.Shelf,
+			&location.EnteredName,
+			&location.BoxName,
+			&location.FreezerName,
+			&location.FreezerModel,
+			&location.Lab,
+			&location.Floor,
+			&location.CheckedOutBy,
+			&location.CheckedOutAt,
+			&location.Purpose,
+			&location.ExpectedReturn,
+		)
+		if err != nil {
+			return nil, err
+		}
+		locations = append(locations, location)
+	}
+	return locations, rows.Err()
+}
+
+func (s *SQLiteStore) SampleFreezerIds(ctx context.Context, t *SampleType, enteredName string) ([]int, error) {
+	query := "SELECT DISTINCT b.freezer_id FROM " + sqliteTable(t.Table) + " l JOIN boxes b ON l.box_id = b.id WHERE l.entered_name = ?"
+	rows, err := s.db.QueryContext(ctx, query, enteredName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (s *SQLiteStore) CreateSampleLink(ctx context.Context, r *http.Request, t *SampleType, link SampleLink) (SampleLink, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return link, err
+	}
+	defer tx.Rollback()
+
+	if link, err = s.insertLink(ctx, tx, r, t, link); err != nil {
+		return link, err
+	}
+	return link, tx.Commit()
+}
+
+// insertLink stores one link with its lineage and quantity inside tx and
+// returns it as stored.
+func (s *SQLiteStore) insertLink(ctx context.Context, tx *sql.Tx, r *http.Request, t *SampleType, link SampleLink) (SampleLink, error) {
+	query := "INSERT INTO " + sqliteTable(t.Table) + " (" + t.IdColumn + ", box_id, entered_name, position, parent_name, remaining_volume_ul, remaining_count) VALUES (?, ?, ?, ?, ?, ?, ?)"
+	result, err := tx.ExecContext(ctx, query, link.SampleId, link.BoxId, link.EnteredName, link.Position, link.ParentName, link.RemainingVolumeUl, link.RemainingCount)
+	if err != nil {
+		return link, sqliteError(err, "insert")
+	}
+	rowId, _ := result.LastInsertId()
+	_, links, err := sqliteLinks(ctx, tx, t, "rowid = ?", rowId)
+	if err != nil {
+		return link, err
+	}
+	if len(links) == 0 {
+		return link, errors.New(t.Label + " link vanished after insert")
+	}
+	if err := s.recordAudit(ctx, tx, r, t.Table, "insert", nil, links[0]); err != nil {
+		return link, err
+	}
+	return links[0], nil
+}
+
+// updateLinks sets set, with setArgs, on the links of one type matching
+// where inside tx, auditing each, and returns how many it changed.
+func (s *SQLiteStore) updateLinks(ctx context.Context, tx *sql.Tx, r *http.Request, t *SampleType, set string, setArgs []interface{}, where string, whereArgs ...interface{}) (int64, error) {
+	rowIds, befores, err := sqliteLinks(ctx, tx, t, where, whereArgs...)
+	if err != nil || len(befores) == 0 {
+		return 0, err
+	}
+
+	query := "UPDATE " + sqliteTable(t.Table) + " SET " + set + " WHERE rowid = ?"
+	for i, rowId := range rowIds {
+		args := append(slices.Clip(setArgs), rowId)
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			return 0, sqliteError(err, "update")
+		}
+		_, afters, err := sqliteLinks(ctx, tx, t, "rowid = ?", rowId)
+		if err != nil {
+			return 0, err
+		}
+		if err := s.recordAudit(ctx, tx, r, t.Table, "update", befores[i], afters[0]); err != nil {
+			return 0, err
+		}
+	}
+	return int64(len(rowIds)), nil
+}
+
+func (s *SQLiteStore) UpdateSampleLink(ctx context.Context, r *http.Request, t *SampleType, enteredName string, change SampleLinkChange) (int64, error) {
+	var sets []string
+	var args []interface{}
+	set := func(column string, value interface{}) {
+		args = append(args, value)
+		sets = append(sets, column+" = ?"+strconv.Itoa(len(args)))
+	}
+
+	if change.NewName != "" {
+		set("entered_name", change.NewName)
+	}
+	if change.BoxId != nil {
+		set("box_id", *change.BoxId)
+		if change.Position == nil && !change.ClearPosition {
+			// the old well means nothing in another box
+			sets = append(sets, "position = CASE WHEN box_id = ?"+strconv.Itoa(len(args))+" THEN position END")
+		}
+	}
+	if change.ClearPosition {
+		sets = append(sets, "position = NULL")
+	} else if change.Position != nil {
+		set("position", *change.Position)
+	}
+	if len(sets) == 0 {
+		return 0, nil
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rowIds, befores, err := sqliteLinks(ctx, tx, t, "entered_name = ?", enteredName)
+	if err != nil || len(befores) == 0 {
+		return 0, err
+	}
+
+	args = append(args, enteredName)
+	query := "UPDATE " + sqliteTable(t.Table) + " SET " + strings.Join(sets, ", ") + " WHERE entered_name = ?" + strconv.Itoa(len(args))
+	if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+		return 0, sqliteError(err, "update")
+	}
+
+	for i, rowId := range rowIds {
+		_, afters, err := sqliteLinks(ctx, tx, t, "rowid = ?", rowId)
+		if err != nil {
+			return 0, err
+		}
+		if err := s.recordAudit(ctx, tx, r, t.Table, "update", befores[i], afters[0]); err != nil {
+			return 0, err
+		}
+	}
+	return int64(len(rowIds)), tx.Commit()
+}
+
+func (s *SQLiteStore) DeleteSampleLink(ctx context.Context, r *http.Request, t *SampleType, enteredName string) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	_, befores, err := sqliteLinks(ctx, tx, t, "entered_name = ?", enteredName)
+	if err != nil || len(befores) == 0 {
+		return 0, err
+	}
+	var aliquots int
+	if err := tx.QueryRowContext(ctx, "SELECT count(*) FROM "+sqliteTable(t.Table)+" WHERE parent_name = ?", enteredName).Scan(&aliquots); err != nil {
+		return 0, err
+	}
+	if apiErr := keptLinkError(t, enteredName, befores[0].ConsumedAt, aliquots); apiErr != nil {
+		return 0, apiErr
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM "+sqliteTable(t.Table)+" WHERE entered_name = ?", enteredName); err != nil {
+		return 0, sqliteError(err, "delete")
+	}
+	for _, before := range befores {
+		if err := s.recordAudit(ctx, tx, r, t.Table, "delete", before, nil); err != nil {
+			return 0, err
+		}
+	}
+	return int64(len(befores)), tx.Commit()
+}
+
+func (s *SQLiteStore) CreateSampleLinks(ctx context.Context, r *http.Request, links []SampleLink) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, link := range links {
+		t := sampleTypesByKey[link.SampleType]
+		if _, err := s.insertLink(ctx, tx, r, t, link); err != nil {
+			return fmt.Errorf("%s %s: %w", t.Label, link.EnteredName, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// changeLinks runs updateLinks in a transaction of its own.
+func (s *SQLiteStore) changeLinks(ctx context.Context, r *http.Request, t *SampleType, set string, setArgs []interface{}, where string, whereArgs ...interface{}) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	n, err := s.updateLinks(ctx, tx, r, t, set, setArgs, where, whereArgs...)
+	if err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+func (s *SQLiteStore) CheckoutSample(ctx context.Context, r *http.Request, t *SampleType, enteredName string, checkout Checkout) (int64, error) {
+	set := "checked_out_by = ?, checked_out_at = ?, checkout_purpose = ?, expected_return = ?"
+	return s.changeLinks(ctx, r, t, set, []interface{}{checkout.CheckedOutBy, time.Now(), checkout.Purpose, checkout.ExpectedReturn}, "entered_name = ? AND checked_out_at IS NULL", enteredName)
+}
+
+func (s *SQLiteStore) ReturnSample(ctx context.Context, r *http.Request, t *SampleType, enteredName string) (int64, error) {
+	set := "checked_out_by = NULL, checked_out_at = NULL, checkout_purpose = NULL, expected_return = NULL"
+	return s.changeLinks(ctx, r, t, set, nil, "entered_name = ? AND checked_out_at IS NOT NULL", enteredName)
+}
+
+// setQuantity is quantityUpdate for SQLite, where IS compares NULLs too.
+func (s *SQLiteStore) setQuantity(ctx context.Context, tx *sql.Tx, r *http.Request, t *SampleType, was SampleLink, quantity SampleQuantity) (int64, error) {
+	set := "remaining_volume_ul = ?, remaining_count = ?"
+	setArgs := []interface{}{quantity.VolumeUl, quantity.Count}
+	if quantity.Consumed {
+		set += ", consumed_at = ?, position = NULL"
+		setArgs = append(setArgs, time.Now())
+	}
+	where := "entered_name = ? AND consumed_at IS NULL AND remaining_volume_ul IS ? AND remaining_count IS ?"
+	return s.updateLinks(ctx, tx, r, t, set, setArgs, where, was.EnteredName, was.RemainingVolumeUl, was.RemainingCount)
+}
+
+func (s *SQLiteStore) SetSampleQuantity(ctx context.Context, r *http.Request, t *SampleType, was SampleLink, quantity SampleQuantity) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	n, err := s.setQuantity(ctx, tx, r, t, was, quantity)
+	if err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+func (s *SQLiteStore) CreateAliquot(ctx context.Context, r *http.Request, t *SampleType, parent SampleLink, taken *SampleQuantity, aliquot SampleLink) (SampleLink, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return aliquot, err
+	}
+	defer tx.Rollback()
+
+	if taken != nil {
+		n, err := s.setQuantity(ctx, tx, r, t, parent, *taken)
+		if err != nil {
+			return aliquot, err
+		}
+		if n == 0 {
+			return aliquot, errQuantityChanged
+		}
+	}
+	if aliquot, err = s.insertLink(ctx, tx, r, t, aliquot); err != nil {
+		return aliquot, err
+	}
+	return aliquot, tx.Commit()
+}
+
+func (s *SQLiteStore) RoleRank(ctx context.Context, username string, roomId *int, freezerId *int) (int, error) {
+	query := "SELECT role FROM user_roles WHERE username = ?1 AND freezer_id IS NULL AND freezer_location_id IS NULL"
+	args := []interface{}{username}
+	switch {
+	case freezerId != nil:
+		query = "SELECT role FROM user_roles WHERE username = ?1 AND ((freezer_id IS NULL AND freezer_location_id IS NULL) OR freezer_id = ?2 OR freezer_location_id = (SELECT freezer_location_id FROM freezer WHERE id = ?2))"
+		args = append(args, *freezerId)
+	case roomId != nil:
+		query = "SELECT role FROM user_roles WHERE username = ?1 AND ((freezer_id IS NULL AND freezer_location_id IS NULL) OR freezer_location_id = ?2)"
+		args = append(args, *roomId)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	best := 0
+	for rows.Next() {
+		var role string
+		if err := rows.Scan(&role); err != nil {
+			return 0, err
+		}
+		best = max(best, roleRank[role])
+	}
+	return best, rows.Err()
+}
+
+func (s *SQLiteStore) ListRoleGrants(ctx context.Context, username string) ([]RoleGrant, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+roleGrantColumns+" FROM user_roles WHERE ?1 = '' OR username = ?1 ORDER BY username, id", username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var grants []RoleGrant
+	for rows.Next() {
+		grant, err := scanRoleGrant(rows)
+		if err != nil {
+			return nil, err
+		}
+		grants = append(grants, grant)
+	}
+	return grants, rows.Err()
+}
+
+func (s *SQLiteStore) GetRoleGrant(ctx context.Context, grantId int) (RoleGrant, error) {
+	grant, err := scanRoleGrant(s.db.QueryRowContext(ctx, "SELECT "+roleGrantColumns+" FROM user_roles WHERE id = ?", grantId))
+	if err == sql.ErrNoRows {
+		return grant, errRoleNotFound
+	}
+	return grant, err
+}
+
+// sqliteRoleGrant is a user's grant on one scope, found false when they hold
+// none there.
+func sqliteRoleGrant(ctx context.Context, q sqlQueryer, username string, roomId *int, freezerId *int) (RoleGrant, bool, error) {
+	query := "SELECT " + roleGrantColumns + " FROM user_roles WHERE username = ? AND freezer_location_id IS ? AND freezer_id IS ?"
+	grant, err := scanRoleGrant(q.QueryRowContext(ctx, query, username, roomId, freezerId))
+	if err == sql.ErrNoRows {
+		return grant, false, nil
+	}
+	return grant, err == nil, err
+}
+
+func (s *SQLiteStore) SaveRoleGrant(ctx context.Context, r *http.Request, grant RoleGrant, grantedBy string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, found, err := sqliteRoleGrant(ctx, tx, grant.Username, grant.FreezerLocationId, grant.FreezerId)
+	if err != nil {
+		return err
+	}
+	query := "INSERT INTO user_roles (username, role, freezer_location_id, freezer_id, granted_by) VALUES (?, ?, ?, ?, ?) ON CONFLICT (username, coalesce(freezer_location_id, 0), coalesce(freezer_id, 0)) DO UPDATE SET role = excluded.role, granted_by = excluded.granted_by, granted_at = CURRENT_TIMESTAMP"
+	if _, err := tx.ExecContext(ctx, query, grant.Username, grant.Role, grant.FreezerLocationId, grant.FreezerId, grantedBy); err != nil {
+		return sqliteError(err, "insert")
+	}
+	after, _, err := sqliteRoleGrant(ctx, tx, grant.Username, grant.FreezerLocationId, grant.FreezerId)
+	if err != nil {
+		return err
+	}
+
+	if found {
+		err = s.recordAudit(ctx, tx, r, rolesTable, "update", before, after)
+	} else {
+		err = s.recordAudit(ctx, tx, r, rolesTable, "insert", nil, after)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) DeleteRoleGrant(ctx context.Context, r *http.Request, username string, roomId *int, freezerId *int) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	before, found, err := sqliteRoleGrant(ctx, tx, username, roomId, freezerId)
+	if err != nil || !found {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM user_roles WHERE id = ?", before.Id); err != nil {
+		return 0, sqliteError(err, "delete")
+	}
+	if err := s.recordAudit(ctx, tx, r, rolesTable, "delete", before, nil); err != nil {
+		return 0, err
+	}
+	return 1, tx.Commit()
+}
+
+func (s *SQLiteStore) LocalUser(ctx context.Context, username string) (LocalUser, error) {
+	var user LocalUser
+	err := s.db.QueryRowContext(ctx, "SELECT password_hash, disabled FROM app_users WHERE username = ?", username).Scan(&user.PasswordHash, &user.Disabled)
+	if err == sql.ErrNoRows {
+		return user, errUserNotFound
+	}
+	return user, err
+}
+
+func (s *SQLiteStore) SaveLocalUser(ctx context.Context, username string, passwordHash string) error {
+	query := "INSERT INTO app_users (username, password_hash) VALUES (?, ?) ON CONFLICT (username) DO UPDATE SET password_hash = excluded.password_hash, disabled = 0"
+	_, err := s.db.ExecContext(ctx, query, username, passwordHash)
+	return err
+}
+
+func (s *SQLiteStore) ListAudit(ctx context.Context, filter AuditFilter) ([]AuditEntry, error) {
+	where, args := auditWhere(filter, func(n int) string { return "?" + strconv.Itoa(n) })
+	rows, err := s.db.QueryContext(ctx, "SELECT "+auditColumns+" FROM audit_log"+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []AuditEntry
+	for rows.Next() {
+		var entry AuditEntry
+		var before, after *string
+		err := rows.Scan(
+			&entry.Id,
+			&entry.OccurredAt,
+			&entry.Actor,
+			&entry.Endpoint,
+			&entry.TableName,
+			&entry.Action,
+			&entry.BoxId,
+			&entry.FreezerId,
+			&entry.NewBoxId,
+			&entry.NewFreezerId,
+			&entry.SampleName,
+			&entry.NewSampleName,
+			&before,
+			&after,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if before != nil {
+			entry.Before = json.RawMessage(*before)
+		}
+		if after != nil {
+			entry.After = json.RawMessage(*after)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
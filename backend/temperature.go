@@ -0,0 +1,851 @@
+package freezerinv
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"gitlab.com/UrsusArcTech/logger"
+)
+
+const (
+	readingsTable = "mgl_freezer_inventory.freezer_temperature_readings"
+
+	maxReadingBytes    = 10 << 20
+	maxReadingsPerPost = 100000
+	maxReadingsListed  = 50000
+
+	// readings outside this range are broken probes, not freezers
+	minReadingC = -273.15
+	maxReadingC = 100
+	// loggers with a drifting clock may run slightly ahead of the server
+	readingClockSkew = 5 * time.Minute
+	maxAlarmDelay    = 7 * 24 * 60
+)
+
+// TemperatureAlarm holds a freezer's alarm thresholds. Either bound may be
+// left unset; a freezer with neither never has an excursion.
+type TemperatureAlarm struct {
+	AlarmMinC         *float64 `json:"alarm_min_c"`
+	AlarmMaxC         *float64 `json:"alarm_max_c"`
+	AlarmDelayMinutes int      `json:"alarm_delay_minutes"`
+}
+
+func (a TemperatureAlarm) validate() *ApiError {
+	invalid := func(field string, message string) *ApiError {
+		return &ApiError{Status: http.StatusBadRequest, Code: CodeValidationFailed, Message: message, Field: field}
+	}
+
+	switch {
+	case a.AlarmMinC != nil && (*a.AlarmMinC < minReadingC || *a.AlarmMinC > maxReadingC):
+		return invalid("alarm_min_c", fmt.Sprintf("Alarm thresholds must be between %.2f and %d °C", minReadingC, maxReadingC))
+	case a.AlarmMaxC != nil && (*a.AlarmMaxC < minReadingC || *a.AlarmMaxC > maxReadingC):
+		return invalid("alarm_max_c", fmt.Sprintf("Alarm thresholds must be between %.2f and %d °C", minReadingC, maxReadingC))
+	case a.AlarmMinC != nil && a.AlarmMaxC != nil && *a.AlarmMinC >= *a.AlarmMaxC:
+		return invalid("alarm_max_c", "The high alarm must be above the low alarm")
+	case a.AlarmDelayMinutes < 0 || a.AlarmDelayMinutes > maxAlarmDelay:
+		return invalid("alarm_delay_minutes", fmt.Sprintf("Alarm delay must be between 0 and %d minutes", maxAlarmDelay))
+	}
+	return nil
+}
+
+// outOfRange says whether a reading trips the alarm, and which way.
+func (a TemperatureAlarm) outOfRange(tempC float64) string {
+	switch {
+	case a.AlarmMaxC != nil && tempC > *a.AlarmMaxC:
+		return "high"
+	case a.AlarmMinC != nil && tempC < *a.AlarmMinC:
+		return "low"
+	}
+	return ""
+}
+
+type TemperatureReading struct {
+	FreezerId  int       `json:"freezer_id"`
+	RecordedAt time.Time `json:"recorded_at"`
+	TempC      float64   `json:"temp_c"`
+	Source     *string   `json:"source"`
+}
+
+// readingRequest is one posted reading. The freezer comes from the path, or
+// on the batch endpoint from freezer_id or a scanned FRZ- code.
+type readingRequest struct {
+	FreezerId  *int       `json:"freezer_id"`
+	Freezer    string     `json:"freezer"`
+	RecordedAt *time.Time `json:"recorded_at"`
+	TempC      *float64   `json:"temp_c"`
+	Source     *string    `json:"source"`
+}
+
+type batchReadingsRequest struct {
+	Readings []readingRequest `json:"readings"`
+}
+
+type IngestResult struct {
+	Received   int `json:"received"`
+	Stored     int `json:"stored"`
+	Duplicates int `json:"duplicates"`
+	OutOfRange int `json:"out_of_range"`
+	// Open lists the excursions still running in the freezers written to
+	Open []Excursion `json:"open"`
+}
+
+type TemperatureSeries struct {
+	FreezerId int `json:"freezer_id"`
+	TemperatureAlarm
+	Readings []TemperatureReading `json:"readings"`
+}
+
+// Excursion is a run of consecutive readings on the wrong side of a
+// threshold. It starts at the first such reading and ends at the first
+// reading back in range, so the real excursion was at least this long.
+type Excursion struct {
+	FreezerId   int    `json:"freezer_id"`
+	FreezerName string `json:"freezer_name"`
+	// Kind is high or low
+	Kind            string     `json:"kind"`
+	ThresholdC      float64    `json:"threshold_c"`
+	PeakTempC       float64    `json:"peak_temp_c"`
+	StartedAt       time.Time  `json:"started_at"`
+	EndedAt         *time.Time `json:"ended_at"`
+	Ongoing         bool       `json:"ongoing"`
+	DurationMinutes float64    `json:"duration_minutes"`
+	Readings        int        `json:"readings"`
+	// Alarm is set once the excursion outlasts the freezer's alarm delay
+	Alarm bool         `json:"alarm"`
+	Boxes []ExposedBox `json:"boxes,omitempty"`
+}
+
+type ExposedBox struct {
+	BoxId   int             `json:"box_id"`
+	BoxName string          `json:"box_name"`
+	Samples []ExposedSample `json:"samples"`
+}
+
+type ExposedSample struct {
+	SampleType     string  `json:"sample_type"`
+	EnteredName    string  `json:"entered_name"`
+	ExposedMinutes float64 `json:"exposed_minutes"`
+}
+
+// checkReading turns a posted reading into one to store. freezerId is used
+// when the reading does not name its own freezer.
+func checkReading(req readingRequest, freezerId *int, field string) (TemperatureReading, *ApiError) {
+	invalid := func(name string, message string) (TemperatureReading, *ApiError) {
+		return TemperatureReading{}, &ApiError{Status: http.StatusBadRequest, Code: CodeValidationFailed, Message: message, Field: field + name}
+	}
+
+	reading := TemperatureReading{Source: emptyAsNil(req.Source)}
+	switch {
+	case req.FreezerId != nil:
+		reading.FreezerId = *req.FreezerId
+	case req.Freezer != "":
+		prefix, id, ok := parseCode(req.Freezer)
+		if !ok || prefix != freezerCodePrefix {
+			return invalid("freezer", req.Freezer+" is not a freezer code")
+		}
+		reading.FreezerId = id
+	case freezerId != nil:
+		reading.FreezerId = *freezerId
+	default:
+		return invalid("freezer_id", "Missing required fields: freezer_id")
+	}
+	if freezerId != nil && reading.FreezerId != *freezerId {
+		return invalid("freezer_id", "The reading is for another freezer")
+	}
+
+	if req.RecordedAt == nil {
+		return invalid("recorded_at", "Missing required fields: recorded_at")
+	}
+	if req.RecordedAt.After(time.Now().Add(readingClockSkew)) {
+		return invalid("recorded_at", "recorded_at is in the future: "+req.RecordedAt.Format(time.RFC3339))
+	}
+	reading.RecordedAt = *req.RecordedAt
+
+	if req.TempC == nil {
+		return invalid("temp_c", "Missing required fields: temp_c")
+	}
+	if *req.TempC < minReadingC || *req.TempC > maxReadingC {
+		return invalid("temp_c", fmt.Sprintf("temp_c must be between %.2f and %d °C", minReadingC, maxReadingC))
+	}
+	reading.TempC = *req.TempC
+	return reading, nil
+}
+
+// ingestReadings stores readings, skipping any a freezer already has for the
+// same moment, and reports what is still out of range afterwards. Readings
+// are not written to the audit log, the table keeps who sent them instead.
+func (h *Handlers) ingestReadings(w http.ResponseWriter, r *http.Request, readings []TemperatureReading) (IngestResult, bool) {
+	result := IngestResult{Received: len(readings), Open: []Excursion{}}
+
+	if len(readings) == 0 {
+		writeValidationError(w, "readings", "No readings given")
+		return result, false
+	}
+	if len(readings) > maxReadingsPerPost {
+		writeValidationError(w, "readings", fmt.Sprintf("At most %d readings can be sent at once", maxReadingsPerPost))
+		return result, false
+	}
+
+	var freezerIds []int
+	for _, reading := range readings {
+		freezerIds = append(freezerIds, reading.FreezerId)
+	}
+	freezerIds = uniqueInts(freezerIds)
+
+	alarms := map[int]TemperatureAlarm{}
+	for _, id := range freezerIds {
+		freezer, err := h.store.GetFreezer(context.Background(), id)
+		if err == errFreezerNotFound {
+			writeError(w, http.StatusNotFound, CodeFreezerNotFound, fmt.Sprintf("Freezer %d not found", id))
+			return result, false
+		}
+		if err != nil {
+			logger.LogError("Database error: " + err.Error())
+			writeDbError(w, err)
+			return result, false
+		}
+		if freezer.Retired {
+			writeApiError(w, &ApiError{Status: http.StatusConflict, Code: CodeRetired, Message: "Freezer " + freezer.Name + " is retired", Field: "freezer_id"})
+			return result, false
+		}
+		alarms[id] = freezer.TemperatureAlarm
+	}
+	if !h.requireRole(w, r, RoleTechnician, freezerIds...) {
+		return result, false
+	}
+
+	columns := struct {
+		freezers []int
+		times    []time.Time
+		temps    []float64
+		sources  []*string
+	}{}
+	for _, reading := range readings {
+		columns.freezers = append(columns.freezers, reading.FreezerId)
+		columns.times = append(columns.times, reading.RecordedAt)
+		columns.temps = append(columns.temps, reading.TempC)
+		columns.sources = append(columns.sources, reading.Source)
+		if alarms[reading.FreezerId].outOfRange(reading.TempC) != "" {
+			result.OutOfRange++
+		}
+	}
+
+	query := "INSERT INTO " + readingsTable + " (freezer_id, recorded_at, temp_c, source, created_by) " +
+		"SELECT f, t, c, s, $5 FROM unnest($1::integer[], $2::timestamptz[], $3::float8[], $4::text[]) AS r(f, t, c, s) " +
+		"ON CONFLICT (freezer_id, recorded_at) DO NOTHING"
+	createdBy := SessionUser(r)
+	tag, err := db.Exec(context.Background(), query, columns.freezers, columns.times, columns.temps, columns.sources, emptyAsNil(&createdBy))
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return result, false
+	}
+	result.Stored = int(tag.RowsAffected())
+	result.Duplicates = result.Received - result.Stored
+
+	for _, id := range freezerIds {
+		open, err := listExcursions(&id, time.Now().AddDate(0, 0, -30), nil, true)
+		if err != nil {
+			logger.LogError("Database error: " + err.Error())
+			writeDbError(w, err)
+			return result, false
+		}
+		result.Open = append(result.Open, open...)
+	}
+	for _, e := range result.Open {
+		if e.Alarm {
+			logger.LogWarning(fmt.Sprintf("Temperature alarm on freezer %s: %.2f °C, %s threshold %.2f °C, since %s", e.FreezerName, e.PeakTempC, e.Kind, e.ThresholdC, e.StartedAt.Format(time.RFC3339)))
+		}
+	}
+	return result, true
+}
+
+// readReadingsBody reads the readings posted to one freezer: a JSON reading,
+// a JSON array of them, or a logger's CSV download as the raw body or a
+// multipart "file" field.
+func readReadingsBody(w http.ResponseWriter, r *http.Request, freezerId int) ([]TemperatureReading, *ApiError) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxReadingBytes)
+
+	invalid := func(message string) *ApiError {
+		return &ApiError{Status: http.StatusBadRequest, Code: CodeValidationFailed, Message: message, Field: "file"}
+	}
+
+	var body io.Reader = r.Body
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	if contentType == "multipart/form-data" {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			return nil, invalid("Upload the logger file as the file field: " + err.Error())
+		}
+		defer file.Close()
+		body = file
+		contentType = "text/csv"
+	}
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, invalid("Could not read the upload: " + err.Error())
+	}
+
+	if contentType != "application/json" {
+		loc := time.Local
+		if tz := r.URL.Query().Get("tz"); tz != "" {
+			if loc, err = time.LoadLocation(tz); err != nil {
+				return nil, &ApiError{Status: http.StatusBadRequest, Code: CodeValidationFailed, Message: "Unknown time zone " + tz, Field: "tz"}
+			}
+		}
+		dateOrder := r.URL.Query().Get("date_order")
+		if dateOrder != "" && dateOrder != "dmy" && dateOrder != "mdy" {
+			return nil, &ApiError{Status: http.StatusBadRequest, Code: CodeValidationFailed, Message: "Unknown date_order " + dateOrder + ", use dmy or mdy", Field: "date_order"}
+		}
+		source := r.URL.Query().Get("source")
+		return parseReadingsCSV(data, freezerId, loc, dateOrder, emptyAsNil(&source))
+	}
+
+	var requests []readingRequest
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		err = decodeStrict(trimmed, &requests)
+	} else {
+		var single readingRequest
+		err = decodeStrict(trimmed, &single)
+		requests = []readingRequest{single}
+	}
+	if err != nil {
+		return nil, &ApiError{Status: http.StatusBadRequest, Code: CodeValidationFailed, Message: "Invalid JSON body: " + err.Error()}
+	}
+
+	var readings []TemperatureReading
+	for i, req := range requests {
+		field := ""
+		if len(requests) > 1 {
+			field = fmt.Sprintf("[%d].", i)
+		}
+		reading, apiErr := checkReading(req, &freezerId, field)
+		if apiErr != nil {
+			return nil, apiErr
+		}
+		readings = append(readings, reading)
+	}
+	return readings, nil
+}
+
+func decodeStrict(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// readingTimeLayouts are the timestamp formats loggers write. Day and month
+// first dates are ambiguous, so those need date_order.
+var readingTimeLayouts = []string{
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006/01/02 15:04:05",
+	"2006/01/02 15:04",
+}
+
+var readingDayFirstLayouts = []string{"02/01/2006 15:04:05", "02/01/2006 15:04", "02/01/2006 03:04:05 PM", "02.01.2006 15:04:05", "02.01.2006 15:04"}
+var readingMonthFirstLayouts = []string{"01/02/2006 15:04:05", "01/02/2006 15:04", "01/02/2006 03:04:05 PM", "1/2/2006 3:04:05 PM", "1/2/2006 15:04"}
+
+func parseReadingTime(s string, loc *time.Location, dateOrder string) (time.Time, bool) {
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, true
+	}
+	layouts := readingTimeLayouts
+	switch dateOrder {
+	case "dmy":
+		layouts = append(layouts, readingDayFirstLayouts...)
+	case "mdy":
+		layouts = append(layouts, readingMonthFirstLayouts...)
+	}
+	for _, layout := range layouts {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// parseReadingTemp reads a temperature cell such as "-80.3", "-80,3 °C" or
+// "−112.5°F", in Celsius unless the cell or its column says Fahrenheit.
+func parseReadingTemp(s string, fahrenheit bool) (float64, bool) {
+	s = strings.TrimSpace(strings.ReplaceAll(s, "−", "-"))
+	upper := strings.ToUpper(s)
+	if strings.HasSuffix(upper, "F") {
+		fahrenheit = true
+	}
+	s = strings.TrimSpace(strings.TrimRight(s, "°CcFf "))
+	s = strings.ReplaceAll(s, ",", ".")
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, false
+	}
+	if fahrenheit {
+		v = (v - 32) * 5 / 9
+	}
+	return v, true
+}
+
+// parseReadingsCSV reads a logger download. Loggers put a few lines of
+// device details above the header, so the header is the first line with a
+// temperature column; without one the file is taken to be time, temperature.
+func parseReadingsCSV(data []byte, freezerId int, loc *time.Location, dateOrder string, source *string) ([]TemperatureReading, *ApiError) {
+	invalid := func(message string) *ApiError {
+		return &ApiError{Status: http.StatusBadRequest, Code: CodeValidationFailed, Message: message, Field: "file"}
+	}
+
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	reader := csv.NewReader(bytes.NewReader(data))
+	// European loggers write decimal commas and separate with semicolons
+	if firstLine, _, _ := bytes.Cut(data, []byte("\n")); bytes.Count(firstLine, []byte(";")) > bytes.Count(firstLine, []byte(",")) {
+		reader.Comma = ';'
+	}
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	reader.LazyQuotes = true
+	table, err := reader.ReadAll()
+	if err != nil {
+		return nil, invalid("Not a readable CSV file: " + err.Error())
+	}
+
+	timeCol, dateCol, tempCol := -1, -1, -1
+	fahrenheit := false
+	start := 0
+	for i, record := range table {
+		t, d, c := -1, -1, -1
+		f := false
+		for j, heading := range record {
+			h := strings.ToLower(strings.TrimSpace(heading))
+			switch {
+			case c == -1 && (strings.Contains(h, "temp") || strings.Contains(h, "°c") || strings.Contains(h, "°f")):
+				c = j
+				f = strings.Contains(h, "°f") || strings.Contains(h, "(f)")
+			case t == -1 && (strings.Contains(h, "time") || strings.Contains(h, "timestamp")):
+				t = j
+			case d == -1 && strings.Contains(h, "date"):
+				d = j
+			}
+		}
+		if c != -1 && (t != -1 || d != -1) {
+			timeCol, dateCol, tempCol, fahrenheit, start = t, d, c, f, i+1
+			// a lone date column holds the whole timestamp
+			if timeCol == -1 {
+				timeCol, dateCol = dateCol, -1
+			}
+			break
+		}
+	}
+	if tempCol == -1 {
+		// no header: time then temperature, after a row number if there is one
+		timeCol, tempCol = 0, 1
+		if len(table) > 0 && len(table[0]) > 2 {
+			if _, err := strconv.Atoi(strings.TrimSpace(table[0][0])); err == nil {
+				timeCol, tempCol = 1, 2
+			}
+		}
+	}
+
+	var readings []TemperatureReading
+	for i, record := range table[start:] {
+		line := start + i + 1
+		if len(record) <= max(timeCol, tempCol, dateCol) {
+			if strings.TrimSpace(strings.Join(record, "")) == "" {
+				continue
+			}
+			return nil, invalid(fmt.Sprintf("Line %d has too few columns", line))
+		}
+
+		stamp := strings.TrimSpace(record[timeCol])
+		if dateCol != -1 {
+			stamp = strings.TrimSpace(record[dateCol]) + " " + stamp
+		}
+		recordedAt, ok := parseReadingTime(stamp, loc, dateOrder)
+		if !ok {
+			return nil, invalid(fmt.Sprintf("Line %d: cannot read the time %q, set date_order for day or month first dates", line, stamp))
+		}
+		tempC, ok := parseReadingTemp(record[tempCol], fahrenheit)
+		if !ok {
+			// loggers mark missed samples with a blank or a dash
+			if cell := strings.TrimSpace(record[tempCol]); cell == "" || cell == "-" || cell == "--" {
+				continue
+			}
+			return nil, invalid(fmt.Sprintf("Line %d: cannot read the temperature %q", line, record[tempCol]))
+		}
+
+		reading, apiErr := checkReading(readingRequest{RecordedAt: &recordedAt, TempC: &tempC, Source: source}, &freezerId, "")
+		if apiErr != nil {
+			apiErr.Field = "file"
+			apiErr.Message = fmt.Sprintf("Line %d: %s", line, apiErr.Message)
+			return nil, apiErr
+		}
+		readings = append(readings, reading)
+	}
+
+	if len(readings) == 0 {
+		return nil, invalid("The file has no readings")
+	}
+	return readings, nil
+}
+
+// listExcursions works out excursions from the readings since from, against
+// each freezer's current thresholds, newest first.
+func listExcursions(freezerId *int, from time.Time, to *time.Time, openOnly bool) ([]Excursion, error) {
+	args := []interface{}{from}
+	readingsWhere := "t.recorded_at >= $1"
+	if freezerId != nil {
+		args = append(args, *freezerId)
+		readingsWhere += " AND t.freezer_id = $" + strconv.Itoa(len(args))
+	}
+	var conditions []string
+	if to != nil {
+		args = append(args, *to)
+		conditions = append(conditions, "e.started_at < $"+strconv.Itoa(len(args)))
+	}
+	if openOnly {
+		conditions = append(conditions, "e.ended_at IS NULL")
+	}
+
+	// consecutive readings in the same state share a grp, the gaps and
+	// islands trick; an excursion ends at the reading after its last one
+	query := "WITH r AS (" +
+		"SELECT t.freezer_id, t.recorded_at, t.temp_c, " +
+		"CASE WHEN t.temp_c > f.alarm_max_c THEN 'high' WHEN t.temp_c < f.alarm_min_c THEN 'low' END AS state, " +
+		"lead(t.recorded_at) OVER (PARTITION BY t.freezer_id ORDER BY t.recorded_at) AS next_at " +
+		"FROM " + readingsTable + " t JOIN mgl_freezer_inventory.freezer f ON f.id = t.freezer_id WHERE " + readingsWhere +
+		"), g AS (" +
+		"SELECT *, row_number() OVER (PARTITION BY freezer_id ORDER BY recorded_at) - row_number() OVER (PARTITION BY freezer_id, state ORDER BY recorded_at) AS grp FROM r" +
+		"), e AS (" +
+		"SELECT freezer_id, state, min(recorded_at) AS started_at, (array_agg(next_at ORDER BY recorded_at DESC))[1] AS ended_at, " +
+		"max(temp_c) AS warmest, min(temp_c) AS coldest, count(*) AS readings FROM g WHERE state IS NOT NULL GROUP BY freezer_id, state, grp" +
+		") SELECT e.freezer_id, f.name, e.state, CASE e.state WHEN 'high' THEN f.alarm_max_c ELSE f.alarm_min_c END, " +
+		"CASE e.state WHEN 'high' THEN e.warmest ELSE e.coldest END, e.started_at, e.ended_at, e.readings, f.alarm_delay_minutes " +
+		"FROM e JOIN mgl_freezer_inventory.freezer f ON f.id = e.freezer_id"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY e.started_at DESC"
+
+	logger.LogMessage(query)
+	rows, err := db.Query(context.Background(), query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	excursions := []Excursion{}
+
+	for rows.Next() {
+		var e Excursion
+		var delay int
+
+		err := rows.Scan(
+			&e.FreezerId,
+			&e.FreezerName,
+			&e.Kind,
+			&e.ThresholdC,
+			&e.PeakTempC,
+			&e.StartedAt,
+			&e.EndedAt,
+			&e.Readings,
+			&delay,
+		)
+
+		if err != nil {
+			return nil, err
+		}
+
+		end := now
+		if e.EndedAt != nil {
+			end = *e.EndedAt
+		} else {
+			e.Ongoing = true
+		}
+		e.DurationMinutes = end.Sub(e.StartedAt).Minutes()
+		e.Alarm = e.DurationMinutes >= float64(delay)
+		excursions = append(excursions, e)
+	}
+	return excursions, rows.Err()
+}
+
+// addExposure lists the boxes in the freezer and how long each sample in them
+// sat through the excursion. It goes by where things are now: a sample that
+// was checked out or used up before the excursion began was not exposed, one
+// taken out part way through was exposed until then.
+func addExposure(e *Excursion) error {
+	query := "SELECT b.id, b.name, s.sample_type, s.entered_name, s.checked_out_at, s.consumed_at FROM mgl_freezer_inventory.boxes b LEFT JOIN (" +
+		unionLinks("entered_name, box_id, checked_out_at, consumed_at", "") +
+		") s ON s.box_id = b.id WHERE b.freezer_id = $1 ORDER BY b.shelf, b.name, s.entered_name"
+	rows, err := db.Query(context.Background(), query, e.FreezerId)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	end := time.Now()
+	if e.EndedAt != nil {
+		end = *e.EndedAt
+	}
+
+	e.Boxes = []ExposedBox{}
+	for rows.Next() {
+		var boxId int
+		var boxName string
+		var sampleType, enteredName *string
+		var checkedOutAt, consumedAt *time.Time
+		if err := rows.Scan(&boxId, &boxName, &sampleType, &enteredName, &checkedOutAt, &consumedAt); err != nil {
+			return err
+		}
+
+		if len(e.Boxes) == 0 || e.Boxes[len(e.Boxes)-1].BoxId != boxId {
+			e.Boxes = append(e.Boxes, ExposedBox{BoxId: boxId, BoxName: boxName, Samples: []ExposedSample{}})
+		}
+		if enteredName == nil {
+			continue
+		}
+
+		until := end
+		gone := false
+		for _, left := range []*time.Time{checkedOutAt, consumedAt} {
+			if left == nil {
+				continue
+			}
+			if !left.After(e.StartedAt) {
+				gone = true
+			} else if left.Before(until) {
+				until = *left
+			}
+		}
+		if gone {
+			continue
+		}
+
+		box := &e.Boxes[len(e.Boxes)-1]
+		box.Samples = append(box.Samples, ExposedSample{SampleType: *sampleType, EnteredName: *enteredName, ExposedMinutes: until.Sub(e.StartedAt).Minutes()})
+	}
+	return rows.Err()
+}
+
+// queryTime reads an RFC 3339 time or a YYYY-MM-DD date, def if absent.
+func queryTime(w http.ResponseWriter, r *http.Request, name string, def *time.Time) (*time.Time, bool) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return def, true
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return &t, true
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return &t, true
+	}
+	writeValidationError(w, name, "Invalid "+name+", use YYYY-MM-DD or an RFC 3339 time")
+	return nil, false
+}
+
+// setTemperatureAlarm replaces a freezer's thresholds; a null bound removes it.
+func (h *Handlers) setTemperatureAlarm(w http.ResponseWriter, r *http.Request, freezerId int, alarm TemperatureAlarm) (FreezerDB, bool) {
+	if apiErr := alarm.validate(); apiErr != nil {
+		writeApiError(w, apiErr)
+		return FreezerDB{}, false
+	}
+	if !h.requireRole(w, r, RoleManager, freezerId) {
+		return FreezerDB{}, false
+	}
+
+	query := snapshotUpdate(freezerTable, "alarm_min_c = $1, alarm_max_c = $2, alarm_delay_minutes = $3", "id = $4")
+	after, err := auditedQuery(r, freezerTable, "update", query, alarm.AlarmMinC, alarm.AlarmMaxC, alarm.AlarmDelayMinutes, freezerId)
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return FreezerDB{}, false
+	}
+	if len(after) == 0 {
+		writeError(w, http.StatusNotFound, CodeFreezerNotFound, errFreezerNotFound.Error())
+		return FreezerDB{}, false
+	}
+
+	freezer, err := h.store.GetFreezer(r.Context(), freezerId)
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return freezer, false
+	}
+	return freezer, true
+}
+
+// ApiPostFreezerReadings takes readings for one freezer as JSON or as a
+// logger CSV. CSV options: tz for times without a zone, date_order (dmy or
+// mdy) and source.
+func (h *Handlers) ApiPostFreezerReadings(w http.ResponseWriter, r *http.Request) {
+	freezerId, ok := pathInt(w, r, "id")
+	if !ok {
+		return
+	}
+	readings, apiErr := readReadingsBody(w, r, freezerId)
+	if apiErr != nil {
+		writeApiError(w, apiErr)
+		return
+	}
+	if result, ok := h.ingestReadings(w, r, readings); ok {
+		writeJSON(w, http.StatusCreated, result)
+	}
+}
+
+// ApiPostReadings takes a batch of readings for any number of freezers.
+func (h *Handlers) ApiPostReadings(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxReadingBytes)
+	var req batchReadingsRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	var readings []TemperatureReading
+	for i, posted := range req.Readings {
+		reading, apiErr := checkReading(posted, nil, fmt.Sprintf("readings[%d].", i))
+		if apiErr != nil {
+			writeApiError(w, apiErr)
+			return
+		}
+		readings = append(readings, reading)
+	}
+	if result, ok := h.ingestReadings(w, r, readings); ok {
+		writeJSON(w, http.StatusCreated, result)
+	}
+}
+
+// ApiListFreezerReadings returns a freezer's readings between from and to,
+// the last day by default, oldest first.
+func (h *Handlers) ApiListFreezerReadings(w http.ResponseWriter, r *http.Request) {
+	freezerId, ok := pathInt(w, r, "id")
+	if !ok {
+		return
+	}
+	dayAgo := time.Now().AddDate(0, 0, -1)
+	from, ok := queryTime(w, r, "from", &dayAgo)
+	if !ok {
+		return
+	}
+	to, ok := queryTime(w, r, "to", nil)
+	if !ok {
+		return
+	}
+
+	freezer, err := h.store.GetFreezer(r.Context(), freezerId)
+	if err == errFreezerNotFound {
+		writeError(w, http.StatusNotFound, CodeFreezerNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		writeDbError(w, err)
+		return
+	}
+	if !h.requireReadScope(w, r, nil, &freezerId, nil) {
+		return
+	}
+
+	query := "SELECT freezer_id, recorded_at, temp_c::float8, source FROM " + readingsTable + " WHERE freezer_id = $1 AND recorded_at >= $2"
+	args := []interface{}{freezerId, *from}
+	if to != nil {
+		args = append(args, *to)
+		query += " AND recorded_at < $3"
+	}
+	query += fmt.Sprintf(" ORDER BY recorded_at LIMIT %d", maxReadingsListed)
+
+	rows, err := db.Query(context.Background(), query, args...)
+	if err != nil {
+		writeDbError(w, err)
+		return
+	}
+	readings, err := pgx.CollectRows(rows, pgx.RowToStructByPos[TemperatureReading])
+	if err != nil {
+		writeDbError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, TemperatureSeries{FreezerId: freezerId, TemperatureAlarm: freezer.TemperatureAlarm, Readings: readings})
+}
+
+// ApiFreezerExcursions lists a freezer's excursions since from (30 days by
+// default) with the boxes and samples each one exposed.
+func (h *Handlers) ApiFreezerExcursions(w http.ResponseWriter, r *http.Request) {
+	freezerId, ok := pathInt(w, r, "id")
+	if !ok {
+		return
+	}
+	if _, err := h.store.GetFreezer(r.Context(), freezerId); err == errFreezerNotFound {
+		writeError(w, http.StatusNotFound, CodeFreezerNotFound, err.Error())
+		return
+	} else if err != nil {
+		writeDbError(w, err)
+		return
+	}
+	if !h.requireReadScope(w, r, nil, &freezerId, nil) {
+		return
+	}
+	apiExcursions(w, r, &freezerId, true)
+}
+
+// ApiListExcursions lists excursions in every freezer. open=true keeps only
+// the ones still running, which is what the alert banner shows.
+func (h *Handlers) ApiListExcursions(w http.ResponseWriter, r *http.Request) {
+	if !h.requireReadScope(w, r, nil, nil, nil) {
+		return
+	}
+	apiExcursions(w, r, nil, false)
+}
+
+func apiExcursions(w http.ResponseWriter, r *http.Request, freezerId *int, exposure bool) {
+	monthAgo := time.Now().AddDate(0, 0, -30)
+	from, ok := queryTime(w, r, "from", &monthAgo)
+	if !ok {
+		return
+	}
+	to, ok := queryTime(w, r, "to", nil)
+	if !ok {
+		return
+	}
+
+	excursions, err := listExcursions(freezerId, *from, to, r.URL.Query().Get("open") == "true")
+	if err != nil {
+		logger.LogError("Database error: " + err.Error())
+		writeDbError(w, err)
+		return
+	}
+	if exposure {
+		for i := range excursions {
+			if err := addExposure(&excursions[i]); err != nil {
+				writeDbError(w, err)
+				return
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, excursions)
+}
+
+func (h *Handlers) ApiSetTemperatureAlarm(w http.ResponseWriter, r *http.Request) {
+	freezerId, ok := pathInt(w, r, "id")
+	if !ok {
+		return
+	}
+	var alarm TemperatureAlarm
+	if !decodeJSON(w, r, &alarm) {
+		return
+	}
+	if freezer, ok := h.setTemperatureAlarm(w, r, freezerId, alarm); ok {
+		writeJSON(w, http.StatusOK, freezer)
+	}
+}
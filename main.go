@@ -1,10 +1,16 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"fmt"
 	freezerinv "freezer_proto/backend"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 	"gitlab.com/UrsusArcTech/logger"
@@ -28,38 +34,329 @@ func main() {
 	flags.CreateFlag("-geturl", "http://dfo-db:8282/", "Set API url and port.")
 
 	_ = godotenv.Load() // Loads .env file into environment variables
-	dsn := os.Getenv("DB_URL")
-	if dsn == "" {
-		logger.LogError("DB_URL not set")
+
+	// MGL_STUB_FILE resolves sample names from a local file instead of the
+	// mgl database, see mgl_stub.example.json
+	resolverTimeout, _ := time.ParseDuration(os.Getenv("MGL_TIMEOUT"))
+	resolverCacheTTL, _ := time.ParseDuration(os.Getenv("MGL_CACHE_TTL"))
+	resolverCacheSize, _ := strconv.Atoi(os.Getenv("MGL_CACHE_SIZE"))
+	resolverMaxLookups, _ := strconv.Atoi(os.Getenv("MGL_MAX_LOOKUPS"))
+	err := freezerinv.InitResolvers(freezerinv.ResolverConfig{
+		Timeout:    resolverTimeout,
+		CacheTTL:   resolverCacheTTL,
+		CacheSize:  resolverCacheSize,
+		MaxLookups: resolverMaxLookups,
+		StubFile:   os.Getenv("MGL_STUB_FILE"),
+	})
+	if err != nil {
+		logger.LogFatal("Could not set up sample lookups: " + err.Error())
+		os.Exit(1)
 	}
 
-	freezerinv.Init(dsn)
+	// sample types beyond eDNA and fish, see sample_types.example.json
+	if err := freezerinv.LoadSampleTypes(os.Getenv("SAMPLE_TYPES_FILE")); err != nil {
+		logger.LogFatal("Could not load sample types: " + err.Error())
+		os.Exit(1)
+	}
 
-	http.HandleFunc("/getfreezerrooms", freezerinv.GetFreezerRooms)
-	http.HandleFunc("/getfreezersinrooms", freezerinv.GetFreezersInRoom)
-	http.HandleFunc("/getboxesbyfreezer", freezerinv.GetBoxesByFreezer)
-	http.HandleFunc("/insertbox", freezerinv.InsertBox)
-	http.HandleFunc("/updatebox", freezerinv.UpdateBox)
-	http.HandleFunc("/deletebox", freezerinv.DeleteBox)
-	http.HandleFunc("/getallboxes", freezerinv.GetAllBoxes)
-	http.HandleFunc("/moveallboxestoshelf", freezerinv.MoveAllBoxesToShelf)
-	http.HandleFunc("/getallfreezers", freezerinv.GetAllFreezers)
+	// STORE=sqlite keeps rooms, freezers, boxes, samples, roles and the audit
+	// log in a local file for field stations without the central database.
+	// Only the routes going through the Store are served then.
+	sqliteMode := os.Getenv("STORE") == "sqlite"
+	var store freezerinv.Store
+	if sqliteMode {
+		path := os.Getenv("SQLITE_PATH")
+		if path == "" {
+			path = "freezer_inventory.db"
+		}
+		logger.LogMessage("Using the SQLite store at " + path)
+		store, err = freezerinv.InitSQLite(path)
+	} else {
+		dsn := os.Getenv("DB_URL")
+		if dsn == "" {
+			logger.LogError("DB_URL not set")
+		}
+		store, err = freezerinv.Init(dsn)
+	}
+	if err != nil {
+		logger.LogFatal("Could not open the database: " + err.Error())
+		os.Exit(1)
+	}
+	h := freezerinv.NewHandlers(store)
 
-	//eDNA
-	http.HandleFunc("/ednalinkbybox", freezerinv.EdnaLinkByBox)
-	http.HandleFunc("/insertednalink", freezerinv.InsertEdnaLink)
-	http.HandleFunc("/updateednalink", freezerinv.UpdateEdnaLink)
-	http.HandleFunc("/checkednaalreadyinbox", freezerinv.CheckEdnaAlreadyInABox)
-	http.HandleFunc("/deleteednalink", freezerinv.DeleteEdnaLink)
+	// freezer_proto migrate up|down [steps]|status manages the central schema
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if sqliteMode {
+			logger.LogFatal("migrate is for the Postgres database, the SQLite store creates its own tables")
+			os.Exit(1)
+		}
+		if err := runMigrate(os.Args[2:]); err != nil {
+			logger.LogFatal("Migration failed: " + err.Error())
+			os.Exit(1)
+		}
+		return
+	}
 
-	//fish
-	http.HandleFunc("/fishlinkbybox", freezerinv.FishLinkByBox)
-	http.HandleFunc("/insertfishlink", freezerinv.InsertfishLink)
-	http.HandleFunc("/updatefishlink", freezerinv.UpdateFishLink)
-	http.HandleFunc("/checkfishalreadyinbox", freezerinv.CheckFishAlreadyInABox)
-	http.HandleFunc("/deletefishlink", freezerinv.DeleteFishLink)
+	// freezer_proto adduser <username> reads the password from stdin
+	if len(os.Args) > 2 && os.Args[1] == "adduser" {
+		fmt.Print("Password: ")
+		password, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err := h.CreateLocalUser(os.Args[2], strings.TrimSpace(password)); err != nil {
+			logger.LogFatal("Could not create user: " + err.Error())
+			os.Exit(1)
+		}
+		fmt.Println("User saved: " + os.Args[2])
+		return
+	}
+
+	// freezer_proto grant <username> <role> gives a lab-wide role, for bootstrapping the first manager
+	if len(os.Args) > 3 && os.Args[1] == "grant" {
+		if err := h.GrantRole(os.Args[2], os.Args[3], nil, nil, "cli"); err != nil {
+			logger.LogFatal("Could not grant role: " + err.Error())
+			os.Exit(1)
+		}
+		fmt.Println("Granted " + os.Args[3] + " to " + os.Args[2])
+		return
+	}
+
+	if !sqliteMode {
+		if err := freezerinv.CheckSchemaVersion(context.Background()); err != nil {
+			logger.LogFatal("Not serving: " + err.Error())
+			os.Exit(1)
+		}
+		if err := freezerinv.CheckSampleTypeTables(context.Background()); err != nil {
+			logger.LogFatal("Not serving: " + err.Error())
+			os.Exit(1)
+		}
+	}
+
+	sessionTTL, _ := time.ParseDuration(os.Getenv("SESSION_TTL"))
+	err = freezerinv.InitAuth(freezerinv.AuthConfig{
+		SessionSecret: os.Getenv("SESSION_SECRET"),
+		SessionTTL:    sessionTTL,
+		SecureCookie:  os.Getenv("SESSION_SECURE_COOKIE") == "true",
+		LdapURL:       os.Getenv("LDAP_URL"),
+		LdapBindDN:    os.Getenv("LDAP_BIND_DN"),
+		LdapStartTLS:  os.Getenv("LDAP_STARTTLS") == "true",
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	//auth
+	http.HandleFunc("GET /api/v1/session", h.WhoAmI)
+	http.HandleFunc("POST /api/v1/session", h.Login)
+	http.HandleFunc("DELETE /api/v1/session", freezerinv.Logout)
+
+	//rooms, freezers and boxes
+	http.HandleFunc("GET /api/v1/rooms", h.GetFreezerRooms)
+	http.HandleFunc("POST /api/v1/rooms", h.RequireLogin(h.ApiCreateRoom))
+	http.HandleFunc("PATCH /api/v1/rooms/{id}", h.RequireLogin(h.ApiUpdateRoom))
+	http.HandleFunc("POST /api/v1/rooms/{id}/retire", h.RequireLogin(h.ApiRetireRoom))
+	http.HandleFunc("GET /api/v1/rooms/{id}/freezers", h.ApiListRoomFreezers)
+	http.HandleFunc("GET /api/v1/freezers", h.GetAllFreezers)
+	http.HandleFunc("POST /api/v1/freezers", h.RequireLogin(h.ApiCreateFreezer))
+	http.HandleFunc("GET /api/v1/freezers/{id}", h.ApiGetFreezer)
+	http.HandleFunc("PATCH /api/v1/freezers/{id}", h.RequireLogin(h.ApiUpdateFreezer))
+	http.HandleFunc("POST /api/v1/freezers/{id}/retire", h.RequireLogin(h.ApiRetireFreezer))
+	http.HandleFunc("GET /api/v1/freezers/{id}/boxes", h.RequireLogin(h.ApiListFreezerBoxes))
+	http.HandleFunc("GET /api/v1/boxes", h.RequireLogin(h.GetAllBoxes))
+	http.HandleFunc("POST /api/v1/boxes", h.RequireLogin(h.ApiCreateBox))
+	http.HandleFunc("PATCH /api/v1/boxes/{id}", h.RequireLogin(h.ApiUpdateBox))
+	http.HandleFunc("DELETE /api/v1/boxes/{id}", h.RequireLogin(h.ApiDeleteBox))
+	http.HandleFunc("GET /api/v1/boxes/{id}/grid", h.RequireLogin(h.ApiBoxGrid))
+
+	//samples, one route set shared by every registered sample type
+	http.HandleFunc("GET /api/v1/sample-types", freezerinv.ApiSampleTypes)
+	http.HandleFunc("GET /api/v1/boxes/{id}/samples/{type}", h.RequireLogin(h.ApiListSampleLinks))
+	http.HandleFunc("POST /api/v1/samples/{type}", h.RequireLogin(h.ApiCreateSampleLink))
+	http.HandleFunc("GET /api/v1/samples/{type}/{name}/locations", h.RequireLogin(h.ApiSampleLocations))
+	http.HandleFunc("PATCH /api/v1/samples/{type}/{name}", h.RequireLogin(h.ApiUpdateSampleLink))
+	http.HandleFunc("DELETE /api/v1/samples/{type}/{name}", h.RequireLogin(h.ApiDeleteSampleLink))
+
+	//checkout and aliquots
+	http.HandleFunc("POST /api/v1/samples/{type}/{name}/checkout", h.RequireLogin(h.ApiCheckoutSample))
+	http.HandleFunc("POST /api/v1/samples/{type}/{name}/return", h.RequireLogin(h.ApiReturnSample))
+	http.HandleFunc("POST /api/v1/samples/{type}/{name}/aliquots", h.RequireLogin(h.ApiCreateAliquot))
+	http.HandleFunc("POST /api/v1/samples/{type}/{name}/consume", h.RequireLogin(h.ApiConsumeSample))
+	http.HandleFunc("PUT /api/v1/samples/{type}/{name}/quantity", h.RequireLogin(h.ApiSetSampleQuantity))
+
+	//scanning
+	http.HandleFunc("GET /api/v1/scan/{code}", h.RequireLogin(h.ApiResolveScan))
+	http.HandleFunc("POST /api/v1/boxes/{id}/scan", h.RequireLogin(h.ApiScanIntoBox))
+
+	//moves
+	http.HandleFunc("POST /api/v1/freezers/{id}/shelves/{shelf}/move", h.RequireLogin(h.ApiMoveShelf))
+	http.HandleFunc("POST /api/v1/boxes/move", h.RequireLogin(h.ApiMoveBoxes))
+
+	//roles
+	http.HandleFunc("GET /api/v1/roles", h.RequireLogin(h.GetRoles))
+	http.HandleFunc("POST /api/v1/roles", h.RequireLogin(h.ApiGrantRole))
+	http.HandleFunc("DELETE /api/v1/roles/{id}", h.RequireLogin(h.ApiRevokeRole))
+
+	//audit
+	http.HandleFunc("GET /api/v1/audit", h.RequireLogin(h.GetAuditLog))
+
+	if !sqliteMode {
+		registerPostgresRoutes(h)
+	}
+
+	// The old query string GET routes change data on GET, so they are only
+	// served when asked for
+	if os.Getenv("LEGACY_ROUTES") == "true" {
+		logger.LogWarning("LEGACY_ROUTES enabled - serving the old GET mutation routes")
+		registerLegacyRoutes(h)
+	}
+
+	if !sqliteMode {
+		snapshotInterval, _ := time.ParseDuration(os.Getenv("CAPACITY_SNAPSHOT_INTERVAL"))
+		freezerinv.StartCapacitySnapshots(snapshotInterval)
+	}
 
 	http.HandleFunc("/", corsHandler)
 	log.Println("Serving static/ on http://localhost:8080")
 	log.Fatal(http.ListenAndServe(":8080", nil))
 }
+
+func registerLegacyRoutes(h *freezerinv.Handlers) {
+	//auth
+	http.HandleFunc("/login", h.Login)
+	http.HandleFunc("POST /logout", freezerinv.Logout)
+	http.HandleFunc("/whoami", h.WhoAmI)
+
+	http.HandleFunc("/getfreezerrooms", h.GetFreezerRooms)
+	http.HandleFunc("/getfreezersinrooms", h.GetFreezersInRoom)
+	http.HandleFunc("/getboxesbyfreezer", h.RequireLogin(h.GetBoxesByFreezer))
+	http.HandleFunc("/insertbox", h.RequireLogin(h.InsertBox))
+	http.HandleFunc("/updatebox", h.RequireLogin(h.UpdateBox))
+	http.HandleFunc("/deletebox", h.RequireLogin(h.DeleteBox))
+	http.HandleFunc("/getallboxes", h.RequireLogin(h.GetAllBoxes))
+	http.HandleFunc("/getallfreezers", h.GetAllFreezers)
+
+	//eDNA
+	http.HandleFunc("/ednalinkbybox", h.RequireLogin(h.EdnaLinkByBox))
+	http.HandleFunc("/insertednalink", h.RequireLogin(h.InsertEdnaLink))
+	http.HandleFunc("/updateednalink", h.RequireLogin(h.UpdateEdnaLink))
+	http.HandleFunc("/checkednaalreadyinbox", h.RequireLogin(h.CheckEdnaAlreadyInABox))
+	http.HandleFunc("/deleteednalink", h.RequireLogin(h.DeleteEdnaLink))
+
+	//fish
+	http.HandleFunc("/fishlinkbybox", h.RequireLogin(h.FishLinkByBox))
+	http.HandleFunc("/insertfishlink", h.RequireLogin(h.InsertfishLink))
+	http.HandleFunc("/updatefishlink", h.RequireLogin(h.UpdateFishLink))
+	http.HandleFunc("/checkfishalreadyinbox", h.RequireLogin(h.CheckFishAlreadyInABox))
+	http.HandleFunc("/deletefishlink", h.RequireLogin(h.DeleteFishLink))
+
+	//moves
+	http.HandleFunc("/moveallboxestoshelf", h.RequireLogin(h.MoveAllBoxesToShelf))
+
+	//roles
+	http.HandleFunc("/roles", h.RequireLogin(h.GetRoles))
+	http.HandleFunc("/grantrole", h.RequireLogin(h.GrantRoleHandler))
+	http.HandleFunc("/revokerole", h.RequireLogin(h.RevokeRole))
+
+	//audit
+	http.HandleFunc("/audit", h.RequireLogin(h.GetAuditLog))
+}
+
+// registerPostgresRoutes adds the routes that query the central database
+// directly rather than through the Store.
+func registerPostgresRoutes(h *freezerinv.Handlers) {
+	//lineage
+	http.HandleFunc("GET /api/v1/samples/{type}/{name}/lineage", h.RequireLogin(h.ApiSampleLineage))
+
+	//checked out samples
+	http.HandleFunc("GET /api/v1/samples/out", h.RequireLogin(h.ApiCheckedOutSamples))
+
+	//temperature
+	http.HandleFunc("GET /api/v1/freezers/{id}/temperatures", h.RequireLogin(h.ApiListFreezerReadings))
+	http.HandleFunc("POST /api/v1/freezers/{id}/temperatures", h.RequireLogin(h.ApiPostFreezerReadings))
+	http.HandleFunc("POST /api/v1/temperatures", h.RequireLogin(h.ApiPostReadings))
+	http.HandleFunc("PUT /api/v1/freezers/{id}/alarm", h.RequireLogin(h.ApiSetTemperatureAlarm))
+	http.HandleFunc("GET /api/v1/freezers/{id}/excursions", h.RequireLogin(h.ApiFreezerExcursions))
+	http.HandleFunc("GET /api/v1/excursions", h.RequireLogin(h.ApiListExcursions))
+
+	//maintenance
+	http.HandleFunc("GET /api/v1/freezers/{id}/maintenance", h.ApiListMaintenance)
+	http.HandleFunc("POST /api/v1/freezers/{id}/maintenance", h.RequireLogin(h.ApiAddMaintenance))
+	http.HandleFunc("DELETE /api/v1/maintenance/{id}", h.RequireLogin(h.ApiDeleteMaintenance))
+	http.HandleFunc("POST /api/v1/maintenance/{id}/attachments", h.RequireLogin(h.ApiAddMaintenanceAttachment))
+	http.HandleFunc("GET /api/v1/maintenance/attachments/{id}", h.RequireLogin(h.ApiGetMaintenanceAttachment))
+	http.HandleFunc("GET /api/v1/maintenance/intervals", freezerinv.ApiListMaintenanceIntervals)
+	http.HandleFunc("PUT /api/v1/maintenance/intervals", h.RequireLogin(h.ApiSetMaintenanceInterval))
+	http.HandleFunc("GET /api/v1/maintenance/overdue", freezerinv.ApiMaintenanceOverdue)
+
+	//evacuation
+	http.HandleFunc("POST /api/v1/freezers/{id}/evacuation/plan", h.RequireLogin(h.ApiPlanEvacuation))
+	http.HandleFunc("POST /api/v1/freezers/{id}/evacuation", h.RequireLogin(h.ApiExecuteEvacuation))
+
+	//capacity
+	http.HandleFunc("GET /api/v1/capacity", h.RequireLogin(h.ApiCapacity))
+	http.HandleFunc("GET /api/v1/freezers/{id}/capacity", h.RequireLogin(h.ApiFreezerCapacity))
+	http.HandleFunc("GET /api/v1/capacity/trend", h.RequireLogin(h.ApiCapacityTrend))
+	http.HandleFunc("POST /api/v1/capacity/snapshots", h.RequireLogin(h.ApiTakeCapacitySnapshot))
+
+	//import
+	http.HandleFunc("POST /api/v1/import", h.RequireLogin(h.ApiImportSamples))
+
+	//export
+	http.HandleFunc("GET /api/v1/export", h.RequireLogin(h.ApiExportInventory))
+
+	//search
+	http.HandleFunc("GET /api/v1/search", h.RequireLogin(h.Search))
+
+	//labels
+	http.HandleFunc("GET /api/v1/labels/boxes", h.RequireLogin(h.ApiBoxLabels))
+	http.HandleFunc("GET /api/v1/labels/freezers", h.RequireLogin(h.ApiFreezerLabels))
+
+}
+
+// runMigrate handles the arguments after migrate.
+func runMigrate(args []string) error {
+	ctx := context.Background()
+	if len(args) == 0 {
+		return fmt.Errorf("use migrate up, migrate down [steps] or migrate status")
+	}
+
+	switch args[0] {
+	case "up":
+		applied, err := freezerinv.MigrateUp(ctx)
+		for _, m := range applied {
+			fmt.Println("Applied " + m.String())
+		}
+		if err == nil && len(applied) == 0 {
+			fmt.Println("Schema is up to date")
+		}
+		return err
+
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				return fmt.Errorf("steps must be a positive number, got %s", args[1])
+			}
+			steps = n
+		}
+		reverted, err := freezerinv.MigrateDown(ctx, steps)
+		for _, m := range reverted {
+			fmt.Println("Reverted " + m.String())
+		}
+		return err
+
+	case "status":
+		migrations, err := freezerinv.MigrationStatus(ctx)
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			state := "pending"
+			if m.AppliedAt != nil {
+				state = "applied " + m.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%s  %s\n", m, state)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown migrate command %s, use up, down or status", args[0])
+}
@@ -3,6 +3,9 @@ let currentRoom = null;
 let currentFreezer = null;
 let currentBox = null;
 let allBoxes = [];
+let sampleTypes = [];
+// false on the SQLite store, which only keeps rooms, freezers, boxes and samples
+let centralStore = true;
 
 // Utility Functions
 function showView(id) {
@@ -13,7 +16,7 @@ async function safeFetchJson(url) {
   try {
     const res = await fetch(url);
     if (!res.ok) {
-      const errText = await res.text();
+      const errText = await errorMessage(res);
       console.error(`Error ${res.status} fetching ${url}: ${errText}`);
       return null;
     }
@@ -23,25 +26,281 @@ async function safeFetchJson(url) {
     return null;
   }
 }
+// Error responses carry {code, message, field, details}; fall back to the raw text
+async function errorMessage(res) {
+  const text = await res.text();
+  try {
+    return JSON.parse(text).message || text;
+  } catch {
+    return text;
+  }
+}
+// Send a JSON body with the given method; returns the raw response
+function sendJson(method, url, body) {
+  return fetch(url, {
+    method,
+    headers: { 'Content-Type': 'application/json' },
+    body: body === undefined ? undefined : JSON.stringify(body),
+  });
+}
+
+// Sample types: each registered type gets its own list, column and option
+const sampleTypeLabel = key => (sampleTypes.find(t => t.key === key) || { label: key }).label;
+
+async function loadSampleTypes() {
+  sampleTypes = await safeFetchJson('/api/v1/sample-types') || [];
+  document.querySelectorAll('.export-type').forEach(select =>
+    sampleTypes.forEach(t => select.append(new Option(`${t.label} only`, t.key))));
+  sampleTypes.forEach(t => {
+    document.getElementById('scanType').append(new Option(t.label, t.key));
+    document.getElementById('sampleTypeInput').append(new Option(t.label, t.key));
+  });
+  document.querySelectorAll('.sample-type-columns').forEach(th =>
+    th.replaceWith(...sampleTypes.map(t => {
+      const col = document.createElement('th');
+      col.textContent = t.label;
+      return col;
+    })));
+  const container = document.getElementById('sampleLists');
+  container.innerHTML = '';
+  sampleTypes.forEach(t => {
+    const div = document.createElement('div');
+    const h2 = document.createElement('h2');
+    h2.textContent = t.label;
+    const ul = document.createElement('ul');
+    ul.id = `sampleList-${t.key}`;
+    div.append(h2, ul);
+    container.append(div);
+  });
+}
 
 // Login
 const loginDlg = document.getElementById('loginDialog');
-//loginDlg.showModal();
-document.getElementById('loginSubmit').addEventListener('click', () => {
-  const user = document.getElementById('usernameInput').value.trim();
-  if (user) {
-    sessionStorage.setItem('username', user);
-    loginDlg.close();
-    loadRooms();
+const logoutBtn = document.getElementById('logoutBtn');
+
+function setSessionUser(user) {
+  document.getElementById('sessionUser').textContent = user ? `Logged in as ${user}` : '';
+  logoutBtn.classList.toggle('hidden', !user);
+}
+
+function setStore(store) {
+  centralStore = store !== 'sqlite';
+  document.body.classList.toggle('field-store', !centralStore);
+}
+
+function showLogin(message = '') {
+  document.getElementById('loginMessage').textContent = message;
+  if (!loginDlg.open) loginDlg.showModal();
+}
+
+// Anything that changes data needs a session and a role; prompt for login when the server says so
+async function checkAuth(res) {
+  if (res.status === 401) {
+    setSessionUser(null);
+    showLogin('Please log in to make changes.');
+    return false;
+  }
+  if (res.status === 403) {
+    alert(await errorMessage(res));
+    return false;
   }
+  return true;
+}
+
+document.getElementById('loginForm').addEventListener('submit', async e => {
+  e.preventDefault();
+  const username = document.getElementById('usernameInput').value.trim();
+  const password = document.getElementById('passwordInput').value;
+  if (!username || !password) return;
+  const res = await sendJson('POST', '/api/v1/session', { username, password });
+  if (!res.ok) {
+    document.getElementById('loginMessage').textContent = await errorMessage(res);
+    return;
+  }
+  const session = await res.json();
+  document.getElementById('passwordInput').value = '';
+  setSessionUser(session.username);
+  setStore(session.store);
+  loginDlg.close();
 });
 
-    loadRooms();
+logoutBtn.onclick = async () => {
+  await fetch('/api/v1/session', { method: 'DELETE' });
+  setSessionUser(null);
+  showLogin();
+};
+
+(async () => {
+  const session = await safeFetchJson('/api/v1/session');
+  if (session) {
+    setSessionUser(session.username);
+    setStore(session.store);
+  } else showLogin();
+  await loadSampleTypes();
+  await loadOverdue();
+  loadRooms();
+  loadAlarms();
+})();
+
+// Global Search: results open the view that holds them
+const searchPanel = document.getElementById('searchResults');
+const searchPageSize = 25;
+let searchQuery = '';
+let searchOffset = 0;
+
+document.getElementById('searchForm').addEventListener('submit', e => {
+  e.preventDefault();
+  searchQuery = document.getElementById('searchInput').value.trim();
+  if (!searchQuery) return;
+  runSearch(0);
+});
+document.getElementById('searchPrev').onclick = () => runSearch(Math.max(0, searchOffset - searchPageSize));
+document.getElementById('searchNext').onclick = () => runSearch(searchOffset + searchPageSize);
+document.getElementById('searchClose').onclick = () => searchPanel.classList.add('hidden');
+
+function describePath(path) {
+  const parts = [`${path.lab} – ${path.floor}`, path.freezer_name];
+  if (path.shelf != null) parts.push(`shelf ${path.shelf}`);
+  if (path.rack != null) parts.push(`rack ${path.rack}`);
+  if (path.drawer != null) parts.push(`drawer ${path.drawer}`);
+  if (path.box_name != null) parts.push(`box ${path.box_name}`);
+  if (path.position_label != null) parts.push(path.position_label);
+  else if (path.position != null) parts.push(`position ${path.position}`);
+  return parts.join(' › ');
+}
+
+async function runSearch(offset) {
+  searchOffset = offset;
+  const params = new URLSearchParams({ q: searchQuery, limit: searchPageSize, offset });
+  const page = await safeFetchJson(`/api/v1/search?${params}`);
+  const list = document.getElementById('searchList');
+  list.innerHTML = '';
+  searchPanel.classList.remove('hidden');
+  if (!page) {
+    document.getElementById('searchSummary').textContent = 'Search failed.';
+    return;
+  }
+  const last = Math.min(page.offset + page.results.length, page.total);
+  document.getElementById('searchSummary').textContent = page.total
+    ? `${page.offset + 1}–${last} of ${page.total} results for "${page.query}"`
+    : `No results for "${page.query}"`;
+  document.getElementById('searchPrev').disabled = page.offset === 0;
+  document.getElementById('searchNext').disabled = last >= page.total;
+  page.results.forEach(result => {
+    const li = document.createElement('li');
+    const btn = document.createElement('button');
+    btn.textContent = `${result.kind}: ${result.name}`;
+    btn.title = `${result.match} match`;
+    btn.onclick = () => openSearchResult(result);
+    const where = document.createElement('span');
+    where.className = 'search-path';
+    where.textContent = describePath(result.path);
+    li.append(btn, where);
+    list.append(li);
+  });
+}
+
+function openSearchResult(result) {
+  searchPanel.classList.add('hidden');
+  currentRoom = result.path.room_id;
+  currentFreezer = result.path.freezer_id;
+  if (result.path.box_id != null) loadSamples(result.path.box_id);
+  else loadBoxes(result.path.freezer_id);
+}
+
+// Scan Mode: a box scan opens it, tube scans check samples in or out of it
+const scanInput = document.getElementById('scanInput');
+let scanBox = null;
+let audioCtx = null;
+
+document.getElementById('scanModeBtn').onclick = () => {
+  showView('scanView');
+  scanInput.focus();
+};
+document.getElementById('exitScan').onclick = loadRooms;
+
+// Short tone: high for success, low for a problem
+function beep(ok) {
+  try {
+    audioCtx = audioCtx || new AudioContext();
+    const osc = audioCtx.createOscillator();
+    osc.frequency.value = ok ? 880 : 220;
+    osc.connect(audioCtx.destination);
+    osc.start();
+    osc.stop(audioCtx.currentTime + (ok ? 0.1 : 0.35));
+  } catch {
+    // no audio, the colour still shows
+  }
+}
+
+function scanFeedback(ok, message) {
+  const status = document.getElementById('scanStatus');
+  status.textContent = message;
+  status.className = `scan-status ${ok ? 'scan-ok' : 'scan-error'}`;
+  const li = document.createElement('li');
+  li.className = ok ? 'scan-ok' : 'scan-error';
+  li.textContent = `${new Date().toLocaleTimeString()} ${message}`;
+  document.getElementById('scanLog').prepend(li);
+  beep(ok);
+}
+
+function openScanBox(box) {
+  scanBox = box;
+  document.getElementById('scanBox').textContent = `Box ${box.name} (shelf ${box.shelf}${box.rack ? `, rack ${box.rack}` : ''}${box.drawer ? `, drawer ${box.drawer}` : ''})`;
+}
+
+document.getElementById('scanForm').addEventListener('submit', async e => {
+  e.preventDefault();
+  const code = scanInput.value.trim();
+  scanInput.value = '';
+  scanInput.focus();
+  if (!code) return;
+
+  const type = document.getElementById('scanType').value;
+  const resolved = await safeFetchJson(`/api/v1/scan/${encodeURIComponent(code)}${type ? `?sample_type=${encodeURIComponent(type)}` : ''}`);
+  if (!resolved) {
+    scanFeedback(false, `${code} is not a known code`);
+    return;
+  }
+  if (resolved.kind === 'box') {
+    openScanBox(resolved.box);
+    scanFeedback(true, `Opened box ${resolved.box.name}`);
+    return;
+  }
+  if (resolved.kind === 'freezer') {
+    scanFeedback(false, `${resolved.freezer.name} is a freezer, scan a box label`);
+    return;
+  }
+  if (!scanBox) {
+    scanFeedback(false, 'Scan a box label first');
+    return;
+  }
+
+  const action = document.querySelector('input[name="scanAction"]:checked').value;
+  const body = { code, action };
+  if (type) body.sample_type = type;
+  const res = await sendJson('POST', `/api/v1/boxes/${scanBox.id}/scan`, body);
+  if (!await checkAuth(res)) return;
+  if (!res.ok) {
+    scanFeedback(false, await errorMessage(res));
+    return;
+  }
+  const filed = await res.json();
+  const kind = sampleTypeLabel(filed.sample_type);
+  const messages = {
+    checked_in: `${kind} ${code} checked in to ${scanBox.name}`,
+    checked_out: `${kind} ${code} checked out of ${scanBox.name}`,
+    removed: `${kind} ${code} removed from ${scanBox.name}`,
+    already_here: `${kind} ${code} is already in ${scanBox.name}`,
+    returned: `${kind} ${code} returned to ${scanBox.name}`,
+  };
+  scanFeedback(filed.result !== 'already_here', messages[filed.result] + (filed.message ? ` – ${filed.message}` : ''));
+});
 
 // Load Rooms
 async function loadRooms() {
   showView('roomView');
-  const rooms = await safeFetchJson('/getfreezerrooms');
+  const rooms = await safeFetchJson('/api/v1/rooms');
   const ul = document.getElementById('roomList');
   ul.innerHTML = '';
   if (!rooms) return;
@@ -50,18 +309,182 @@ async function loadRooms() {
     const btn = document.createElement('button');
     btn.textContent = `${r.lab} – ${r.floor}`;
     btn.onclick = () => loadFreezers(r.id);
-    li.append(btn);
+    const editBtn = document.createElement('button');
+    editBtn.textContent = 'Edit';
+    editBtn.onclick = () => openRoomDialog(r);
+    const retireBtn = document.createElement('button');
+    retireBtn.textContent = 'Retire';
+    retireBtn.onclick = () => retireRoom(r);
+    li.append(btn, editBtn, retireBtn);
     ul.append(li);
   });
 }
 
+// Add / Edit Room Dialog
+const roomDlg = document.getElementById('roomDialog');
+let editingRoom = null;
+document.getElementById('addRoomBtn').onclick = () => openRoomDialog(null);
+document.getElementById('roomCancel').onclick = () => roomDlg.close();
+
+function openRoomDialog(room) {
+  editingRoom = room;
+  document.getElementById('roomDialogTitle').textContent = room ? 'Edit Room' : 'Add Room';
+  document.getElementById('roomLab').value = room ? room.lab : '';
+  document.getElementById('roomFloor').value = room ? room.floor : '';
+  document.getElementById('roomMessage').textContent = '';
+  roomDlg.showModal();
+}
+
+document.getElementById('roomForm').addEventListener('submit', async e => {
+  e.preventDefault();
+  const body = {
+    lab: document.getElementById('roomLab').value.trim(),
+    floor: document.getElementById('roomFloor').value.trim(),
+  };
+  const res = editingRoom
+    ? await sendJson('PATCH', `/api/v1/rooms/${editingRoom.id}`, body)
+    : await sendJson('POST', '/api/v1/rooms', body);
+  if (!await checkAuth(res)) return;
+  if (!res.ok) {
+    document.getElementById('roomMessage').textContent = await errorMessage(res);
+    return;
+  }
+  roomDlg.close();
+  loadRooms();
+});
+
+async function retireRoom(room) {
+  if (!confirm(`Retire room "${room.lab} – ${room.floor}"? It will no longer be listed.`)) return;
+  const res = await fetch(`/api/v1/rooms/${room.id}/retire`, { method: 'POST' });
+  if (!await checkAuth(res)) return;
+  if (!res.ok) {
+    alert(await errorMessage(res));
+    return;
+  }
+  loadRooms();
+}
+
+// Import Dialog: preview with dry_run, then import the same file for real
+const importDlg = document.getElementById('importDialog');
+const importFile = document.getElementById('importFile');
+const importCommit = document.getElementById('importCommit');
+document.getElementById('importBtn').onclick = () => {
+  importFile.value = '';
+  showImportReport(null);
+  importDlg.showModal();
+};
+document.getElementById('importCancel').onclick = () => importDlg.close();
+importFile.onchange = () => showImportReport(null);
+
+function uploadImport(dryRun) {
+  const form = new FormData();
+  form.append('file', importFile.files[0]);
+  return fetch(`/api/v1/import${dryRun ? '?dry_run=true' : ''}`, { method: 'POST', body: form });
+}
+
+function showImportReport(report, message = '') {
+  const table = document.getElementById('importReport');
+  const tbody = table.querySelector('tbody');
+  tbody.innerHTML = '';
+  table.classList.toggle('hidden', !report);
+  importCommit.disabled = !report || report.errors > 0 || report.already_stored > 0;
+  if (report && !message) {
+    message = `${report.total} rows: ${report.ready} ready, ${report.unresolved} unresolved, ${report.already_stored} already stored, ${report.errors} errors`;
+  }
+  document.getElementById('importMessage').textContent = message;
+  if (!report) return;
+  report.rows.forEach(row => {
+    const tr = document.createElement('tr');
+    tr.className = `import-${row.status}`;
+    [row.line, row.box, row.sample_type, row.entered_name, row.position ?? '', row.status, row.message || '']
+      .forEach(value => {
+        const td = document.createElement('td');
+        td.textContent = value;
+        tr.append(td);
+      });
+    tbody.append(tr);
+  });
+}
+
+document.getElementById('importForm').addEventListener('submit', async e => {
+  e.preventDefault();
+  if (!importFile.files.length) return;
+  const res = await uploadImport(true);
+  if (!await checkAuth(res)) return;
+  if (!res.ok) {
+    showImportReport(null, await errorMessage(res));
+    return;
+  }
+  showImportReport(await res.json());
+});
+
+importCommit.onclick = async () => {
+  const res = await uploadImport(false);
+  if (!await checkAuth(res)) return;
+  if (!res.ok) {
+    const text = await res.text();
+    try {
+      const err = JSON.parse(text);
+      showImportReport(err.details || null, err.message);
+    } catch {
+      showImportReport(null, text);
+    }
+    return;
+  }
+  const report = await res.json();
+  showImportReport(null, `Imported ${report.total} samples.`);
+};
+
+// Export: each view downloads what it shows, data-filter names the scope
+function exportUrl(format, filters) {
+  const params = new URLSearchParams({ format });
+  Object.entries(filters).forEach(([key, value]) => {
+    if (value !== null && value !== undefined && value !== '') params.set(key, value);
+  });
+  return `/api/v1/export?${params}`;
+}
+
+document.querySelectorAll('.export-controls').forEach(ctl => {
+  ctl.querySelector('.export-btn').onclick = () => {
+    const scope = { room: currentRoom, freezer: currentFreezer, box: currentBox };
+    const filters = { type: ctl.querySelector('.export-type').value };
+    if (ctl.dataset.filter) filters[ctl.dataset.filter] = scope[ctl.dataset.filter];
+    window.location.href = exportUrl(ctl.querySelector('.export-format').value, filters);
+  };
+});
+
+// Labels: the buttons pick what to label, the dialog picks how
+const labelDlg = document.getElementById('labelDialog');
+let labelTarget = null;
+document.getElementById('labelCancel').onclick = () => labelDlg.close();
+document.getElementById('freezerLabelsBtn').onclick = () => openLabelDialog('freezers', { room: currentRoom });
+document.getElementById('boxLabelsBtn').onclick = () => openLabelDialog('boxes', { freezer: currentFreezer });
+document.getElementById('boxLabelBtn').onclick = () => openLabelDialog('boxes', { ids: currentBox });
+
+function openLabelDialog(kind, filters) {
+  labelTarget = { kind, filters };
+  labelDlg.showModal();
+}
+
+document.getElementById('labelForm').addEventListener('submit', e => {
+  e.preventDefault();
+  const params = new URLSearchParams(labelTarget.filters);
+  params.set('size', document.getElementById('labelSize').value);
+  params.set('symbology', document.getElementById('labelSymbology').value);
+  params.set('format', document.getElementById('labelFormat').value);
+  const sheet = document.getElementById('labelSheet').value;
+  if (sheet) params.set('sheet', sheet);
+  labelDlg.close();
+  window.location.href = `/api/v1/labels/${labelTarget.kind}?${params}`;
+});
+
 // Load Freezers
 async function loadFreezers(roomId) {
   currentRoom = roomId;
   showView('freezerView');
   document.getElementById('backToRooms').onclick = loadRooms;
 
-  const freezers = await safeFetchJson(`/getfreezersinrooms?roomid=${roomId}`);
+  const freezers = await safeFetchJson(`/api/v1/rooms/${roomId}/freezers`);
   const container = document.getElementById('freezerList');
   container.innerHTML = '';
   if (!freezers) return;
@@ -73,13 +496,486 @@ async function loadFreezers(roomId) {
       <p>Model: ${f.model}</p>
       <p>Temp: ${f.current_holding_temp_c}°C</p>
       <p>Projects: ${f.manual_projects_contained}</p>
+      <p>Layout: ${f.shelf_count} × ${f.shelf_label.toLowerCase()}${f.racks_per_shelf ? `, ${f.racks_per_shelf} racks each` : ''}${f.drawers_per_rack ? `, ${f.drawers_per_rack} drawers per rack` : ''}</p>
       <p>Last Calibrated: ${f.last_calibrated}</p>
     `;
+    const editBtn = document.createElement('button');
+    editBtn.textContent = 'Edit';
+    editBtn.onclick = e => { e.stopPropagation(); openFreezerDialog(f); };
+    const retireBtn = document.createElement('button');
+    retireBtn.textContent = 'Retire';
+    retireBtn.onclick = e => { e.stopPropagation(); retireFreezer(f); };
+    const labelBtn = document.createElement('button');
+    labelBtn.className = 'central-only';
+    labelBtn.textContent = 'Label';
+    labelBtn.onclick = e => { e.stopPropagation(); openLabelDialog('freezers', { ids: f.id }); };
+    const tempBtn = document.createElement('button');
+    tempBtn.className = 'central-only';
+    tempBtn.textContent = 'Temps';
+    tempBtn.onclick = e => { e.stopPropagation(); openTempDialog(f); };
+    const logBtn = document.createElement('button');
+    logBtn.className = 'central-only';
+    logBtn.textContent = 'Maintenance';
+    logBtn.onclick = e => { e.stopPropagation(); openLogDialog(f); };
+    const evacBtn = document.createElement('button');
+    evacBtn.className = 'central-only';
+    evacBtn.textContent = 'Evacuate';
+    evacBtn.onclick = e => { e.stopPropagation(); openEvacDialog(f); };
+    card.append(editBtn, retireBtn, labelBtn, tempBtn, logBtn, evacBtn);
+    const overdue = overdueMaintenance.filter(d => d.freezer_id === f.id && d.overdue);
+    if (overdue.length) {
+      const badge = document.createElement('span');
+      badge.className = 'badge-overdue';
+      badge.textContent = `${overdue.map(d => d.kind).join(', ')} overdue`;
+      card.prepend(badge);
+    }
     card.onclick = () => loadBoxes(f.id);
     container.append(card);
   });
 }
 
+// Temperature: thresholds, logger uploads and excursions for one freezer
+const tempDlg = document.getElementById('tempDialog');
+let tempFreezer = null;
+document.getElementById('tempClose').onclick = () => tempDlg.close();
+
+async function openTempDialog(freezer) {
+  tempFreezer = freezer;
+  document.getElementById('tempDialogTitle').textContent = `Temperature – ${freezer.name}`;
+  document.getElementById('alarmMin').value = freezer.alarm_min_c ?? '';
+  document.getElementById('alarmMax').value = freezer.alarm_max_c ?? '';
+  document.getElementById('alarmDelay').value = freezer.alarm_delay_minutes;
+  document.getElementById('tempMessage').textContent = '';
+  document.getElementById('readingsForm').reset();
+  await loadTempDetails();
+  if (!tempDlg.open) tempDlg.showModal();
+}
+
+async function loadTempDetails() {
+  const series = await safeFetchJson(`/api/v1/freezers/${tempFreezer.id}/temperatures`);
+  const readings = series ? series.readings : [];
+  const summary = document.getElementById('tempSummary');
+  if (readings.length) {
+    const temps = readings.map(r => r.temp_c);
+    const last = readings[readings.length - 1];
+    summary.textContent = `Last reading ${last.temp_c} °C at ${new Date(last.recorded_at).toLocaleString()}; last 24 h between ${Math.min(...temps)} and ${Math.max(...temps)} °C`;
+  } else {
+    summary.textContent = 'No readings in the last 24 hours';
+  }
+
+  const excursions = await safeFetchJson(`/api/v1/freezers/${tempFreezer.id}/excursions`) || [];
+  const tbody = document.querySelector('#excursionTable tbody');
+  tbody.innerHTML = '';
+  excursions.forEach(x => {
+    const tr = document.createElement('tr');
+    if (x.alarm) tr.className = 'overdue';
+    const samples = x.boxes.reduce((n, b) => n + b.samples.length, 0);
+    [x.kind, new Date(x.started_at).toLocaleString(), x.ongoing ? 'ongoing' : new Date(x.ended_at).toLocaleString(),
+      Math.round(x.duration_minutes), x.peak_temp_c, `${x.boxes.length} boxes, ${samples} samples`]
+      .forEach(value => {
+        const td = document.createElement('td');
+        td.textContent = value;
+        tr.append(td);
+      });
+    tr.title = x.boxes.filter(b => b.samples.length).map(b => `${b.box_name}: ${b.samples.map(s => s.entered_name).join(', ')}`).join('\n');
+    tbody.append(tr);
+  });
+}
+
+document.getElementById('alarmForm').addEventListener('submit', async e => {
+  e.preventDefault();
+  const number = id => {
+    const value = document.getElementById(id).value;
+    return value === '' ? null : Number(value);
+  };
+  const res = await sendJson('PUT', `/api/v1/freezers/${tempFreezer.id}/alarm`, {
+    alarm_min_c: number('alarmMin'),
+    alarm_max_c: number('alarmMax'),
+    alarm_delay_minutes: number('alarmDelay') || 0,
+  });
+  const msg = document.getElementById('tempMessage');
+  if (!await checkAuth(res)) return;
+  if (!res.ok) { msg.textContent = await errorMessage(res); return; }
+  tempFreezer = await res.json();
+  msg.textContent = 'Thresholds saved.';
+  await loadTempDetails();
+  loadAlarms();
+});
+
+document.getElementById('readingsForm').addEventListener('submit', async e => {
+  e.preventDefault();
+  const form = new FormData();
+  form.append('file', document.getElementById('readingsFile').files[0]);
+  const params = new URLSearchParams({ tz: Intl.DateTimeFormat().resolvedOptions().timeZone });
+  const dateOrder = document.getElementById('readingsDateOrder').value;
+  if (dateOrder) params.set('date_order', dateOrder);
+  const res = await fetch(`/api/v1/freezers/${tempFreezer.id}/temperatures?${params}`, { method: 'POST', body: form });
+  const msg = document.getElementById('tempMessage');
+  if (!await checkAuth(res)) return;
+  if (!res.ok) { msg.textContent = await errorMessage(res); return; }
+  const result = await res.json();
+  msg.textContent = `Stored ${result.stored} of ${result.received} readings (${result.duplicates} already stored, ${result.out_of_range} out of range).`;
+  await loadTempDetails();
+  loadAlarms();
+});
+
+// Alarm banner for excursions still running anywhere
+async function loadAlarms() {
+  if (!centralStore) return;
+  const open = (await safeFetchJson('/api/v1/excursions?open=true') || []).filter(x => x.alarm);
+  const banner = document.getElementById('alarmBanner');
+  banner.classList.toggle('hidden', open.length === 0);
+  banner.textContent = open.map(x =>
+    `${x.freezer_name}: ${x.kind} temperature, ${x.peak_temp_c} °C against ${x.threshold_c} °C for ${Math.round(x.duration_minutes)} minutes`).join(' · ');
+}
+setInterval(loadAlarms, 5 * 60 * 1000);
+
+// Maintenance: overdue badge, what is due, intervals per model and each freezer's log
+const maintenanceKinds = ['calibration', 'defrost', 'repair', 'service'];
+document.querySelectorAll('.maintenance-kind').forEach(select => {
+  maintenanceKinds.forEach(kind => select.append(new Option(kind, kind)));
+});
+let overdueMaintenance = [];
+
+async function loadOverdue() {
+  if (!centralStore) return;
+  overdueMaintenance = await safeFetchJson('/api/v1/maintenance/overdue') || [];
+  const badge = document.getElementById('overdueBadge');
+  badge.textContent = overdueMaintenance.length;
+  badge.classList.toggle('hidden', overdueMaintenance.length === 0);
+}
+
+const maintenanceDlg = document.getElementById('maintenanceDialog');
+document.getElementById('maintenanceBtn').onclick = openMaintenanceDialog;
+document.getElementById('dueWithin').onchange = openMaintenanceDialog;
+document.getElementById('maintenanceClose').onclick = () => maintenanceDlg.close();
+
+const dateOrNever = value => value ? new Date(value).toLocaleDateString() : 'never';
+
+function fillTable(selector, rows) {
+  const tbody = document.querySelector(`${selector} tbody`);
+  tbody.innerHTML = '';
+  rows.forEach(({ cells, className }) => {
+    const tr = document.createElement('tr');
+    if (className) tr.className = className;
+    cells.forEach(value => {
+      const td = document.createElement('td');
+      td.textContent = value;
+      tr.append(td);
+    });
+    tbody.append(tr);
+  });
+}
+
+async function openMaintenanceDialog() {
+  const within = Number(document.getElementById('dueWithin').value) || 0;
+  const due = await safeFetchJson(`/api/v1/maintenance/overdue?within=${within}`) || [];
+  fillTable('#dueTable', due.map(d => ({
+    className: d.overdue ? 'overdue' : '',
+    cells: [d.freezer_name, `${d.lab} – ${d.floor}`, d.kind, dateOrNever(d.last_done),
+      d.overdue ? (d.due_at ? `${d.days_overdue} days overdue` : 'overdue') : dateOrNever(d.due_at)],
+  })));
+  const intervals = await safeFetchJson('/api/v1/maintenance/intervals') || [];
+  fillTable('#intervalTable', intervals.map(i => ({ cells: [i.model, i.kind, i.interval_days] })));
+  if (!maintenanceDlg.open) maintenanceDlg.showModal();
+}
+
+document.getElementById('intervalForm').addEventListener('submit', async e => {
+  e.preventDefault();
+  const res = await sendJson('PUT', '/api/v1/maintenance/intervals', {
+    model: document.getElementById('intervalModel').value,
+    kind: document.getElementById('intervalKind').value,
+    interval_days: Number(document.getElementById('intervalDays').value),
+  });
+  const msg = document.getElementById('maintenanceMessage');
+  if (!await checkAuth(res)) return;
+  if (!res.ok) { msg.textContent = await errorMessage(res); return; }
+  msg.textContent = 'Interval saved.';
+  e.target.reset();
+  await loadOverdue();
+  openMaintenanceDialog();
+});
+
+const logDlg = document.getElementById('logDialog');
+let logFreezer = null;
+document.getElementById('logClose').onclick = () => logDlg.close();
+
+async function openLogDialog(freezer) {
+  logFreezer = freezer;
+  document.getElementById('logDialogTitle').textContent = `Maintenance Log – ${freezer.name}`;
+  document.getElementById('logMessage').textContent = '';
+  document.getElementById('logForm').reset();
+  await loadLog();
+  if (!logDlg.open) logDlg.showModal();
+}
+
+async function loadLog() {
+  const entries = await safeFetchJson(`/api/v1/freezers/${logFreezer.id}/maintenance`) || [];
+  const ul = document.getElementById('logList');
+  ul.innerHTML = '';
+  entries.forEach(entry => {
+    const li = document.createElement('li');
+    li.textContent = `${new Date(entry.performed_at).toLocaleDateString()} – ${entry.kind}${entry.performed_by ? ` by ${entry.performed_by}` : ''}${entry.notes ? `: ${entry.notes}` : ''}`;
+    entry.attachments.forEach(a => {
+      const link = document.createElement('a');
+      link.href = `/api/v1/maintenance/attachments/${a.id}`;
+      link.textContent = a.filename;
+      li.append(' ', link);
+    });
+    const delBtn = document.createElement('button'); delBtn.textContent = 'Delete';
+    delBtn.onclick = async () => {
+      if (!confirm(`Delete this ${entry.kind} entry?`)) return;
+      const res = await fetch(`/api/v1/maintenance/${entry.id}`, { method: 'DELETE' });
+      if (!await checkAuth(res)) return;
+      if (!res.ok) { alert(await errorMessage(res)); return; }
+      loadLog();
+      loadOverdue();
+    };
+    li.append(' ', delBtn);
+    ul.append(li);
+  });
+}
+
+document.getElementById('logForm').addEventListener('submit', async e => {
+  e.preventDefault();
+  const date = document.getElementById('logDate').value;
+  const by = document.getElementById('logBy').value.trim();
+  const body = {
+    kind: document.getElementById('logKind').value,
+    notes: document.getElementById('logNotes').value,
+  };
+  if (date) body.performed_at = new Date(`${date}T12:00:00`).toISOString();
+  if (by) body.performed_by = by;
+  const msg = document.getElementById('logMessage');
+  const res = await sendJson('POST', `/api/v1/freezers/${logFreezer.id}/maintenance`, body);
+  if (!await checkAuth(res)) return;
+  if (!res.ok) { msg.textContent = await errorMessage(res); return; }
+  const entry = await res.json();
+
+  const file = document.getElementById('logFile').files[0];
+  if (file) {
+    const form = new FormData();
+    form.append('file', file);
+    const upload = await fetch(`/api/v1/maintenance/${entry.id}/attachments`, { method: 'POST', body: form });
+    if (!upload.ok) msg.textContent = `Entry added, but the attachment failed: ${await errorMessage(upload)}`;
+  }
+  e.target.reset();
+  await loadLog();
+  await loadOverdue();
+  if (currentRoom) loadFreezers(currentRoom);
+});
+
+// Evacuation: plan where a failing freezer's boxes can go, then move them all at once
+const evacDlg = document.getElementById('evacDialog');
+let evacFreezer = null;
+let evacPlan = null;
+document.getElementById('evacClose').onclick = () => evacDlg.close();
+
+const slotText = (shelf, rack, drawer) =>
+  `shelf ${shelf}${rack ? `, rack ${rack}` : ''}${drawer ? `, drawer ${drawer}` : ''}`;
+
+function openEvacDialog(freezer) {
+  evacFreezer = freezer;
+  evacPlan = null;
+  document.getElementById('evacDialogTitle').textContent = `Evacuate – ${freezer.name}`;
+  document.getElementById('evacSummary').textContent = '';
+  document.getElementById('evacMessage').textContent = '';
+  document.getElementById('evacExecute').disabled = true;
+  fillTable('#evacTable', []);
+  evacDlg.showModal();
+}
+
+document.getElementById('evacForm').addEventListener('submit', async e => {
+  e.preventDefault();
+  const msg = document.getElementById('evacMessage');
+  msg.textContent = '';
+  const res = await sendJson('POST', `/api/v1/freezers/${evacFreezer.id}/evacuation/plan`, {
+    scope: document.getElementById('evacScope').value,
+    same_temp_class: document.getElementById('evacSameClass').checked,
+  });
+  if (!await checkAuth(res)) return;
+  if (!res.ok) { msg.textContent = await errorMessage(res); return; }
+  evacPlan = await res.json();
+
+  const targets = evacPlan.targets.map(t => `${t.freezer_name} (${t.receiving})`).join(', ');
+  document.getElementById('evacSummary').textContent = evacPlan.complete
+    ? `All ${evacPlan.boxes} boxes fit${targets ? `: ${targets}` : ''}.`
+    : `${evacPlan.unplaced.length} of ${evacPlan.boxes} boxes have nowhere to go${targets ? `; the rest go to ${targets}` : ''}.`;
+  fillTable('#evacTable', [
+    ...evacPlan.moves.map(m => ({
+      cells: [m.box_name, slotText(m.from_shelf, m.from_rack, m.from_drawer), m.freezer_name, slotText(m.shelf, m.rack, m.drawer)],
+    })),
+    ...evacPlan.unplaced.map(b => ({
+      className: 'overdue',
+      cells: [b.name, slotText(b.shelf, b.rack, b.drawer), 'no space', ''],
+    })),
+  ]);
+  document.getElementById('evacExecute').disabled = evacPlan.moves.length === 0;
+});
+
+document.getElementById('evacExecute').onclick = async () => {
+  const partial = evacPlan.complete ? '' : ` ${evacPlan.unplaced.length} boxes will stay behind.`;
+  if (!confirm(`Move ${evacPlan.moves.length} boxes out of ${evacFreezer.name}?${partial}`)) return;
+  const msg = document.getElementById('evacMessage');
+  const res = await sendJson('POST', `/api/v1/freezers/${evacFreezer.id}/evacuation`, {
+    moves: evacPlan.moves.map(m => ({ box_id: m.box_id, freezer_id: m.freezer_id, shelf: m.shelf, rack: m.rack, drawer: m.drawer })),
+  });
+  if (!await checkAuth(res)) return;
+  if (!res.ok) { msg.textContent = `Nothing was moved: ${await errorMessage(res)}`; return; }
+  const result = await res.json();
+  msg.textContent = `Moved ${result.moved} boxes.`;
+  document.getElementById('evacExecute').disabled = true;
+  evacPlan = null;
+};
+
+// Capacity: how full each room, freezer and shelf is, and how that has changed
+const capacityDlg = document.getElementById('capacityDialog');
+document.getElementById('capacityBtn').onclick = openCapacityDialog;
+document.getElementById('capacityClose').onclick = () => capacityDlg.close();
+
+const percentText = o => o.percent_full === null ? 'unknown' : `${o.percent_full}%`;
+const capacityRow = o => ({
+  className: o.percent_full !== null && o.percent_full >= 100 ? 'overdue' : '',
+  cells: [o.boxes, o.capacity ?? 'not set', percentText(o), ...sampleTypes.map(t => o.samples[t.key] ?? 0)],
+});
+
+async function openCapacityDialog() {
+  const rooms = await safeFetchJson('/api/v1/capacity') || [];
+  const tbody = document.querySelector('#capacityTable tbody');
+  tbody.innerHTML = '';
+  rooms.forEach(room => {
+    const roomName = `${room.lab} – ${room.floor}`;
+    [{ ...room, freezer_name: 'All freezers' }, ...room.freezers].forEach(o => {
+      const { className, cells } = capacityRow(o);
+      const tr = document.createElement('tr');
+      tr.className = className;
+      [roomName, o.freezer_name, ...cells].forEach(value => {
+        const td = document.createElement('td');
+        td.textContent = value;
+        tr.append(td);
+      });
+      if (o.freezer_id) {
+        tr.classList.add('selectable');
+        tr.onclick = () => showFreezerCapacity(o.freezer_id);
+      }
+      tbody.append(tr);
+    });
+  });
+  const unknown = rooms.reduce((n, room) => n + room.unknown_capacity, 0);
+  document.getElementById('capacitySummary').textContent = unknown
+    ? `${unknown} freezers have no boxes per slot set, so their capacity is unknown.`
+    : '';
+  document.getElementById('capacityFreezer').classList.add('hidden');
+  await loadCapacityTrend('');
+  if (!capacityDlg.open) capacityDlg.showModal();
+}
+
+async function showFreezerCapacity(freezerId) {
+  const freezer = await safeFetchJson(`/api/v1/freezers/${freezerId}/capacity`);
+  if (!freezer) return;
+  document.getElementById('capacityFreezerTitle').textContent = `${freezer.freezer_name} – ${percentText(freezer)} full`;
+  fillTable('#shelfTable', freezer.shelves.map(shelf => {
+    const row = capacityRow(shelf);
+    return { ...row, cells: [`${freezer.shelf_label} ${shelf.shelf}`, ...row.cells] };
+  }));
+  fillTable('#boxSampleTable', freezer.box_samples.map(box => ({
+    cells: [box.name, slotText(box.shelf, box.rack, box.drawer), ...sampleTypes.map(t => box.by_type[t.key] ?? 0),
+      box.positions ? `${box.samples} of ${box.positions}` : box.samples],
+  })));
+  document.getElementById('capacityFreezer').classList.remove('hidden');
+  await loadCapacityTrend(`?freezer=${freezerId}`);
+}
+
+async function loadCapacityTrend(query) {
+  const points = await safeFetchJson(`/api/v1/capacity/trend${query}`) || [];
+  const line = document.querySelector('#capacityTrend polyline');
+  const summary = document.getElementById('capacityTrendSummary');
+  if (points.length === 0) {
+    line.setAttribute('points', '');
+    summary.textContent = 'No snapshots yet.';
+    return;
+  }
+  const most = Math.max(1, ...points.map(p => p.boxes));
+  const step = points.length > 1 ? 100 / (points.length - 1) : 0;
+  line.setAttribute('points', points.map((p, i) => `${i * step},${100 - p.boxes * 100 / most}`).join(' '));
+  const first = points[0];
+  const last = points[points.length - 1];
+  summary.textContent = `${first.date}: ${first.boxes} boxes (${percentText(first)}) → ${last.date}: ${last.boxes} boxes (${percentText(last)})`;
+}
+
+document.getElementById('capacitySnapshot').onclick = async () => {
+  const res = await fetch('/api/v1/capacity/snapshots', { method: 'POST' });
+  if (!await checkAuth(res)) return;
+  if (!res.ok) { alert(await errorMessage(res)); return; }
+  openCapacityDialog();
+};
+
+// Add / Edit Freezer Dialog
+const freezerDlg = document.getElementById('freezerDialog');
+let editingFreezer = null;
+document.getElementById('addFreezerBtn').onclick = () => openFreezerDialog(null);
+document.getElementById('freezerCancel').onclick = () => freezerDlg.close();
+
+function openFreezerDialog(freezer) {
+  editingFreezer = freezer;
+  document.getElementById('freezerDialogTitle').textContent = freezer ? 'Edit Freezer' : 'Add Freezer';
+  document.getElementById('freezerName').value = freezer ? freezer.name : '';
+  document.getElementById('freezerModel').value = freezer ? freezer.model : '';
+  document.getElementById('freezerTemp').value = freezer && freezer.current_holding_temp_c != null ? freezer.current_holding_temp_c : '';
+  document.getElementById('freezerProjects').value = freezer ? freezer.manual_projects_contained : '';
+  document.getElementById('freezerShelfCount').value = freezer ? freezer.shelf_count : 5;
+  document.getElementById('freezerShelfLabel').value = freezer ? freezer.shelf_label : 'Shelf';
+  document.getElementById('freezerRacks').value = freezer && freezer.racks_per_shelf ? freezer.racks_per_shelf : '';
+  document.getElementById('freezerDrawers').value = freezer && freezer.drawers_per_rack ? freezer.drawers_per_rack : '';
+  document.getElementById('freezerBoxesPerSlot').value = freezer && freezer.boxes_per_slot ? freezer.boxes_per_slot : '';
+  document.getElementById('freezerComments').value = freezer && freezer.comments ? freezer.comments : '';
+  document.getElementById('freezerMessage').textContent = '';
+  freezerDlg.showModal();
+}
+
+document.getElementById('freezerForm').addEventListener('submit', async e => {
+  e.preventDefault();
+  const temp = document.getElementById('freezerTemp').value;
+  const body = {
+    name: document.getElementById('freezerName').value.trim(),
+    model: document.getElementById('freezerModel').value.trim(),
+    manual_projects_contained: document.getElementById('freezerProjects').value.trim(),
+    comments: document.getElementById('freezerComments').value.trim(),
+    shelf_count: Number(document.getElementById('freezerShelfCount').value),
+    shelf_label: document.getElementById('freezerShelfLabel').value,
+    // 0 means no racks / drawers
+    racks_per_shelf: Number(document.getElementById('freezerRacks').value || 0),
+    drawers_per_rack: Number(document.getElementById('freezerDrawers').value || 0),
+    boxes_per_slot: Number(document.getElementById('freezerBoxesPerSlot').value || 0),
+  };
+  if (temp !== '') body.current_holding_temp_c = Number(temp);
+  let res;
+  if (editingFreezer) {
+    res = await sendJson('PATCH', `/api/v1/freezers/${editingFreezer.id}`, body);
+  } else {
+    body.freezer_location_id = Number(currentRoom);
+    res = await sendJson('POST', '/api/v1/freezers', body);
+  }
+  if (!await checkAuth(res)) return;
+  if (!res.ok) {
+    document.getElementById('freezerMessage').textContent = await errorMessage(res);
+    return;
+  }
+  freezerDlg.close();
+  loadFreezers(currentRoom);
+});
+
+async function retireFreezer(freezer) {
+  if (!confirm(`Retire freezer "${freezer.name}"? It must be empty first.`)) return;
+  const res = await fetch(`/api/v1/freezers/${freezer.id}/retire`, { method: 'POST' });
+  if (!await checkAuth(res)) return;
+  if (!res.ok) {
+    alert(await errorMessage(res));
+    return;
+  }
+  loadFreezers(currentRoom);
+}
+
 
 
 // Load Boxes with Drag-and-Drop
@@ -89,18 +985,24 @@ async function loadBoxes(freezerId) {
   document.getElementById('backToFreezers').onclick = () => loadFreezers(currentRoom);
   document.getElementById('addBoxBtn').onclick = () => document.getElementById('addBoxDialog').showModal();
 
-  const boxes = await safeFetchJson(`/getboxesbyfreezer?freezerid=${freezerId}`) || [];
+  const boxes = await safeFetchJson(`/api/v1/freezers/${freezerId}/boxes`) || [];
+  const layout = await safeFetchJson(`/api/v1/freezers/${freezerId}`) || { shelf_count: 5, shelf_label: 'Shelf' };
+  fillPlacementOptions(layout);
   const container = document.getElementById('shelvesContainer');
   container.innerHTML = '';
 
-  // Create 5 shelves
-  for (let i = 1; i <= 5; i++) {
+  // One drop zone per shelf, and one per rack inside it when the freezer has racks
+  for (let i = 1; i <= layout.shelf_count; i++) {
     const shelf = document.createElement('div');
     shelf.className = 'shelf';
     shelf.dataset.shelf = i;
     shelf.ondragover = e => e.preventDefault();
     shelf.ondrop = e => handleDrop(e, freezerId);
 
+    const shelfLabel = document.createElement('h4');
+    shelfLabel.textContent = `${layout.shelf_label} ${i}`;
+    shelf.append(shelfLabel);
+
 
     const moveAllShelfBoxesBtn = document.createElement('button');
     moveAllShelfBoxesBtn.textContent = 'Move all boxes';
@@ -108,24 +1010,22 @@ async function loadBoxes(freezerId) {
     moveAllShelfBoxesBtn.onclick = async (e) => {
       e.stopPropagation();
       // 1) Load all freezers
-      const freezers = await safeFetchJson('/getallfreezers') || [];
+      const freezers = await safeFetchJson('/api/v1/freezers') || [];
       const choiceList = freezers.map(f => `${f.id}: ${f.name}`).join('\n');
       const choice = prompt(`Select target freezer:\n${choiceList}`, String(currentFreezer));
       if (!choice) return;
       const newFreezer = choice.split(':')[0].trim();
       // 2) Ask for shelf number
-      const newShelf = prompt('Enter target shelf number (1–5):', String(i));
+      const newShelf = prompt(`Enter target ${layout.shelf_label.toLowerCase()} number:`, String(i));
       if (!newShelf) return;
       // 3) Call API
-      const params = new URLSearchParams({
-        oldshelf: String(i),
-        newshelf: String(newShelf),
-        oldfreezer: String(currentFreezer),
-        newfreezer: newFreezer,
+      const res = await sendJson('POST', `/api/v1/freezers/${currentFreezer}/shelves/${i}/move`, {
+        freezer_id: Number(newFreezer),
+        shelf: Number(newShelf),
       });
-      const res = await fetch(`/moveallboxestoshelf?${params.toString()}`);
+      if (!await checkAuth(res)) return;
       if (!res.ok) {
-        alert(await res.text());
+        alert(await errorMessage(res));
         return;
       }
       // 4) Refresh view
@@ -133,12 +1033,36 @@ async function loadBoxes(freezerId) {
     };
     shelf.append(moveAllShelfBoxesBtn);
 
+    const exportShelfBtn = document.createElement('button');
+    exportShelfBtn.textContent = 'Download';
+    exportShelfBtn.title = `Download the samples on this ${layout.shelf_label.toLowerCase()} as CSV`;
+    exportShelfBtn.onclick = e => {
+      e.stopPropagation();
+      window.location.href = exportUrl('csv', { freezer: freezerId, shelf: i });
+    };
+    shelf.append(exportShelfBtn);
+
+
+    const racks = [];
+    for (let r = 1; r <= (layout.racks_per_shelf || 0); r++) {
+      const rack = document.createElement('div');
+      rack.className = 'rack';
+      rack.dataset.shelf = i;
+      rack.dataset.rack = r;
+      rack.ondragover = e => e.preventDefault();
+      rack.ondrop = e => handleDrop(e, freezerId);
+      const rackLabel = document.createElement('span');
+      rackLabel.className = 'rack-label';
+      rackLabel.textContent = `Rack ${r}`;
+      rack.append(rackLabel);
+      racks[r] = rack;
+    }
 
     boxes.filter(b => String(b.shelf) === String(i)).forEach(b => {
       const boxEl = document.createElement('div');
       boxEl.className = 'box';
       boxEl.id = `box-${b.id}`;
-      boxEl.textContent = b.name;
+      boxEl.textContent = b.drawer ? `${b.name} (drawer ${b.drawer})` : b.name;
       boxEl.draggable = true;
       boxEl.ondragstart = e => e.dataTransfer.setData('text', b.id);
       boxEl.onclick = () => loadSamples(b.id);
@@ -163,43 +1087,54 @@ async function loadBoxes(freezerId) {
       };
       boxEl.append(delBtn);
 
-      shelf.append(boxEl);
+      (racks[b.rack] || shelf).append(boxEl);
     });
 
+    racks.forEach(rack => shelf.append(rack));
     container.append(shelf);
   }
 }
 
-function getOwnText(el) {
-  return Array.from(el.childNodes)
-    .filter(node => node.nodeType === Node.TEXT_NODE)
-    .map(node => node.textContent.trim())
-    .join(' ')
-    .trim();
-}
-
 function editBox(box) {
   const newName = prompt('New box name:', box.name);
   if (newName && newName !== box.name) {
-    fetch(`/updatebox?boxid=${box.id}&freezerid=${currentFreezer}&shelf=${box.shelf}&name=${encodeURIComponent(newName)}`)
+    sendJson('PATCH', `/api/v1/boxes/${box.id}`, { name: newName })
+      .then(checkAuth)
       .then(() => loadBoxes(currentFreezer));
   }
 }
 
 function deleteBox(box) {
   if (!confirm(`Delete box "${box.name}"?`)) return;
-  fetch(`/deletebox?boxid=${box.id}`).then(() => loadBoxes(currentFreezer));
+  fetch(`/api/v1/boxes/${box.id}`, { method: 'DELETE' }).then(checkAuth).then(() => loadBoxes(currentFreezer));
 }
 
 // Handle Box Drop
 async function handleDrop(e, freezerId) {
   e.preventDefault();
+  // racks sit inside shelves, only the innermost zone handles the drop
+  e.stopPropagation();
   const boxId = e.dataTransfer.getData('text');
   const newShelf = e.currentTarget.dataset.shelf;
+  const newRack = e.currentTarget.dataset.rack;
   const boxEl = document.getElementById(`box-${boxId}`);
   e.currentTarget.append(boxEl);
-  const name = encodeURIComponent(getOwnText(boxEl));
-  await fetch(`/updatebox?boxid=${boxId}&freezerid=${freezerId}&shelf=${newShelf}&name=${name}`);
+  // a dropped box leaves its drawer
+  const res = await sendJson('POST', '/api/v1/boxes/move', {
+    moves: [{
+      box_id: Number(boxId),
+      freezer_id: Number(freezerId),
+      shelf: Number(newShelf),
+      rack: newRack ? Number(newRack) : null,
+      drawer: null,
+    }],
+  });
+  if (!await checkAuth(res)) { loadBoxes(freezerId); return; }
+  if (!res.ok) {
+    // put the box back where the server still has it
+    alert(await errorMessage(res));
+    loadBoxes(freezerId);
+  }
 }
 
 // Add Box Dialog
@@ -208,11 +1143,23 @@ document.getElementById('addBoxCancel').onclick = () => addBoxDlg.close();
 document.getElementById('addBoxSubmit').onclick = async () => {
   const name = document.getElementById('newBoxName').value.trim();
   const shelf = document.getElementById('newBoxShelf').value;
+  const rack = document.getElementById('newBoxRack').value;
+  const drawer = document.getElementById('newBoxDrawer').value;
   if (!name) return;
-  const response = await fetch(`/insertbox?freezerid=${currentFreezer}&shelf=${shelf}&name=${encodeURIComponent(name)}`);
-  
+  const body = {
+    name,
+    freezer_id: Number(currentFreezer),
+    shelf: Number(shelf),
+  };
+  if (rack) body.rack = Number(rack);
+  if (rack && drawer) body.drawer = Number(drawer);
+  const format = document.getElementById('newBoxFormat').value;
+  if (format) body.format = format;
+  const response = await sendJson('POST', '/api/v1/boxes', body);
+  if (!await checkAuth(response)) return;
+
   if (!response.ok) {
-    const errText = await response.text();
+    const errText = await errorMessage(response);
     alert(errText);
     return;
   }
@@ -221,9 +1168,24 @@ document.getElementById('addBoxSubmit').onclick = async () => {
   loadBoxes(currentFreezer);
 };
 
+// Shelf, rack and drawer choices in the add box dialog follow the freezer's layout
+function fillPlacementOptions(layout) {
+  const fill = (id, count, blank) => {
+    const select = document.getElementById(id);
+    select.innerHTML = '';
+    if (blank) select.append(new Option(blank, ''));
+    for (let i = 1; i <= count; i++) select.append(new Option(String(i), String(i)));
+    select.closest('label').classList.toggle('hidden', !count);
+  };
+  document.getElementById('newBoxShelfLabel').textContent = `${layout.shelf_label}:`;
+  fill('newBoxShelf', layout.shelf_count);
+  fill('newBoxRack', layout.racks_per_shelf || 0, 'None');
+  fill('newBoxDrawer', layout.drawers_per_rack || 0, 'None');
+}
+
 // Fetch all boxes for Move
 async function fetchAllBoxes() {
-  allBoxes = await safeFetchJson('/getallboxes') || [];
+  allBoxes = await safeFetchJson('/api/v1/boxes') || [];
 }
 
 // Load Samples View
@@ -237,23 +1199,69 @@ async function loadSamples(boxId) {
 
 // Display Samples with Edit/Delete/Move
 async function displaySamples() {
-  const ednas = await safeFetchJson(`/ednalinkbybox?boxid=${currentBox}`) || [];
-  const fishes = await safeFetchJson(`/fishlinkbybox?boxid=${currentBox}`) || [];
-  renderList('ednaList', ednas, 'edna');
-  renderList('fishList', fishes, 'fish');
+  const lists = await Promise.all(sampleTypes.map(t => safeFetchJson(`/api/v1/boxes/${currentBox}/samples/${t.key}`)));
+  currentGrid = await safeFetchJson(`/api/v1/boxes/${currentBox}/grid`);
+  renderGrid(currentGrid);
+  sampleTypes.forEach((t, i) => renderList(`sampleList-${t.key}`, lists[i] || [], t.key));
 }
 
+// Box Grid: one cell per well, clicking a free one picks it for the next sample
+let currentGrid = null;
+
+function renderGrid(grid) {
+  const container = document.getElementById('boxGrid');
+  const positionInput = document.getElementById('positionInput');
+  container.innerHTML = '';
+  positionInput.innerHTML = '';
+  document.getElementById('boxFormatSelect').value = grid && grid.format ? grid.format : '';
+  const hasGrid = !!(grid && grid.format);
+  document.getElementById('positionLabel').classList.toggle('hidden', !hasGrid);
+  if (!hasGrid) return;
+
+  positionInput.append(new Option('Unplaced', ''));
+  container.style.gridTemplateColumns = `repeat(${grid.cols}, 1fr)`;
+  grid.cells.forEach(cell => {
+    const el = document.createElement('div');
+    el.className = cell.name ? 'well occupied' : 'well';
+    el.textContent = cell.label;
+    if (cell.name) {
+      el.title = `${cell.label}: ${sampleTypeLabel(cell.sample_type)} ${cell.name}`;
+    } else {
+      el.title = `${cell.label}: free`;
+      el.onclick = () => { positionInput.value = String(cell.position); };
+      positionInput.append(new Option(cell.label, String(cell.position)));
+    }
+    container.append(el);
+  });
+}
+
+// Turns A1 style labels back into well numbers for the current grid
+function positionFromLabel(label) {
+  const m = /^([A-Za-z])(\d+)$/.exec(label.trim());
+  if (!m || !currentGrid || !currentGrid.format) return null;
+  const row = m[1].toUpperCase().charCodeAt(0) - 65;
+  const col = Number(m[2]);
+  if (row >= currentGrid.rows || col < 1 || col > currentGrid.cols) return null;
+  return row * currentGrid.cols + col;
+}
+
+document.getElementById('boxFormatSelect').onchange = async e => {
+  const res = await sendJson('PATCH', `/api/v1/boxes/${currentBox}`, { format: e.target.value });
+  if (await checkAuth(res) && !res.ok) alert(await errorMessage(res));
+  displaySamples();
+};
+
 function renderList(listId, items, type) {
   const ul = document.getElementById(listId);
   ul.innerHTML = '';
   items.forEach(item => {
     const li = document.createElement('li');
-    // Show name
-    li.textContent = item.entered_name;
+    // Show name, and well when the box has a grid
+    const cell = currentGrid && currentGrid.cells.find(c => c.position === item.position);
+    li.textContent = cell ? `${cell.label} – ${item.entered_name}` : item.entered_name;
 
     // Warning if missing database ID
-    const idField = type === 'fish' ? item.fish_id : item.edna_id;
-    if (idField === null || idField === undefined) {
+    if (item.sample_id === null || item.sample_id === undefined) {
       const warn = document.createElement('span');
       warn.textContent = ' ⚠️';
       warn.title = 'Not found in database';
@@ -269,7 +1277,48 @@ function renderList(listId, items, type) {
     editBtn.onclick = () => editSample(item.entered_name, type);
     delBtn.onclick = () => deleteSample(item.entered_name, type);
     moveBtn.onclick = () => moveSample(item.entered_name, type);
-    li.append(' ', editBtn, ' ', delBtn, ' ', moveBtn);
+    const quantity = describeQuantity(item);
+    if (item.parent_name || quantity) {
+      const info = document.createElement('span');
+      info.className = 'sample-info';
+      info.textContent = ` (${[item.parent_name ? `from ${item.parent_name}` : '', quantity].filter(Boolean).join(', ')})`;
+      li.append(info);
+    }
+    const lineageBtn = document.createElement('button'); lineageBtn.textContent = 'Lineage'; lineageBtn.className = 'central-only';
+    lineageBtn.onclick = () => showLineage(item.entered_name, type);
+    if (item.consumed_at) {
+      // a consumed sample only stays listed for its lineage
+      const used = document.createElement('span');
+      used.className = 'badge-consumed';
+      used.textContent = 'CONSUMED';
+      used.title = `Used up on ${new Date(item.consumed_at).toLocaleDateString()}`;
+      li.append(' ', used, ' ', lineageBtn);
+      ul.append(li);
+      return;
+    }
+    const aliquotBtn = document.createElement('button'); aliquotBtn.textContent = 'Aliquot'; aliquotBtn.className = 'central-only';
+    const consumeBtn = document.createElement('button'); consumeBtn.textContent = 'Consume'; consumeBtn.className = 'central-only';
+    aliquotBtn.onclick = () => createAliquot(item, type);
+    consumeBtn.onclick = () => consumeSample(item, type);
+    li.append(' ', editBtn, ' ', delBtn, ' ', moveBtn, ' ', aliquotBtn, ' ', consumeBtn, ' ', lineageBtn);
+    if (item.checked_out_by) {
+      const out = document.createElement('span');
+      out.className = 'badge-out';
+      out.textContent = 'OUT';
+      out.title = `Checked out by ${item.checked_out_by}${item.checkout_purpose ? ` for ${item.checkout_purpose}` : ''}${item.expected_return ? `, due back ${item.expected_return}` : ''}`;
+      const returnBtn = document.createElement('button'); returnBtn.textContent = 'Return'; returnBtn.className = 'central-only';
+      returnBtn.onclick = () => returnSample(item.entered_name, type);
+      li.append(' ', out, ' ', returnBtn);
+    } else {
+      const checkoutBtn = document.createElement('button'); checkoutBtn.textContent = 'Check out'; checkoutBtn.className = 'central-only';
+      checkoutBtn.onclick = () => checkoutSample(item.entered_name, type);
+      li.append(' ', checkoutBtn);
+    }
+    if (currentGrid && currentGrid.format) {
+      const placeBtn = document.createElement('button'); placeBtn.textContent = 'Place';
+      placeBtn.onclick = () => placeSample(item.entered_name, type, cell);
+      li.append(' ', placeBtn);
+    }
     ul.append(li);
   });
 }
@@ -279,7 +1328,8 @@ function editSample(oldName, type) {
   const promptMsg = `New ${type} ID for "${oldName}" :`;
   const newName = prompt(promptMsg, oldName);
   if (newName && newName !== oldName) {
-    fetch(`/update${type}link?boxid=${currentBox}&enteredname=${encodeURIComponent(oldName)}&newenteredname=${encodeURIComponent(newName)}`)
+    sendJson('PATCH', `/api/v1/samples/${type}/${encodeURIComponent(oldName)}`, { entered_name: newName })
+      .then(checkAuth)
       .then(() => displaySamples());
   }
 }
@@ -287,8 +1337,8 @@ function editSample(oldName, type) {
 // Delete Sample
 function deleteSample(name, type) {
   if (!confirm(`Delete ${type} "${name}"?`)) return;
-  const endpoint = type === 'fish' ? '/deletefishlink' : '/deleteednalink';
-  fetch(`${endpoint}?enteredname=${encodeURIComponent(name)}`)
+  fetch(`/api/v1/samples/${type}/${encodeURIComponent(name)}`, { method: 'DELETE' })
+    .then(checkAuth)
     .then(() => displaySamples());
 }
 
@@ -298,33 +1348,161 @@ function moveSample(name, type) {
   const choiceStr = choices.join('\n');
   const input = prompt(`Choose new box_id:\n${choiceStr}`, allBoxes[0]?.box_id || '');
   if (input) {
-    fetch(`/update${type}link?boxid=${encodeURIComponent(input)}&enteredname=${encodeURIComponent(name)}`)
+    sendJson('PATCH', `/api/v1/samples/${type}/${encodeURIComponent(name)}`, { box_id: Number(input) })
+      .then(checkAuth)
       .then(() => displaySamples());
   }
 }
 
+// Check a sample out of its box; it keeps its place until it is returned
+async function checkoutSample(name, type) {
+  const purpose = prompt(`Purpose for taking "${name}" out (e.g. extraction):`, '');
+  if (purpose === null) return;
+  const expected = prompt('Expected return date (YYYY-MM-DD, empty if unknown):', '');
+  if (expected === null) return;
+  const res = await sendJson('POST', `/api/v1/samples/${type}/${encodeURIComponent(name)}/checkout`, {
+    purpose,
+    expected_return: expected.trim(),
+  });
+  if (!await checkAuth(res)) return;
+  if (!res.ok) { alert(await errorMessage(res)); return; }
+  displaySamples();
+}
+
+async function returnSample(name, type) {
+  const res = await fetch(`/api/v1/samples/${type}/${encodeURIComponent(name)}/return`, { method: 'POST' });
+  if (!await checkAuth(res)) return;
+  if (!res.ok) { alert(await errorMessage(res)); return; }
+  displaySamples();
+}
+
+function describeQuantity(item) {
+  const parts = [];
+  if (item.remaining_volume_ul !== null && item.remaining_volume_ul !== undefined) parts.push(`${item.remaining_volume_ul} µL`);
+  if (item.remaining_count !== null && item.remaining_count !== undefined) parts.push(`${item.remaining_count} left`);
+  return parts.join(', ');
+}
+
+// Split an aliquot off a sample, into this box unless another is given
+async function createAliquot(item, type) {
+  const name = prompt(`Name for the new aliquot of "${item.entered_name}":`, `${item.entered_name}-A`);
+  if (!name) return;
+  const boxInput = prompt('Box id for the aliquot:', currentBox);
+  if (boxInput === null) return;
+  const volume = prompt(`Volume to take in µL (empty for none${item.remaining_volume_ul != null ? `, ${item.remaining_volume_ul} left` : ''}):`, '');
+  if (volume === null) return;
+  const body = { entered_name: name.trim(), box_id: Number(boxInput) };
+  if (volume.trim() !== '') body.volume_ul = Number(volume);
+  const res = await sendJson('POST', `/api/v1/samples/${type}/${encodeURIComponent(item.entered_name)}/aliquots`, body);
+  if (!await checkAuth(res)) return;
+  if (!res.ok) { alert(await errorMessage(res)); return; }
+  displaySamples();
+}
+
+async function consumeSample(item, type) {
+  const input = prompt(`Volume of "${item.entered_name}" used in µL (empty to use it all${item.remaining_volume_ul != null ? `, ${item.remaining_volume_ul} left` : ''}):`, '');
+  if (input === null) return;
+  const body = input.trim() === '' ? { all: true } : { volume_ul: Number(input) };
+  if (body.all && !confirm(`Mark "${item.entered_name}" as fully consumed?`)) return;
+  const res = await sendJson('POST', `/api/v1/samples/${type}/${encodeURIComponent(item.entered_name)}/consume`, body);
+  if (!await checkAuth(res)) return;
+  if (!res.ok) { alert(await errorMessage(res)); return; }
+  displaySamples();
+}
+
+// Lineage: the sample's family tree from its oldest stored ancestor down
+const lineageDlg = document.getElementById('lineageDialog');
+document.getElementById('lineageClose').onclick = () => lineageDlg.close();
+
+async function showLineage(name, type) {
+  const lineage = await safeFetchJson(`/api/v1/samples/${type}/${encodeURIComponent(name)}/lineage`);
+  if (!lineage) return;
+  document.getElementById('lineageSummary').textContent = lineage.ancestors.length
+    ? `${name} comes from ${lineage.ancestors.join(' › ')}`
+    : `${name} has no recorded parent`;
+  const tree = document.getElementById('lineageTree');
+  tree.innerHTML = '';
+  tree.append(lineageItem(lineage.tree, name));
+  lineageDlg.showModal();
+}
+
+function lineageItem(node, selected) {
+  const li = document.createElement('li');
+  const where = node.consumed_at ? 'consumed' : `${node.freezer_name} › ${node.box_name}`;
+  const quantity = describeQuantity(node);
+  li.textContent = `${node.entered_name} – ${where}${quantity ? ` (${quantity})` : ''}${node.checked_out_by ? ` – out with ${node.checked_out_by}` : ''}`;
+  if (node.entered_name === selected) li.className = 'selected';
+  if (node.children.length) {
+    const ul = document.createElement('ul');
+    node.children.forEach(child => ul.append(lineageItem(child, selected)));
+    li.append(ul);
+  }
+  return li;
+}
+
+// Currently Out report
+const outDlg = document.getElementById('outDialog');
+document.getElementById('outReportBtn').onclick = loadOutReport;
+document.getElementById('outOverdue').onchange = loadOutReport;
+document.getElementById('outClose').onclick = () => outDlg.close();
+
+async function loadOutReport() {
+  const overdue = document.getElementById('outOverdue').checked;
+  const samples = await safeFetchJson(`/api/v1/samples/out${overdue ? '?overdue=true' : ''}`) || [];
+  const tbody = document.querySelector('#outTable tbody');
+  tbody.innerHTML = '';
+  document.getElementById('outSummary').textContent = `${samples.length} samples out`;
+  samples.forEach(s => {
+    const tr = document.createElement('tr');
+    if (s.overdue) tr.className = 'overdue';
+    [sampleTypeLabel(s.sample_type), s.entered_name, `${s.lab} – ${s.floor} › ${s.freezer_name} › ${s.box_name}`, s.checked_out_by,
+      new Date(s.checked_out_at).toLocaleDateString(), s.checkout_purpose || '', s.expected_return || '']
+      .forEach(value => {
+        const td = document.createElement('td');
+        td.textContent = value;
+        tr.append(td);
+      });
+    tbody.append(tr);
+  });
+  if (!outDlg.open) outDlg.showModal();
+}
+
+// Place Sample in a well of the current box; an empty answer unplaces it
+async function placeSample(name, type, cell) {
+  const input = prompt(`Well for "${name}" (e.g. A1, empty to unplace):`, cell ? cell.label : '');
+  if (input === null) return;
+  let position = 0;
+  if (input.trim() !== '') {
+    position = positionFromLabel(input);
+    if (!position) { alert(`${input} is not a well in this box.`); return; }
+  }
+  const res = await sendJson('PATCH', `/api/v1/samples/${type}/${encodeURIComponent(name)}`, { position });
+  if (!await checkAuth(res)) return;
+  if (!res.ok) { alert(await errorMessage(res)); return; }
+  displaySamples();
+}
+
 // Add Sample Form
 const sampleForm = document.getElementById('addSampleForm');
 sampleForm.addEventListener('submit', async e => {
   e.preventDefault();
-  const ednaVal = document.getElementById('ednaInput').value.trim();
-  const fishVal = document.getElementById('fishInput').value.trim();
+  const type = document.getElementById('sampleTypeInput').value;
+  const name = document.getElementById('sampleNameInput').value.trim();
   const msg = document.getElementById('message'); msg.textContent = '';
-  let type, name;
-  if (ednaVal && !fishVal) { type = 'edna'; name = ednaVal; }
-  else if (fishVal && !ednaVal) { type = 'fish'; name = fishVal; }
-  else { msg.textContent = 'Please enter exactly one ID.'; return; }
-  const checkUrl = type === 'fish'
-    ? `/checkfishalreadyinbox?fishid=${encodeURIComponent(name)}&boxid=${currentBox}`
-    : `/checkednaalreadyinbox?ednaid=${encodeURIComponent(name)}&boxid=${currentBox}`;
-  const text = await (await fetch(checkUrl)).text();
-  if (text.trim() === '0') {
-    const insertUrl = type === 'fish'
-      ? `/insertfishlink?boxid=${currentBox}&enteredname=${encodeURIComponent(name)}`
-      : `/insertednalink?boxid=${currentBox}&enteredname=${encodeURIComponent(name)}`;
-    await fetch(insertUrl);
-    sampleForm.reset(); displaySamples(); msg.textContent = 'Added sample.';
-  } else {
-    msg.textContent = text;
+  if (!type || !name) { msg.textContent = 'Please pick a sample type and enter an ID.'; return; }
+  const locations = await safeFetchJson(`/api/v1/samples/${type}/${encodeURIComponent(name)}/locations`);
+  if (!locations) { msg.textContent = 'Could not check where this sample is stored.'; return; }
+  if (locations.length > 0) {
+    const l = locations[0];
+    msg.textContent = `${sampleTypeLabel(type)} already exists in: Box: ${l.box_name}, Freezer: ${l.freezer_name} (${l.freezer_model}), Shelf: ${l.shelf}, Floor: ${l.floor}, Lab: ${l.lab}`;
+    return;
   }
+  const body = { entered_name: name, box_id: Number(currentBox) };
+  const position = document.getElementById('positionInput').value;
+  if (position) body.position = Number(position);
+  const res = await sendJson('POST', `/api/v1/samples/${type}`, body);
+  if (!await checkAuth(res)) return;
+  if (!res.ok) { msg.textContent = await errorMessage(res); return; }
+  const created = await res.json();
+  sampleForm.reset(); displaySamples(); msg.textContent = created.message || 'Added sample.';
 });
\ No newline at end of file